@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// logQuery writes one access log line per handled query, describing what was sent back.
+func logQuery(w *queryWriter, req *dns.Msg, elapsed time.Duration) {
+	clientIp := clientAddr(w)
+	fields := log.Fields{
+		"client":   clientIp,
+		"proto":    transport(w),
+		"tag":      w.tag,
+		"duration": elapsed.String(),
+	}
+	if via := proxyAddr(w); via != "" {
+		fields["via"] = via
+	}
+
+	if len(req.Question) > 0 {
+		fields["question"] = strings.ToLower(req.Question[0].Name)
+		fields["type"] = dns.Type(req.Question[0].Qtype).String()
+	}
+
+	if w.msg != nil {
+		fields["rcode"] = dns.RcodeToString[w.msg.Rcode]
+		fields["answers"] = len(w.msg.Answer)
+		fields["size"] = w.msg.Len()
+		fields["truncated"] = w.msg.Truncated
+		fields["compressed"] = w.msg.Compress
+	} else {
+		fields["rcode"] = "none"
+	}
+
+	entry := log.WithFields(fields)
+	if *accessLog {
+		entry.Info("Query")
+	} else {
+		entry.Debug("Query")
+	}
+}
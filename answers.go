@@ -1,9 +1,10 @@
 package main
 
 import (
-	"math/rand"
+	"hash/fnv"
 	"net"
 	"strings"
+	"sync/atomic"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/miekg/dns"
@@ -18,6 +19,81 @@ const RECURSE_KEY = "recurse"
 // Maximum recursion when resolving CNAMEs
 const MAX_DEPTH = 10
 
+// Responses for queries that can't be answered locally or by recursion
+const (
+	MISS_SERVFAIL = "servfail"
+	MISS_NXDOMAIN = "nxdomain"
+	MISS_REFUSED  = "refused"
+)
+
+// The key of the entry holding a client's answers: the entry for its address if there is one,
+// otherwise the entry for the most specific network (e.g. "10.42.0.0/16") containing it.
+func (answers *Answers) ClientKey(clientIp string) string {
+	if _, ok := (*answers)[clientIp]; ok {
+		return clientIp
+	}
+	ip := net.ParseIP(clientIp)
+	if ip == nil {
+		return clientIp
+	}
+
+	key := clientIp
+	bits := -1
+	for candidate := range *answers {
+		if !strings.Contains(candidate, "/") {
+			continue
+		}
+		_, network, err := net.ParseCIDR(candidate)
+		if err != nil || !network.Contains(ip) {
+			continue
+		}
+		if ones, _ := network.Mask.Size(); ones > bits {
+			key = candidate
+			bits = ones
+		}
+	}
+	return key
+}
+
+// Per-client overrides of the global flags. A client entry's setting wins over the default entry's,
+// which wins over the command line.
+func (answers *Answers) Ttl(clientUUID string) uint32 {
+	for _, key := range []string{clientUUID, DEFAULT_KEY} {
+		if client, ok := (*answers)[key]; ok && client.Ttl != nil {
+			return *client.Ttl
+		}
+	}
+	return uint32(*defaultTtl)
+}
+
+// Gives local records that didn't set their own TTL (and so got the global default) the client's TTL
+func (answers *Answers) ApplyTtl(clientUUID string, records []dns.RR) {
+	ttl := answers.Ttl(clientUUID)
+	for _, record := range records {
+		if record.Header().Ttl == uint32(*defaultTtl) {
+			record.Header().Ttl = ttl
+		}
+	}
+}
+
+func (answers *Answers) Recursion(clientUUID string) bool {
+	for _, key := range []string{clientUUID, DEFAULT_KEY} {
+		if client, ok := (*answers)[key]; ok && client.Recursion != nil {
+			return *client.Recursion
+		}
+	}
+	return true
+}
+
+func (answers *Answers) Miss(clientUUID string) string {
+	for _, key := range []string{clientUUID, DEFAULT_KEY} {
+		if client, ok := (*answers)[key]; ok && client.Miss != "" {
+			return strings.ToLower(client.Miss)
+		}
+	}
+	return MISS_SERVFAIL
+}
+
 // Recursive servers
 func (answers *Answers) Recursers(clientUUID string) []string {
 	var hosts []string
@@ -68,11 +144,27 @@ func (answers *Answers) AuthoritativeSuffixes() []string {
 			suffixes = append(suffixes, withDots)
 		}
 	}
+	// Declared zones are authoritative too
+	for _, rule := range client.Zones {
+		suffixes = append(suffixes, "."+rule.name())
+	}
 
 	return suffixes
 }
 
-func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn string, cnameParents []dns.RR, depth int) (records []dns.RR, ok bool) {
+// Whether the name is under one of the authoritative suffixes
+func (answers *Answers) Authoritative(fqdn string) bool {
+	for _, suffix := range answers.AuthoritativeSuffixes() {
+		if strings.HasSuffix(fqdn, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The A or AAAA records (qtype) of the name, following local CNAMEs
+func (answers *Answers) Addresses(qtype uint16, query *QueryContext, fqdn string, answerFqdn string, cnameParents []dns.RR, depth int) (records []dns.RR, ok bool) {
+	clientUUID := query.ClientKey
 	fqdn = dns.Fqdn(fqdn)
 
 	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Trying to resolve addresses")
@@ -85,7 +177,7 @@ func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn str
 
 	// Look for a CNAME entry
 	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Trying CNAME Records")
-	result, ok := answers.Matching(dns.TypeCNAME, clientUUID, fqdn, answerFqdn)
+	result, ok := answers.Matching(dns.TypeCNAME, query, fqdn, answerFqdn)
 	if ok && len(result) > 0 {
 		cname := result[0].(*dns.CNAME)
 		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Matched CNAME ", cname.Target)
@@ -97,7 +189,7 @@ func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn str
 		}
 
 		// Recurse to find the eventual A for this CNAME
-		children, ok := answers.Addresses(clientUUID, dns.Fqdn(cname.Target), dns.Fqdn(cname.Target), append(cnameParents, cname), depth+1)
+		children, ok := answers.Addresses(qtype, query, dns.Fqdn(cname.Target), dns.Fqdn(cname.Target), append(cnameParents, cname), depth+1)
 		if ok && len(children) > 0 {
 			log.WithFields(log.Fields{"fqdn": fqdn, "target": cname.Target, "client": clientUUID, "depth": depth}).Debug("Resolved CNAME ", children)
 			records = append(records, cname)
@@ -106,21 +198,21 @@ func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn str
 		}
 	}
 
-	// Look for an A entry
-	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Trying A Records")
-	result, ok = answers.Matching(dns.TypeA, clientUUID, fqdn, answerFqdn)
+	// Look for an A (or AAAA) entry
+	log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debugf("Trying %s Records", dns.TypeToString[qtype])
+	result, ok = answers.Matching(qtype, query, fqdn, answerFqdn)
 	if ok && len(result) > 0 {
-		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Matched A ", result)
-		shuffle(&result)
+		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debugf("Matched %s %v", dns.TypeToString[qtype], result)
 		return result, true
 	}
 
-	// When resolving CNAMES, check recursive server
-	if len(cnameParents) > 0 {
+	// When resolving CNAMES, check recursive server for targets outside of our zones, unless recursion
+	// is off for the client or the target is local with addresses of the other family only
+	if len(cnameParents) > 0 && answers.Recursion(clientUUID) && !answers.Authoritative(fqdn) && !answers.hasOtherFamily(qtype, query, fqdn) {
 		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "depth": depth}).Debug("Trying recursive servers")
 		r := new(dns.Msg)
-		r.SetQuestion(fqdn, dns.TypeA)
-		msg, err := ResolveTryAll(r, answers.Recursers(clientUUID))
+		r.SetQuestion(fqdn, qtype)
+		msg, err := ResolveTryAll(r, answers.RecursersFor(clientUUID, r.Question[0]))
 		if err == nil {
 			return msg.Answer, true
 		}
@@ -130,15 +222,109 @@ func (answers *Answers) Addresses(clientUUID string, fqdn string, answerFqdn str
 	return nil, false
 }
 
-func (answers *Answers) Matching(qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
-	authoritativeFor := answers.AuthoritativeSuffixes()
-	authoritative := false
-	for _, suffix := range authoritativeFor {
-		if strings.HasSuffix(fqdn, suffix) {
-			authoritative = true
-			break
+// The local CNAME records leading from the name (named answerFqdn) to a name without one, and that
+// name. Nothing when the chain loops or is longer than MAX_DEPTH.
+func (answers *Answers) CnameChain(query *QueryContext, fqdn string, answerFqdn string) (chain []dns.RR, target string) {
+	seen := map[string]bool{dns.Fqdn(fqdn): true}
+	target = dns.Fqdn(fqdn)
+	for {
+		result, ok := answers.Matching(dns.TypeCNAME, query, target, answerFqdn)
+		if !ok || len(result) == 0 {
+			return chain, target
+		}
+		cname := result[0].(*dns.CNAME)
+		target, answerFqdn = dns.Fqdn(cname.Target), dns.Fqdn(cname.Target)
+		if seen[target] || len(chain) >= MAX_DEPTH {
+			log.WithFields(log.Fields{"fqdn": fqdn, "client": query.ClientKey, "target": target}).Warn("CNAME chain loops or is too long")
+			return nil, ""
+		}
+		seen[target] = true
+		chain = append(chain, cname)
+	}
+}
+
+func (answers *Answers) hasOtherFamily(qtype uint16, query *QueryContext, fqdn string) bool {
+	other := dns.TypeAAAA
+	if qtype == dns.TypeAAAA {
+		other = dns.TypeA
+	}
+	_, ok := answers.Matching(other, query, fqdn, fqdn)
+	return ok
+}
+
+// Whether the name has local records of any type for the client
+func (answers *Answers) Exists(query *QueryContext, fqdn string, answerFqdn string) bool {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypePTR, dns.TypeTXT, dns.TypeSRV} {
+		if _, ok := answers.Matching(qtype, query, fqdn, answerFqdn); ok {
+			return true
 		}
 	}
+	return false
+}
+
+// Whether the client's or the default entry has records of names under the name, which makes it an
+// empty non-terminal: a name that exists without records of its own
+func (answers *Answers) HasDescendants(clientUUID string, fqdn string) bool {
+	suffix := "." + strings.ToLower(dns.Fqdn(fqdn))
+	keys := []string{clientUUID}
+	if clientUUID != DEFAULT_KEY {
+		keys = append(keys, DEFAULT_KEY)
+	}
+	for _, key := range keys {
+		client := (*answers)[key]
+		for _, name := range client.recordNames() {
+			if strings.HasSuffix(name, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The records of the name (named answerFqdn) from the client's and the default answers, trying the
+// search suffixes. Wildcard entries ("*.stack.rancher.internal."), then pattern rules, only answer for
+// names that have no exact entry of any type, the closest wildcard first.
+func (answers *Answers) Matching(qtype uint16, query *QueryContext, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
+	records, ok = answers.matching(qtype, query, fqdn, answerFqdn, false)
+	if ok {
+		return
+	}
+	records, ok = answers.matching(qtype, query, fqdn, answerFqdn, true)
+	if !ok {
+		records, ok = answers.MatchingPatterns(qtype, query.ClientKey, fqdn, answerFqdn)
+	}
+	if ok && !answers.existsExactly(query, fqdn, answerFqdn) {
+		return
+	}
+	return nil, false
+}
+
+func (answers *Answers) existsExactly(query *QueryContext, fqdn string, answerFqdn string) bool {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA, dns.TypeCNAME, dns.TypePTR, dns.TypeTXT, dns.TypeSRV} {
+		if _, ok := answers.matching(qtype, query, fqdn, answerFqdn, false); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// How Matching found the records of a name: by its own entry, a wildcard entry or a pattern rule. Only
+// meaningful for names that Matching (or Addresses, for the name's CNAME) has records for.
+func (answers *Answers) MatchKind(qtype uint16, query *QueryContext, fqdn string, answerFqdn string) string {
+	if answers.existsExactly(query, fqdn, answerFqdn) {
+		return MATCH_EXACT
+	}
+	for _, t := range []uint16{qtype, dns.TypeCNAME} {
+		if _, ok := answers.matching(t, query, fqdn, answerFqdn, true); ok {
+			return MATCH_WILDCARD
+		}
+	}
+	return MATCH_PATTERN
+}
+
+func (answers *Answers) matching(qtype uint16, query *QueryContext, fqdn string, answerFqdn string, wildcard bool) (records []dns.RR, ok bool) {
+	clientUUID := query.ClientKey
+	authoritative := answers.Authoritative(fqdn)
 
 	// If we are authoritative for a suffix the label has, there's no point trying alternate search suffixes
 	var clientSearches []string
@@ -150,14 +336,14 @@ func (answers *Answers) Matching(qtype uint16, clientUUID string, fqdn string, a
 
 	// Client answers, client search
 	log.WithFields(log.Fields{"label": fqdn, "client": clientUUID}).Debug("Trying client answers, client search")
-	records, ok = answers.MatchingSearch(qtype, clientUUID, fqdn, answerFqdn, []string{})
+	records, ok = answers.MatchingSearch(qtype, clientUUID, fqdn, answerFqdn, []string{}, wildcard)
 	if ok {
 		return
 	}
 
 	// Default answers, client search
 	log.WithFields(log.Fields{"label": fqdn, "client": clientUUID}).Debug("Trying default answers, client search")
-	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, fqdn, answerFqdn, clientSearches)
+	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, fqdn, answerFqdn, clientSearches, wildcard)
 	if ok {
 		return
 	}
@@ -165,7 +351,7 @@ func (answers *Answers) Matching(qtype uint16, clientUUID string, fqdn string, a
 	// Default answers, default search
 	log.WithFields(log.Fields{"label": fqdn, "client": clientUUID}).Debug("Trying default answers, default search")
 	defaultSearches := answers.SearchSuffixes(DEFAULT_KEY)
-	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, fqdn, answerFqdn, defaultSearches)
+	records, ok = answers.MatchingSearch(qtype, DEFAULT_KEY, fqdn, answerFqdn, defaultSearches, wildcard)
 	if ok {
 		return
 	}
@@ -173,8 +359,12 @@ func (answers *Answers) Matching(qtype uint16, clientUUID string, fqdn string, a
 	return nil, false
 }
 
-func (answers *Answers) MatchingSearch(qtype uint16, clientUUID string, fqdn string, answerFqdn string, searches []string) (records []dns.RR, ok bool) {
-	records, ok = answers.MatchingExact(qtype, clientUUID, fqdn, answerFqdn)
+func (answers *Answers) MatchingSearch(qtype uint16, clientUUID string, fqdn string, answerFqdn string, searches []string, wildcard bool) (records []dns.RR, ok bool) {
+	lookup := answers.MatchingExact
+	if wildcard {
+		lookup = answers.MatchingWildcard
+	}
+	records, ok = lookup(qtype, clientUUID, fqdn, answerFqdn)
 	if ok {
 		log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID}).Debug("Matched exact FQDN")
 		return
@@ -188,7 +378,7 @@ func (answers *Answers) MatchingSearch(qtype uint16, clientUUID string, fqdn str
 				newFqdn := base + "." + strings.TrimRight(suffix, ".") + "."
 				log.WithFields(log.Fields{"fqdn": newFqdn, "client": clientUUID}).Debug("Trying alternate suffix")
 
-				records, ok = answers.MatchingExact(qtype, clientUUID, newFqdn, answerFqdn)
+				records, ok = lookup(qtype, clientUUID, newFqdn, answerFqdn)
 				if ok {
 					log.WithFields(log.Fields{"fqdn": newFqdn, "client": clientUUID}).Debug("Matched alternate suffix")
 					return
@@ -201,25 +391,39 @@ func (answers *Answers) MatchingSearch(qtype uint16, clientUUID string, fqdn str
 }
 
 func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
+	var source string
 	client, ok := (*answers)[clientUUID]
 	if ok {
 		switch qtype {
-		case dns.TypeA:
+		case dns.TypeA, dns.TypeAAAA:
 			//log.WithFields(log.Fields{"qtype": "A", "client": clientUUID, "fqdn": fqdn}).Debug("Searching for A")
+			// The "a" entries hold the IPv4 and IPv6 addresses of a name, answered by A and AAAA queries
 			res, ok := client.A[fqdn]
 			if ok && len(res.Answer) > 0 {
+				source = res.Source
 				ttl := uint32(*defaultTtl)
 				if res.Ttl != nil {
 					ttl = *res.Ttl
 				}
 
-				for i := 0; i < len(res.Answer); i++ {
-					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl}
-					ip := net.ParseIP(res.Answer[i])
-					record := &dns.A{Hdr: hdr, A: ip}
-					records = append(records, record)
+				// Addresses failing their health check are withheld
+				answer := res.healthyAnswer(qtype == dns.TypeA)
+				for i := 0; i < len(answer); i++ {
+					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: qtype, Class: dns.ClassINET, Ttl: ttl}
+					ip := net.ParseIP(answer[i])
+					if ip == nil {
+						continue
+					}
+					if ip4 := ip.To4(); ip4 != nil && qtype == dns.TypeA {
+						records = append(records, &dns.A{Hdr: hdr, A: ip4})
+					} else if ip4 == nil && qtype == dns.TypeAAAA {
+						records = append(records, &dns.AAAA{Hdr: hdr, AAAA: ip})
+					}
 				}
 
+				if len(res.Weights) > 0 {
+					rememberWeights(records, res)
+				}
 				shuffle(&records)
 			}
 
@@ -232,6 +436,7 @@ func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn stri
 			}
 
 			if ok {
+				source = res.Source
 				hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: ttl}
 				record := &dns.CNAME{Hdr: hdr, Target: res.Answer}
 				records = append(records, record)
@@ -246,6 +451,7 @@ func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn stri
 			}
 
 			if ok {
+				source = res.Source
 				hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl}
 				record := &dns.PTR{Hdr: hdr, Ptr: res.Answer}
 				records = append(records, record)
@@ -260,6 +466,7 @@ func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn stri
 			}
 
 			if ok {
+				source = res.Source
 				for i := 0; i < len(res.Answer); i++ {
 					hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}
 					str := res.Answer[i]
@@ -271,30 +478,145 @@ func (answers *Answers) MatchingExact(qtype uint16, clientUUID string, fqdn stri
 					records = append(records, record)
 				}
 			}
+
+		case dns.TypeSRV:
+			res, ok := client.Srv[fqdn]
+			ttl := uint32(*defaultTtl)
+			if res.Ttl != nil {
+				ttl = *res.Ttl
+			}
+
+			if ok {
+				source = res.Source
+				for i := 0; i < len(res.Answer); i++ {
+					record, err := parseSrvAnswer(res.Answer[i])
+					if err != nil {
+						log.WithFields(log.Fields{"qtype": "SRV", "client": clientUUID, "fqdn": fqdn}).Warn(err)
+						return nil, false
+					}
+					record.Hdr = dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: ttl}
+					records = append(records, record)
+				}
+			}
 		}
 	}
 
 	if len(records) > 0 {
+		log.WithFields(log.Fields{"qtype": dns.Type(qtype).String(), "client": clientUUID, "fqdn": fqdn, "source": source}).Debug("Found records")
 		return records, true
 	} else {
 		return nil, false
 	}
 }
 
-// Shuffles the sub-section of the supplied slice starting from the first A or AAAA record and going
-// until the end. In other words, doesn't shuffle CNAME records at the start of the slice whose order
-// should be maintained.
+// The records of the closest wildcard entry covering the name
+func (answers *Answers) MatchingWildcard(qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
+	for _, name := range wildcardNames(fqdn) {
+		records, ok = answers.MatchingExact(qtype, clientUUID, name, answerFqdn)
+		if ok {
+			log.WithFields(log.Fields{"fqdn": fqdn, "client": clientUUID, "wildcard": name}).Debug("Matched wildcard")
+			return
+		}
+	}
+	return nil, false
+}
+
+// The wildcard names that could cover the name, closest first: "*.b.example.", then "*.example." for
+// "a.b.example."
+func wildcardNames(fqdn string) []string {
+	var names []string
+	labels := dns.SplitDomainName(fqdn)
+	for i := 1; i < len(labels); i++ {
+		names = append(names, "*."+strings.Join(labels[i:], ".")+".")
+	}
+	return names
+}
+
+// Orders of the address records of a response, for --rrset-order
+const (
+	// Shuffled for every response
+	RRSET_ORDER_RANDOM = "random"
+	// Rotated by one for every response for the name, so each record comes first in turn
+	RRSET_ORDER_CYCLIC = "cyclic"
+	// As given in the answers file (or by the recurser)
+	RRSET_ORDER_FIXED = "fixed"
+)
+
+// Number of rotation counters of the cyclic order; names sharing a counter still rotate, only not one
+// step at a time
+const RRSET_ORDER_COUNTERS = 4096
+
+var rotations [RRSET_ORDER_COUNTERS]uint32
+
+// Shuffles (see --rrset-order) the sub-section of the supplied slice starting from the first A or AAAA
+// record and going until the end. In other words, doesn't shuffle CNAME records at the start of the
+// slice whose order should be maintained. The cyclic order is left to rotateAnswers.
 func shuffle(items *[]dns.RR) {
 	max := len(*items)
-	foundA := false
+	start := 0
+	for start < max {
+		if record := (*items)[start].Header(); record.Rrtype == dns.TypeA || record.Rrtype == dns.TypeAAAA {
+			break
+		}
+		start++
+	}
+	if max-start < 2 {
+		return
+	}
+	if weightedOrder((*items)[start:]) {
+		return
+	}
 
-	for i := 0; i < max; i++ {
-		record := (*items)[i].Header()
-		if !foundA && record.Rrtype != dns.TypeA && record.Rrtype != dns.TypeAAAA {
+	switch *rrsetOrder {
+	case RRSET_ORDER_FIXED, RRSET_ORDER_CYCLIC:
+	default:
+		for i := start; i < max; i++ {
+			j := i + random.Intn(max-i)
+			(*items)[i], (*items)[j] = (*items)[j], (*items)[i]
+		}
+	}
+}
+
+// Rotates each RRset of address records in the answer by one step of its counter, with the cyclic
+// --rrset-order. Done once per response: the records are looked up several times over while it's put
+// together (following CNAMEs, for the address records of targets), which would otherwise take a fixed
+// number of steps per query and, with as many addresses, always give the same order.
+func rotateAnswers(m *dns.Msg) {
+	if *rrsetOrder != RRSET_ORDER_CYCLIC || len(m.Answer) < 2 {
+		return
+	}
+	var keys []rrsetKey
+	positions := make(map[rrsetKey][]int)
+	for i, rr := range m.Answer {
+		header := rr.Header()
+		if header.Rrtype != dns.TypeA && header.Rrtype != dns.TypeAAAA {
 			continue
 		}
-		foundA = true
-		j := i + rand.Intn(max-i)
-		(*items)[i], (*items)[j] = (*items)[j], (*items)[i]
+		key := rrsetKey{strings.ToLower(header.Name), header.Rrtype}
+		if _, ok := positions[key]; !ok {
+			keys = append(keys, key)
+		}
+		positions[key] = append(positions[key], i)
+	}
+
+	for _, key := range keys {
+		at := positions[key]
+		if len(at) < 2 {
+			continue
+		}
+		addresses := make([]dns.RR, len(at))
+		for i, p := range at {
+			addresses[i] = m.Answer[p]
+		}
+		if _, weighted := servedWeightsOf(addresses); weighted {
+			continue
+		}
+		hash := fnv.New32a()
+		hash.Write([]byte(key.name))
+		counter := &rotations[(hash.Sum32()+uint32(key.rrtype))%RRSET_ORDER_COUNTERS]
+		offset := int((atomic.AddUint32(counter, 1) - 1) % uint32(len(addresses)))
+		for i, p := range at {
+			m.Answer[p] = addresses[(i+offset)%len(addresses)]
+		}
 	}
 }
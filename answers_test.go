@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"testing"
 
 	"github.com/miekg/dns"
@@ -124,3 +125,366 @@ func (t *Tests) testShuffle(aType uint16, c *check.C) {
 	c.Check(aRecord2First, check.Equals, true)
 	c.Check(aRecord3First, check.Equals, true)
 }
+
+func (t *Tests) TestRrsetOrder(c *check.C) {
+	saved := *rrsetOrder
+	defer func() { *rrsetOrder = saved }()
+
+	cname := &dns.RR_Header{Name: "cname.rotate.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 100}
+	var addresses []dns.RR
+	for i := 1; i <= 3; i++ {
+		addresses = append(addresses, &dns.A{Hdr: dns.RR_Header{Name: "web.rotate.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 100}, A: net.IPv4(10, 0, 0, byte(i))})
+	}
+
+	// Each record comes first in turn, the others following in their order
+	*rrsetOrder = RRSET_ORDER_CYCLIC
+	var firsts []string
+	for i := 0; i < 6; i++ {
+		records := append([]dns.RR{cname}, addresses...)
+		shuffle(&records)
+		c.Check(records[1:], check.DeepEquals, addresses)
+		m := &dns.Msg{Answer: records}
+		rotateAnswers(m)
+		records = m.Answer
+		c.Check(records[0], check.Equals, dns.RR(cname))
+		first, next := records[1].(*dns.A).A[15], records[2].(*dns.A).A[15]
+		c.Check(next, check.Equals, first%3+1)
+		firsts = append(firsts, records[1].(*dns.A).A.String())
+	}
+	c.Check(firsts[0] != firsts[1] && firsts[1] != firsts[2] && firsts[0] != firsts[2], check.Equals, true)
+	c.Check(firsts[3:], check.DeepEquals, firsts[:3])
+
+	*rrsetOrder = RRSET_ORDER_FIXED
+	records := append([]dns.RR{}, addresses...)
+	shuffle(&records)
+	c.Check(records, check.DeepEquals, addresses)
+}
+
+func TestRrsetOrderPerResponse(t *testing.T) {
+	saved, savedEnvironments, savedOrder := answers, environmentAnswers, *rrsetOrder
+	defer func() { answers, environmentAnswers, *rrsetOrder = saved, savedEnvironments, savedOrder }()
+	*rrsetOrder = RRSET_ORDER_CYCLIC
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		A: map[string]RecordA{
+			"pair.rotate.": {Answer: []string{"10.0.0.1", "10.0.0.2"}},
+		},
+		Cname: map[string]RecordCname{
+			"alias.rotate.": {Answer: "pair.rotate."},
+		},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	// However many times the records are looked up for a response, consecutive ones differ
+	for _, name := range []string{"pair.rotate.", "alias.rotate."} {
+		var firsts []string
+		for i := 0; i < 2; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			w := &testWriter{}
+			route(w, req)
+			if w.msg == nil || len(w.msg.Answer) == 0 {
+				t.Fatalf("Expected an answer for %s, got %v", name, w.msg)
+			}
+			a, ok := w.msg.Answer[len(w.msg.Answer)-2].(*dns.A)
+			if !ok {
+				t.Fatalf("Expected two addresses for %s, got %v", name, w.msg)
+			}
+			firsts = append(firsts, a.A.String())
+		}
+		if firsts[0] == firsts[1] {
+			t.Fatalf("Expected consecutive responses for %s in different orders, got %v first twice", name, firsts[0])
+		}
+	}
+}
+
+func (t *Tests) TestClientKeyNetworks(c *check.C) {
+	answers := Answers{
+		"10.42.0.0/16":   ClientAnswers{},
+		"10.42.99.0/24":  ClientAnswers{},
+		"10.42.99.7":     ClientAnswers{},
+		"2001:db8::/32":  ClientAnswers{},
+		DEFAULT_KEY:      ClientAnswers{},
+		"not-a-network/": ClientAnswers{},
+	}
+	c.Check(answers.ClientKey("10.42.99.7"), check.Equals, "10.42.99.7")
+	c.Check(answers.ClientKey("10.42.99.8"), check.Equals, "10.42.99.0/24")
+	c.Check(answers.ClientKey("10.42.1.1"), check.Equals, "10.42.0.0/16")
+	c.Check(answers.ClientKey("2001:db8::1"), check.Equals, "2001:db8::/32")
+	c.Check(answers.ClientKey("192.168.0.1"), check.Equals, "192.168.0.1")
+}
+
+func (t *Tests) TestClientOverrides(c *check.C) {
+	ttl := uint32(5)
+	off := false
+	answers := Answers{
+		"10.42.99.0/24": ClientAnswers{Ttl: &ttl, Recursion: &off, Miss: "NXDOMAIN"},
+		DEFAULT_KEY:     ClientAnswers{Miss: MISS_REFUSED},
+	}
+	c.Check(answers.Ttl("10.42.99.0/24"), check.Equals, ttl)
+	c.Check(answers.Recursion("10.42.99.0/24"), check.Equals, false)
+	c.Check(answers.Miss("10.42.99.0/24"), check.Equals, MISS_NXDOMAIN)
+
+	c.Check(answers.Ttl("10.1.1.1"), check.Equals, uint32(*defaultTtl))
+	c.Check(answers.Recursion("10.1.1.1"), check.Equals, true)
+	c.Check(answers.Miss("10.1.1.1"), check.Equals, MISS_REFUSED)
+}
+
+func TestIPv6Answers(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		A: map[string]RecordA{
+			"dual.test.": {Answer: []string{"10.0.0.1", "fd00::1"}},
+			"v4.test.":   {Answer: []string{"10.0.0.2"}},
+			"v6.test.":   {Answer: []string{"fd00::3"}},
+		},
+		Cname: map[string]RecordCname{
+			"alias.test.": {Answer: "dual.test."},
+		},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	for _, test := range []struct {
+		name     string
+		qtype    uint16
+		expected []string
+	}{
+		{"dual.test.", dns.TypeA, []string{"10.0.0.1"}},
+		{"dual.test.", dns.TypeAAAA, []string{"fd00::1"}},
+		{"v4.test.", dns.TypeAAAA, nil},
+		{"v6.test.", dns.TypeAAAA, []string{"fd00::3"}},
+		{"v6.test.", dns.TypeA, nil},
+		{"alias.test.", dns.TypeAAAA, []string{"dual.test.", "fd00::1"}},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		w := &testWriter{}
+		route(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != len(test.expected) {
+			t.Fatalf("Expected %v for %s %s, got %v", test.expected, dns.TypeToString[test.qtype], test.name, w.msg)
+		}
+		for i, rr := range w.msg.Answer {
+			var got string
+			switch record := rr.(type) {
+			case *dns.A:
+				got = record.A.String()
+			case *dns.AAAA:
+				got = record.AAAA.String()
+			case *dns.CNAME:
+				got = record.Target
+			}
+			if got != test.expected[i] {
+				t.Fatalf("Expected %v for %s %s, got %v", test.expected, dns.TypeToString[test.qtype], test.name, w.msg.Answer)
+			}
+		}
+	}
+
+	if err := validateAnswer("A", []string{"10.0.0.1", "2001:db8::1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateAnswer("A", []string{"2001:db8::zz"}); err == nil {
+		t.Fatalf("Expected an invalid address to be rejected")
+	}
+}
+
+func TestCnameChain(t *testing.T) {
+	dns.HandleFunc("offzone.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Qtype == dns.TypeA {
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("10.9.9.9"),
+			}}
+		}
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("offzone.test.")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Recurse:       []string{conn.LocalAddr().String()},
+		Authoritative: []string{"local.test."},
+		A: map[string]RecordA{
+			"web.local.test.": {Answer: []string{"10.0.0.1", "fd00::1"}},
+			"db.local.test.":  {Answer: []string{"10.0.0.2"}},
+		},
+		Cname: map[string]RecordCname{
+			"www.local.test.":     {Answer: "app.local.test."},
+			"app.local.test.":     {Answer: "web.local.test."},
+			"mysql.local.test.":   {Answer: "db.local.test."},
+			"broken.local.test.":  {Answer: "gone.local.test."},
+			"partner.local.test.": {Answer: "api.offzone.test."},
+			"loop1.local.test.":   {Answer: "loop2.local.test."},
+			"loop2.local.test.":   {Answer: "loop1.local.test."},
+		},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	for _, test := range []struct {
+		name     string
+		qtype    uint16
+		rcode    int
+		expected []string
+	}{
+		{"www.local.test.", dns.TypeA, dns.RcodeSuccess, []string{"app.local.test.", "web.local.test.", "10.0.0.1"}},
+		{"www.local.test.", dns.TypeAAAA, dns.RcodeSuccess, []string{"app.local.test.", "web.local.test.", "fd00::1"}},
+		{"mysql.local.test.", dns.TypeAAAA, dns.RcodeSuccess, []string{"db.local.test."}},
+		{"broken.local.test.", dns.TypeA, dns.RcodeNameError, []string{"gone.local.test."}},
+		{"partner.local.test.", dns.TypeA, dns.RcodeSuccess, []string{"api.offzone.test.", "10.9.9.9"}},
+		{"partner.local.test.", dns.TypeAAAA, dns.RcodeSuccess, []string{"api.offzone.test."}},
+		// Circular chains aren't followed, but the name exists
+		{"loop1.local.test.", dns.TypeA, dns.RcodeSuccess, nil},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		w := &testWriter{}
+		route(w, req)
+		if w.msg == nil || w.msg.Rcode != test.rcode || len(w.msg.Answer) != len(test.expected) {
+			t.Fatalf("Expected %s %v for %s %s, got %v", dns.RcodeToString[test.rcode], test.expected, dns.TypeToString[test.qtype], test.name, w.msg)
+		}
+		for i, rr := range w.msg.Answer {
+			var got string
+			switch record := rr.(type) {
+			case *dns.A:
+				got = record.A.String()
+			case *dns.AAAA:
+				got = record.AAAA.String()
+			case *dns.CNAME:
+				got = record.Target
+			}
+			if got != test.expected[i] {
+				t.Fatalf("Expected %v for %s %s, got %v", test.expected, dns.TypeToString[test.qtype], test.name, w.msg.Answer)
+			}
+		}
+	}
+}
+
+func TestWildcardAnswers(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+	answers = Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"*.stack.rancher.internal.":     {Answer: []string{"10.0.0.1"}},
+				"*.db.stack.rancher.internal.":  {Answer: []string{"10.0.0.2"}},
+				"web.stack.rancher.internal.":   {Answer: []string{"10.0.0.3"}},
+				"*.other.rancher.internal.":     {Answer: []string{"10.0.0.4"}},
+				"exact.other.rancher.internal.": {Answer: []string{"fd00::4"}},
+			},
+			Txt: map[string]RecordTxt{
+				"*.stack.rancher.internal.": {Answer: []string{"wildcard"}},
+			},
+		},
+		"10.1.1.1": ClientAnswers{
+			A: map[string]RecordA{
+				"*.client.rancher.internal.": {Answer: []string{"10.0.0.5"}},
+			},
+		},
+	}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	for _, test := range []struct {
+		name     string
+		qtype    uint16
+		expected string
+	}{
+		{"c1a2b3.stack.rancher.internal.", dns.TypeA, "10.0.0.1"},
+		{"a.b.stack.rancher.internal.", dns.TypeA, "10.0.0.1"},
+		{"primary.db.stack.rancher.internal.", dns.TypeA, "10.0.0.2"},
+		{"web.stack.rancher.internal.", dns.TypeA, "10.0.0.3"},
+		{"c1a2b3.stack.rancher.internal.", dns.TypeTXT, "wildcard"},
+		// Names with exact entries of other types only aren't covered by the wildcard
+		{"web.stack.rancher.internal.", dns.TypeTXT, ""},
+		{"exact.other.rancher.internal.", dns.TypeA, ""},
+		{"anything.client.rancher.internal.", dns.TypeA, "10.0.0.5"},
+	} {
+		query := &QueryContext{ClientKey: "10.1.1.1"}
+		records, ok := answers.Matching(test.qtype, query, test.name, test.name)
+		if test.expected == "" {
+			if ok {
+				t.Fatalf("Expected nothing for %s %s, got %v", dns.TypeToString[test.qtype], test.name, records)
+			}
+			continue
+		}
+		if !ok || len(records) != 1 || records[0].Header().Name != test.name {
+			t.Fatalf("Expected %s for %s %s, got %v", test.expected, dns.TypeToString[test.qtype], test.name, records)
+		}
+		var got string
+		switch record := records[0].(type) {
+		case *dns.A:
+			got = record.A.String()
+		case *dns.TXT:
+			got = record.Txt[0]
+		}
+		if got != test.expected {
+			t.Fatalf("Expected %s for %s %s, got %v", test.expected, dns.TypeToString[test.qtype], test.name, records)
+		}
+	}
+
+	if _, ok := answers.Matching(dns.TypeA, &QueryContext{ClientKey: "10.1.1.1"}, "stack.rancher.internal.", "stack.rancher.internal."); ok {
+		t.Fatalf("Expected a wildcard not to cover its parent name")
+	}
+}
+
+func TestNodata(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+	noRecursion := false
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Authoritative: []string{"local.test."},
+		Zones:         []ZoneRule{{Zone: "corp.test", Ns: []string{"ns1.corp.test"}}},
+		Recursion:     &noRecursion,
+		A: map[string]RecordA{
+			"web.local.test.":   {Answer: []string{"10.0.0.1"}},
+			"a.svc.local.test.": {Answer: []string{"10.0.0.2"}},
+			"web.other.test.":   {Answer: []string{"10.0.0.3"}},
+			"web.corp.test.":    {Answer: []string{"10.0.0.4"}},
+		},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	for _, test := range []struct {
+		name  string
+		qtype uint16
+		rcode int
+		zone  string
+	}{
+		{"web.local.test.", dns.TypeTXT, dns.RcodeSuccess, "local.test."},
+		// Names with names under them exist
+		{"svc.local.test.", dns.TypeA, dns.RcodeSuccess, "local.test."},
+		{"missing.local.test.", dns.TypeA, dns.RcodeNameError, "local.test."},
+		// The SOA of a declared zone is that of its apex
+		{"web.corp.test.", dns.TypeTXT, dns.RcodeSuccess, "corp.test."},
+		// Local names outside of the authoritative zones that can't be recursed for, without an SOA
+		{"web.other.test.", dns.TypeTXT, dns.RcodeSuccess, ""},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, test.qtype)
+		w := &testWriter{}
+		route(w, req)
+		if w.msg == nil || w.msg.Rcode != test.rcode || len(w.msg.Answer) != 0 || !w.msg.Authoritative {
+			t.Fatalf("Expected %s for %s %s, got %v", dns.RcodeToString[test.rcode], dns.TypeToString[test.qtype], test.name, w.msg)
+		}
+		if test.zone == "" && len(w.msg.Ns) != 0 {
+			t.Fatalf("Expected no SOA for %s %s, got %v", dns.TypeToString[test.qtype], test.name, w.msg.Ns)
+		}
+		if test.zone != "" && (len(w.msg.Ns) != 1 || w.msg.Ns[0].Header().Name != test.zone) {
+			t.Fatalf("Expected the SOA of %s for %s %s, got %v", test.zone, dns.TypeToString[test.qtype], test.name, w.msg.Ns)
+		}
+	}
+}
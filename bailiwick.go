@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Strips records from a recursive response that have nothing to do with the question that was
+// asked, so a misbehaving upstream (or a spoofer racing it) can't get unrelated names into the
+// cache or in front of clients.
+//
+// Answer records are kept when their owner is the question name or a name reached from it through
+// the CNAME/DNAME chain in the response. Authority records are kept when their owner is an ancestor
+// of one of those names, and NSEC and NSEC3 records (with their signatures) when their owner is at or
+// below the zone of such a SOA or NS record, or of the answer's signatures: hashed or not, the owners
+// of denial proofs are seldom ancestors of the name they deny. Additional records are only kept as
+// glue for targets named by the records that survived. Returns the number of records dropped.
+func enforceBailiwick(req *dns.Msg, resp *dns.Msg) int {
+	if len(req.Question) == 0 {
+		return 0
+	}
+
+	names := map[string]bool{canonicalName(req.Question[0].Name): true}
+
+	// Follow the chain until it stops growing, records can come in any order
+	for grew := true; grew; {
+		grew = false
+		for _, rr := range resp.Answer {
+			owner := canonicalName(rr.Header().Name)
+			var target string
+			switch t := rr.(type) {
+			case *dns.CNAME:
+				if !names[owner] {
+					continue
+				}
+				target = canonicalName(t.Target)
+			case *dns.DNAME:
+				for name := range names {
+					if name != owner && dns.IsSubDomain(owner, name) {
+						names[owner] = true
+						target = canonicalName(strings.TrimSuffix(name, owner) + t.Target)
+						break
+					}
+				}
+			}
+			if target != "" && !names[target] {
+				names[target] = true
+				grew = true
+			}
+		}
+	}
+
+	dropped := 0
+	answer := resp.Answer[:0]
+	for _, rr := range resp.Answer {
+		if names[canonicalName(rr.Header().Name)] {
+			answer = append(answer, rr)
+		} else {
+			dropped++
+		}
+	}
+	resp.Answer = answer
+
+	// The zones whose denial proofs are of the names
+	zones := make(map[string]bool)
+	for _, rr := range resp.Answer {
+		if sig, ok := rr.(*dns.RRSIG); ok && coversAny(canonicalName(sig.SignerName), names) {
+			zones[canonicalName(sig.SignerName)] = true
+		}
+	}
+	for _, rr := range resp.Ns {
+		if rrtype := rr.Header().Rrtype; (rrtype == dns.TypeSOA || rrtype == dns.TypeNS) && coversAny(canonicalName(rr.Header().Name), names) {
+			zones[canonicalName(rr.Header().Name)] = true
+		}
+	}
+
+	ns := resp.Ns[:0]
+	for _, rr := range resp.Ns {
+		owner := canonicalName(rr.Header().Name)
+		if coversAny(owner, names) || (isDenialRecord(rr) && belowAny(owner, zones)) {
+			ns = append(ns, rr)
+		} else {
+			dropped++
+		}
+	}
+	resp.Ns = ns
+
+	glue := make(map[string]bool)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range section {
+			switch t := rr.(type) {
+			case *dns.NS:
+				glue[canonicalName(t.Ns)] = true
+			case *dns.MX:
+				glue[canonicalName(t.Mx)] = true
+			case *dns.SRV:
+				glue[canonicalName(t.Target)] = true
+			}
+		}
+	}
+
+	extra := resp.Extra[:0]
+	for _, rr := range resp.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT || glue[canonicalName(rr.Header().Name)] {
+			extra = append(extra, rr)
+		} else {
+			dropped++
+		}
+	}
+	resp.Extra = extra
+
+	if dropped > 0 {
+		log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "dropped": dropped}).Warn("Dropped out-of-bailiwick records from recursive response")
+	}
+
+	return dropped
+}
+
+// Returns true if zone is one of names or an ancestor of one of them
+func coversAny(zone string, names map[string]bool) bool {
+	for name := range names {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// NSEC and NSEC3 records and the signatures covering them
+func isDenialRecord(rr dns.RR) bool {
+	rrtype := rr.Header().Rrtype
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		rrtype = sig.TypeCovered
+	}
+	return rrtype == dns.TypeNSEC || rrtype == dns.TypeNSEC3
+}
+
+// Returns true if name is one of zones or below one of them
+func belowAny(name string, zones map[string]bool) bool {
+	for zone := range zones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("Bad test record %s: %v", s, err)
+	}
+	return rr
+}
+
+func TestBailiwickKeepsChain(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{
+		mustRR(t, "cdn.example.net. 60 IN A 1.2.3.4"),
+		mustRR(t, "WWW.example.com. 60 IN CNAME cdn.example.net."),
+		mustRR(t, "bank.com. 60 IN A 6.6.6.6"),
+	}
+	resp.Ns = []dns.RR{
+		mustRR(t, "example.net. 60 IN NS ns1.example.net."),
+		mustRR(t, "bank.com. 60 IN NS ns.evil.com."),
+	}
+	resp.Extra = []dns.RR{
+		mustRR(t, "ns1.example.net. 60 IN A 1.1.1.1"),
+		mustRR(t, "ns.evil.com. 60 IN A 6.6.6.7"),
+	}
+
+	if dropped := enforceBailiwick(req, resp); dropped != 3 {
+		t.Fatalf("Expected 3 records dropped, got %d", dropped)
+	}
+	if len(resp.Answer) != 2 {
+		t.Fatalf("Incorrect answers kept [%v]", resp.Answer)
+	}
+	if len(resp.Ns) != 1 || resp.Ns[0].Header().Name != "example.net." {
+		t.Fatalf("Incorrect authority kept [%v]", resp.Ns)
+	}
+	if len(resp.Extra) != 1 || resp.Extra[0].Header().Name != "ns1.example.net." {
+		t.Fatalf("Incorrect additional kept [%v]", resp.Extra)
+	}
+}
+
+func TestBailiwickDname(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("a.old.example.com.", dns.TypeA)
+
+	resp := new(dns.Msg)
+	resp.Answer = []dns.RR{
+		mustRR(t, "old.example.com. 60 IN DNAME new.example.com."),
+		mustRR(t, "a.old.example.com. 60 IN CNAME a.new.example.com."),
+		mustRR(t, "a.new.example.com. 60 IN A 1.2.3.4"),
+	}
+	if dropped := enforceBailiwick(req, resp); dropped != 0 {
+		t.Fatalf("Expected nothing dropped, got %d [%v]", dropped, resp.Answer)
+	}
+}
+
+func TestBailiwickKeepsDenials(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("missing.example.com.", dns.TypeA)
+
+	resp := new(dns.Msg)
+	resp.Rcode = dns.RcodeNameError
+	resp.Ns = []dns.RR{
+		mustRR(t, "example.com. 300 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 300"),
+		mustRR(t, "example.com. 300 IN RRSIG SOA 13 2 300 20261021000000 20261014000000 1234 example.com. c2lnbmF0dXJl"),
+		mustRR(t, "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.com. 300 IN NSEC3 1 0 0 AB 0P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOO A RRSIG"),
+		mustRR(t, "0p9mhaveqvm6t7vbl5lop2u3t2rp3tom.example.com. 300 IN RRSIG NSEC3 13 3 300 20261021000000 20261014000000 1234 example.com. c2lnbmF0dXJl"),
+		mustRR(t, "bad.example.com. 300 IN NSEC www.example.com. A RRSIG NSEC"),
+		// Denials of another zone prove nothing for this name
+		mustRR(t, "bank.com. 300 IN NSEC www.bank.com. A RRSIG NSEC"),
+		mustRR(t, "9p9mhaveqvm6t7vbl5lop2u3t2rp3tom.evil.com. 300 IN NSEC3 1 0 0 AB 9P9MHAVEQVM6T7VBL5LOP2U3T2RP3TOO A RRSIG"),
+	}
+
+	if dropped := enforceBailiwick(req, resp); dropped != 2 {
+		t.Fatalf("Expected 2 records dropped, got %d [%v]", dropped, resp.Ns)
+	}
+	if len(resp.Ns) != 5 {
+		t.Fatalf("Expected the SOA and the NSEC3 and NSEC proofs kept with their signatures, got [%v]", resp.Ns)
+	}
+}
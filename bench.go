@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Outcome of the queries sent by "rancher-dns bench"
+type benchResult struct {
+	sync.Mutex
+	sent      int
+	errors    int
+	rcodes    map[string]int
+	latencies []time.Duration
+}
+
+func (r *benchResult) record(resp *dns.Msg, err error, elapsed time.Duration) {
+	r.Lock()
+	defer r.Unlock()
+	if err != nil || resp == nil {
+		r.errors++
+		return
+	}
+	r.rcodes[dns.RcodeToString[resp.Rcode]]++
+	r.latencies = append(r.latencies, elapsed)
+}
+
+// Nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// Reads "name [type]" lines, skipping blank lines and # comments
+func readBenchQueries(path string, defaultType uint16) ([]dns.Question, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var questions []dns.Question
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		qtype := defaultType
+		if len(fields) > 1 {
+			t, ok := dns.StringToType[strings.ToUpper(fields[1])]
+			if !ok {
+				return nil, fmt.Errorf("invalid type in %s: %s", path, fields[1])
+			}
+			qtype = t
+		}
+		questions = append(questions, dns.Question{Name: dns.Fqdn(fields[0]), Qtype: qtype, Qclass: dns.ClassINET})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(questions) == 0 {
+		return nil, fmt.Errorf("no queries in %s", path)
+	}
+	return questions, nil
+}
+
+func randomLabel() string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 12)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// Entry point of "rancher-dns bench", which sends queries to a server at a fixed rate and reports
+// latency percentiles and error rates
+func runBench(args []string) int {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := flags.String("target", "127.0.0.1:53", "Server to query")
+	qps := flags.Uint("qps", 100, "Queries per second")
+	duration := flags.Uint("duration", 10, "Duration (in seconds) of the run")
+	queriesFile := flags.String("queries", "", "File with one \"name [type]\" query per line, replayed in order (random names if empty)")
+	zone := flags.String("zone", "bench.test.", "Zone under which random names are generated")
+	qtypeName := flags.String("type", "A", "Query type for random names and lines without a type")
+	timeout := flags.Uint("timeout", 2, "timeout (in seconds) for each query")
+	useTcp := flags.Bool("tcp", false, "Query over TCP instead of UDP")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bench [options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	qtype, ok := dns.StringToType[strings.ToUpper(*qtypeName)]
+	if !ok || *qps == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	var questions []dns.Question
+	if *queriesFile != "" {
+		var err error
+		if questions, err = readBenchQueries(*queriesFile, qtype); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	rand.Seed(time.Now().UTC().UnixNano())
+	c := &dns.Client{
+		DialTimeout:  time.Duration(*timeout) * time.Second,
+		ReadTimeout:  time.Duration(*timeout) * time.Second,
+		WriteTimeout: time.Duration(*timeout) * time.Second,
+	}
+	if *useTcp {
+		c.Net = "tcp"
+	}
+
+	result := &benchResult{rcodes: make(map[string]int)}
+	var wg sync.WaitGroup
+	ticker := time.NewTicker(time.Second / time.Duration(*qps))
+	defer ticker.Stop()
+	start := time.Now()
+	for i := 0; time.Since(start) < time.Duration(*duration)*time.Second; i++ {
+		<-ticker.C
+		req := new(dns.Msg)
+		if questions != nil {
+			q := questions[i%len(questions)]
+			req.SetQuestion(q.Name, q.Qtype)
+		} else {
+			req.SetQuestion(randomLabel()+"."+dns.Fqdn(*zone), qtype)
+		}
+
+		result.sent++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sent := time.Now()
+			resp, _, err := c.Exchange(req, *target)
+			result.record(resp, err, time.Since(sent))
+		}()
+	}
+	sending := time.Since(start)
+	wg.Wait()
+
+	printBench(result, sending)
+	return 0
+}
+
+// Prints the summary, with the rate computed over the time spent sending
+func printBench(result *benchResult, elapsed time.Duration) {
+	sorted := make([]time.Duration, len(result.latencies))
+	copy(sorted, result.latencies)
+	sort.Sort(byDuration(sorted))
+
+	fmt.Printf("Sent %d queries in %s (%.1f qps)\n", result.sent, elapsed, float64(result.sent)/elapsed.Seconds())
+	if result.sent > 0 {
+		fmt.Printf("Errors: %d (%.2f%%)\n", result.errors, 100*float64(result.errors)/float64(result.sent))
+	}
+
+	var rcodes []string
+	for rcode := range result.rcodes {
+		rcodes = append(rcodes, rcode)
+	}
+	sort.Strings(rcodes)
+	for _, rcode := range rcodes {
+		fmt.Printf("%s: %d\n", rcode, result.rcodes[rcode])
+	}
+
+	if len(sorted) > 0 {
+		fmt.Printf("Latency p50: %s, p90: %s, p99: %s, max: %s\n",
+			percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99), sorted[len(sorted)-1])
+	}
+}
+
+type byDuration []time.Duration
+
+func (d byDuration) Len() int           { return len(d) }
+func (d byDuration) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byDuration) Less(i, j int) bool { return d[i] < d[j] }
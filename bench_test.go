@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	if p := percentile(sorted, 50); p != 50*time.Millisecond {
+		t.Fatalf("Incorrect p50: %s", p)
+	}
+	if p := percentile(sorted, 99); p != 99*time.Millisecond {
+		t.Fatalf("Incorrect p99: %s", p)
+	}
+	if p := percentile(sorted[:1], 90); p != time.Millisecond {
+		t.Fatalf("Incorrect p90 of one sample: %s", p)
+	}
+	if p := percentile(nil, 50); p != 0 {
+		t.Fatalf("Incorrect p50 of no samples: %s", p)
+	}
+}
+
+func TestReadBenchQueries(t *testing.T) {
+	f, err := ioutil.TempFile("", "bench")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# comment\nweb.example.com\n\nexample.com txt\n")
+	f.Close()
+
+	questions, err := readBenchQueries(f.Name(), dns.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(questions) != 2 || questions[0].Name != "web.example.com." || questions[0].Qtype != dns.TypeA || questions[1].Qtype != dns.TypeTXT {
+		t.Fatalf("Incorrect queries %+v", questions)
+	}
+}
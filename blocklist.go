@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const (
+	BLOCKLIST_HOSTS   = "hosts"
+	BLOCKLIST_DOMAINS = "domains"
+	BLOCKLIST_RPZ     = "rpz"
+
+	DEFAULT_BLOCKLIST_REFRESH = 3600
+	// Lists are fetched with a timeout, and at most this large
+	BLOCKLIST_FETCH_TIMEOUT = 30 * time.Second
+	MAX_BLOCKLIST_SIZE      = 64 << 20
+)
+
+// How a name is blocked
+type blockAction uint8
+
+const (
+	BLOCK_NONE blockAction = iota
+	BLOCK_NXDOMAIN
+	BLOCK_NODATA
+)
+
+// What a list blocks for a name: the name itself, and the names under it
+type blockedName struct {
+	name  blockAction
+	below blockAction
+}
+
+// Blocklist subscriptions, read from the "blocklists" list of the default entry. Every list is fetched
+// from its URL at startup and then every refresh seconds, and clients in its network (all clients
+// without one) get NXDOMAIN for the names on it and every name under them, like a suppressed zone. The
+// names of a response policy zone are blocked as RPZ specifies instead: an entry only matches its own
+// name and a "*." entry only the names under it, each with its NXDOMAIN or NODATA action. A list that
+// couldn't be refreshed for expire seconds (3 refresh intervals by default) expires: its names are no
+// longer blocked until it is fetched again.
+func (answers *Answers) BlocklistRules() []BlocklistRule {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.Blocklists
+}
+
+func (rule *BlocklistRule) Validate() error {
+	if rule.Name == "" {
+		return fmt.Errorf("blocklist without a name: %+v", *rule)
+	}
+	if u, err := url.Parse(rule.Url); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid url for blocklist %s: %s", rule.Name, rule.Url)
+	}
+	switch rule.Format {
+	case BLOCKLIST_HOSTS, BLOCKLIST_DOMAINS, BLOCKLIST_RPZ:
+	default:
+		return fmt.Errorf("invalid format for blocklist %s: %s (hosts, domains or rpz)", rule.Name, rule.Format)
+	}
+	if rule.Network != "" && parseNetwork(rule.Network) == nil {
+		return fmt.Errorf("invalid network for blocklist %s: %s", rule.Name, rule.Network)
+	}
+	return nil
+}
+
+func (rule *BlocklistRule) refresh() time.Duration {
+	if rule.Refresh == 0 {
+		return DEFAULT_BLOCKLIST_REFRESH * time.Second
+	}
+	return time.Duration(rule.Refresh) * time.Second
+}
+
+func (rule *BlocklistRule) expire() time.Duration {
+	if rule.Expire == 0 {
+		return 3 * rule.refresh()
+	}
+	return time.Duration(rule.Expire) * time.Second
+}
+
+// Host names of hosts files that aren't meant to be blocked
+var hostsFileNames = map[string]bool{
+	"localhost.": true, "localhost.localdomain.": true, "local.": true, "broadcasthost.": true,
+	"ip6-localhost.": true, "ip6-loopback.": true, "0.0.0.0.": true,
+}
+
+// The names on a list, lower case and fully qualified
+func parseBlocklist(format string, r io.Reader) (map[string]blockedName, error) {
+	names := make(map[string]blockedName)
+	if format == BLOCKLIST_RPZ {
+		return names, parseRpz(r, names)
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		// "0.0.0.0 ads.example.com tracker.example.com" or "ads.example.com"
+		if format == BLOCKLIST_HOSTS {
+			fields = fields[1:]
+		} else {
+			fields = fields[:1]
+		}
+		for _, field := range fields {
+			name := strings.ToLower(dns.Fqdn(strings.TrimPrefix(field, "*.")))
+			if _, ok := dns.IsDomainName(name); !ok || name == "." || hostsFileNames[name] {
+				continue
+			}
+			names[name] = blockedName{name: BLOCK_NXDOMAIN, below: BLOCK_NXDOMAIN}
+		}
+	}
+	return names, scanner.Err()
+}
+
+// Names of a response policy zone with the NXDOMAIN ("CNAME .") or NODATA ("CNAME *.") action, relative to
+// the zone's apex (its SOA record). Other policies, e.g. rpz-passthru. or local data, aren't blocks.
+// "*.name" entries are kept as the action for the names under name, which doesn't block name itself.
+func parseRpz(r io.Reader, names map[string]blockedName) error {
+	var apex string
+	var err error
+	for token := range dns.ParseZone(r, ".", "") {
+		if token.Error != nil {
+			if err == nil {
+				err = token.Error
+			}
+			continue
+		}
+		switch rr := token.RR.(type) {
+		case *dns.SOA:
+			if apex == "" {
+				apex = strings.ToLower(rr.Hdr.Name)
+			}
+		case *dns.CNAME:
+			action := BLOCK_NXDOMAIN
+			switch rr.Target {
+			case ".":
+			case "*.":
+				action = BLOCK_NODATA
+			default:
+				continue
+			}
+			name := strings.ToLower(rr.Hdr.Name)
+			if apex != "" && apex != "." {
+				if !strings.HasSuffix(name, "."+apex) {
+					continue
+				}
+				name = strings.TrimSuffix(name, apex)
+			}
+			wildcard := strings.HasPrefix(name, "*.")
+			name = strings.TrimPrefix(name, "*.")
+			if name == "" || name == "." {
+				continue
+			}
+			entry := names[name]
+			if wildcard {
+				entry.below = action
+			} else {
+				entry.name = action
+			}
+			names[name] = entry
+		}
+	}
+	return err
+}
+
+// State of a subscription
+type blocklist struct {
+	rule    BlocklistRule
+	names   map[string]blockedName
+	fetched time.Time
+	err     error
+	stop    chan struct{}
+}
+
+// Status of a subscription, as shown by GET /v1/blocklists
+type BlocklistStatus struct {
+	Name      string     `json:"name"`
+	Url       string     `json:"url"`
+	Format    string     `json:"format"`
+	Network   string     `json:"network,omitempty"`
+	Enabled   bool       `json:"enabled"`
+	Names     int        `json:"names"`
+	Fetched   *time.Time `json:"fetched,omitempty"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	LastError string     `json:"lastError,omitempty"`
+}
+
+type blocklistSubscriptions struct {
+	sync.RWMutex
+	lists map[string]*blocklist
+	// Names of the lists disabled through the API, kept across reloads
+	disabled map[string]bool
+	// Fetches a list, replaced by tests
+	fetch func(rule BlocklistRule) (map[string]blockedName, error)
+}
+
+var blocklists = &blocklistSubscriptions{
+	lists:    make(map[string]*blocklist),
+	disabled: make(map[string]bool),
+	fetch:    fetchBlocklist,
+}
+
+func fetchBlocklist(rule BlocklistRule) (map[string]blockedName, error) {
+	client := &http.Client{Timeout: BLOCKLIST_FETCH_TIMEOUT}
+	resp, err := client.Get(rule.Url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rule.Url, resp.Status)
+	}
+	return readBlocklist(rule.Format, resp.Body, MAX_BLOCKLIST_SIZE)
+}
+
+// Parses the list, failing rather than keeping a truncated list when it's larger than limit bytes
+func readBlocklist(format string, r io.Reader, limit int64) (map[string]blockedName, error) {
+	body := &io.LimitedReader{R: r, N: limit + 1}
+	names, err := parseBlocklist(format, body)
+	if body.N == 0 {
+		return nil, fmt.Errorf("blocklist larger than %d bytes", limit)
+	}
+	return names, err
+}
+
+// Replaces the subscriptions, keeping the names and schedule of the lists whose rule didn't change
+func (s *blocklistSubscriptions) SetRules(rules []BlocklistRule) {
+	s.Lock()
+	defer s.Unlock()
+	lists := make(map[string]*blocklist)
+	for _, rule := range rules {
+		if list, ok := s.lists[rule.Name]; ok && list.rule == rule {
+			lists[rule.Name] = list
+			continue
+		}
+		list := &blocklist{rule: rule, stop: make(chan struct{})}
+		lists[rule.Name] = list
+		go s.refresh(list)
+	}
+	for name, list := range s.lists {
+		if lists[name] != list {
+			close(list.stop)
+		}
+	}
+	s.lists = lists
+}
+
+// Fetches the list until it is unsubscribed
+func (s *blocklistSubscriptions) refresh(list *blocklist) {
+	for {
+		names, err := s.fetch(list.rule)
+		fields := log.Fields{"blocklist": list.rule.Name, "url": list.rule.Url}
+		s.Lock()
+		if err != nil {
+			list.err = err
+			log.WithFields(fields).Warn("Failed to fetch blocklist: ", err)
+			stats.incr("blocklistFetchErrors")
+		} else {
+			list.names, list.fetched, list.err = names, time.Now(), nil
+			log.WithFields(fields).WithField("names", len(names)).Info("Fetched blocklist")
+		}
+		s.Unlock()
+
+		select {
+		case <-list.stop:
+			return
+		case <-time.After(list.rule.refresh()):
+		}
+	}
+}
+
+// The enabled, unexpired list blocking the name for the client, if any, and how. The entry for the name
+// itself comes first, then the one of its closest listed parent.
+func (s *blocklistSubscriptions) Blocked(clientIp string, fqdn string) (string, blockAction, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.lists) == 0 {
+		return "", BLOCK_NONE, false
+	}
+	now := time.Now()
+	labels := dns.SplitDomainName(strings.ToLower(fqdn))
+	for _, list := range s.lists {
+		if s.disabled[list.rule.Name] || list.names == nil || now.Sub(list.fetched) > list.rule.expire() {
+			continue
+		}
+		if list.rule.Network != "" && !inNetwork(clientIp, list.rule.Network) {
+			continue
+		}
+		if entry := list.names[strings.Join(labels, ".")+"."]; entry.name != BLOCK_NONE {
+			return list.rule.Name, entry.name, true
+		}
+		for i := 1; i < len(labels); i++ {
+			if entry := list.names[strings.Join(labels[i:], ".")+"."]; entry.below != BLOCK_NONE {
+				return list.rule.Name, entry.below, true
+			}
+		}
+	}
+	return "", BLOCK_NONE, false
+}
+
+func (s *blocklistSubscriptions) SetEnabled(name string, enabled bool) error {
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.lists[name]; !ok {
+		return fmt.Errorf("no blocklist %s", name)
+	}
+	if enabled {
+		delete(s.disabled, name)
+	} else {
+		s.disabled[name] = true
+	}
+	log.WithFields(log.Fields{"blocklist": name, "enabled": enabled}).Warn("Changed blocklist")
+	return nil
+}
+
+func (s *blocklistSubscriptions) Status() []BlocklistStatus {
+	s.RLock()
+	defer s.RUnlock()
+	out := []BlocklistStatus{}
+	for name, list := range s.lists {
+		status := BlocklistStatus{
+			Name:    name,
+			Url:     list.rule.Url,
+			Format:  list.rule.Format,
+			Network: list.rule.Network,
+			Enabled: !s.disabled[name],
+			Names:   len(list.names),
+		}
+		if !list.fetched.IsZero() {
+			fetched, expires := list.fetched, list.fetched.Add(list.rule.expire())
+			status.Fetched, status.Expires = &fetched, &expires
+			if time.Now().After(expires) {
+				status.Names = 0
+			}
+		}
+		if list.err != nil {
+			status.LastError = list.err.Error()
+		}
+		out = append(out, status)
+	}
+	sort.Sort(byBlocklistName(out))
+	return out
+}
+
+type byBlocklistName []BlocklistStatus
+
+func (b byBlocklistName) Len() int           { return len(b) }
+func (b byBlocklistName) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byBlocklistName) Less(i, j int) bool { return b[i].Name < b[j].Name }
+
+// GET /v1/blocklists shows the subscriptions, POST /v1/blocklists?name=NAME&enabled=false disables a
+// list (enabled=true enables it again)
+func httpBlocklists(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method == "POST" {
+		name := req.URL.Query().Get("name")
+		enabled := req.URL.Query().Get("enabled") != "false"
+		if err := blocklists.SetEnabled(name, enabled); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(blocklists.Status())
+}
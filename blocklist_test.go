@@ -0,0 +1,202 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseBlocklist(t *testing.T) {
+	zone := blockedName{name: BLOCK_NXDOMAIN, below: BLOCK_NXDOMAIN}
+	for _, test := range []struct {
+		format   string
+		list     string
+		expected map[string]blockedName
+	}{
+		{BLOCKLIST_HOSTS, "# ad servers\n127.0.0.1 localhost\n0.0.0.0 Ads.example.com tracker.example.net # both\n:: ipv6.example.org\n",
+			map[string]blockedName{"ads.example.com.": zone, "tracker.example.net.": zone, "ipv6.example.org.": zone}},
+		{BLOCKLIST_DOMAINS, "ads.example.com\n\n*.tracker.example.net\n# comment\nbad..name\n",
+			map[string]blockedName{"ads.example.com.": zone, "tracker.example.net.": zone}},
+		{BLOCKLIST_RPZ, "$ORIGIN rpz.example.\n$TTL 300\n@ SOA ns.example. admin.example. 1 3600 600 86400 300\n" +
+			"ads.example.com CNAME .\n*.tracker.example.net CNAME *.\nallowed.example.com CNAME rpz-passthru.\nlocal.example.com A 10.0.0.1\n" +
+			"both.example.org CNAME *.\n*.both.example.org CNAME .\n",
+			map[string]blockedName{
+				"ads.example.com.":     {name: BLOCK_NXDOMAIN},
+				"tracker.example.net.": {below: BLOCK_NODATA},
+				"both.example.org.":    {name: BLOCK_NODATA, below: BLOCK_NXDOMAIN},
+			}},
+	} {
+		names, err := parseBlocklist(test.format, strings.NewReader(test.list))
+		if err != nil {
+			t.Fatalf("Unexpected error for the %s list: %v", test.format, err)
+		}
+		if len(names) != len(test.expected) {
+			t.Fatalf("Expected %v from the %s list, got %v", test.expected, test.format, names)
+		}
+		for name, entry := range test.expected {
+			if names[name] != entry {
+				t.Fatalf("Expected %s as %+v on the %s list, got %v", name, entry, test.format, names)
+			}
+		}
+	}
+
+	// Lists over the limit fail rather than being cut short
+	list := "ads.example.com\ntracker.example.net\n"
+	if _, err := readBlocklist(BLOCKLIST_DOMAINS, strings.NewReader(list), int64(len(list))); err != nil {
+		t.Fatalf("Expected a list at the limit to load, got %v", err)
+	}
+	if names, err := readBlocklist(BLOCKLIST_DOMAINS, strings.NewReader(list), int64(len(list)-1)); err == nil {
+		t.Fatalf("Expected a list over the limit to fail, got %v", names)
+	}
+
+	for _, invalid := range []BlocklistRule{
+		{Url: "https://lists.example.com/ads.txt", Format: BLOCKLIST_HOSTS},
+		{Name: "ads", Url: "ftp://lists.example.com/ads.txt", Format: BLOCKLIST_HOSTS},
+		{Name: "ads", Url: "https://lists.example.com/ads.txt", Format: "adblock"},
+		{Name: "ads", Url: "https://lists.example.com/ads.txt", Format: BLOCKLIST_HOSTS, Network: "10.0.0.0/33"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestBlocklistSubscriptions(t *testing.T) {
+	fetched := make(chan string, 10)
+	s := &blocklistSubscriptions{
+		lists:    make(map[string]*blocklist),
+		disabled: make(map[string]bool),
+		fetch: func(rule BlocklistRule) (map[string]blockedName, error) {
+			defer func() { fetched <- rule.Name }()
+			return map[string]blockedName{"ads.example.com.": {name: BLOCK_NXDOMAIN, below: BLOCK_NXDOMAIN}}, nil
+		},
+	}
+	defer s.SetRules(nil)
+	wait := func() {
+		select {
+		case <-fetched:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected the list to be fetched")
+		}
+		// Let the fetch be stored
+		s.Lock()
+		s.Unlock()
+	}
+
+	s.SetRules([]BlocklistRule{{Name: "ads", Url: "https://lists.example.com/ads.txt", Format: BLOCKLIST_DOMAINS, Network: "10.1.0.0/16"}})
+	wait()
+	if list, action, ok := s.Blocked("10.1.1.1", "x.Ads.example.com."); !ok || list != "ads" || action != BLOCK_NXDOMAIN {
+		t.Fatalf("Expected names under the listed name to be blocked")
+	}
+	if _, _, ok := s.Blocked("10.1.1.1", "example.com."); ok {
+		t.Fatalf("Expected the parent of a listed name not to be blocked")
+	}
+	if _, _, ok := s.Blocked("10.2.1.1", "ads.example.com."); ok {
+		t.Fatalf("Expected clients outside of the network not to be blocked")
+	}
+
+	if err := s.SetEnabled("ads", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := s.Blocked("10.1.1.1", "ads.example.com."); ok {
+		t.Fatalf("Expected a disabled list not to block")
+	}
+	if status := s.Status(); len(status) != 1 || status[0].Enabled || status[0].Names != 1 {
+		t.Fatalf("Expected the disabled list in the status, got %+v", status)
+	}
+	s.SetEnabled("ads", true)
+	if err := s.SetEnabled("malware", false); err == nil {
+		t.Fatalf("Expected an unknown list to be rejected")
+	}
+
+	// A list that couldn't be refreshed in time expires
+	s.Lock()
+	s.lists["ads"].fetched = time.Now().Add(-4 * DEFAULT_BLOCKLIST_REFRESH * time.Second)
+	s.Unlock()
+	if _, _, ok := s.Blocked("10.1.1.1", "ads.example.com."); ok {
+		t.Fatalf("Expected an expired list not to block")
+	}
+
+	// A changed subscription is fetched again
+	s.SetRules([]BlocklistRule{{Name: "ads", Url: "https://lists.example.com/ads.txt", Format: BLOCKLIST_DOMAINS}})
+	wait()
+	if _, _, ok := s.Blocked("10.2.1.1", "ads.example.com."); !ok {
+		t.Fatalf("Expected the new subscription to block")
+	}
+}
+
+func TestBlocklistedQuery(t *testing.T) {
+	saved, savedEnvironments, savedLists := answers, environmentAnswers, blocklists.lists
+	defer func() {
+		answers, environmentAnswers = saved, savedEnvironments
+		blocklists.Lock()
+		blocklists.lists = savedLists
+		blocklists.Unlock()
+	}()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		A: map[string]RecordA{"ads.example.com.": {Answer: []string{"10.0.0.1"}}},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+	blocklists.Lock()
+	blocklists.lists = map[string]*blocklist{"ads": {
+		rule: BlocklistRule{Name: "ads", Format: BLOCKLIST_DOMAINS},
+		names: map[string]blockedName{
+			"ads.example.com.":     {name: BLOCK_NXDOMAIN, below: BLOCK_NXDOMAIN},
+			"tracker.example.net.": {below: BLOCK_NODATA},
+		},
+		fetched: time.Now(),
+	}}
+	blocklists.Unlock()
+
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.com.", dns.TypeA)
+	w := &testWriter{}
+	route(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeNameError || len(w.msg.Answer) != 0 {
+		t.Fatalf("Expected NXDOMAIN for a blocklisted name, got %v", w.msg)
+	}
+
+	// The NODATA policy of an RPZ
+	req.SetQuestion("x.tracker.example.net.", dns.TypeA)
+	w = &testWriter{}
+	route(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 0 {
+		t.Fatalf("Expected NODATA for a name with the NODATA policy, got %v", w.msg)
+	}
+}
+
+func TestBlockedRpz(t *testing.T) {
+	names, err := parseBlocklist(BLOCKLIST_RPZ, strings.NewReader("$ORIGIN rpz.example.\n$TTL 300\n"+
+		"@ SOA ns.example. admin.example. 1 3600 600 86400 300\n"+
+		"ads.example.com CNAME .\n*.tracker.example.net CNAME *.\n*.example.org CNAME .\nwww.example.org CNAME *.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &blocklistSubscriptions{
+		lists:    map[string]*blocklist{"rpz": {rule: BlocklistRule{Name: "rpz", Format: BLOCKLIST_RPZ}, names: names, fetched: time.Now()}},
+		disabled: make(map[string]bool),
+	}
+	for _, test := range []struct {
+		name     string
+		expected blockAction
+	}{
+		{"ads.example.com.", BLOCK_NXDOMAIN},
+		// Exact names don't block the names under them
+		{"x.ads.example.com.", BLOCK_NONE},
+		// Wildcards block the names under them, but not the name itself
+		{"x.tracker.example.net.", BLOCK_NODATA},
+		{"a.b.tracker.example.net.", BLOCK_NODATA},
+		{"tracker.example.net.", BLOCK_NONE},
+		// Exact names come before wildcards
+		{"www.example.org.", BLOCK_NODATA},
+		{"x.www.example.org.", BLOCK_NXDOMAIN},
+		{"example.org.", BLOCK_NONE},
+	} {
+		if _, action, ok := s.Blocked("10.0.0.1", test.name); action != test.expected || ok != (test.expected != BLOCK_NONE) {
+			t.Fatalf("Expected %s to be blocked with %d, got %d", test.name, test.expected, action)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// What answers a query instead once recursion is over --recursion-budget
+const (
+	// A cached response, expired up to --rate-limit-stale seconds ago
+	SUBSTITUTE_STALE = "stale"
+	// The local answers, for zones whose "order" falls back to them
+	SUBSTITUTE_LOCAL = "local"
+)
+
+type resolution struct {
+	msg *dns.Msg
+	err error
+}
+
+// Resolves the query through the recursers, waiting no longer than --recursion-budget milliseconds
+// when something else could answer it: a stale cached response (served here) or a local name of a
+// zone falling back to local answers (left to the next stage). The substitute used is returned,
+// empty if the recursers answered in time or there is none. The response still arriving past the
+// budget is cached for the next query, unless it has to be validated or is specific to the client's
+// subnet, which takes the client's query.
+func resolveWithinBudget(w dns.ResponseWriter, req *dns.Msg, upstream *dns.Msg, resolvers []string, answers Answers, query *QueryContext, fallback bool) (*dns.Msg, string, error) {
+	budget := time.Duration(*recursionBudget) * time.Millisecond
+	if budget == 0 || debugging(w) {
+		msg, err := ResolveTryAll(upstream, resolvers)
+		return msg, "", err
+	}
+
+	done := make(chan resolution, 1)
+	go func() {
+		msg, err := ResolveTryAll(upstream, resolvers)
+		done <- resolution{msg, err}
+	}()
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		return r.msg, "", r.err
+	case <-timer.C:
+	}
+
+	fqdn := strings.ToLower(req.Question[0].Name)
+	fields := log.Fields{"client": query.ClientKey, "type": dns.Type(req.Question[0].Qtype).String(), "question": fqdn}
+	if stale := staleCacheHit(query.View, req, time.Duration(*rateLimitStale)*time.Second); stale != nil && (!fallback || hasAnswers(stale)) {
+		go cacheLateResponse(query.View, req, done)
+		log.WithFields(fields).Debug("Sent cached response, recursion over its latency budget")
+		trace(w, "path=budget-cache")
+		stats.incr("recursionBudgetStale")
+		setExtendedError(w, EDE_STALE_ANSWER, "recursion over its latency budget")
+		Respond(w, req, stale)
+		return nil, SUBSTITUTE_STALE, nil
+	}
+	if fallback && answers.Exists(query, formatFqdn(query.ClientKey, fqdn), fqdn) {
+		go cacheLateResponse(query.View, req, done)
+		log.WithFields(fields).Debug("Recursion over its latency budget, falling back to local answers")
+		trace(w, "recursion=over-budget")
+		stats.incr("recursionBudgetLocal")
+		return nil, SUBSTITUTE_LOCAL, nil
+	}
+
+	r := <-done
+	return r.msg, "", r.err
+}
+
+// Caches the response of the recursers arriving after the query was answered otherwise
+func cacheLateResponse(view string, req *dns.Msg, done chan resolution) {
+	r := <-done
+	if r.err != nil || r.msg == nil || validator != nil || *forwardClientSubnet {
+		return
+	}
+	msg := r.msg
+	msg.Compress = true
+	addToRecursionCache(view, req, msg)
+}
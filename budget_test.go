@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestRecursionBudget(t *testing.T) {
+	dns.HandleFunc("slow.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		time.Sleep(200 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("10.9.9.9"),
+		}}
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("slow.test.")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	saved, savedEnvironments, savedCache, savedBudget := answers, environmentAnswers, globalCache, *recursionBudget
+	defer func() {
+		answers, environmentAnswers, globalCache, *recursionBudget = saved, savedEnvironments, savedCache, savedBudget
+	}()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Recurse: []string{conn.LocalAddr().String()},
+		Order:   []OrderRule{{Zone: "local.slow.test", Order: []string{ORDER_RECURSE, ORDER_LOCAL}}},
+		A:       map[string]RecordA{"baseline.local.slow.test.": {Answer: []string{"10.0.0.2"}}},
+	}}
+	environmentAnswers = nil
+	globalCache = cache.New(10, 600)
+	globalCache.SetStale(time.Minute)
+	clearClientSpecificCaches()
+	*recursionBudget = 50
+
+	query := func(name string) (*dns.Msg, time.Duration) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := &testWriter{}
+		start := time.Now()
+		route(w, req)
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("Expected an answer for %s, got %v", name, w.msg)
+		}
+		return w.msg, time.Since(start)
+	}
+
+	expired := new(dns.Msg)
+	expired.SetQuestion("web.slow.test.", dns.TypeA)
+	expired.Answer = []dns.RR{mustRR(t, "web.slow.test. 60 IN A 10.0.0.1")}
+	globalCache.InsertMessage(cache.Key(expired.Question[0], false, false), expired, -time.Second)
+	if msg, elapsed := query("web.slow.test."); msg.Answer[0].(*dns.A).A.String() != "10.0.0.1" || elapsed > 150*time.Millisecond {
+		t.Fatalf("Expected the stale response within the budget, got %v after %s", msg.Answer[0], elapsed)
+	}
+	time.Sleep(250 * time.Millisecond)
+	if msg, elapsed := query("web.slow.test."); msg.Answer[0].(*dns.A).A.String() != "10.9.9.9" || elapsed > 150*time.Millisecond {
+		t.Fatalf("Expected the late response to have been cached, got %v after %s", msg.Answer[0], elapsed)
+	}
+
+	if msg, elapsed := query("baseline.local.slow.test."); msg.Answer[0].(*dns.A).A.String() != "10.0.0.2" || elapsed > 150*time.Millisecond {
+		t.Fatalf("Expected the local answer within the budget, got %v after %s", msg.Answer[0], elapsed)
+	}
+
+	// Nothing else to answer with, so the recursers are waited for
+	if msg, elapsed := query("other.slow.test."); msg.Answer[0].(*dns.A).A.String() != "10.9.9.9" || elapsed < 150*time.Millisecond {
+		t.Fatalf("Expected the recursed answer, got %v after %s", msg.Answer[0], elapsed)
+	}
+}
@@ -1,18 +1,55 @@
 package main
 
 import (
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/rancher/rancher-dns/cache"
 )
 
+// The recursive caches of the views other than the top-level answers' (the global cache), by
+// viewName. Server blocks and environments have recursers of their own, so what one view's recursers
+// answered is never served to the clients of another.
+var (
+	viewCaches      = make(map[string]*cache.Cache)
+	viewCachesMutex sync.RWMutex
+)
+
+// Longest time (in seconds) a positive response is cached
+func positiveCacheTtl() uint {
+	if *cacheTtl > 0 {
+		return *cacheTtl
+	}
+	return *defaultTtl
+}
+
+// NXDOMAIN, or NOERROR without answers (NODATA)
+func isNegative(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeNameError || (msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0)
+}
+
+// A cache of --cache-capacity entries and at most --cache-max-bytes, for recursive responses kept
+// --rate-limit-stale or --serve-stale seconds past their expiry, whichever is longer
+func newCache(recursive bool) *cache.Cache {
+	c := cache.New(int(*cacheCapacity), int(positiveCacheTtl()))
+	c.SetMaxBytes(int(*cacheMaxBytes))
+	if recursive {
+		stale := *rateLimitStale
+		if *serveStale > stale {
+			stale = *serveStale
+		}
+		c.SetStale(time.Duration(stale) * time.Second)
+	}
+	return c
+}
+
 func getClientCache(clientUUID string) *cache.Cache {
 	clientSpecificCachesMutex.RLock()
 	clientCache, ok := clientSpecificCaches[clientUUID]
 	clientSpecificCachesMutex.RUnlock()
 	if !ok {
-		clientCache = cache.New(int(*cacheCapacity), int(*defaultTtl))
+		clientCache = newCache(false)
 		clientSpecificCachesMutex.Lock()
 		clientSpecificCaches[clientUUID] = clientCache
 		clientSpecificCachesMutex.Unlock()
@@ -20,38 +57,100 @@ func getClientCache(clientUUID string) *cache.Cache {
 	return clientCache
 }
 
+// The view of the server block or environment answering a query, empty for the top-level answers
+func viewName(block *ServerBlock, environment string) string {
+	if block != nil {
+		return "server/" + block.Name
+	}
+	if environment != "" {
+		return "environment/" + environment
+	}
+	return ""
+}
+
+// The recursive cache of the view
+func recursionCache(view string) *cache.Cache {
+	if view == "" {
+		return globalCache
+	}
+	viewCachesMutex.RLock()
+	viewCache, ok := viewCaches[view]
+	viewCachesMutex.RUnlock()
+	if !ok {
+		viewCachesMutex.Lock()
+		if viewCache, ok = viewCaches[view]; !ok {
+			viewCache = newCache(true)
+			viewCaches[view] = viewCache
+		}
+		viewCachesMutex.Unlock()
+	}
+	return viewCache
+}
+
 func globalCacheHit(req *dns.Msg) (*dns.Msg, time.Time) {
-	return globalCache.Hit(req.Question[0], false, false, req.MsgHdr.Id)
+	return recursionCacheHit("", req)
+}
+
+func recursionCacheHit(view string, req *dns.Msg) (*dns.Msg, time.Time) {
+	return recursionCache(view).Hit(req.Question[0], false, false, req.MsgHdr.Id)
 }
 
 func clientSpecificCacheHit(clientUUID string, req *dns.Msg) (*dns.Msg, time.Time) {
 	return getClientCache(clientUUID).Hit(req.Question[0], false, false, req.MsgHdr.Id)
 }
 
-func addToCache(req, msg *dns.Msg, clientUUID ...string) {
-	var currCache *cache.Cache
-	if len(clientUUID) == 0 {
-		currCache = globalCache
-	} else {
-		currCache = getClientCache(clientUUID[0])
-	}
+func addToCache(currCache *cache.Cache, req, msg *dns.Msg) {
 	ttl := currCache.GetTTL()
-	if len(msg.Answer) > 0 {
-		var requestTtl = time.Duration(msg.Answer[0].Header().Ttl) * time.Second
-		if requestTtl < ttl {
-			ttl = requestTtl
+	if isNegative(msg) {
+		if negativeTtl := time.Duration(*negativeCacheTtl) * time.Second; negativeTtl < ttl {
+			ttl = negativeTtl
+		}
+		if soaTtl, ok := negativeSoaTtl(msg); ok && soaTtl < ttl {
+			ttl = soaTtl
+		}
+	} else {
+		// Until the first record expires, e.g. the A records at the end of a long-lived CNAME
+		for _, rr := range msg.Answer {
+			if requestTtl := time.Duration(rr.Header().Ttl) * time.Second; requestTtl < ttl {
+				ttl = requestTtl
+			}
 		}
 	}
 	key := cache.Key(req.Question[0], false, false)
 	currCache.InsertMessage(key, msg, ttl)
 }
 
+// How long the negative response may be cached by its SOA record (RFC 2308 5): the lesser of the
+// SOA's own TTL and its MINIMUM field
+func negativeSoaTtl(msg *dns.Msg) (time.Duration, bool) {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			ttl := soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			return time.Duration(ttl) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
 func addToGlobalCache(req, msg *dns.Msg) {
-	addToCache(req, msg)
+	addToRecursionCache("", req, msg)
+}
+
+// Recursive negative responses without a SOA record aren't cached at all (RFC 2308 5): nothing says
+// for how long they hold
+func addToRecursionCache(view string, req, msg *dns.Msg) {
+	if _, ok := negativeSoaTtl(msg); isNegative(msg) && !ok {
+		stats.incr("negativeUncached")
+		return
+	}
+	addToCache(recursionCache(view), req, msg)
 }
 
 func addToClientSpecificCache(clientUUID string, req, msg *dns.Msg) {
-	addToCache(req, msg, clientUUID)
+	addToCache(getClientCache(clientUUID), req, msg)
 }
 
 func clearClientSpecificCaches() {
@@ -59,3 +158,35 @@ func clearClientSpecificCaches() {
 	clientSpecificCaches = make(map[string]*cache.Cache)
 	clientSpecificCachesMutex.Unlock()
 }
+
+// Drops the caches of every view but the top-level one; the global cache is left to the caller
+func clearViewCaches() {
+	viewCachesMutex.Lock()
+	viewCaches = make(map[string]*cache.Cache)
+	viewCachesMutex.Unlock()
+}
+
+// The hits, misses and evictions of the recursive caches, with their entries and approximate bytes
+func recursionCacheCounters() map[string]uint64 {
+	caches := []*cache.Cache{globalCache}
+	viewCachesMutex.RLock()
+	for _, c := range viewCaches {
+		caches = append(caches, c)
+	}
+	viewCachesMutex.RUnlock()
+
+	counters := map[string]uint64{"hits": 0, "misses": 0, "evictions": 0, "entries": 0, "bytes": 0}
+	for _, c := range caches {
+		if c == nil {
+			continue
+		}
+		hits, misses, evictions := c.Counters()
+		entries, size := c.Len()
+		counters["hits"] += hits
+		counters["misses"] += misses
+		counters["evictions"] += evictions
+		counters["entries"] += uint64(entries)
+		counters["bytes"] += uint64(size)
+	}
+	return counters
+}
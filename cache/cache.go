@@ -10,8 +10,10 @@ package cache
 // races. This should be optimized.
 
 import (
+	"container/list"
 	"crypto/sha1"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -21,23 +23,33 @@ import (
 // The signature is put in answer, extra is empty there. This wastes some memory.
 type elem struct {
 	expiration time.Time // time added + TTL, after this the elem is invalid
+	inserted   time.Time // time added, the TTLs of msg are counted down from
 	msg        *dns.Msg
+	size       int           // approximate bytes, the key and the packed message
+	used       *list.Element // place in the recency list, holding the key
 }
 
-// Cache is a cache that holds on the a number of RRs or DNS messages. The cache
-// eviction is randomized.
+// Cache is a cache that holds on the a number of RRs or DNS messages. When it's
+// full (capacity elems or maxBytes bytes) the least recently used elems are evicted.
 type Cache struct {
 	sync.RWMutex
 
 	capacity int
+	maxBytes int // 0 for no limit
+	size     int
 	m        map[string]*elem
+	used     *list.List // keys, most recently used first
 	ttl      time.Duration
+	stale    time.Duration // how long expired elems are kept around for Stale
+
+	hits, misses, evictions uint64
 }
 
 // New returns a new cache with the capacity and the ttl specified.
 func New(capacity, ttl int) *Cache {
 	c := new(Cache)
 	c.m = make(map[string]*elem)
+	c.used = list.New()
 	c.capacity = capacity
 	c.ttl = time.Duration(ttl) * time.Second
 	return c
@@ -45,26 +57,52 @@ func New(capacity, ttl int) *Cache {
 
 func (c *Cache) Capacity() int { return c.capacity }
 
+// SetStale keeps expired messages for d, during which Stale still returns them.
+func (c *Cache) SetStale(d time.Duration) { c.stale = d }
+
+// SetMaxBytes limits the approximate size of the elems (see Len) to n bytes, 0 for no limit.
+func (c *Cache) SetMaxBytes(n int) { c.maxBytes = n }
+
+// Len returns the number of elements in the cache and their approximate size in bytes (packed).
+func (c *Cache) Len() (int, int) {
+	c.RLock()
+	defer c.RUnlock()
+	return len(c.m), c.size
+}
+
+// Counters returns the number of hits and misses of Hit and the number of elems evicted to
+// make room for others.
+func (c *Cache) Counters() (hits, misses, evictions uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses), atomic.LoadUint64(&c.evictions)
+}
+
 func (c *Cache) Remove(s string) {
 	c.Lock()
-	delete(c.m, s)
+	c.remove(s)
 	c.Unlock()
 }
 
-// EvictRandom removes a random member a the cache.
 // Must be called under a write lock.
-func (c *Cache) EvictRandom() {
-	clen := len(c.m)
-	if clen < c.capacity {
-		return
+func (c *Cache) remove(s string) {
+	if e, ok := c.m[s]; ok {
+		c.used.Remove(e.used)
+		c.size -= e.size
+		delete(c.m, s)
 	}
-	i := c.capacity - clen
-	for k, _ := range c.m {
-		delete(c.m, k)
-		i--
-		if i == 0 {
-			break
-		}
+}
+
+// add puts the elem in the cache as the most recently used one and evicts the least
+// recently used ones while the cache is over its capacity or size.
+// Must be called under a write lock.
+func (c *Cache) add(s string, e *elem) {
+	c.remove(s)
+	e.size = len(s) + e.msg.Len()
+	e.used = c.used.PushFront(s)
+	c.m[s] = e
+	c.size += e.size
+	for len(c.m) > 1 && (len(c.m) > c.capacity || (c.maxBytes > 0 && c.size > c.maxBytes)) {
+		c.remove(c.used.Back().Value.(string))
+		atomic.AddUint64(&c.evictions, 1)
 	}
 }
 
@@ -76,11 +114,10 @@ func (c *Cache) InsertMessage(s string, msg *dns.Msg, ttl time.Duration) {
 	}
 
 	c.Lock()
-	if _, ok := c.m[s]; !ok {
-		c.m[s] = &elem{time.Now().UTC().Add(ttl), msg.Copy()}
-
+	if e, ok := c.m[s]; !ok || time.Since(e.expiration) >= 0 {
+		now := time.Now().UTC()
+		c.add(s, &elem{expiration: now.Add(ttl), inserted: now, msg: msg.Copy()})
 	}
-	c.EvictRandom()
 	c.Unlock()
 }
 
@@ -97,33 +134,42 @@ func (c *Cache) InsertSignature(s string, sig *dns.RRSIG) {
 			m = 0
 		}
 		t := time.Unix(int64(sig.Expiration)-(m*(1<<31)), 0).UTC()
-		c.m[s] = &elem{t, &dns.Msg{Answer: []dns.RR{dns.Copy(sig)}}}
+		c.add(s, &elem{expiration: t, inserted: time.Now().UTC(), msg: &dns.Msg{Answer: []dns.RR{dns.Copy(sig)}}})
 	}
-	c.EvictRandom()
 	c.Unlock()
 }
 
 // Search returns a dns.Msg, the expiration time and a boolean indicating if we found something
 // in the cache.
 func (c *Cache) Search(s string) (*dns.Msg, time.Time, bool) {
-	if c.capacity <= 0 {
+	e, ok := c.search(s)
+	if !ok {
 		return nil, time.Time{}, false
 	}
-	c.RLock()
+	return e.msg, e.expiration, true
+}
+
+// search returns a copy of the elem, with a copy of its message, and makes it the
+// most recently used one.
+func (c *Cache) search(s string) (elem, bool) {
+	if c.capacity <= 0 {
+		return elem{}, false
+	}
+	c.Lock()
+	defer c.Unlock()
 	if e, ok := c.m[s]; ok {
-		e1 := e.msg.Copy()
-		c.RUnlock()
-		return e1, e.expiration, true
+		c.used.MoveToFront(e.used)
+		return elem{expiration: e.expiration, inserted: e.inserted, msg: e.msg.Copy()}, true
 	}
-	c.RUnlock()
-	return nil, time.Time{}, false
+	return elem{}, false
 }
 
-// Key creates a hash key from a question section. It creates a different key
+// Key creates a hash key from a question section (name, type and class). It creates a different key
 // for requests with DNSSEC.
 func Key(q dns.Question, dnssec, tcp bool) string {
 	h := sha1.New()
 	i := append([]byte(q.Name), packUint16(q.Qtype)...)
+	i = append(i, packUint16(q.Qclass)...)
 	if dnssec {
 		i = append(i, byte(255))
 	}
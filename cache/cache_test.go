@@ -0,0 +1,56 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLeastRecentlyUsedEviction(t *testing.T) {
+	question := func(name string) dns.Question {
+		return dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	}
+	insert := func(c *Cache, name string) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		c.InsertMessage(Key(question(name), false, false), m, time.Minute)
+	}
+	cached := func(c *Cache, name string) bool {
+		m, _ := c.Hit(question(name), false, false, 1)
+		return m != nil
+	}
+
+	c := New(2, 600)
+	insert(c, "a.example.")
+	insert(c, "b.example.")
+	if !cached(c, "a.example.") {
+		t.Fatalf("Expected a.example. to be cached")
+	}
+	insert(c, "c.example.")
+	if !cached(c, "a.example.") || cached(c, "b.example.") || !cached(c, "c.example.") {
+		t.Fatalf("Expected the least recently used entry to be evicted")
+	}
+	if hits, misses, evictions := c.Counters(); hits != 3 || misses != 1 || evictions != 1 {
+		t.Fatalf("Expected 3 hits, 1 miss and 1 eviction, got %d %d %d", hits, misses, evictions)
+	}
+
+	c = New(100, 600)
+	insert(c, "a.example.")
+	_, size := c.Len()
+	c.SetMaxBytes(2*size + size/2)
+	for _, name := range []string{"b.example.", "c.example.", "d.example."} {
+		insert(c, name)
+	}
+	if entries, bytes := c.Len(); entries != 2 || bytes > 2*size+size/2 {
+		t.Fatalf("Expected the cache to stay within its size, got %d entries of %d bytes", entries, bytes)
+	}
+	if cached(c, "b.example.") || !cached(c, "d.example.") {
+		t.Fatalf("Expected the oldest entries to be evicted first")
+	}
+
+	c.Remove(Key(question("d.example."), false, false))
+	if entries, bytes := c.Len(); entries != 1 || bytes != size {
+		t.Fatalf("Expected the size to follow removals, got %d entries of %d bytes", entries, bytes)
+	}
+}
@@ -5,27 +5,71 @@
 package cache
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
-// Hit returns a dns message from the cache. If the message's TTL is expired nil
-// is returned and the message is removed from the cache.
+// Hit returns a dns message from the cache, with the TTLs of its records counted
+// down by the time it has been in the cache. If the message's TTL is expired nil
+// is returned and the message is removed from the cache, unless it is kept for
+// Stale.
 func (c *Cache) Hit(question dns.Question, dnssec, tcp bool, msgid uint16) (*dns.Msg, time.Time) {
 	key := Key(question, dnssec, tcp)
-	m1, exp, hit := c.Search(key)
+	e, hit := c.search(key)
+	m1, exp := e.msg, e.expiration
 	if hit {
+		decrementTtls(m1, time.Since(e.inserted))
 		// Cache hit! \o/
 		if time.Since(exp) < 0 {
 			m1.Id = msgid
 			m1.Compress = true
 			// Even if something ended up with the TC bit *in* the cache, set it to off
 			m1.Truncated = false
+			atomic.AddUint64(&c.hits, 1)
 			return m1, exp
 		}
 		// Expired! /o\
-		c.Remove(key)
+		if time.Since(exp) >= c.stale {
+			c.Remove(key)
+		}
 	}
+	atomic.AddUint64(&c.misses, 1)
 	return nil, time.Now()
 }
+
+// Stale returns a dns message from the cache that may have expired, as long as
+// it hasn't been expired for longer than the cache's stale duration, and its
+// expiration time. Its TTLs are counted down like those of Hit, to 0 at most.
+func (c *Cache) Stale(question dns.Question, dnssec, tcp bool, msgid uint16) (*dns.Msg, time.Time) {
+	e, hit := c.search(Key(question, dnssec, tcp))
+	m1, exp := e.msg, e.expiration
+	if !hit || time.Since(exp) >= c.stale {
+		return nil, time.Now()
+	}
+	decrementTtls(m1, time.Since(e.inserted))
+	m1.Id = msgid
+	m1.Compress = true
+	m1.Truncated = false
+	return m1, exp
+}
+
+// decrementTtls takes the age off the TTL of every record of the message but the OPT
+// pseudo-record, so each keeps counting down from what its server gave it.
+func decrementTtls(m *dns.Msg, age time.Duration) {
+	seconds := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl > seconds {
+				header.Ttl -= seconds
+			} else {
+				header.Ttl = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHitCountsTtlsDown(t *testing.T) {
+	c := New(10, 600)
+	c.SetStale(time.Hour)
+	question := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	m := new(dns.Msg)
+	m.SetQuestion(question.Name, question.Qtype)
+	for _, s := range []string{"www.example.com. 3600 IN CNAME web.example.com.", "web.example.com. 300 IN A 10.0.0.1"} {
+		rr, _ := dns.NewRR(s)
+		m.Answer = append(m.Answer, rr)
+	}
+	soa, _ := dns.NewRR("example.com. 100 IN SOA ns.example.com. admin.example.com. 1 7200 3600 1209600 60")
+	m.Ns = []dns.RR{soa}
+	m.SetEdns0(4096, false)
+	key := Key(question, false, false)
+	c.InsertMessage(key, m, 300*time.Second)
+
+	// As if it had been cached 120 seconds ago
+	c.m[key].inserted = c.m[key].inserted.Add(-120 * time.Second)
+	hit, _ := c.Hit(question, false, false, 1)
+	if hit == nil || hit.Answer[0].Header().Ttl != 3480 || hit.Answer[1].Header().Ttl != 180 || hit.Ns[0].Header().Ttl != 0 {
+		t.Fatalf("Expected each TTL to count down from its own, got %v", hit)
+	}
+	if opt := hit.IsEdns0(); opt == nil || opt.UDPSize() != 4096 {
+		t.Fatalf("Expected the OPT record to be left alone, got %v", opt)
+	}
+	if c.m[key].msg.Answer[1].Header().Ttl != 300 {
+		t.Fatalf("Expected the cached message to keep its TTLs")
+	}
+
+	c.m[key].expiration = time.Now().Add(-time.Second)
+	c.m[key].inserted = c.m[key].inserted.Add(-time.Hour)
+	if hit, _ := c.Hit(question, false, false, 1); hit != nil {
+		t.Fatalf("Expected no hit once expired")
+	}
+	if stale, _ := c.Stale(question, false, false, 1); stale == nil || stale.Answer[1].Header().Ttl != 0 {
+		t.Fatalf("Expected the stale TTLs to stop at 0, got %v", stale)
+	}
+	if hit, _ := c.Hit(dns.Question{Name: question.Name, Qtype: dns.TypeA, Qclass: dns.ClassCHAOS}, false, false, 1); hit != nil {
+		t.Fatalf("Expected the class to be part of the key")
+	}
+}
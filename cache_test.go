@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestNegativeCacheTtl(t *testing.T) {
+	savedGlobal, savedNegative := globalCache, *negativeCacheTtl
+	defer func() { globalCache, *negativeCacheTtl = savedGlobal, savedNegative }()
+	globalCache = cache.New(10, 600)
+	*negativeCacheTtl = 1
+
+	positive := new(dns.Msg)
+	positive.SetQuestion("web.example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(positive)
+	resp.Answer = []dns.RR{mustRR(t, "web.example.com. 300 IN A 10.0.0.1")}
+	addToGlobalCache(positive, resp)
+
+	negative := new(dns.Msg)
+	negative.SetQuestion("missing.example.com.", dns.TypeA)
+	nx := new(dns.Msg)
+	nx.SetRcode(negative, dns.RcodeNameError)
+	nx.Ns = []dns.RR{mustRR(t, "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 3600")}
+	addToGlobalCache(negative, nx)
+
+	if _, exp := globalCacheHit(positive); time.Until(exp) < 299*time.Second {
+		t.Fatalf("Positive response should be cached for its TTL, expires in %s", time.Until(exp))
+	}
+	if msg, exp := globalCacheHit(negative); msg == nil || time.Until(exp) > time.Second {
+		t.Fatalf("Negative response should be cached for the negative TTL, expires in %s", time.Until(exp))
+	}
+}
+
+func TestNegativeCacheSoaTtl(t *testing.T) {
+	savedGlobal, savedNegative := globalCache, *negativeCacheTtl
+	defer func() { globalCache, *negativeCacheTtl = savedGlobal, savedNegative }()
+	globalCache = cache.New(10, 600)
+	*negativeCacheTtl = 300
+
+	for _, test := range []struct {
+		name string
+		soa  string
+		ttl  time.Duration
+	}{
+		{"minimum.example.com.", "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 30", 30 * time.Second},
+		{"soa-ttl.example.com.", "example.com. 20 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 120", 20 * time.Second},
+		{"capped.example.com.", "example.com. 3600 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 3600", 300 * time.Second},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+		nx := new(dns.Msg)
+		nx.SetRcode(req, dns.RcodeNameError)
+		if test.soa != "" {
+			nx.Ns = []dns.RR{mustRR(t, test.soa)}
+		}
+		addToGlobalCache(req, nx)
+
+		msg, exp := globalCacheHit(req)
+		if msg == nil || time.Until(exp) > test.ttl || time.Until(exp) < test.ttl-time.Second {
+			t.Fatalf("Expected %s cached for %s, expires in %s", test.name, test.ttl, time.Until(exp))
+		}
+	}
+
+	// Without a SOA, nothing says for how long the name doesn't exist
+	for _, rcode := range []int{dns.RcodeNameError, dns.RcodeSuccess} {
+		req := new(dns.Msg)
+		req.SetQuestion("no-soa.example.com.", dns.TypeA)
+		negative := new(dns.Msg)
+		negative.SetRcode(req, rcode)
+		addToGlobalCache(req, negative)
+		if msg, _ := globalCacheHit(req); msg != nil {
+			t.Fatalf("Expected the %s without SOA not to be cached, got %v", dns.RcodeToString[rcode], msg)
+		}
+		if stale, _ := globalCache.Stale(req.Question[0], false, false, req.Id); stale != nil {
+			t.Fatalf("Expected nothing kept for serving stale either")
+		}
+	}
+}
+
+// A query arriving on another listener than testWriter's
+type listenerWriter struct {
+	testWriter
+	local net.Addr
+}
+
+func (w *listenerWriter) LocalAddr() net.Addr { return w.local }
+
+func TestViewCaches(t *testing.T) {
+	saved, savedEnvironments, savedUpstreams, savedCache := answers, environmentAnswers, fakeUpstreams, globalCache
+	savedBlocks, savedBlockAnswers := serverBlocks, serverBlockAnswers
+	defer func() {
+		answers, environmentAnswers, fakeUpstreams, globalCache = saved, savedEnvironments, savedUpstreams, savedCache
+		serverBlocks, serverBlockAnswers = savedBlocks, savedBlockAnswers
+		clearViewCaches()
+	}()
+	globalCache = cache.New(10, 600)
+	clearViewCaches()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{Recurse: []string{"192.0.2.53"}}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+	serverBlocks = []ServerBlock{{Name: "internal", Listen: []string{":53"}, Recurse: []string{"10.42.0.2"}}}
+	rebuildServerBlockAnswers(answers, answers.Environments())
+
+	upstream := func(addr string) {
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{mustRR(t, "web.example.com. 300 IN A "+addr)}
+		fakeUpstreams = replayUpstreams{"web.example.com. A": m}
+	}
+	query := func(w dns.ResponseWriter, tw *testWriter) string {
+		req := new(dns.Msg)
+		req.SetQuestion("web.example.com.", dns.TypeA)
+		route(w, req)
+		if tw.msg != nil && len(tw.msg.Answer) == 1 {
+			return tw.msg.Answer[0].(*dns.A).A.String()
+		}
+		return ""
+	}
+	internal := func() string {
+		w := &testWriter{}
+		return query(w, w)
+	}
+	public := func() string {
+		w := &listenerWriter{local: &net.UDPAddr{IP: net.ParseIP("10.1.1.53"), Port: 5353}}
+		return query(w, &w.testWriter)
+	}
+
+	upstream("10.0.0.1")
+	if addr := internal(); addr != "10.0.0.1" {
+		t.Fatalf("Expected the recursed answer, got %q", addr)
+	}
+	upstream("10.0.0.2")
+	if addr := public(); addr != "10.0.0.2" {
+		t.Fatalf("Expected the other view's cached answer not to be served, got %q", addr)
+	}
+	fakeUpstreams = replayUpstreams{}
+	if addr := internal(); addr != "10.0.0.1" {
+		t.Fatalf("Expected the view's own cached answer, got %q", addr)
+	}
+	if addr := public(); addr != "10.0.0.2" {
+		t.Fatalf("Expected the top-level cached answer, got %q", addr)
+	}
+}
+
+func TestCachedUntilFirstRecordExpires(t *testing.T) {
+	savedGlobal := globalCache
+	defer func() { globalCache = savedGlobal }()
+	globalCache = cache.New(10, 600)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		mustRR(t, "www.example.com. 3600 IN CNAME web.example.com."),
+		mustRR(t, "web.example.com. 30 IN A 10.0.0.1"),
+	}
+	addToGlobalCache(req, resp)
+
+	msg, exp := globalCacheHit(req)
+	if msg == nil || time.Until(exp) > 30*time.Second {
+		t.Fatalf("Expected the response to be cached for the shortest TTL, expires in %s", time.Until(exp))
+	}
+	update(msg, exp)
+	if ttl := msg.Answer[0].Header().Ttl; ttl > 30 {
+		t.Fatalf("Expected no record to be served past the entry's expiry, got a TTL of %d", ttl)
+	}
+}
+
+func TestRecursedAaaaNxdomain(t *testing.T) {
+	saved, savedEnvironments, savedUpstreams, savedCache := answers, environmentAnswers, fakeUpstreams, globalCache
+	defer func() {
+		answers, environmentAnswers, fakeUpstreams, globalCache = saved, savedEnvironments, savedUpstreams, savedCache
+	}()
+	globalCache = cache.New(10, 600)
+	answers = Answers{DEFAULT_KEY: ClientAnswers{Recurse: []string{"192.0.2.53"}}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	nx := new(dns.Msg)
+	nx.Rcode = dns.RcodeNameError
+	nx.Ns = []dns.RR{mustRR(t, "example.com. 300 IN SOA ns.example.com. admin.example.com. 1 7200 3600 86400 300")}
+	fakeUpstreams = replayUpstreams{"gone.example.com. AAAA": nx}
+
+	// The upstream's NXDOMAIN stands, fresh and from the cache
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("gone.example.com.", dns.TypeAAAA)
+		w := &testWriter{}
+		route(w, req)
+		if w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+			t.Fatalf("Expected the AAAA NXDOMAIN to be passed on, got %v", w.msg)
+		}
+	}
+}
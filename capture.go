@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Packets kept when a capture is started without a size, and at most
+const (
+	DEFAULT_CAPTURE_SIZE = 1000
+	MAX_CAPTURE_SIZE     = 100000
+)
+
+// Bytes of a message kept in a frame, so its IP and UDP lengths and the frame fit the 65535 bytes
+// snapshot length. Larger (TCP) messages are cut short, with their whole length as the original length.
+const MAX_CAPTURE_DATA = 65535 - 40 - 8
+
+// pcap link type for packets that start with an IPv4 or IPv6 header
+const LINKTYPE_RAW = 101
+
+// A query or response as it was seen on the wire
+type capturedPacket struct {
+	time time.Time
+	src  *net.UDPAddr
+	dst  *net.UDPAddr
+	data []byte
+}
+
+// Ring buffer of the last queries and responses, started and saved on demand through the admin API
+// (or "rancher-dns ctl capture"), so the traffic can be inspected without tcpdump in the container
+type packetCapture struct {
+	sync.Mutex
+	packets []capturedPacket
+	next    int
+	full    bool
+}
+
+var (
+	capture      *packetCapture
+	captureMutex sync.RWMutex
+)
+
+func startCapture(size int) {
+	captureMutex.Lock()
+	capture = &packetCapture{packets: make([]capturedPacket, size)}
+	captureMutex.Unlock()
+	log.Infof("Capturing the last %d packets", size)
+}
+
+func stopCapture() {
+	captureMutex.Lock()
+	capture = nil
+	captureMutex.Unlock()
+	log.Info("Stopped capturing packets")
+}
+
+func capturing() *packetCapture {
+	captureMutex.RLock()
+	defer captureMutex.RUnlock()
+	return capture
+}
+
+// Records the message sent from src to dst if a capture is running
+func captureMsg(src net.Addr, dst net.Addr, m *dns.Msg) {
+	c := capturing()
+	if c == nil {
+		return
+	}
+	data, err := m.Pack()
+	if err != nil {
+		return
+	}
+	c.add(capturedPacket{time: time.Now(), src: udpAddr(src), dst: udpAddr(dst), data: data})
+}
+
+func (c *packetCapture) add(packet capturedPacket) {
+	c.Lock()
+	c.packets[c.next] = packet
+	c.next = (c.next + 1) % len(c.packets)
+	c.full = c.full || c.next == 0
+	c.Unlock()
+}
+
+// Bytes of packet data held
+func (c *packetCapture) Size() int {
+	c.Lock()
+	defer c.Unlock()
+	size := 0
+	for _, packet := range c.packets {
+		size += len(packet.data)
+	}
+	return size
+}
+
+// The captured packets, oldest first
+func (c *packetCapture) Packets() []capturedPacket {
+	c.Lock()
+	defer c.Unlock()
+	if !c.full {
+		return append([]capturedPacket(nil), c.packets[:c.next]...)
+	}
+	return append(append([]capturedPacket(nil), c.packets[c.next:]...), c.packets[:c.next]...)
+}
+
+// Writes the packets in pcap format. Messages are wrapped in made-up IP and UDP headers (TCP queries
+// included, which show up as datagrams) so the usual tools decode them as DNS.
+func writePcap(w io.Writer, packets []capturedPacket) error {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], LINKTYPE_RAW)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	for _, packet := range packets {
+		frame := ipFrame(packet)
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:], uint32(packet.time.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(packet.time.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)-len(capturedData(packet))+len(packet.data)))
+		if _, err := w.Write(append(record, frame...)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The part of the message kept in its frame
+func capturedData(packet capturedPacket) []byte {
+	if len(packet.data) > MAX_CAPTURE_DATA {
+		return packet.data[:MAX_CAPTURE_DATA]
+	}
+	return packet.data
+}
+
+// The message in a UDP datagram in an IPv4 packet, or IPv6 when either address is IPv6
+func ipFrame(packet capturedPacket) []byte {
+	data := capturedData(packet)
+	udp := make([]byte, 8, 8+len(data))
+	binary.BigEndian.PutUint16(udp[0:], uint16(packet.src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(packet.dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(data)))
+	udp = append(udp, data...)
+
+	src4, dst4 := packet.src.IP.To4(), packet.dst.IP.To4()
+	if src4 != nil && dst4 != nil {
+		ip := make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = 17
+		copy(ip[12:], src4)
+		copy(ip[16:], dst4)
+		binary.BigEndian.PutUint16(ip[10:], ipChecksum(ip))
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40)
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = 17
+	ip[7] = 64
+	copy(ip[8:], packet.src.IP.To16())
+	copy(ip[24:], packet.dst.IP.To16())
+	return append(ip, udp...)
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(header[i])<<8 | uint32(header[i+1])
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func udpAddr(addr net.Addr) *net.UDPAddr {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a
+	case *net.TCPAddr:
+		return &net.UDPAddr{IP: a.IP, Port: a.Port}
+	}
+	a := &net.UDPAddr{IP: net.IPv4zero}
+	if addr != nil {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+			if ip := net.ParseIP(host); ip != nil {
+				a.IP = ip
+			}
+			a.Port, _ = strconv.Atoi(port)
+		}
+	}
+	return a
+}
+
+// GET /v1/capture saves the captured packets as pcap, POST starts a capture of the last "size"
+// packets (replacing a running one, at most MAX_CAPTURE_SIZE), DELETE stops it
+func httpCapture(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "POST":
+		size := DEFAULT_CAPTURE_SIZE
+		if s := req.URL.Query().Get("size"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > MAX_CAPTURE_SIZE {
+				http.Error(w, "invalid size: "+s, http.StatusBadRequest)
+				return
+			}
+			size = n
+		}
+		startCapture(size)
+		fmt.Fprintf(w, "Capturing the last %d packets\n", size)
+	case "DELETE":
+		stopCapture()
+		fmt.Fprintln(w, "Stopped")
+	default:
+		c := capturing()
+		if c == nil {
+			http.Error(w, "no capture running", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		writePcap(w, c.Packets())
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCapture(t *testing.T) {
+	defer stopCapture()
+
+	client := &net.UDPAddr{IP: net.ParseIP("10.1.1.1"), Port: 5353}
+	server := &net.TCPAddr{IP: net.ParseIP("10.1.1.53"), Port: 53}
+	captureMsg(client, server, new(dns.Msg))
+	if capturing() != nil {
+		t.Fatalf("Nothing should be captured before a capture is started")
+	}
+
+	startCapture(2)
+	for _, name := range []string{"a.", "b.", "c."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		captureMsg(client, server, m)
+	}
+	packets := capturing().Packets()
+	if len(packets) != 2 {
+		t.Fatalf("Expected the last 2 packets, got %d", len(packets))
+	}
+
+	var buf bytes.Buffer
+	if err := writePcap(&buf, packets); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	if binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != LINKTYPE_RAW {
+		t.Fatalf("Incorrect pcap header %v", data[:24])
+	}
+
+	data = data[24:]
+	for _, name := range []string{"b.", "c."} {
+		length := binary.LittleEndian.Uint32(data[8:])
+		frame := data[16 : 16+length]
+		data = data[16+length:]
+		if frame[0] != 0x45 || ipChecksum(frame[:20]) != 0 {
+			t.Fatalf("Incorrect IPv4 header %v", frame[:20])
+		}
+		if binary.BigEndian.Uint16(frame[20:]) != 5353 || binary.BigEndian.Uint16(frame[22:]) != 53 {
+			t.Fatalf("Incorrect UDP ports %v", frame[20:28])
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(frame[28:]); err != nil || m.Question[0].Name != name {
+			t.Fatalf("Expected a query for %s, got %v (%v)", name, m, err)
+		}
+	}
+	if len(data) != 0 {
+		t.Fatalf("Unexpected trailing data %v", data)
+	}
+
+	v6 := ipFrame(capturedPacket{src: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5353}, dst: udpAddr(server), data: []byte{1, 2}})
+	if v6[0] != 0x60 || len(v6) != 40+8+2 || !net.IP(v6[24:40]).Equal(server.IP) {
+		t.Fatalf("Incorrect IPv6 frame %v", v6)
+	}
+}
+
+func TestCaptureLimits(t *testing.T) {
+	defer stopCapture()
+
+	// TCP messages larger than a frame can hold are cut short, keeping their length in the record
+	client := &net.UDPAddr{IP: net.ParseIP("10.1.1.1"), Port: 5353}
+	server := &net.UDPAddr{IP: net.ParseIP("10.1.1.53"), Port: 53}
+	large := capturedPacket{src: client, dst: server, data: make([]byte, 65535)}
+	var buf bytes.Buffer
+	if err := writePcap(&buf, []capturedPacket{large}); err != nil {
+		t.Fatal(err)
+	}
+	record := buf.Bytes()[24:]
+	included, original := binary.LittleEndian.Uint32(record[8:]), binary.LittleEndian.Uint32(record[12:])
+	if included > 65535 || original != 20+8+65535 {
+		t.Fatalf("Expected the frame cut to the snapshot length with its original length, got %d of %d", included, original)
+	}
+	frame := record[16:]
+	if length := binary.BigEndian.Uint16(frame[2:]); int(length) != len(frame) || int(included) != len(frame) || ipChecksum(frame[:20]) != 0 {
+		t.Fatalf("Expected an IPv4 length of %d, got %d", len(frame), length)
+	}
+	if length := binary.BigEndian.Uint16(frame[24:]); int(length) != len(frame)-20 {
+		t.Fatalf("Expected a UDP length of %d, got %d", len(frame)-20, length)
+	}
+
+	for size, status := range map[string]int{"10": http.StatusOK, "0": http.StatusBadRequest, "100001": http.StatusBadRequest} {
+		w := httptest.NewRecorder()
+		httpCapture(w, httptest.NewRequest("POST", "/v1/capture?size="+size, nil))
+		if w.Code != status {
+			t.Fatalf("Expected %d for a capture of %s packets, got %d", status, size, w.Code)
+		}
+	}
+}
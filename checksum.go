@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The version of the served answers. Every change to them starts a new generation; the checksums
+// let fleet tooling check that every host serves the same answers, both overall and per source
+// (pins and runtime records are usually local to a host, the answers file shouldn't be).
+type AnswersVersion struct {
+	Generation uint64            `json:"generation"`
+	Checksum   string            `json:"checksum"`
+	Since      time.Time         `json:"since"`
+	Sources    map[string]string `json:"sources"`
+}
+
+// Guarded by answersMutex
+var answersVersion AnswersVersion
+
+// SHA-256 of the answers in a canonical form: YAML has the map keys sorted, and leaves out the source
+// of each record, so the same answers have the same checksum wherever they were loaded from
+func answersChecksum(answers Answers) string {
+	data, err := yaml.Marshal(answers)
+	if err != nil {
+		log.Error("Failed to serialize answers for their checksum: ", err)
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Starts a new generation if the served answers changed. Must be called with answersMutex held.
+func updateAnswersVersion() {
+	checksum := answersChecksum(answers)
+	sources := make(map[string]string, len(sourceChain))
+	for _, source := range sourceChain {
+		sources[source.Name()] = answersChecksum(source.Answers())
+	}
+	answersVersion.Sources = sources
+	if checksum == answersVersion.Checksum {
+		return
+	}
+	answersVersion.Generation++
+	answersVersion.Checksum = checksum
+	answersVersion.Since = time.Now().UTC()
+	log.WithFields(log.Fields{"generation": answersVersion.Generation, "checksum": checksum}).Info("Serving new answers")
+}
+
+func currentAnswersVersion() AnswersVersion {
+	answersMutex.Lock()
+	defer answersMutex.Unlock()
+	return answersVersion
+}
+
+func httpVersion(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(currentAnswersVersion())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAnswersChecksum(t *testing.T) {
+	ttl := uint32(42)
+	a := Answers{DEFAULT_KEY: ClientAnswers{
+		Recurse: []string{"8.8.8.8"},
+		A:       map[string]RecordA{"web.": {Answer: []string{"10.0.0.1"}, Source: SOURCE_FILE}, "db.": {Answer: []string{"10.0.0.2"}}},
+		Txt:     map[string]RecordTxt{"web.": {Answer: []string{"v=1"}, Ttl: &ttl}},
+	}}
+	b := Answers{DEFAULT_KEY: ClientAnswers{
+		Recurse: []string{"8.8.8.8"},
+		A:       map[string]RecordA{"db.": {Answer: []string{"10.0.0.2"}}, "web.": {Answer: []string{"10.0.0.1"}, Source: SOURCE_DYNAMIC}},
+		Txt:     map[string]RecordTxt{"web.": {Answer: []string{"v=1"}, Ttl: &ttl}},
+	}}
+	if answersChecksum(a) != answersChecksum(b) {
+		t.Fatalf("Expected the same answers to have the same checksum")
+	}
+
+	ttl2 := uint32(43)
+	b[DEFAULT_KEY].Txt["web."] = RecordTxt{Answer: []string{"v=1"}, Ttl: &ttl2}
+	if answersChecksum(a) == answersChecksum(b) {
+		t.Fatalf("Expected a different TTL to change the checksum")
+	}
+}
+
+func TestAnswersVersion(t *testing.T) {
+	saved, savedEnvironments, savedChain, savedVersion := answers, environmentAnswers, sourceChain, answersVersion
+	defer func() {
+		answers, environmentAnswers, sourceChain, answersVersion = saved, savedEnvironments, savedChain, savedVersion
+	}()
+
+	source := &recordSource{name: SOURCE_FILE, answers: Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.0.0.1"}}}}}}
+	sourceChain = []AnswerSource{source}
+	answersVersion = AnswersVersion{}
+
+	answersMutex.Lock()
+	rebuildAnswers()
+	first := answersVersion
+	rebuildAnswers()
+	answersMutex.Unlock()
+	if first.Generation != 1 || currentAnswersVersion().Generation != 1 {
+		t.Fatalf("Expected a rebuild without changes to keep the generation, got %+v", currentAnswersVersion())
+	}
+	if first.Sources[SOURCE_FILE] != first.Checksum {
+		t.Fatalf("Expected the checksum of the only source to be that of the answers, got %+v", first)
+	}
+
+	source.Set(Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.0.0.2"}}}}})
+	answersMutex.Lock()
+	rebuildAnswers()
+	answersMutex.Unlock()
+	if version := currentAnswersVersion(); version.Generation != 2 || version.Checksum == first.Checksum {
+		t.Fatalf("Expected a new generation, got %+v", version)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Responses to queries of a client that already has --client-max-inflight queries being answered
+// (--client-overflow)
+const (
+	CLIENT_OVERFLOW_REFUSED  = "refused"
+	CLIENT_OVERFLOW_SERVFAIL = "servfail"
+	CLIENT_OVERFLOW_DROP     = "drop"
+)
+
+// The queries of each client IP being answered, so a single client running thousands of lookups in
+// parallel can't keep every handler busy with its queries (most of them waiting on the recursers)
+type inflightQueries struct {
+	sync.Mutex
+	counts map[string]uint
+}
+
+var clientQueries = &inflightQueries{counts: make(map[string]uint)}
+
+// Counts a query of the client as being answered, unless the client is at the limit
+func (q *inflightQueries) acquire(client string, limit uint) bool {
+	q.Lock()
+	defer q.Unlock()
+	if q.counts[client] >= limit {
+		return false
+	}
+	q.counts[client]++
+	return true
+}
+
+func (q *inflightQueries) release(client string) {
+	q.Lock()
+	defer q.Unlock()
+	if q.counts[client] <= 1 {
+		delete(q.counts, client)
+	} else {
+		q.counts[client]--
+	}
+}
+
+// Answers the query, unless its client is at --client-max-inflight
+func limitedRoute(w dns.ResponseWriter, req *dns.Msg) {
+	client := clientAddr(w)
+	if !clientQueries.acquire(client, *clientMaxInflight) {
+		answerOverflow(w, req, client)
+		return
+	}
+	defer clientQueries.release(client)
+	route(w, req)
+}
+
+// Answers a query over the client's limit as configured
+func answerOverflow(w dns.ResponseWriter, req *dns.Msg, client string) {
+	stats.incr("clientOverflow")
+	log.WithFields(log.Fields{"client": client, "limit": *clientMaxInflight}).Warn("Client has too many queries in flight")
+	switch *clientOverflow {
+	case CLIENT_OVERFLOW_DROP:
+		return
+	case CLIENT_OVERFLOW_SERVFAIL:
+		dns.HandleFailed(w, req)
+	default:
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		setExtendedError(w, EDE_OTHER, "too many queries in flight")
+		w.WriteMsg(m)
+	}
+}
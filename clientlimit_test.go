@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientInflightLimit(t *testing.T) {
+	savedLimit, savedOverflow := *clientMaxInflight, *clientOverflow
+	defer func() { *clientMaxInflight, *clientOverflow = savedLimit, savedOverflow }()
+	*clientMaxInflight = 2
+
+	queries := &inflightQueries{counts: make(map[string]uint)}
+	if !queries.acquire("10.0.0.1", 2) || !queries.acquire("10.0.0.1", 2) {
+		t.Fatalf("Expected the queries under the limit to be answered")
+	}
+	if queries.acquire("10.0.0.1", 2) {
+		t.Fatalf("Expected a query over the limit to be refused")
+	}
+	if !queries.acquire("10.0.0.2", 2) {
+		t.Fatalf("Expected other clients to have their own limit")
+	}
+	queries.release("10.0.0.1")
+	if !queries.acquire("10.0.0.1", 2) {
+		t.Fatalf("Expected an answered query to make room")
+	}
+	queries.release("10.0.0.1")
+	queries.release("10.0.0.1")
+	queries.release("10.0.0.2")
+	if len(queries.counts) != 0 {
+		t.Fatalf("Expected clients without queries to be forgotten, got %v", queries.counts)
+	}
+
+	// Queries of a client at its limit get the overflow response
+	client := clientAddr(&testWriter{})
+	for i := uint(0); i < *clientMaxInflight; i++ {
+		clientQueries.acquire(client, *clientMaxInflight)
+		defer clientQueries.release(client)
+	}
+	for _, test := range []struct {
+		overflow string
+		rcode    int
+	}{
+		{CLIENT_OVERFLOW_REFUSED, dns.RcodeRefused},
+		{CLIENT_OVERFLOW_SERVFAIL, dns.RcodeServerFailure},
+		{CLIENT_OVERFLOW_DROP, -1},
+	} {
+		*clientOverflow = test.overflow
+		req := new(dns.Msg)
+		req.SetQuestion("web.", dns.TypeA)
+		w := &testWriter{}
+		limitedRoute(w, req)
+		if test.rcode < 0 && w.msg != nil {
+			t.Fatalf("Expected no response with %s, got %v", test.overflow, w.msg)
+		}
+		if test.rcode >= 0 && (w.msg == nil || w.msg.Rcode != test.rcode) {
+			t.Fatalf("Expected %s with %s, got %v", dns.RcodeToString[test.rcode], test.overflow, w.msg)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// The clock and the randomness that answers depend on (serials, expiries, the order of addresses).
+// "rancher-dns replay" swaps in a fixed time and seed, so that replaying the same queries gives the same
+// responses every time.
+var (
+	now    = time.Now
+	random = rand.New(&lockedSource{src: rand.NewSource(time.Now().UnixNano()).(rand.Source64)})
+)
+
+// A rand.Source for use from concurrent queries, which the one of rand.New alone isn't
+type lockedSource struct {
+	sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.Lock()
+	defer s.Unlock()
+	s.src.Seed(seed)
+}
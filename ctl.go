@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Entry point of "rancher-dns ctl <command>", which talks to a running server's reload/admin listener
+func runCtl(args []string) int {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8113", "Address of the server's reload listener (--listenReload)")
+	client := flags.String("client", "", "Only show records of this client key")
+	asJson := flags.Bool("json", false, "Print raw JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s ctl [options] dump|export|reload [ZONE FRAGMENT]|validate|capture start [SIZE]|capture stop|capture save FILE|pin [-for D] [-type T] NAME ANSWER...|unpin [-type T] NAME|pins|upstreams|version|blocklists|blocklist enable|disable NAME\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	switch flags.Arg(0) {
+	case "dump":
+		query := url.Values{}
+		if *client != "" {
+			query.Set("client", *client)
+		}
+		body, err := ctlGet(*addr, "/v1/dump?"+query.Encode())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *asJson {
+			os.Stdout.Write(body)
+			return 0
+		}
+		var records []DumpRecord
+		if err := json.Unmarshal(body, &records); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printDump(records)
+		return 0
+	case "export":
+		body, err := ctlGet(*addr, "/v1/dump?format=answers")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		os.Stdout.Write(body)
+		return 0
+	case "reload", "validate":
+		var body []byte
+		var err error
+		if flags.Arg(0) == "validate" {
+			body, err = ctlPost(*addr, "/reload?validate=true")
+		} else if flags.NArg() == 3 {
+			// A zone and the fragment with its records
+			fragment, readErr := ioutil.ReadFile(flags.Arg(2))
+			if readErr != nil {
+				fmt.Fprintln(os.Stderr, readErr)
+				return 1
+			}
+			body, err = ctlPostBody(*addr, "/reload?"+url.Values{"zone": {flags.Arg(1)}}.Encode(), fragment)
+		} else {
+			body, err = ctlPost(*addr, "/reload")
+		}
+		if err != nil && body == nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *asJson {
+			os.Stdout.Write(body)
+		} else {
+			var result ReloadResult
+			if err := json.Unmarshal(body, &result); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			printReload(result)
+		}
+		if err != nil {
+			return 1
+		}
+		return 0
+	case "capture":
+		return ctlCapture(*addr, flags.Args()[1:], flags.Usage)
+	case "upstreams":
+		body, err := ctlGet(*addr, "/v1/upstreams")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *asJson {
+			os.Stdout.Write(body)
+			return 0
+		}
+		var upstreams map[string]upstreamCapabilities
+		if err := json.Unmarshal(body, &upstreams); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printUpstreams(upstreams)
+		return 0
+	case "version":
+		body, err := ctlGet(*addr, "/v1/version")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *asJson {
+			os.Stdout.Write(body)
+			return 0
+		}
+		var version AnswersVersion
+		if err := json.Unmarshal(body, &version); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printVersion(version)
+		return 0
+	case "blocklists", "blocklist":
+		return ctlBlocklists(*addr, flags.Args(), *asJson, flags.Usage)
+	case "pin", "unpin":
+		return ctlPin(*addr, flags.Arg(0), *client, flags.Args()[1:])
+	case "pins":
+		body, err := ctlGet(*addr, "/v1/pins")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if *asJson {
+			os.Stdout.Write(body)
+			return 0
+		}
+		var pins []Pin
+		if err := json.Unmarshal(body, &pins); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		printPins(pins)
+		return 0
+	default:
+		flags.Usage()
+		return 2
+	}
+}
+
+// "capture start [SIZE]" starts capturing the last SIZE packets, "capture save FILE" writes them to
+// FILE ("-" for stdout) as pcap and "capture stop" stops capturing
+func ctlCapture(addr string, args []string, usage func()) int {
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+
+	var body []byte
+	var err error
+	switch {
+	case args[0] == "start" && len(args) <= 2:
+		query := url.Values{}
+		if len(args) == 2 {
+			query.Set("size", args[1])
+		}
+		body, err = ctlPost(addr, "/v1/capture?"+query.Encode())
+	case args[0] == "stop" && len(args) == 1:
+		body, err = ctlDelete(addr, "/v1/capture")
+	case args[0] == "save" && len(args) == 2:
+		if body, err = ctlGet(addr, "/v1/capture"); err == nil {
+			if args[1] == "-" {
+				os.Stdout.Write(body)
+				return 0
+			}
+			if err = ioutil.WriteFile(args[1], body, 0644); err == nil {
+				fmt.Printf("Saved %d bytes to %s\n", len(body), args[1])
+				return 0
+			}
+		}
+	default:
+		usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	os.Stdout.Write(body)
+	return 0
+}
+
+// "pin [-for 30m] [-type A] NAME ANSWER..." temporarily overrides a record, "unpin [-type A] NAME"
+// removes the override again
+func ctlPin(addr string, command string, client string, args []string) int {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	duration := flags.Duration("for", DEFAULT_PIN_DURATION, "How long the pin lasts")
+	qtype := flags.String("type", "A", "Record type: A, CNAME, PTR, TXT or SRV")
+	comment := flags.String("comment", "", "Note kept with the pin, e.g. the incident")
+	flags.StringVar(&client, "client", client, "Client key the record is pinned for")
+	flags.Usage = func() {
+		if command == "pin" {
+			fmt.Fprintf(os.Stderr, "Usage: %s ctl pin [options] NAME ANSWER...\n", os.Args[0])
+		} else {
+			fmt.Fprintf(os.Stderr, "Usage: %s ctl unpin [options] NAME\n", os.Args[0])
+		}
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	var pin Pin
+	if command == "pin" {
+		if flags.NArg() < 2 {
+			flags.Usage()
+			return 2
+		}
+		req := PinRequest{
+			RecordOp: RecordOp{Client: client, Type: *qtype, Name: flags.Arg(0), Answer: flags.Args()[1:], Comment: *comment},
+			For:      duration.String(),
+		}
+		reqBody, _ := json.Marshal(req)
+		body, err := ctlPostBody(addr, "/v1/pins", reqBody)
+		if err == nil {
+			err = json.Unmarshal(body, &pin)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Printf("Pinned %s %s to %s for client %s until %s\n", pin.Type, pin.Name, strings.Join(pin.Answer, ","),
+			pin.Client, pin.Expires.Local().Format(time.RFC3339))
+		return 0
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	query := url.Values{"client": {client}, "type": {*qtype}, "name": {flags.Arg(0)}}
+	body, err := ctlDelete(addr, "/v1/pins?"+query.Encode())
+	if err == nil {
+		err = json.Unmarshal(body, &pin)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("Unpinned %s %s for client %s\n", pin.Type, pin.Name, pin.Client)
+	return 0
+}
+
+// "blocklists" shows the blocklist subscriptions, "blocklist enable|disable NAME" turns one on or off
+func ctlBlocklists(addr string, args []string, asJson bool, usage func()) int {
+	var body []byte
+	var err error
+	switch {
+	case args[0] == "blocklists" && len(args) == 1:
+		body, err = ctlGet(addr, "/v1/blocklists")
+	case args[0] == "blocklist" && len(args) == 3 && (args[1] == "enable" || args[1] == "disable"):
+		query := url.Values{}
+		query.Set("name", args[2])
+		query.Set("enabled", fmt.Sprint(args[1] == "enable"))
+		body, err = ctlPost(addr, "/v1/blocklists?"+query.Encode())
+	default:
+		usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if asJson {
+		os.Stdout.Write(body)
+		return 0
+	}
+	var lists []BlocklistStatus
+	if err := json.Unmarshal(body, &lists); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	printBlocklists(lists)
+	return 0
+}
+
+func ctlGet(addr string, path string) ([]byte, error) {
+	resp, err := http.Get("http://" + addr + path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// Like ctlGet, but returns the body along with the error when the server answered with an error status
+func ctlPost(addr string, path string) ([]byte, error) {
+	return ctlPostBody(addr, path, nil)
+}
+
+func ctlPostBody(addr string, path string, reqBody []byte) ([]byte, error) {
+	resp, err := http.Post("http://"+addr+path, "application/json", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return body, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func ctlDelete(addr string, path string) ([]byte, error) {
+	req, err := http.NewRequest("DELETE", "http://"+addr+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func printReload(result ReloadResult) {
+	failure := result.Error
+	if result.Stage != "" {
+		failure = result.Stage + ": " + result.Error
+	}
+	if result.DryRun && result.Ok {
+		fmt.Printf("Valid, checked in %.1fms, would serve:\n", result.DurationMs)
+	} else if result.DryRun {
+		fmt.Printf("Invalid: %s\n", failure)
+	} else if result.Ok && result.Zone != "" {
+		fmt.Printf("Reloaded zone %s in %.1fms\n", result.Zone, result.DurationMs)
+	} else if result.Ok {
+		fmt.Printf("Reloaded in %.1fms\n", result.DurationMs)
+	} else {
+		fmt.Printf("Reload failed: %s\n", failure)
+	}
+	fmt.Printf("Clients: %d, A: %d, CNAME: %d, PTR: %d, TXT: %d, SRV: %d\n", result.Clients,
+		result.Records["A"], result.Records["CNAME"], result.Records["PTR"], result.Records["TXT"], result.Records["SRV"])
+	fmt.Printf("Generation %d, %s\n", result.Generation, result.Checksum)
+}
+
+func printVersion(version AnswersVersion) {
+	fmt.Printf("Generation %d since %s\n", version.Generation, version.Since.Format(time.RFC3339))
+	fmt.Printf("Checksum: %s\n", version.Checksum)
+	names := make([]string, 0, len(version.Sources))
+	for name := range version.Sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tCHECKSUM")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%s\n", name, version.Sources[name])
+	}
+	w.Flush()
+}
+
+func printDump(records []DumpRecord) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tNAME\tTYPE\tTTL\tANSWER\tSOURCE\tCOMMENT")
+	for _, rec := range records {
+		ttl := "-"
+		if rec.Ttl != nil {
+			ttl = fmt.Sprint(*rec.Ttl)
+		}
+		answer := rec.Answer
+		if len(rec.Weights) > 0 {
+			// Weighted addresses with their weight, e.g. 10.1.2.7(90)
+			answer = nil
+			for _, address := range rec.Answer {
+				weight, ok := rec.Weights[address]
+				if !ok {
+					weight = DEFAULT_WEIGHT
+				}
+				answer = append(answer, fmt.Sprintf("%s(%d)", address, weight))
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", rec.Client, rec.Name, rec.Type, ttl, strings.Join(answer, ","), rec.Source, rec.Comment)
+	}
+	w.Flush()
+}
+
+func printPins(pins []Pin) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CLIENT\tNAME\tTYPE\tTTL\tANSWER\tEXPIRES\tCOMMENT")
+	for _, pin := range pins {
+		left := time.Until(pin.Expires) / time.Second * time.Second
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\tin %s\t%s\n", pin.Client, pin.Name, pin.Type, pin.Ttl, strings.Join(pin.Answer, ","), left, pin.Comment)
+	}
+	w.Flush()
+}
+
+func printBlocklists(lists []BlocklistStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tFORMAT\tENABLED\tNAMES\tFETCHED\tERROR")
+	for _, list := range lists {
+		fetched := "never"
+		if list.Fetched != nil {
+			fetched = fmt.Sprintf("%s ago", time.Since(*list.Fetched)/time.Second*time.Second)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%d\t%s\t%s\n", list.Name, list.Format, list.Enabled, list.Names, fetched, list.LastError)
+	}
+	w.Flush()
+}
+
+func printUpstreams(upstreams map[string]upstreamCapabilities) {
+	var resolvers []string
+	for resolver := range upstreams {
+		resolvers = append(resolvers, resolver)
+	}
+	sort.Strings(resolvers)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "RECURSER\tREACHABLE\tEDNS\tTCP\tPROBED")
+	for _, resolver := range resolvers {
+		caps := upstreams[resolver]
+		fmt.Fprintf(w, "%s\t%t\t%t\t%t\t%s ago\n", resolver, caps.Reachable, caps.Edns, caps.Tcp, time.Since(caps.Probed)/time.Second*time.Second)
+	}
+	w.Flush()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0 option code (from the local/experimental range) that marks a debug query, honored with
+// --debug-queries: the caches are bypassed and a TXT record describing how the query was answered is
+// added to the additional section.
+const DEBUG_OPTION = 65431
+
+// Owner name of the debug TXT record
+const DEBUG_NAME = "debug.rancher-dns."
+
+// What happened while answering a debug query
+type queryDebug struct {
+	start time.Time
+	notes []string
+}
+
+func isDebugQuery(req *dns.Msg) bool {
+	if !*debugQueries {
+		return false
+	}
+	if o := req.IsEdns0(); o != nil {
+		for _, option := range o.Option {
+			if option.Option() == DEBUG_OPTION {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether the query being answered through w is a debug query
+func debugging(w dns.ResponseWriter) bool {
+	qw, ok := w.(*queryWriter)
+	return ok && qw.debug != nil
+}
+
+// Adds a "key=value" note to the debug record of a debug query, does nothing for other queries
+func trace(w dns.ResponseWriter, format string, args ...interface{}) {
+	if qw, ok := w.(*queryWriter); ok && qw.debug != nil {
+		qw.debug.notes = append(qw.debug.notes, fmt.Sprintf(format, args...))
+	}
+}
+
+func (d *queryDebug) record() dns.RR {
+	hdr := dns.RR_Header{Name: DEBUG_NAME, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+	txt := append([]string{}, d.notes...)
+	txt = append(txt, fmt.Sprintf("elapsed=%.3fms", durationMs(time.Since(d.start))))
+	return &dns.TXT{Hdr: hdr, Txt: txt}
+}
+
+// Name of the source the local records for the name come from, trying the client's search suffixes
+// the same way the lookup does
+func localSource(query *QueryContext, fqdn string, qtype uint16) string {
+	names := []string{fqdn}
+	base := strings.TrimRight(fqdn, ".")
+	environment := answersFor(query.Environment)
+	for _, suffix := range environment.SearchSuffixes(query.ClientKey) {
+		names = append(names, base+"."+strings.TrimRight(suffix, ".")+".")
+	}
+	for _, name := range names {
+		names = append(names, wildcardNames(name)...)
+	}
+
+	answersMutex.Lock()
+	defer answersMutex.Unlock()
+	for _, key := range []string{query.ClientKey, DEFAULT_KEY} {
+		for _, name := range names {
+			for _, t := range []uint16{qtype, dns.TypeCNAME} {
+				if source, _ := lookupSources(query.ForKey(key), name, t); source != nil {
+					return source.Name()
+				}
+			}
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIsDebugQuery(t *testing.T) {
+	saved := *debugQueries
+	defer func() { *debugQueries = saved }()
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	o := req.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: DEBUG_OPTION, Data: []byte{}})
+
+	*debugQueries = false
+	if isDebugQuery(req) {
+		t.Fatalf("Debug queries should be ignored unless enabled")
+	}
+	*debugQueries = true
+	if !isDebugQuery(req) {
+		t.Fatalf("Expected a debug query")
+	}
+
+	plain := new(dns.Msg)
+	plain.SetQuestion("web.", dns.TypeA)
+	plain.SetEdns0(4096, false)
+	if isDebugQuery(plain) {
+		t.Fatalf("Query without the option should not be a debug query")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Authenticated denial of existence: the NSEC (RFC 4035, section 5.4) or NSEC3 (RFC 5155, section 8)
+// records of a negative response, once their signatures are verified, have to prove that the name
+// doesn't exist (NXDOMAIN) or doesn't have the type (NODATA), and that no wildcard could have answered
+// in its place. A signed SOA alone proves nothing: it would fit the negative response for any name.
+type denialProof struct {
+	zone   string
+	nsecs  []*dns.NSEC
+	nsec3s []*dns.NSEC3
+}
+
+// Adds the records of the verified RRset that can take part in a proof for the zone
+func (p *denialProof) add(records []dns.RR) {
+	for _, record := range records {
+		switch record := record.(type) {
+		case *dns.NSEC:
+			if dns.IsSubDomain(p.zone, strings.ToLower(record.Hdr.Name)) {
+				p.nsecs = append(p.nsecs, record)
+			}
+		case *dns.NSEC3:
+			// Hashed owner names are right below the apex
+			if strings.EqualFold(parentName(record.Hdr.Name), p.zone) {
+				p.nsec3s = append(p.nsec3s, record)
+			}
+		}
+	}
+}
+
+func (p *denialProof) empty() bool {
+	return len(p.nsecs) == 0 && len(p.nsec3s) == 0
+}
+
+// Checks that the records prove the denial of the type at the name, or with nxdomain of the name
+// altogether. errInsecure when the proof rests on an opt-out NSEC3 record, as an unsigned delegation
+// may be hiding in the span it covers.
+func (p *denialProof) prove(name string, qtype uint16, nxdomain bool) error {
+	name = strings.ToLower(dns.Fqdn(name))
+	if !dns.IsSubDomain(p.zone, name) {
+		return bogus("denial of %s from %s, which isn't its zone", name, p.zone)
+	}
+	if len(p.nsecs) > 0 {
+		return p.proveNsec(name, qtype, nxdomain)
+	}
+	if len(p.nsec3s) > 0 {
+		return p.proveNsec3(name, qtype, nxdomain)
+	}
+	return bogus("no NSEC or NSEC3 records denying %s", name)
+}
+
+func (p *denialProof) proveNsec(name string, qtype uint16, nxdomain bool) error {
+	if match := p.nsecMatching(name); match != nil {
+		if nxdomain {
+			return bogus("NXDOMAIN for %s, which has an NSEC record", name)
+		}
+		return deniesType(name, match.TypeBitMap, qtype)
+	}
+	cover := p.nsecCovering(name)
+	if cover == nil {
+		return bogus("no NSEC record covering %s", name)
+	}
+	if dns.IsSubDomain(strings.ToLower(cover.Hdr.Name), name) && (delegationTypes(cover.TypeBitMap) || typeInBitmap(cover.TypeBitMap, dns.TypeDNAME)) {
+		// Nothing below a delegation or a DNAME belongs to the zone
+		return bogus("NSEC record of the delegation or DNAME %s covering %s", cover.Hdr.Name, name)
+	}
+	// The closest encloser is the longest ancestor the name shares with either end of the span
+	encloser := commonAncestor(name, cover.Hdr.Name)
+	if next := commonAncestor(name, cover.NextDomain); dns.CountLabel(next) > dns.CountLabel(encloser) {
+		encloser = next
+	}
+	if !dns.IsSubDomain(p.zone, encloser) {
+		encloser = p.zone
+	}
+	wildcard := "*." + encloser
+	if nxdomain {
+		if p.nsecCovering(wildcard) == nil {
+			return bogus("no NSEC record covering %s", wildcard)
+		}
+		return nil
+	}
+	// NODATA for a name the wildcard would have answered for
+	if match := p.nsecMatching(wildcard); match != nil {
+		return deniesType(wildcard, match.TypeBitMap, qtype)
+	}
+	return bogus("no NSEC record matching %s", name)
+}
+
+func (p *denialProof) proveNsec3(name string, qtype uint16, nxdomain bool) error {
+	if match := p.nsec3Matching(name); match != nil {
+		if nxdomain {
+			return bogus("NXDOMAIN for %s, which has an NSEC3 record", name)
+		}
+		return deniesType(name, match.TypeBitMap, qtype)
+	}
+
+	encloser, nextCloser, err := p.closestEncloser(name)
+	if err != nil {
+		return err
+	}
+	cover := p.nsec3Covering(nextCloser)
+	optOut := cover.Flags&NSEC3_OPT_OUT != 0
+	wildcard := "*." + encloser
+	if nxdomain {
+		if p.nsec3Covering(wildcard) == nil {
+			return bogus("no NSEC3 record covering %s", wildcard)
+		}
+	} else if match := p.nsec3Matching(wildcard); match != nil {
+		if err := deniesType(wildcard, match.TypeBitMap, qtype); err != nil {
+			return err
+		}
+	} else if !optOut || qtype != dns.TypeDS {
+		// Only a DS query may get NODATA for a name the chain opted out of
+		return bogus("no NSEC3 record matching %s", name)
+	}
+	if optOut {
+		return errInsecure
+	}
+	return nil
+}
+
+// The closest provable encloser of the name (RFC 5155, section 8.3): its deepest ancestor with a
+// matching NSEC3 record, whose child towards the name (the next closer name) is covered by one
+func (p *denialProof) closestEncloser(name string) (string, string, error) {
+	nextCloser := name
+	for encloser := parentName(name); encloser != "" && dns.IsSubDomain(p.zone, encloser); encloser = parentName(encloser) {
+		match := p.nsec3Matching(encloser)
+		if match == nil {
+			nextCloser = encloser
+			continue
+		}
+		// Nothing below a delegation or a DNAME belongs to the zone
+		if delegationTypes(match.TypeBitMap) || typeInBitmap(match.TypeBitMap, dns.TypeDNAME) {
+			return "", "", bogus("closest encloser %s of %s is a delegation or DNAME", encloser, name)
+		}
+		if p.nsec3Covering(nextCloser) == nil {
+			return "", "", bogus("no NSEC3 record covering %s", nextCloser)
+		}
+		return encloser, nextCloser, nil
+	}
+	return "", "", bogus("no closest encloser of %s", name)
+}
+
+// A matching NSEC record proves the types at its owner, unless the owner is a delegation: the parent's
+// record there only speaks for the DS (RFC 4035, section 5.4).
+func deniesType(name string, types []uint16, qtype uint16) error {
+	if typeInBitmap(types, qtype) || typeInBitmap(types, dns.TypeCNAME) {
+		return bogus("denial of %s %s, which its NSEC record lists", name, dns.Type(qtype))
+	}
+	if qtype != dns.TypeDS && delegationTypes(types) {
+		return bogus("denial of %s %s from the parent side of a delegation", name, dns.Type(qtype))
+	}
+	return nil
+}
+
+// Whether the NSEC or NSEC3 record of the name shows a delegation there
+func (p *denialProof) delegation(name string) bool {
+	if match := p.nsecMatching(name); match != nil {
+		return delegationTypes(match.TypeBitMap)
+	}
+	if match := p.nsec3Matching(name); match != nil {
+		return delegationTypes(match.TypeBitMap)
+	}
+	return false
+}
+
+// NS records without a SOA: the parent side of a zone cut
+func delegationTypes(types []uint16) bool {
+	return typeInBitmap(types, dns.TypeNS) && !typeInBitmap(types, dns.TypeSOA)
+}
+
+func (p *denialProof) nsecMatching(name string) *dns.NSEC {
+	for _, rr := range p.nsecs {
+		if strings.EqualFold(rr.Hdr.Name, name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+func (p *denialProof) nsecCovering(name string) *dns.NSEC {
+	for _, rr := range p.nsecs {
+		if nsecCovers(rr, name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+func (p *denialProof) nsec3Matching(name string) *dns.NSEC3 {
+	for _, rr := range p.nsec3s {
+		if hash, ok := nsec3Hash(rr, name); ok && hash == nsec3Owner(rr) {
+			return rr
+		}
+	}
+	return nil
+}
+
+func (p *denialProof) nsec3Covering(name string) *dns.NSEC3 {
+	for _, rr := range p.nsec3s {
+		if nsec3Covers(rr, name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// Whether the name falls strictly between the owner of the NSEC record and the next name, in the
+// canonical order (the last record of the zone wraps around to the apex)
+func nsecCovers(rr *dns.NSEC, name string) bool {
+	owner, next := rr.Hdr.Name, rr.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	return canonicalCompare(owner, name) < 0 || canonicalCompare(name, next) < 0
+}
+
+func typeInBitmap(types []uint16, t uint16) bool {
+	for _, element := range types {
+		if element == t {
+			return true
+		}
+	}
+	return false
+}
+
+// The canonical order of names (RFC 4034, section 6.1): label by label from the root, case-insensitive
+func canonicalCompare(a, b string) int {
+	x, y := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(x)-1, len(y)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(x[i], y[j]); c != 0 {
+			return c
+		}
+	}
+	return len(x) - len(y)
+}
+
+// The longest common ancestor of the names, "." for none
+func commonAncestor(a, b string) string {
+	a, b = strings.ToLower(dns.Fqdn(a)), strings.ToLower(dns.Fqdn(b))
+	labels := dns.SplitDomainName(a)
+	n := dns.CompareDomainName(a, b)
+	if n == 0 {
+		return "."
+	}
+	return strings.Join(labels[len(labels)-n:], ".") + "."
+}
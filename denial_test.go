@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCanonicalOrder(t *testing.T) {
+	// RFC 4034, section 6.1
+	ordered := []string{"example.", "a.example.", "yljkjljk.a.example.", "Z.a.example.", "zABC.a.EXAMPLE.", "z.example.", "*.z.example."}
+	for i := 1; i < len(ordered); i++ {
+		if canonicalCompare(ordered[i-1], ordered[i]) >= 0 {
+			t.Fatalf("Expected %s before %s", ordered[i-1], ordered[i])
+		}
+	}
+	if canonicalCompare("WWW.example.", "www.example.") != 0 {
+		t.Fatalf("Expected the order to ignore case")
+	}
+	if ancestor := commonAncestor("a.b.Example.com.", "c.b.example.com."); ancestor != "b.example.com." {
+		t.Fatalf("Expected b.example.com., got %s", ancestor)
+	}
+}
+
+func TestNsecCovers(t *testing.T) {
+	span := mustRR(t, "bad.example.com. 300 IN NSEC www.example.com. A RRSIG NSEC").(*dns.NSEC)
+	last := mustRR(t, "www.example.com. 300 IN NSEC example.com. A RRSIG NSEC").(*dns.NSEC)
+	for name, expected := range map[string]bool{
+		"cdn.example.com.":        true,
+		"a.bad.example.com.":      true,
+		"bad.example.com.":        false,
+		"www.example.com.":        false,
+		"aaa.example.com.":        false,
+		"zzz.example.com.":        false,
+		"a.www.example.com.":      false,
+		"a.insecure.example.com.": true,
+	} {
+		if covered := nsecCovers(span, name); covered != expected {
+			t.Fatalf("Expected %v for %s, got %v", expected, name, covered)
+		}
+	}
+	// The last record wraps around to the apex
+	if !nsecCovers(last, "zzz.example.com.") || !nsecCovers(last, "a.www.example.com.") || nsecCovers(last, "cdn.example.com.") {
+		t.Fatalf("Expected the last record to cover the names after its owner")
+	}
+}
+
+func TestDenialAtDelegation(t *testing.T) {
+	proof := &denialProof{zone: "example.com."}
+	proof.add([]dns.RR{
+		mustRR(t, "insecure.example.com. 300 IN NSEC www.example.com. NS RRSIG NSEC"),
+		mustRR(t, "www.example.com. 300 IN NSEC example.com. A RRSIG NSEC"),
+		mustRR(t, "other.zone. 300 IN NSEC z.other.zone. A RRSIG NSEC"),
+	})
+	if len(proof.nsecs) != 2 {
+		t.Fatalf("Expected the records of other zones left out, got %v", proof.nsecs)
+	}
+	if err := proof.prove("insecure.example.com.", dns.TypeDS, false); err != nil || !proof.delegation("insecure.example.com.") {
+		t.Fatalf("Expected the delegation to be proven without DS, got %v", err)
+	}
+	// The parent's record doesn't speak for the child's data
+	if err := proof.prove("insecure.example.com.", dns.TypeA, false); err == nil {
+		t.Fatalf("Expected the parent side of the delegation not to deny A")
+	}
+	if err := proof.prove("a.insecure.example.com.", dns.TypeA, true); err == nil {
+		t.Fatalf("Expected the delegation's record not to deny names below it")
+	}
+	if err := proof.prove("www.example.com.", dns.TypeA, false); err == nil {
+		t.Fatalf("Expected the record listing A not to deny it")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	DIFF_ADDED   = "added"
+	DIFF_REMOVED = "removed"
+	DIFF_CHANGED = "changed"
+)
+
+// A difference between two answers files, as reported by "rancher-dns diff": a record (type and name)
+// or a setting (the JSON key, e.g. "recurse") of a client entry that was added, removed or changed
+type AnswersChange struct {
+	Change  string   `json:"change"`
+	Client  string   `json:"client"`
+	Type    string   `json:"type,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Setting string   `json:"setting,omitempty"`
+	Before  []string `json:"before,omitempty"`
+	After   []string `json:"after,omitempty"`
+}
+
+// The records and settings that differ between the answers, sorted by client, then settings before
+// records by name and type. The order of a record's answers (shuffled when served) doesn't matter; the
+// TTL does.
+func diffAnswers(before, after Answers) []AnswersChange {
+	changes := []AnswersChange{}
+
+	records := func(answers Answers) map[string]DumpRecord {
+		out := make(map[string]DumpRecord)
+		for _, rec := range answers.Dump() {
+			out[rec.Client+" "+rec.Type+" "+rec.Name] = rec
+		}
+		return out
+	}
+	beforeRecords, afterRecords := records(before), records(after)
+	for key, rec := range beforeRecords {
+		if other, ok := afterRecords[key]; !ok {
+			changes = append(changes, AnswersChange{Change: DIFF_REMOVED, Client: rec.Client, Type: rec.Type, Name: rec.Name, Before: recordAnswer(rec)})
+		} else if !reflect.DeepEqual(recordAnswer(rec), recordAnswer(other)) {
+			changes = append(changes, AnswersChange{Change: DIFF_CHANGED, Client: rec.Client, Type: rec.Type, Name: rec.Name, Before: recordAnswer(rec), After: recordAnswer(other)})
+		}
+	}
+	for key, rec := range afterRecords {
+		if _, ok := beforeRecords[key]; !ok {
+			changes = append(changes, AnswersChange{Change: DIFF_ADDED, Client: rec.Client, Type: rec.Type, Name: rec.Name, After: recordAnswer(rec)})
+		}
+	}
+
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	for key := range keys {
+		changes = append(changes, diffSettings(key, before[key], after[key])...)
+	}
+
+	sort.Sort(byChangeClientName(changes))
+	return changes
+}
+
+// The answer of a record as compared: its sorted answers, then its weights, health check and TTL if it
+// has them
+func recordAnswer(rec DumpRecord) []string {
+	answer := append([]string{}, rec.Answer...)
+	sort.Strings(answer)
+	var weights []string
+	for address, weight := range rec.Weights {
+		weights = append(weights, fmt.Sprintf("weight %s=%d", address, weight))
+	}
+	sort.Strings(weights)
+	answer = append(answer, weights...)
+	if rec.Check != nil {
+		if data, err := json.Marshal(rec.Check); err == nil {
+			answer = append(answer, "check "+string(data))
+		}
+	}
+	if rec.Ttl != nil {
+		answer = append(answer, fmt.Sprintf("ttl=%d", *rec.Ttl))
+	}
+	return answer
+}
+
+// The settings (every field besides the records) that differ between the entries
+func diffSettings(client string, before, after ClientAnswers) []AnswersChange {
+	var changes []AnswersChange
+	b, a := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < b.NumField(); i++ {
+		field := b.Type().Field(i)
+		switch field.Name {
+		case "A", "Cname", "Ptr", "Txt", "Srv":
+			continue
+		}
+		beforeValue, afterValue := settingValue(b.Field(i)), settingValue(a.Field(i))
+		if reflect.DeepEqual(beforeValue, afterValue) {
+			continue
+		}
+		change := AnswersChange{Change: DIFF_CHANGED, Client: client, Setting: strings.ToLower(field.Name), Before: beforeValue, After: afterValue}
+		if beforeValue == nil {
+			change.Change = DIFF_ADDED
+		} else if afterValue == nil {
+			change.Change = DIFF_REMOVED
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// A setting as compared and shown: a list of values (one per rule), nothing when it isn't set
+func settingValue(v reflect.Value) []string {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Elem().Kind() == reflect.Struct {
+			if data, err := json.Marshal(v.Interface()); err == nil {
+				return []string{string(data)}
+			}
+		}
+		return []string{fmt.Sprint(v.Elem().Interface())}
+	case reflect.String:
+		if v.String() == "" {
+			return nil
+		}
+		return []string{v.String()}
+	case reflect.Slice:
+		var values []string
+		for i := 0; i < v.Len(); i++ {
+			item := v.Index(i).Interface()
+			if v.Index(i).Kind() == reflect.String {
+				values = append(values, v.Index(i).String())
+			} else if data, err := json.Marshal(item); err == nil {
+				values = append(values, string(data))
+			}
+		}
+		return values
+	}
+	return []string{fmt.Sprint(v.Interface())}
+}
+
+type byChangeClientName []AnswersChange
+
+func (c byChangeClientName) Len() int      { return len(c) }
+func (c byChangeClientName) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byChangeClientName) Less(i, j int) bool {
+	if c[i].Client != c[j].Client {
+		return c[i].Client < c[j].Client
+	}
+	if (c[i].Setting == "") != (c[j].Setting == "") {
+		return c[i].Setting != ""
+	}
+	if c[i].Setting != c[j].Setting {
+		return c[i].Setting < c[j].Setting
+	}
+	if c[i].Name != c[j].Name {
+		return c[i].Name < c[j].Name
+	}
+	return c[i].Type < c[j].Type
+}
+
+// Entry point of "rancher-dns diff OLD NEW", which exits with 0 when the files answer the same, 1 when
+// they don't and 2 when either can't be loaded
+func runDiff(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	asJson := flags.Bool("json", false, "Print the changes as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s diff [options] OLD NEW\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return 2
+	}
+
+	// Normalization warnings aren't part of the diff
+	log.SetLevel(log.ErrorLevel)
+	var loaded []Answers
+	for _, path := range flags.Args() {
+		if _, err := os.Stat(path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		answers, err := ParseAnswers(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 2
+		}
+		loaded = append(loaded, answers)
+	}
+
+	changes := diffAnswers(loaded[0], loaded[1])
+	if *asJson {
+		json.NewEncoder(os.Stdout).Encode(changes)
+	} else {
+		printDiff(changes)
+	}
+	if len(changes) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func printDiff(changes []AnswersChange) {
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.Change]++
+		what := change.Type + " " + change.Name
+		if change.Setting != "" {
+			what = change.Setting
+		}
+		switch change.Change {
+		case DIFF_ADDED:
+			fmt.Printf("+ %s %s: %s\n", change.Client, what, strings.Join(change.After, ", "))
+		case DIFF_REMOVED:
+			fmt.Printf("- %s %s: %s\n", change.Client, what, strings.Join(change.Before, ", "))
+		case DIFF_CHANGED:
+			fmt.Printf("~ %s %s: %s -> %s\n", change.Client, what, strings.Join(change.Before, ", "), strings.Join(change.After, ", "))
+		}
+	}
+	fmt.Printf("%d added, %d removed, %d changed\n", counts[DIFF_ADDED], counts[DIFF_REMOVED], counts[DIFF_CHANGED])
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffAnswers(t *testing.T) {
+	ttl := uint32(30)
+	recursion := false
+	before := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"8.8.8.8"},
+			A: map[string]RecordA{
+				"web.": {Answer: []string{"10.0.0.1", "10.0.0.2"}, Source: "file:old.json"},
+				"db.":  {Answer: []string{"10.0.0.5"}},
+			},
+			Cname: map[string]RecordCname{"www.": {Answer: "web."}},
+		},
+		"10.1.1.1": ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.1.0.1"}}}},
+	}
+	after := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse:   []string{"1.1.1.1"},
+			Recursion: &recursion,
+			A: map[string]RecordA{
+				"web.": {Answer: []string{"10.0.0.2", "10.0.0.1"}, Source: "file:new.json", Comment: "reordered"},
+				"db.":  {Answer: []string{"10.0.0.5"}, Ttl: &ttl},
+				"api.": {Answer: []string{"10.0.0.7"}},
+			},
+		},
+		"10.1.1.1": ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.1.0.1"}}}},
+	}
+
+	expected := []AnswersChange{
+		{Change: DIFF_CHANGED, Client: DEFAULT_KEY, Setting: "recurse", Before: []string{"8.8.8.8"}, After: []string{"1.1.1.1"}},
+		{Change: DIFF_ADDED, Client: DEFAULT_KEY, Setting: "recursion", After: []string{"false"}},
+		{Change: DIFF_ADDED, Client: DEFAULT_KEY, Type: "A", Name: "api.", After: []string{"10.0.0.7"}},
+		{Change: DIFF_CHANGED, Client: DEFAULT_KEY, Type: "A", Name: "db.", Before: []string{"10.0.0.5"}, After: []string{"10.0.0.5", "ttl=30"}},
+		{Change: DIFF_REMOVED, Client: DEFAULT_KEY, Type: "CNAME", Name: "www.", Before: []string{"web."}},
+	}
+	changes := diffAnswers(before, after)
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %+v", len(expected), changes)
+	}
+	for i, change := range changes {
+		if change.Change != expected[i].Change || change.Client != expected[i].Client || change.Setting != expected[i].Setting ||
+			change.Type != expected[i].Type || change.Name != expected[i].Name ||
+			len(change.Before) != len(expected[i].Before) || len(change.After) != len(expected[i].After) {
+			t.Fatalf("Expected %+v, got %+v", expected[i], change)
+		}
+	}
+
+	if changes := diffAnswers(before, before); len(changes) != 0 {
+		t.Fatalf("Expected no changes between the same answers, got %+v", changes)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Online DNSSEC signing (--dnssec) of the declared zones: the response to a query with the DO bit for
+// a name in a zone gets an RRSIG for each of its RRsets in the zone, made with the zone signing key
+// (the DNSKEY RRset with the key signing key), and a negative response gets the NSEC3 records proving
+// the denial, from a chain of the records of the zone rebuilt with every generation of the answers.
+// The apex answers DNSKEY and NSEC3PARAM queries. Without PEM files, the keys are generated at startup
+// and change with every restart, so the DS logged for each zone has to be published in its parent again.
+const (
+	DNSSEC_KSK_FLAGS = 257
+	DNSSEC_ZSK_FLAGS = 256
+	// Signatures are valid from an hour back, for clocks behind ours, for a week; they are made again
+	// once half of that has passed
+	DNSSEC_INCEPTION_SKEW     = time.Hour
+	DNSSEC_SIGNATURE_VALIDITY = 7 * 24 * time.Hour
+	DNSSEC_SIGNATURE_CACHE    = 10000
+	DNSSEC_SALT_LENGTH        = 8
+)
+
+type signingKey struct {
+	// Without an owner name, which is that of each zone
+	dnskey *dns.DNSKEY
+	signer crypto.Signer
+}
+
+type zoneSigner struct {
+	sync.Mutex
+	ksk, zsk *signingKey
+	// The chains of the generation of the answers they were made for
+	generation uint64
+	chains     map[string]*nsec3Chain
+	// Signatures by zone, key and RRset content, kept across generations while their RRset is unchanged
+	signatures map[string]*cachedSignature
+	// Zones whose DS was logged
+	announced map[string]bool
+}
+
+var dnssecSigner *zoneSigner
+
+// Reads the key signing and zone signing keys, generating those without a file. Called once when
+// parsing flags.
+func setupDnssec(kskFile, zskFile string) error {
+	ksk, err := loadSigningKey(kskFile, DNSSEC_KSK_FLAGS)
+	if err != nil {
+		return fmt.Errorf("key signing key: %v", err)
+	}
+	zsk, err := loadSigningKey(zskFile, DNSSEC_ZSK_FLAGS)
+	if err != nil {
+		return fmt.Errorf("zone signing key: %v", err)
+	}
+	if kskFile == "" || zskFile == "" {
+		log.Warn("Signing with DNSSEC keys generated at startup, which change with every restart")
+	}
+	dnssecSigner = &zoneSigner{ksk: ksk, zsk: zsk, announced: make(map[string]bool)}
+	return nil
+}
+
+// The key in the PEM file, or a new ECDSA P-256 one for no file
+func loadSigningKey(path string, flags uint16) (*signingKey, error) {
+	if path == "" {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return newSigningKey(key, flags)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	signer, err := parsePrivateKey(block)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return newSigningKey(signer, flags)
+}
+
+func parsePrivateKey(block *pem.Block) (crypto.Signer, error) {
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			return signer, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported key type %s", block.Type)
+}
+
+// The DNSKEY of the private key: ECDSAP256SHA256, ECDSAP384SHA384, or RSASHA256 for RSA keys
+func newSigningKey(signer crypto.Signer, flags uint16) (*signingKey, error) {
+	dnskey := &dns.DNSKEY{Hdr: dns.RR_Header{Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET}, Flags: flags, Protocol: 3}
+	var public []byte
+	switch key := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			dnskey.Algorithm = dns.ECDSAP256SHA256
+		case elliptic.P384():
+			dnskey.Algorithm = dns.ECDSAP384SHA384
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", key.Curve.Params().Name)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		public = make([]byte, 2*size)
+		key.X.FillBytes(public[:size])
+		key.Y.FillBytes(public[size:])
+	case *rsa.PublicKey:
+		dnskey.Algorithm = dns.RSASHA256
+		// The exponent's length, in three octets past 255 (RFC 3110, section 2)
+		exponent := big.NewInt(int64(key.E)).Bytes()
+		if len(exponent) < 256 {
+			public = []byte{byte(len(exponent))}
+		} else {
+			public = []byte{0, byte(len(exponent) >> 8), byte(len(exponent))}
+		}
+		public = append(append(public, exponent...), key.N.Bytes()...)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	dnskey.PublicKey = base64.StdEncoding.EncodeToString(public)
+	return &signingKey{dnskey: dnskey, signer: signer}, nil
+}
+
+// The DNSKEY of the key for the zone
+func (k *signingKey) record(zone string, ttl uint32) *dns.DNSKEY {
+	record := *k.dnskey
+	record.Hdr.Name = zone
+	record.Hdr.Ttl = ttl
+	return &record
+}
+
+// The DNSKEY RRset of the zone
+func (s *zoneSigner) dnskeys(zone string, ttl uint32) []dns.RR {
+	return []dns.RR{s.ksk.record(zone, ttl), s.zsk.record(zone, ttl)}
+}
+
+// The NSEC3 chain of the zone for the current generation of the answers
+func (s *zoneSigner) chain(zone string) *nsec3Chain {
+	generation := currentAnswersVersion().Generation
+	s.Lock()
+	defer s.Unlock()
+	if generation != s.generation || s.chains == nil {
+		s.generation = generation
+		s.chains = make(map[string]*nsec3Chain)
+		s.pruneSignatures()
+	}
+	if chain, ok := s.chains[zone]; ok {
+		return chain
+	}
+
+	soa := answers.zoneSoa(zone)
+	owners := map[string][]uint16{zone: {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY, dns.TypeNSEC3PARAM}}
+	for _, record := range answers.zoneContents(zone) {
+		name := strings.ToLower(record.Header().Name)
+		owners[name] = append(owners[name], record.Header().Rrtype)
+	}
+	// A new salt with every chain, so hashes computed for the last one are of no use
+	chain := newNSEC3Chain(zone, owners, answers.zoneApex(zone).nsec3Params(), soa.Minttl)
+	s.chains[zone] = chain
+	if !s.announced[zone] {
+		s.announced[zone] = true
+		ds := s.ksk.record(zone, soa.Hdr.Ttl).ToDS(dns.SHA256)
+		log.WithFields(log.Fields{"zone": zone, "keyTag": s.ksk.dnskey.KeyTag(), "ds": ds.String()}).Info("Signing zone")
+	}
+	return chain
+}
+
+// The NSEC3PARAM of the zone, for the current chain
+func (s *zoneSigner) nsec3param(zone string, ttl uint32) *dns.NSEC3PARAM {
+	params := s.chain(zone).params
+	return &dns.NSEC3PARAM{
+		Hdr:        dns.RR_Header{Name: zone, Rrtype: dns.TypeNSEC3PARAM, Class: dns.ClassINET, Ttl: ttl},
+		Hash:       dns.SHA1,
+		Iterations: params.Iterations,
+		SaltLength: uint8(len(params.Salt) / 2),
+		Salt:       params.Salt,
+	}
+}
+
+// Signs the response to a query with the DO bit for a name in a declared zone, on a copy as it may be
+// cached; other responses are returned as they are
+func (s *zoneSigner) signResponse(req *dns.Msg, m *dns.Msg) *dns.Msg {
+	if o := req.IsEdns0(); o == nil || !o.Do() {
+		return m
+	}
+	qname := strings.ToLower(req.Question[0].Name)
+	rule := answers.ZoneFor(qname)
+	if rule == nil {
+		return m
+	}
+	zone := rule.name()
+
+	m = m.Copy()
+	if m.Rcode == dns.RcodeNameError || (m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0) {
+		m.Ns = append(m.Ns, s.chain(zone).Denial(qname)...)
+	}
+	m.Answer = s.signSection(zone, m.Answer)
+	m.Ns = s.signSection(zone, m.Ns)
+	m.Extra = s.signSection(zone, m.Extra)
+	if o := m.IsEdns0(); o != nil {
+		o.SetDo()
+	} else {
+		m.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	return m
+}
+
+// The records with an RRSIG after each RRset of the zone. Delegations (NS RRsets below the apex) aren't
+// signed, as the child zone is authoritative for them.
+func (s *zoneSigner) signSection(zone string, records []dns.RR) []dns.RR {
+	var order []string
+	rrsets := make(map[string][]dns.RR)
+	for _, record := range records {
+		hdr := record.Header()
+		name := strings.ToLower(hdr.Name)
+		switch {
+		case hdr.Rrtype == dns.TypeOPT || hdr.Rrtype == dns.TypeTSIG || hdr.Rrtype == dns.TypeRRSIG:
+			continue
+		case !inZone(name, zone):
+			continue
+		case hdr.Rrtype == dns.TypeNS && name != zone:
+			continue
+		}
+		key := name + " " + dns.Type(hdr.Rrtype).String()
+		if _, ok := rrsets[key]; !ok {
+			order = append(order, key)
+		}
+		rrsets[key] = append(rrsets[key], record)
+	}
+	if len(order) == 0 {
+		return records
+	}
+
+	signed := append([]dns.RR{}, records...)
+	for _, key := range order {
+		signer := s.zsk
+		if rrsets[key][0].Header().Rrtype == dns.TypeDNSKEY {
+			signer = s.ksk
+		}
+		sig, err := s.signature(zone, signer, rrsets[key])
+		if err != nil {
+			log.WithFields(log.Fields{"zone": zone, "rrset": key}).Errorf("Failed to sign: %v", err)
+			continue
+		}
+		signed = append(signed, sig)
+	}
+	return signed
+}
+
+// The signature of the RRset, made again once half of its validity has passed. Should that fail, the
+// previous one is served for as long as it's valid. A signature is served for the RRset with a lower TTL
+// than it was made for, with that TTL; a higher one needs a new signature for its original TTL.
+func (s *zoneSigner) signature(zone string, key *signingKey, rrset []dns.RR) (*dns.RRSIG, error) {
+	cacheKey := signatureKey(zone, key, rrset)
+	current := now()
+	ttl := rrset[0].Header().Ttl
+
+	s.Lock()
+	cached, ok := s.signatures[cacheKey]
+	s.Unlock()
+	if ok && freshSignature(cached.sig, current) && cached.sig.OrigTtl >= ttl {
+		return signatureWithTtl(cached.sig, ttl), nil
+	}
+
+	sig, err := signRrset(zone, key, rrset, current)
+	if err != nil {
+		if ok && servePreviousSignature(cached, current, err) {
+			return signatureWithTtl(cached.sig, ttl), nil
+		}
+		return nil, err
+	}
+	s.cacheSignature(cacheKey, &cachedSignature{sig: sig, zone: zone, key: key, rrset: rrset})
+	return sig, nil
+}
+
+func signatureWithTtl(sig *dns.RRSIG, ttl uint32) *dns.RRSIG {
+	if sig.Hdr.Ttl == ttl {
+		return sig
+	}
+	copied := *sig
+	copied.Hdr.Ttl = ttl
+	return &copied
+}
+
+func signatureKey(zone string, key *signingKey, rrset []dns.RR) string {
+	return fmt.Sprintf("%s %d %d\n%s", zone, key.dnskey.Algorithm, key.dnskey.KeyTag(), rrsetContent(rrset))
+}
+
+// The owner, class and type of the RRset and the sorted rdata of its records, without the TTL, which
+// doesn't change what's signed but the original TTL in the signature
+func rrsetContent(rrset []dns.RR) string {
+	hdr := rrset[0].Header()
+	var rdatas []string
+	for _, record := range rrset {
+		copied := dns.Copy(record)
+		copied.Header().Name, copied.Header().Ttl = ".", 0
+		rdatas = append(rdatas, copied.String())
+	}
+	sort.Strings(rdatas)
+	return fmt.Sprintf("%s %d %d\n%s", strings.ToLower(hdr.Name), hdr.Class, hdr.Rrtype, strings.Join(rdatas, "\n"))
+}
+
+// Drops the signatures of the RRsets that changed or are gone from their zone with a new generation of
+// the answers, keeping those of the RRsets it left as they were. Called with the signer locked.
+func (s *zoneSigner) pruneSignatures() {
+	zones := make(map[string]map[string]bool)
+	for cacheKey, cached := range s.signatures {
+		contents, ok := zones[cached.zone]
+		if !ok {
+			contents = zoneRrsetContents(cached.zone)
+			zones[cached.zone] = contents
+		}
+		if !contents[rrsetContent(cached.rrset)] {
+			delete(s.signatures, cacheKey)
+		}
+	}
+}
+
+// The content of each RRset of the zone, as by rrsetContent
+func zoneRrsetContents(zone string) map[string]bool {
+	rrsets := make(map[rrsetKey][]dns.RR)
+	for _, record := range answers.zoneContents(zone) {
+		key := rrsetKey{strings.ToLower(record.Header().Name), record.Header().Rrtype}
+		rrsets[key] = append(rrsets[key], record)
+	}
+	contents := make(map[string]bool)
+	for _, rrset := range rrsets {
+		contents[rrsetContent(rrset)] = true
+	}
+	return contents
+}
+
+// Valid for more than half of its validity, and already (the clock may have been set back)
+func freshSignature(sig *dns.RRSIG, current time.Time) bool {
+	return time.Unix(int64(sig.Expiration), 0).Sub(current) > DNSSEC_SIGNATURE_VALIDITY/2 && int64(sig.Inception) <= current.Unix()
+}
+
+func signRrset(zone string, key *signingKey, rrset []dns.RR, current time.Time) (*dns.RRSIG, error) {
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Ttl: rrset[0].Header().Ttl},
+		Algorithm:  key.dnskey.Algorithm,
+		SignerName: zone,
+		KeyTag:     key.dnskey.KeyTag(),
+		Inception:  uint32(current.Add(-DNSSEC_INCEPTION_SKEW).Unix()),
+		Expiration: uint32(current.Add(DNSSEC_SIGNATURE_VALIDITY).Unix()),
+	}
+	if err := sig.Sign(key.signer, rrset); err != nil {
+		return nil, err
+	}
+	stats.incr("dnssecSignatures")
+	return sig, nil
+}
+
+func (s *zoneSigner) cacheSignature(cacheKey string, cached *cachedSignature) {
+	s.Lock()
+	if s.signatures == nil || len(s.signatures) >= DNSSEC_SIGNATURE_CACHE {
+		s.signatures = make(map[string]*cachedSignature)
+	}
+	s.signatures[cacheKey] = cached
+	s.Unlock()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLoadSigningKeys(t *testing.T) {
+	defer func() { dnssecSigner = nil }()
+	dir, err := ioutil.TempDir("", "dnssec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ec, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalECPrivateKey(ec)
+	ksk := filepath.Join(dir, "ksk.pem")
+	ioutil.WriteFile(ksk, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	der, _ = x509.MarshalPKCS8PrivateKey(rsaKey)
+	zsk := filepath.Join(dir, "zsk.pem")
+	ioutil.WriteFile(zsk, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	if err := setupDnssec(ksk, zsk); err != nil {
+		t.Fatal(err)
+	}
+	if key := dnssecSigner.ksk.dnskey; key.Algorithm != dns.ECDSAP384SHA384 || key.Flags != DNSSEC_KSK_FLAGS {
+		t.Fatalf("Incorrect key signing key %v", key)
+	}
+	if key := dnssecSigner.zsk.dnskey; key.Algorithm != dns.RSASHA256 || key.Flags != DNSSEC_ZSK_FLAGS {
+		t.Fatalf("Incorrect zone signing key %v", key)
+	}
+
+	// The DNSKEY verifies what the private key signs
+	rrset := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "web.example.internal.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: []byte{10, 0, 0, 1}}}
+	for _, key := range []*signingKey{dnssecSigner.ksk, dnssecSigner.zsk} {
+		sig, err := dnssecSigner.signature("example.internal.", key, rrset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sig.Verify(key.record("example.internal.", 60), rrset); err != nil {
+			t.Fatalf("Failed to verify the signature of %v: %v", key.dnskey, err)
+		}
+	}
+
+	ioutil.WriteFile(zsk, []byte("not a key"), 0600)
+	if err := setupDnssec(ksk, zsk); err == nil {
+		t.Fatalf("Expected the invalid key to be rejected")
+	}
+}
+
+func TestSignedAnswers(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers, dnssecSigner = saved, savedEnvironments, nil }()
+	if err := setupDnssec("", ""); err != nil {
+		t.Fatal(err)
+	}
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Zones: []ZoneRule{{Zone: "example.internal", Ns: []string{"ns1.example.internal"}, Minttl: 30}},
+		A:     map[string]RecordA{"web.example.internal.": {Answer: []string{"10.0.0.1", "10.0.0.2"}}},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	query := func(name string, qtype uint16, do bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(dns.DefaultMsgSize, do)
+		w := &testWriter{}
+		route(&queryWriter{ResponseWriter: w, edns: true}, req)
+		if w.msg == nil {
+			t.Fatalf("Expected a response for %s", name)
+		}
+		return w.msg
+	}
+	zsk := dnssecSigner.zsk.record("example.internal.", 0)
+	// Every RRset of the type (a denial can have NSEC3 records of several owners) has to verify
+	verify := func(section []dns.RR, rrtype uint16, key *dns.DNSKEY) {
+		signed := 0
+		for _, record := range section {
+			sig, ok := record.(*dns.RRSIG)
+			if !ok || sig.TypeCovered != rrtype {
+				continue
+			}
+			var rrset []dns.RR
+			for _, record := range section {
+				if record.Header().Rrtype == rrtype && record.Header().Name == sig.Header().Name {
+					rrset = append(rrset, record)
+				}
+			}
+			if err := sig.Verify(key, rrset); err != nil || sig.SignerName != "example.internal." {
+				t.Fatalf("Failed to verify the %s RRset of %s: %v", dns.Type(rrtype), sig.Header().Name, err)
+			}
+			signed++
+		}
+		if signed == 0 {
+			t.Fatalf("Expected a signed %s RRset, got %v", dns.Type(rrtype), section)
+		}
+	}
+
+	msg := query("web.example.internal.", dns.TypeA, true)
+	if len(msg.Answer) != 3 || msg.IsEdns0() == nil || !msg.IsEdns0().Do() {
+		t.Fatalf("Expected the addresses and their signature, got %v", msg)
+	}
+	verify(msg.Answer, dns.TypeA, zsk)
+	if msg := query("web.example.internal.", dns.TypeA, false); len(msg.Answer) != 2 {
+		t.Fatalf("Expected no signature without the DO bit, got %v", msg)
+	}
+
+	// Denials carry the signed SOA and NSEC3 proof
+	msg = query("missing.example.internal.", dns.TypeA, true)
+	if msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN, got %v", msg)
+	}
+	verify(msg.Ns, dns.TypeSOA, zsk)
+	verify(msg.Ns, dns.TypeNSEC3, zsk)
+	msg = query("web.example.internal.", dns.TypeTXT, true)
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 {
+		t.Fatalf("Expected NODATA, got %v", msg)
+	}
+	verify(msg.Ns, dns.TypeNSEC3, zsk)
+
+	// The DNSKEY RRset is signed with the key signing key
+	msg = query("example.internal.", dns.TypeDNSKEY, true)
+	verify(msg.Answer, dns.TypeDNSKEY, dnssecSigner.ksk.record("example.internal.", 0))
+	msg = query("example.internal.", dns.TypeNSEC3PARAM, true)
+	if param, ok := msg.Answer[0].(*dns.NSEC3PARAM); !ok || param.Salt != dnssecSigner.chain("example.internal.").params.Salt {
+		t.Fatalf("Expected the NSEC3PARAM of the chain, got %v", msg)
+	}
+
+	// Names outside of the zones aren't signed
+	answers[DEFAULT_KEY].A["web.other.internal."] = RecordA{Answer: []string{"10.0.1.1"}}
+	clearClientSpecificCaches()
+	if msg := query("web.other.internal.", dns.TypeA, true); len(msg.Answer) != 1 {
+		t.Fatalf("Expected no signature outside of the zones, got %v", msg)
+	}
+}
+
+func TestNsec3OptOut(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers, dnssecSigner = saved, savedEnvironments, nil }()
+	if err := setupDnssec("", ""); err != nil {
+		t.Fatal(err)
+	}
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Zones: []ZoneRule{
+			{Zone: "example.internal", Ns: []string{"ns1.example.internal"}, Nsec3: &Nsec3Rule{OptOut: true, Iterations: 5}},
+			{Zone: "sub.example.internal", Ns: []string{"ns1.sub.example.internal"}},
+		},
+		A: map[string]RecordA{"web.example.internal.": {Answer: []string{"10.0.0.1"}}},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	chain := dnssecSigner.chain("example.internal.")
+	if chain.params.Iterations != 5 || !chain.params.OptOut || dnssecSigner.nsec3param("example.internal.", 0).Iterations != 5 {
+		t.Fatalf("Expected the zone's NSEC3 parameters, got %+v", chain.params)
+	}
+	for _, rr := range chain.records {
+		if rr.Flags&NSEC3_OPT_OUT == 0 || rr.Iterations != 5 {
+			t.Fatalf("Expected opt-out records with 5 iterations, got %v", rr)
+		}
+	}
+	if chain.matching("sub.example.internal.") != nil {
+		t.Fatalf("Expected the unsigned delegation to be left out of the chain")
+	}
+
+	// The denial of the delegation's DS holds, as insecure
+	proof := &denialProof{zone: "example.internal."}
+	proof.add(chain.Denial("sub.example.internal."))
+	if err := proof.prove("sub.example.internal.", dns.TypeDS, false); err != errInsecure {
+		t.Fatalf("Expected the opt-out denial of the DS, got %v", err)
+	}
+	if err := proof.prove("sub.example.internal.", dns.TypeA, false); err == nil {
+		t.Fatalf("Expected the opt-out span not to deny other types")
+	}
+
+	// Without opt-out, the delegation has its record
+	rule := answers[DEFAULT_KEY].Zones[0]
+	rule.Nsec3 = nil
+	owners := map[string][]uint16{"example.internal.": {dns.TypeSOA, dns.TypeNS}, "sub.example.internal.": {dns.TypeNS}}
+	if newNSEC3Chain("example.internal.", owners, rule.nsec3Params(), 30).matching("sub.example.internal.") == nil {
+		t.Fatalf("Expected the delegation in the chain without opt-out")
+	}
+
+	rule.Nsec3 = &Nsec3Rule{Iterations: MAX_NSEC3_ITERATIONS + 1}
+	if err := rule.Validate(); err == nil {
+		t.Fatalf("Expected too many iterations to be rejected")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+	"github.com/miekg/dns"
+)
+
+// The media type of DNS messages over HTTPS (RFC 8484)
+const DOH_MEDIA_TYPE = "application/dns-message"
+
+const (
+	// Clients get this long to send a request and to take its response, which leaves room for
+	// recursing, and connections are closed after being idle for this long
+	DOH_LISTENER_READ_TIMEOUT  = 5 * time.Second
+	DOH_LISTENER_WRITE_TIMEOUT = 15 * time.Second
+	DOH_LISTENER_IDLE_TIMEOUT  = 60 * time.Second
+	// A shutdown waits this long for the requests being answered before closing their connections
+	DOH_SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+// A DNS over HTTPS listener (--doh-listen): queries are GET requests with the message in the "dns"
+// parameter or POST requests with it as the body, answered by handleQuery like those over UDP and TCP.
+// Without --doh-cert it serves plain HTTP, for a proxy terminating TLS in front of it.
+type dohServer struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+func (s *dohServer) ActivateAndServe() error {
+	if s.server.TLSConfig != nil {
+		return s.server.ServeTLS(s.listener, "", "")
+	}
+	return s.server.Serve(s.listener)
+}
+
+func (s *dohServer) Shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DOH_SHUTDOWN_TIMEOUT)
+	defer cancel()
+	if err := s.server.Shutdown(ctx); err != nil {
+		s.server.Close()
+		return err
+	}
+	return nil
+}
+
+func newDohServer(addr string, certFile string, keyFile string, path string) (*dohServer, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("--doh-cert and --doh-key go together")
+	}
+	router := mux.NewRouter()
+	router.HandleFunc(path, httpDnsQuery).Methods("GET", "POST")
+	server := &http.Server{
+		Handler:      router,
+		ReadTimeout:  DOH_LISTENER_READ_TIMEOUT,
+		WriteTimeout: DOH_LISTENER_WRITE_TIMEOUT,
+		IdleTimeout:  DOH_LISTENER_IDLE_TIMEOUT,
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	}
+	l, err := net.Listen(listenNet("tcp", addr), addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dohServer{server: server, listener: l}, nil
+}
+
+// Starts serving DNS over HTTPS on the address
+func listenDoh(addr string) error {
+	server, err := newDohServer(addr, *dohCert, *dohKey, *dohPath)
+	if err != nil {
+		return err
+	}
+	go serve(server.ActivateAndServe)
+	dnsServersMutex.Lock()
+	dnsServers = append(dnsServers, server)
+	dnsServersMutex.Unlock()
+	log.WithFields(log.Fields{"path": *dohPath, "tls": server.server.TLSConfig != nil}).Info("Listening for DNS over HTTPS on ", server.listener.Addr())
+	return nil
+}
+
+// The query of a DoH request
+func dohQuery(w http.ResponseWriter, r *http.Request) (*dns.Msg, int, error) {
+	var data []byte
+	switch r.Method {
+	case "GET":
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("missing dns parameter")
+		}
+		var err error
+		// base64url without padding, though padded ones are taken too
+		if data, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "=")); err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid dns parameter: %v", err)
+		}
+	default:
+		if mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0]); mediaType != DOH_MEDIA_TYPE {
+			return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q", mediaType)
+		}
+		var err error
+		if data, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize)); err != nil {
+			return nil, http.StatusRequestEntityTooLarge, err
+		}
+	}
+	req := new(dns.Msg)
+	if err := req.Unpack(data); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("malformed query: %v", err)
+	}
+	return req, http.StatusOK, nil
+}
+
+func httpDnsQuery(w http.ResponseWriter, r *http.Request) {
+	req, status, err := dohQuery(w, r)
+	if err != nil {
+		stats.incr("dohInvalid")
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	dw := newDohWriter(r)
+	if len(req.Question) == 1 && (req.Question[0].Qtype == dns.TypeAXFR || req.Question[0].Qtype == dns.TypeIXFR) {
+		// A transfer takes a stream of messages, which one HTTP response can't carry
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		dw.msg = m
+	} else {
+		handleQuery(dw, req)
+	}
+	if dw.msg == nil {
+		// Dropped, e.g. by --client-overflow=drop
+		http.Error(w, "no response", http.StatusServiceUnavailable)
+		return
+	}
+	data, err := dw.msg.Pack()
+	if err != nil {
+		log.WithFields(log.Fields{"client": clientAddr(dw)}).Warnf("Failed to pack DoH response: %v", err)
+		http.Error(w, "failed to pack the response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", DOH_MEDIA_TYPE)
+	if ttl, ok := dohMaxAge(dw.msg); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(data)
+}
+
+// HTTP caches keep a response for no longer than its records' smallest TTL (RFC 8484 5.1), failures
+// not at all
+func dohMaxAge(m *dns.Msg) (uint32, bool) {
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if t := rr.Header().Rrtype; t == dns.TypeOPT || t == dns.TypeTSIG {
+				continue
+			}
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
+
+// dohWriter is the dns.ResponseWriter of a DoH request, keeping the response for the HTTP handler
+type dohWriter struct {
+	local  net.Addr
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func newDohWriter(r *http.Request) *dohWriter {
+	w := &dohWriter{remote: &net.TCPAddr{}}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		w.local = local
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		w.remote = addr
+	}
+	return w
+}
+
+func (w *dohWriter) LocalAddr() net.Addr {
+	if w.local == nil {
+		return &net.TCPAddr{}
+	}
+	return w.local
+}
+
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+func (w *dohWriter) Transport() string    { return "doh" }
+func (w *dohWriter) Close() error         { return nil }
+func (w *dohWriter) TsigTimersOnly(bool)  {}
+func (w *dohWriter) Hijack()              {}
+
+// Signed queries aren't verified over DoH, they get NOTAUTH
+func (w *dohWriter) TsigStatus() error { return errTsigUnverified }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *dohWriter) Write(data []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(data); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(data), nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDohListener(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Authoritative: []string{"corp.internal"},
+		A:             map[string]RecordA{"web.corp.internal.": {Answer: []string{"10.0.0.1"}, Ttl: func(ttl uint32) *uint32 { return &ttl }(42)}},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	server, err := newDohServer("127.0.0.1:0", "", "", "/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	url := "http://" + server.listener.Addr().String() + "/dns-query"
+
+	query := func(name string, qtype uint16) []byte {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.Id = 0
+		data, _ := req.Pack()
+		return data
+	}
+	response := func(resp *http.Response, err error) (*dns.Msg, *http.Response) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return nil, resp
+		}
+		if resp.Header.Get("Content-Type") != DOH_MEDIA_TYPE {
+			t.Fatalf("Unexpected content type %q", resp.Header.Get("Content-Type"))
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(body); err != nil {
+			t.Fatalf("Malformed response: %v", err)
+		}
+		return msg, resp
+	}
+
+	msg, resp := response(http.Get(url + "?dns=" + base64.RawURLEncoding.EncodeToString(query("web.corp.internal.", dns.TypeA))))
+	if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatalf("Expected the address over GET, got %v (%d)", msg, resp.StatusCode)
+	}
+	if resp.Header.Get("Cache-Control") != "max-age=42" {
+		t.Fatalf("Expected the TTL as max-age, got %q", resp.Header.Get("Cache-Control"))
+	}
+
+	msg, _ = response(http.Post(url, DOH_MEDIA_TYPE, bytes.NewReader(query("missing.corp.internal.", dns.TypeA))))
+	if msg == nil || msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected NXDOMAIN over POST, got %v", msg)
+	}
+
+	msg, _ = response(http.Post(url, DOH_MEDIA_TYPE, bytes.NewReader(query("corp.internal.", dns.TypeAXFR))))
+	if msg == nil || msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("Expected transfers to be refused, got %v", msg)
+	}
+
+	for _, test := range []struct {
+		resp   func() (*http.Response, error)
+		status int
+	}{
+		{func() (*http.Response, error) { return http.Get(url) }, http.StatusBadRequest},
+		{func() (*http.Response, error) { return http.Get(url + "?dns=!!!") }, http.StatusBadRequest},
+		{func() (*http.Response, error) {
+			return http.Post(url, "text/plain", bytes.NewReader(query("web.corp.internal.", dns.TypeA)))
+		}, http.StatusUnsupportedMediaType},
+		{func() (*http.Response, error) {
+			return http.Post(url, DOH_MEDIA_TYPE, bytes.NewReader([]byte{1, 2, 3}))
+		}, http.StatusBadRequest},
+	} {
+		if msg, resp := response(test.resp()); msg != nil || resp.StatusCode != test.status {
+			t.Fatalf("Expected status %d, got %d", test.status, resp.StatusCode)
+		}
+	}
+}
+
+func TestDohShutdown(t *testing.T) {
+	server, err := newDohServer("127.0.0.1:0", "", "", "/dns-query")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.server.ReadTimeout != DOH_LISTENER_READ_TIMEOUT || server.server.WriteTimeout != DOH_LISTENER_WRITE_TIMEOUT ||
+		server.server.IdleTimeout != DOH_LISTENER_IDLE_TIMEOUT {
+		t.Fatalf("Expected the request and idle timeouts to be set, got %+v", server.server)
+	}
+	// A request in flight when the shutdown starts
+	started := make(chan struct{})
+	server.server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("answered"))
+	})
+	go server.ActivateAndServe()
+
+	done := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + server.listener.Addr().String() + "/dns-query")
+		if err == nil {
+			var body []byte
+			body, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err == nil && string(body) != "answered" {
+				err = fmt.Errorf("unexpected body %q", body)
+			}
+		}
+		done <- err
+	}()
+	<-started
+	if err := server.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Expected the request in flight to be answered, got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Recursers given as https:// URLs are sent queries over DNS over HTTPS (RFC 8484), POSTed to the URL
+// (/dns-query if it has no path). One HTTP client is shared by all of them, keeping connections open
+// between queries and multiplexing concurrent ones over HTTP/2. Their certificates are verified like
+// those of tls:// recursers.
+const (
+	DOH_RECURSER_PREFIX = "https://"
+	TRANSPORT_HTTPS     = "https"
+	DOH_IDLE_TIMEOUT    = 90 * time.Second
+)
+
+var (
+	dohUpstreamClient *http.Client
+	dohUpstreamOnce   sync.Once
+)
+
+func isDohRecurser(resolver string) bool {
+	return strings.HasPrefix(resolver, DOH_RECURSER_PREFIX)
+}
+
+// The DoH recurser entry as it was written (its URL is what --upstream-doh-headers entries refer to),
+// with the default path if it has none
+func canonicalDohRecurser(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	u, err := url.Parse(entry)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %v", entry, err)
+	}
+	if u.User != nil || u.Fragment != "" || u.Hostname() == "" {
+		return "", fmt.Errorf("invalid URL %q: expected https://HOST[:PORT][/PATH]", entry)
+	}
+	if _, err := canonicalRecurser(u.Host); err != nil {
+		return "", err
+	}
+	if u.Path == "" {
+		u.Path = "/dns-query"
+		entry = u.String()
+	}
+	return entry, nil
+}
+
+// The address (host and port) of a DoH recurser
+func dohRecurserAddr(resolver string) string {
+	u, err := url.Parse(resolver)
+	if err != nil {
+		return resolver
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+func dohClient() *http.Client {
+	dohUpstreamOnce.Do(func() {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				dialer := outboundDialer("tcp", addr, time.Duration(*recurserTimeout)*time.Second)
+				if dialer == nil {
+					dialer = &net.Dialer{}
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSClientConfig:     upstreamTlsConfig.Clone(),
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     DOH_IDLE_TIMEOUT,
+		}
+		dohUpstreamClient = &http.Client{Transport: transport}
+	})
+	return dohUpstreamClient
+}
+
+// POSTs the query to the DoH recurser. It's sent with ID 0, as HTTP caches would otherwise see every
+// query as a different request (RFC 8484 4.1).
+func exchangeDoh(req *dns.Msg, resolver string) (*dns.Msg, error) {
+	query := req.Copy()
+	query.Id = 0
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*recurserTimeout)*time.Second)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, "POST", resolver, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", DOH_MEDIA_TYPE)
+	r.Header.Set("Accept", DOH_MEDIA_TYPE)
+	setUpstreamHeaders(r, resolver)
+
+	httpResp, err := dohClient().Do(r)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", httpResp.Status)
+	}
+	if mediaType := strings.TrimSpace(strings.Split(httpResp.Header.Get("Content-Type"), ";")[0]); mediaType != DOH_MEDIA_TYPE {
+		return nil, fmt.Errorf("unexpected content type %q", mediaType)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > dns.MaxMsgSize {
+		return nil, fmt.Errorf("response over %d bytes", dns.MaxMsgSize)
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// One record of the loaded answers, as shown by "ctl dump"
+type DumpRecord struct {
+	Client  string   `json:"client"`
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Answer  []string `json:"answer"`
+	Ttl     *uint32  `json:"ttl,omitempty"`
+	Source  string   `json:"source"`
+	Comment string   `json:"comment,omitempty"`
+	// The weights and health check of an A record's addresses
+	Weights map[string]uint32 `json:"weights,omitempty"`
+	Check   *HealthCheck      `json:"check,omitempty"`
+}
+
+// Flattens the answers into a list of records, sorted by client, name and type
+func (answers *Answers) Dump() []DumpRecord {
+	var records []DumpRecord
+	for key, client := range *answers {
+		for name, rec := range client.A {
+			records = append(records, DumpRecord{key, "A", name, rec.Answer, rec.Ttl, rec.Source, rec.Comment, rec.Weights, rec.Check})
+		}
+		for name, rec := range client.Cname {
+			records = append(records, DumpRecord{key, "CNAME", name, []string{rec.Answer}, rec.Ttl, rec.Source, rec.Comment, nil, nil})
+		}
+		for name, rec := range client.Ptr {
+			records = append(records, DumpRecord{key, "PTR", name, []string{rec.Answer}, rec.Ttl, rec.Source, rec.Comment, nil, nil})
+		}
+		for name, rec := range client.Txt {
+			records = append(records, DumpRecord{key, "TXT", name, rec.Answer, rec.Ttl, rec.Source, rec.Comment, nil, nil})
+		}
+		for name, rec := range client.Srv {
+			records = append(records, DumpRecord{key, "SRV", name, rec.Answer, rec.Ttl, rec.Source, rec.Comment, nil, nil})
+		}
+	}
+
+	sort.Sort(byClientNameType(records))
+	return records
+}
+
+type byClientNameType []DumpRecord
+
+func (r byClientNameType) Len() int      { return len(r) }
+func (r byClientNameType) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byClientNameType) Less(i, j int) bool {
+	if r[i].Client != r[j].Client {
+		return r[i].Client < r[j].Client
+	}
+	if r[i].Name != r[j].Name {
+		return r[i].Name < r[j].Name
+	}
+	return r[i].Type < r[j].Type
+}
+
+// GET /v1/dump lists the records, GET /v1/dump?format=answers exports the answers as an answers file
+func httpDump(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Query().Get("format") == "answers" {
+		answersMutex.Lock()
+		data, err := answers.Export()
+		answersMutex.Unlock()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	records := answers.Dump()
+	if client := req.URL.Query().Get("client"); client != "" {
+		var filtered []DumpRecord
+		for _, rec := range records {
+			if strings.EqualFold(rec.Client, client) {
+				filtered = append(filtered, rec)
+			}
+		}
+		records = filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDumpWithSources(t *testing.T) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A:     map[string]RecordA{"web.": {Answer: []string{"10.1.1.1"}}},
+			Cname: map[string]RecordCname{"www.": {Answer: "web.", Source: "metadata:x"}},
+		},
+		"10.1.1.2": ClientAnswers{
+			A: map[string]RecordA{"db.": {Answer: []string{"10.1.1.3"}}},
+		},
+	}
+	answers.SetSource(fileSource("answers.json"))
+
+	records := answers.Dump()
+	if len(records) != 3 {
+		t.Fatalf("Incorrect number of records [%v]", records)
+	}
+	expected := []DumpRecord{
+		{Client: "10.1.1.2", Type: "A", Name: "db.", Source: "file:answers.json"},
+		{Client: DEFAULT_KEY, Type: "A", Name: "web.", Source: "file:answers.json"},
+		{Client: DEFAULT_KEY, Type: "CNAME", Name: "www.", Source: "metadata:x"},
+	}
+	for i, rec := range records {
+		if rec.Client != expected[i].Client || rec.Type != expected[i].Type || rec.Name != expected[i].Name || rec.Source != expected[i].Source {
+			t.Fatalf("Incorrect record %d: expected %+v, got %+v", i, expected[i], rec)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+const SOURCE_DYNAMIC = "dynamic"
+
+const (
+	OP_SET    = "set"
+	OP_DELETE = "delete"
+)
+
+var (
+	// Guards the composition of the served answers from the sources
+	answersMutex sync.Mutex
+	// Serializes record batches, so each one is planned against the records left by the previous one
+	batchMutex sync.Mutex
+)
+
+// One operation of a batch sent to POST /v1/records
+type RecordOp struct {
+	Op      string   `json:"op"`
+	Client  string   `json:"client"`
+	Type    string   `json:"type"`
+	Name    string   `json:"name"`
+	Answer  []string `json:"answer"`
+	Ttl     *uint32  `json:"ttl,omitempty"`
+	Comment string   `json:"comment,omitempty"`
+	// Seconds the record set lives for, after which it's removed. Turned into the Unix time it
+	// expires at when the batch is applied, which is what the journal keeps.
+	Lease   uint32 `json:"lease,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+type RecordChange struct {
+	Op     string   `json:"op"`
+	Client string   `json:"client"`
+	Type   string   `json:"type"`
+	Name   string   `json:"name"`
+	Before []string `json:"before"`
+	After  []string `json:"after"`
+}
+
+type BatchResult struct {
+	DryRun  bool           `json:"dryRun"`
+	Applied bool           `json:"applied"`
+	Changes []RecordChange `json:"changes"`
+	Errors  []string       `json:"errors,omitempty"`
+}
+
+// Copies the answers deep enough that records can be changed in the copy
+func (answers *Answers) Copy() Answers {
+	out := make(Answers)
+	for key, client := range *answers {
+		c := client
+		c.A, c.Cname, c.Ptr, c.Txt, c.Srv = nil, nil, nil, nil, nil
+		c.mergeRecords(&client)
+		out[key] = c
+	}
+	return out
+}
+
+// Adds (or replaces) the records of other to the client, allocating fresh maps
+func (client *ClientAnswers) mergeRecords(other *ClientAnswers) {
+	a := make(map[string]RecordA)
+	for k, v := range client.A {
+		a[k] = v
+	}
+	for k, v := range other.A {
+		a[k] = v
+	}
+	cname := make(map[string]RecordCname)
+	for k, v := range client.Cname {
+		cname[k] = v
+	}
+	for k, v := range other.Cname {
+		cname[k] = v
+	}
+	ptr := make(map[string]RecordPtr)
+	for k, v := range client.Ptr {
+		ptr[k] = v
+	}
+	for k, v := range other.Ptr {
+		ptr[k] = v
+	}
+	txt := make(map[string]RecordTxt)
+	for k, v := range client.Txt {
+		txt[k] = v
+	}
+	for k, v := range other.Txt {
+		txt[k] = v
+	}
+	srv := make(map[string]RecordSrv)
+	for k, v := range client.Srv {
+		srv[k] = v
+	}
+	for k, v := range other.Srv {
+		srv[k] = v
+	}
+	client.A, client.Cname, client.Ptr, client.Txt, client.Srv = a, cname, ptr, txt, srv
+}
+
+// Validates the whole batch against a copy of the dynamic records and returns the result of applying
+// it there. Nothing is changed: either every operation is valid or the batch is rejected.
+func planBatch(ops []RecordOp) (Answers, BatchResult) {
+	result := BatchResult{Changes: []RecordChange{}}
+	current := dynamicRecords.Answers()
+	planned := current.Copy()
+	for i, op := range ops {
+		change, err := planned.apply(op, SOURCE_DYNAMIC)
+		if err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("operation %d: %v", i, err))
+			continue
+		}
+		result.Changes = append(result.Changes, change)
+	}
+	return planned, result
+}
+
+// Applies a batch of record operations atomically, or just reports what would change when dryRun is set
+func ApplyBatch(ops []RecordOp, dryRun bool) BatchResult {
+	batchMutex.Lock()
+	defer batchMutex.Unlock()
+
+	now := now()
+	for i := range ops {
+		if ops[i].Lease > 0 {
+			ops[i].Expires = now.Add(time.Duration(ops[i].Lease) * time.Second).Unix()
+		}
+	}
+	planned, result := planBatch(ops)
+	result.DryRun = dryRun
+	if len(result.Errors) > 0 || dryRun {
+		return result
+	}
+
+	if journal != nil {
+		if err := journal.Append(ops); err != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("failed to journal the batch: %v", err))
+			return result
+		}
+	}
+	dynamicRecords.Set(planned)
+	if journal != nil {
+		journal.MaybeCompact(planned)
+	}
+	result.Applied = true
+	log.WithFields(log.Fields{"changes": len(result.Changes)}).Info("Applied record updates")
+	return result
+}
+
+// Fills in the default client and brings the type and name into the form records are kept in
+func (op *RecordOp) normalize() error {
+	op.Client = strings.TrimSpace(op.Client)
+	if op.Client == "" {
+		op.Client = DEFAULT_KEY
+	}
+	if _, clientKey := splitEnvironmentKey(op.Client); strings.Contains(clientKey, "/") && parseNetwork(clientKey) == nil {
+		return fmt.Errorf("invalid client network %s", op.Client)
+	}
+	op.Type = strings.ToUpper(op.Type)
+	if arpa, err := dns.ReverseAddr(op.Name); op.Type == "PTR" && err == nil {
+		op.Name = arpa
+	}
+	op.Name = strings.ToLower(dns.Fqdn(op.Name))
+	if _, ok := dns.IsDomainName(op.Name); !ok {
+		return fmt.Errorf("invalid name %s", op.Name)
+	}
+	return nil
+}
+
+// Applies one operation to the answers, labelling the records it sets with source
+func (answers *Answers) apply(op RecordOp, source string) (RecordChange, error) {
+	if err := op.normalize(); err != nil {
+		return RecordChange{}, err
+	}
+
+	change := RecordChange{Op: op.Op, Client: op.Client, Type: op.Type, Name: op.Name}
+	client := (*answers)[op.Client]
+	client.mergeRecords(&ClientAnswers{})
+	change.Before = client.recordAnswer(op.Type, op.Name)
+
+	switch op.Op {
+	case OP_SET:
+		if err := validateAnswer(op.Type, op.Answer); err != nil {
+			return change, err
+		}
+		switch op.Type {
+		case "A":
+			client.A[op.Name] = RecordA{Ttl: op.Ttl, Answer: op.Answer, Comment: op.Comment, Source: source, Expires: op.Expires}
+		case "CNAME":
+			client.Cname[op.Name] = RecordCname{Ttl: op.Ttl, Answer: dns.Fqdn(op.Answer[0]), Comment: op.Comment, Source: source, Expires: op.Expires}
+		case "PTR":
+			client.Ptr[op.Name] = RecordPtr{Ttl: op.Ttl, Answer: dns.Fqdn(op.Answer[0]), Comment: op.Comment, Source: source, Expires: op.Expires}
+		case "TXT":
+			client.Txt[op.Name] = RecordTxt{Ttl: op.Ttl, Answer: op.Answer, Comment: op.Comment, Source: source, Expires: op.Expires}
+		case "SRV":
+			client.Srv[op.Name] = RecordSrv{Ttl: op.Ttl, Answer: normalizeSrvAnswers(op.Answer), Comment: op.Comment, Source: source, Expires: op.Expires}
+		}
+	case OP_DELETE:
+		if change.Before == nil {
+			return change, fmt.Errorf("no dynamic %s record for %s (client %s)", op.Type, op.Name, op.Client)
+		}
+		switch op.Type {
+		case "A":
+			delete(client.A, op.Name)
+		case "CNAME":
+			delete(client.Cname, op.Name)
+		case "PTR":
+			delete(client.Ptr, op.Name)
+		case "TXT":
+			delete(client.Txt, op.Name)
+		case "SRV":
+			delete(client.Srv, op.Name)
+		}
+	default:
+		return change, fmt.Errorf("unknown operation %q, expected %s or %s", op.Op, OP_SET, OP_DELETE)
+	}
+
+	(*answers)[op.Client] = client
+	change.After = client.recordAnswer(op.Type, op.Name)
+	return change, nil
+}
+
+func (client *ClientAnswers) recordAnswer(qtype string, name string) []string {
+	switch qtype {
+	case "A":
+		if rec, ok := client.A[name]; ok {
+			return rec.Answer
+		}
+	case "CNAME":
+		if rec, ok := client.Cname[name]; ok {
+			return []string{rec.Answer}
+		}
+	case "PTR":
+		if rec, ok := client.Ptr[name]; ok {
+			return []string{rec.Answer}
+		}
+	case "TXT":
+		if rec, ok := client.Txt[name]; ok {
+			return rec.Answer
+		}
+	case "SRV":
+		if rec, ok := client.Srv[name]; ok {
+			return rec.Answer
+		}
+	}
+	return nil
+}
+
+func validateAnswer(qtype string, answer []string) error {
+	if len(answer) == 0 {
+		return fmt.Errorf("no answer for %s record", qtype)
+	}
+	switch qtype {
+	case "A":
+		for _, a := range answer {
+			if ip := net.ParseIP(a); ip == nil {
+				return fmt.Errorf("invalid IP address %s", a)
+			}
+		}
+	case "CNAME", "PTR":
+		if len(answer) != 1 {
+			return fmt.Errorf("%s record takes exactly one answer", qtype)
+		}
+		if _, ok := dns.IsDomainName(answer[0]); !ok {
+			return fmt.Errorf("invalid target %s", answer[0])
+		}
+	case "TXT":
+		for _, a := range answer {
+			if len(a) > 255 {
+				return fmt.Errorf("TXT record too long: %s", a)
+			}
+		}
+	case "SRV":
+		for _, a := range answer {
+			if _, err := parseSrvAnswer(a); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported record type %s", qtype)
+	}
+	return nil
+}
+
+func httpRecords(w http.ResponseWriter, req *http.Request) {
+	var ops []RecordOp
+	if err := json.NewDecoder(req.Body).Decode(&ops); err != nil {
+		http.Error(w, "Invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dryRun := req.URL.Query().Get("dryRun") == "true"
+	result := ApplyBatch(ops, dryRun)
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(result.Errors) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBatchIsAtomic(t *testing.T) {
+	if err := setupSources(""); err != nil {
+		t.Fatal(err)
+	}
+	dynamicRecords.Set(make(Answers))
+	setBaseAnswers(Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"static.": {Answer: []string{"10.0.0.1"}}}}})
+
+	result := ApplyBatch([]RecordOp{
+		{Op: OP_SET, Type: "A", Name: "web", Answer: []string{"10.0.0.2"}},
+		{Op: OP_SET, Type: "A", Name: "bad", Answer: []string{"not-an-ip"}},
+	}, false)
+	if result.Applied || len(result.Errors) != 1 {
+		t.Fatalf("Expected the batch to be rejected [%+v]", result)
+	}
+	if _, ok := answers[DEFAULT_KEY].A["web."]; ok {
+		t.Fatalf("Rejected batch should not change the answers")
+	}
+
+	result = ApplyBatch([]RecordOp{
+		{Op: OP_SET, Type: "A", Name: "web", Answer: []string{"10.0.0.2"}},
+		{Op: OP_SET, Client: "10.1.0.0/16", Type: "CNAME", Name: "www.", Answer: []string{"web"}},
+	}, true)
+	if result.Applied || len(result.Changes) != 2 || len(result.Errors) != 0 {
+		t.Fatalf("Expected a dry run with 2 changes [%+v]", result)
+	}
+	if _, ok := answers[DEFAULT_KEY].A["web."]; ok {
+		t.Fatalf("Dry run should not change the answers")
+	}
+
+	result = ApplyBatch([]RecordOp{
+		{Op: OP_SET, Type: "A", Name: "web", Answer: []string{"10.0.0.2"}, Comment: "OPS-123"},
+		{Op: OP_SET, Client: "10.1.0.0/16", Type: "CNAME", Name: "www.", Answer: []string{"web"}},
+	}, false)
+	if !result.Applied {
+		t.Fatalf("Expected the batch to be applied [%+v]", result)
+	}
+	if rec := answers[DEFAULT_KEY].A["web."]; len(rec.Answer) != 1 || rec.Source != SOURCE_DYNAMIC || rec.Comment != "OPS-123" {
+		t.Fatalf("Incorrect dynamic record [%+v]", rec)
+	}
+	if _, ok := answers[DEFAULT_KEY].A["static."]; !ok {
+		t.Fatalf("Static records should be kept")
+	}
+	if rec := answers["10.1.0.0/16"].Cname["www."]; rec.Answer != "web." {
+		t.Fatalf("Incorrect dynamic record [%+v]", rec)
+	}
+
+	result = ApplyBatch([]RecordOp{{Op: OP_DELETE, Type: "A", Name: "static."}}, false)
+	if result.Applied {
+		t.Fatalf("Only dynamic records can be deleted [%+v]", result)
+	}
+	result = ApplyBatch([]RecordOp{{Op: OP_DELETE, Type: "A", Name: "web."}}, false)
+	if _, ok := answers[DEFAULT_KEY].A["web."]; !result.Applied || ok {
+		t.Fatalf("Expected the dynamic record to be deleted [%+v]", result)
+	}
+}
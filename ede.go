@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0 option code of extended DNS errors (RFC 8914)
+const EDNS0_EDE = 15
+
+// Extended DNS error info codes (RFC 8914, section 4)
+const (
+	EDE_OTHER                  = 0
+	EDE_STALE_ANSWER           = 3
+	EDE_DNSSEC_BOGUS           = 6
+	EDE_BLOCKED                = 15
+	EDE_PROHIBITED             = 18
+	EDE_NO_REACHABLE_AUTHORITY = 22
+	EDE_NETWORK_ERROR          = 23
+	EDE_NOT_SUPPORTED          = 21
+)
+
+type extendedError struct {
+	code uint16
+	text string
+}
+
+// Explains the response to the query being answered through w with an extended DNS error, which is
+// sent to clients that used EDNS0. The first error given for a query is kept.
+func setExtendedError(w dns.ResponseWriter, code uint16, text string) {
+	if qw, ok := w.(*queryWriter); ok && qw.ede == nil {
+		qw.ede = &extendedError{code, text}
+	}
+}
+
+// Extended error for a failure to get an answer from the recursers
+func recursionError(err error) (uint16, string) {
+	if err == nil {
+		return EDE_NO_REACHABLE_AUTHORITY, "no recursers"
+	}
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return EDE_NO_REACHABLE_AUTHORITY, "recursers timed out"
+	}
+	if _, ok := err.(*upstreamLimitError); ok {
+		return EDE_OTHER, "recurser response exceeded limits"
+	}
+	if _, ok := err.(*rateLimitedError); ok {
+		return EDE_OTHER, "recursion rate limited"
+	}
+	return EDE_NETWORK_ERROR, "network error reaching recursers"
+}
+
+// Adds the extended error to the response
+func (e *extendedError) addTo(m *dns.Msg) {
+	data := make([]byte, 2, 2+len(e.text))
+	binary.BigEndian.PutUint16(data, e.code)
+	data = append(data, e.text...)
+	addEdnsOption(m, &dns.EDNS0_LOCAL{Code: EDNS0_EDE, Data: data})
+}
+
+// Adds the option to the response's OPT record, adding one if it doesn't have one yet
+func addEdnsOption(m *dns.Msg, option dns.EDNS0) {
+	if o := m.IsEdns0(); o != nil {
+		o.Option = append(o.Option, option)
+		return
+	}
+	o := newOpt()
+	o.Option = append(o.Option, option)
+	m.Extra = append(m.Extra, o)
+}
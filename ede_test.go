@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecursionError(t *testing.T) {
+	if code, _ := recursionError(timeoutError{}); code != EDE_NO_REACHABLE_AUTHORITY {
+		t.Fatalf("Incorrect code for a timeout: %d", code)
+	}
+	if code, _ := recursionError(errors.New("connection refused")); code != EDE_NETWORK_ERROR {
+		t.Fatalf("Incorrect code for a network error: %d", code)
+	}
+}
+
+func TestExtendedErrorOption(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("web.", dns.TypeA)
+	e := &extendedError{EDE_BLOCKED, "blocked by policy"}
+	e.addTo(m)
+
+	o := m.IsEdns0()
+	if o == nil || len(o.Option) != 1 {
+		t.Fatalf("Expected an OPT record with one option [%v]", m)
+	}
+	local, ok := o.Option[0].(*dns.EDNS0_LOCAL)
+	if !ok || local.Code != EDNS0_EDE || binary.BigEndian.Uint16(local.Data) != EDE_BLOCKED || string(local.Data[2:]) != "blocked by policy" {
+		t.Fatalf("Incorrect extended error option %v", o.Option[0])
+	}
+
+	e.addTo(m)
+	if len(m.Extra) != 1 || len(m.IsEdns0().Option) != 2 {
+		t.Fatalf("Expected the existing OPT record to be reused [%v]", m)
+	}
+}
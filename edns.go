@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// The payload size of clients not using EDNS0, and the least one advertised by a client that is honoured
+const EDNS_MIN_UDP_SIZE = 512
+
+// The DO bit in the TTL field of the OPT record
+const EDNS_DO = 1 << 15
+
+// Largest UDP response sent: the client's advertised buffer size (RFC 6891), at most --edns-udp-size.
+// Over TCP the only limit is the message size.
+func udpPayloadSize(req *dns.Msg, tcp bool) int {
+	if tcp {
+		return dns.MaxMsgSize - 1
+	}
+	size := EDNS_MIN_UDP_SIZE
+	if o := req.IsEdns0(); o != nil && int(o.UDPSize()) > size {
+		size = int(o.UDPSize())
+	}
+	if limit := int(*ednsUdpSize); size > limit && limit >= EDNS_MIN_UDP_SIZE {
+		size = limit
+	}
+	return size
+}
+
+// Whether the query uses a version of EDNS that isn't supported, to be answered with BADVERS
+func unsupportedEdnsVersion(req *dns.Msg) bool {
+	o := req.IsEdns0()
+	return o != nil && o.Version() != 0
+}
+
+// answerBadVersion answers a query of an unsupported EDNS version with BADVERS and the version
+// that is supported, 0
+func answerBadVersion(w dns.ResponseWriter, req *dns.Msg) {
+	stats.incr("ednsBadVersion")
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeBadVers)
+	setResponseOpt(req, m)
+	w.WriteMsg(m)
+}
+
+// A new OPT record advertising --edns-udp-size
+func newOpt() *dns.OPT {
+	o := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+	o.SetUDPSize(uint16(*ednsUdpSize))
+	return o
+}
+
+// setResponseOpt gives the response a single OPT record that advertises --edns-udp-size with EDNS
+// version 0 and the DO bit of the query (RFC 3225), keeping the options it has. Responses to
+// queries without EDNS0 mustn't have one, so any OPT relayed from recursers is dropped for those.
+func setResponseOpt(req *dns.Msg, m *dns.Msg) {
+	reqOpt := req.IsEdns0()
+	var opt *dns.OPT
+	extra := make([]dns.RR, 0, len(m.Extra)+1)
+	for _, rr := range m.Extra {
+		o, ok := rr.(*dns.OPT)
+		if !ok {
+			extra = append(extra, rr)
+		} else if opt == nil {
+			opt = o
+		} else {
+			opt.Option = append(opt.Option, o.Option...)
+		}
+	}
+	if reqOpt == nil {
+		m.Extra = extra
+		return
+	}
+	if opt == nil {
+		opt = newOpt()
+	}
+	opt.SetUDPSize(uint16(*ednsUdpSize))
+	opt.SetVersion(0)
+	if reqOpt.Do() {
+		opt.Hdr.Ttl |= EDNS_DO
+	} else {
+		opt.Hdr.Ttl &^= EDNS_DO
+	}
+	m.Extra = append(extra, opt)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestEdnsPayloadSize(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+	var txt []string
+	for i := 0; i < 40; i++ {
+		txt = append(txt, fmt.Sprintf("record %d %s", i, strings.Repeat("x", 60)))
+	}
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Authoritative: []string{"corp.internal"},
+		Txt:           map[string]RecordTxt{"big.corp.internal.": {Answer: txt}},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	query := func(w dns.ResponseWriter, size uint16) (*dns.Msg, int) {
+		req := new(dns.Msg)
+		req.SetQuestion("big.corp.internal.", dns.TypeTXT)
+		if size > 0 {
+			req.SetEdns0(size, true)
+		}
+		route(&queryWriter{ResponseWriter: w, edns: size > 0}, req)
+		var msg *dns.Msg
+		switch w := w.(type) {
+		case *testWriter:
+			msg = w.msg
+		case *transferWriter:
+			msg = w.msgs[0]
+		}
+		// Whatever was cut, the response is still well-formed
+		packed, err := msg.Pack()
+		if err != nil {
+			t.Fatalf("Failed to pack the response: %v", err)
+		}
+		out := new(dns.Msg)
+		if err := out.Unpack(packed); err != nil && err != dns.ErrTruncated {
+			t.Fatalf("Malformed response: %v", err)
+		}
+		return out, len(packed)
+	}
+
+	for _, test := range []struct {
+		size   uint16
+		limit  int
+		advert uint16
+	}{
+		{0, 512, 0},
+		{1024, 1024, 1232},
+		{4096, 1232, 1232},
+		{100, 512, 1232},
+	} {
+		msg, size := query(&testWriter{}, test.size)
+		if !msg.Truncated || len(msg.Answer) == 0 || len(msg.Answer) == len(txt) || size > test.limit {
+			t.Fatalf("Expected a truncated response of at most %d bytes for a %d byte buffer, got %d answers in %d bytes", test.limit, test.size, len(msg.Answer), size)
+		}
+		if o := msg.IsEdns0(); (o == nil) != (test.advert == 0) || (o != nil && (o.UDPSize() != test.advert || !o.Do())) {
+			t.Fatalf("Expected an OPT record advertising %d for a %d byte buffer, got %v", test.advert, test.size, o)
+		}
+	}
+
+	// Over TCP it all fits
+	if msg, _ := query(&transferWriter{}, 1024); msg.Truncated || len(msg.Answer) != len(txt) {
+		t.Fatalf("Expected all the answers over TCP, got %d", len(msg.Answer))
+	}
+}
+
+func TestEdnsVersion(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("web.corp.internal.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	req.IsEdns0().SetVersion(1)
+	w := &testWriter{}
+	route(&queryWriter{ResponseWriter: w, edns: true}, req)
+
+	packed, _ := w.msg.Pack()
+	msg := new(dns.Msg)
+	msg.Unpack(packed)
+	o := msg.IsEdns0()
+	if o == nil || msg.Rcode|int(o.ExtendedRcode())<<4 != dns.RcodeBadVers || o.Version() != 0 {
+		t.Fatalf("Expected BADVERS with EDNS version 0, got %v", msg)
+	}
+}
+
+func TestSetResponseOpt(t *testing.T) {
+	// A recurser's OPT record is replaced by one of ours, keeping its options
+	relayed := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetEdns0(4096, true)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: EDNS0_EDE, Data: []byte{0, 0}})
+		return m
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("web.example.com.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	m := relayed()
+	setResponseOpt(req, m)
+	if o := m.IsEdns0(); len(m.Extra) != 1 || o.UDPSize() != uint16(*ednsUdpSize) || o.Do() || len(o.Option) != 1 {
+		t.Fatalf("Expected our OPT record with the recurser's options, got %v", m.Extra)
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("web.example.com.", dns.TypeA)
+	m = relayed()
+	setResponseOpt(req, m)
+	if len(m.Extra) != 0 {
+		t.Fatalf("Expected no OPT record for a query without EDNS0, got %v", m.Extra)
+	}
+}
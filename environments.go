@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// The top-level key in the config holding the answers of each environment (tenant), keyed by name
+const ENVIRONMENTS_KEY = "environments"
+
+// Separates the environment from the client in the keys of environment entries ("prod#default",
+// "prod#10.42.0.0/16"). Not part of any IP, network or UUID.
+const ENVIRONMENT_SEPARATOR = "#"
+
+var (
+	// Answers of each environment, keyed by the client keys within it. Rebuilt with the answers.
+	environmentAnswers = make(map[string]Answers)
+)
+
+// Environment selection rules, read from the "environments" list of the default entry. The first
+// rule whose network and listener (each optional) match the query answers it from the rule's
+// environment instead of the top-level answers.
+func (answers *Answers) EnvironmentRules() []EnvironmentRule {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.Environments
+}
+
+// The environment queries from the client arriving on the listener are answered from, "" for the
+// top-level answers
+func (answers *Answers) EnvironmentFor(clientIp string, listener string) string {
+	for _, rule := range answers.EnvironmentRules() {
+		if rule.Matches(clientIp, listener) {
+			return rule.Name
+		}
+	}
+	return ""
+}
+
+// The answers of the environment (the top-level answers for "")
+func answersFor(environment string) Answers {
+	if environment == "" {
+		return answers
+	}
+	return environmentAnswers[environment]
+}
+
+// Splits the answers into those of each environment, with the environment taken off the keys
+func (answers *Answers) Environments() map[string]Answers {
+	environments := make(map[string]Answers)
+	for key, client := range *answers {
+		environment, clientKey := splitEnvironmentKey(key)
+		if environment == "" {
+			continue
+		}
+		if _, ok := environments[environment]; !ok {
+			environments[environment] = make(Answers)
+		}
+		environments[environment][clientKey] = client
+	}
+	return environments
+}
+
+// The key of the client's entry within the environment
+func environmentKey(environment string, clientKey string) string {
+	if environment == "" {
+		return clientKey
+	}
+	return environment + ENVIRONMENT_SEPARATOR + clientKey
+}
+
+func splitEnvironmentKey(key string) (environment string, clientKey string) {
+	if i := strings.Index(key, ENVIRONMENT_SEPARATOR); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+func (rule *EnvironmentRule) Matches(clientIp string, listener string) bool {
+	if rule.Network != "" && !inNetwork(clientIp, rule.Network) {
+		return false
+	}
+	if rule.Listener != "" && rule.Listener != listener {
+		// A listener given without a port matches on the address alone
+		if host, _, err := net.SplitHostPort(listener); err != nil || strings.Trim(rule.Listener, "[]") != host {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *EnvironmentRule) Validate() error {
+	if rule.Name == "" || strings.Contains(rule.Name, ENVIRONMENT_SEPARATOR) {
+		return fmt.Errorf("invalid environment name: %+v", *rule)
+	}
+	if rule.Network != "" && parseNetwork(rule.Network) == nil {
+		return fmt.Errorf("invalid network for environment %s: %s", rule.Name, rule.Network)
+	}
+	return nil
+}
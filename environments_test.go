@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const environmentsConfig = `
+default:
+  recurse: [8.8.8.8]
+  environments:
+    - name: prod
+      network: 10.1.0.0/16
+    - name: staging
+      listener: 10.2.1.53
+  a:
+    web.:
+      answer: [1.1.1.1]
+environments:
+  prod:
+    default:
+      recurse: [10.1.0.2]
+      a:
+        web.:
+          answer: [10.1.0.10]
+    10.1.1.0/24:
+      a:
+        db.:
+          answer: [10.1.1.20]
+`
+
+func TestParseEnvironments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "environments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "answers.yaml")
+	if err := ioutil.WriteFile(path, []byte(environmentsConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseAnswers(path)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if _, ok := parsed[ENVIRONMENTS_KEY]; ok {
+		t.Fatalf("The environments section should not be a client entry")
+	}
+	if _, ok := parsed["prod#10.1.1.0/24"]; !ok || len(parsed) != 3 {
+		t.Fatalf("Expected the prod entries to be flattened, got %v", parsed)
+	}
+
+	if env := parsed.EnvironmentFor("10.1.1.1", "10.2.1.53:53"); env != "prod" {
+		t.Fatalf("Expected the network rule to match first, got %q", env)
+	}
+	if env := parsed.EnvironmentFor("192.168.0.1", "10.2.1.53:53"); env != "staging" {
+		t.Fatalf("Expected the listener rule to match, got %q", env)
+	}
+	if env := parsed.EnvironmentFor("192.168.0.1", "10.3.1.53:53"); env != "" {
+		t.Fatalf("Expected the top-level answers, got %q", env)
+	}
+
+	prod := parsed.Environments()["prod"]
+	if prod.ClientKey("10.1.1.1") != "10.1.1.0/24" || prod.Recursers("10.1.1.0/24")[0] != "10.1.0.2" {
+		t.Fatalf("Incorrect prod answers %v", prod)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("environments:\n  a#b:\n    default: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseAnswers(path); err == nil {
+		t.Fatalf("Expected an invalid environment name to be rejected")
+	}
+}
+
+func TestRouteEnvironment(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+
+	answers = Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Environments: []EnvironmentRule{{Name: "prod", Network: "10.1.0.0/16"}},
+			A:            map[string]RecordA{"web.": {Answer: []string{"1.1.1.1"}}},
+		},
+		"prod#default": ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.1.0.10"}}}},
+	}
+	environmentAnswers = answers.Environments()
+	clearClientSpecificCaches()
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.", dns.TypeA)
+	w := &testWriter{}
+	route(w, req)
+	if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != "10.1.0.10" {
+		t.Fatalf("Expected the prod answer, got %v", w.msg)
+	}
+
+	answers[DEFAULT_KEY] = ClientAnswers{A: answers[DEFAULT_KEY].A}
+	clearClientSpecificCaches()
+	route(w, req)
+	if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Fatalf("Expected the top-level answer, got %v", w.msg)
+	}
+}
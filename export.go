@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A record of an exported answers file
+type exportRecord struct {
+	Answer  interface{}       `json:"answer"`
+	Weights map[string]uint32 `json:"weights,omitempty"`
+	Check   *HealthCheck      `json:"check,omitempty"`
+	Ttl     *uint32           `json:"ttl,omitempty"`
+	Comment string            `json:"comment,omitempty"`
+}
+
+// The answers as an answers file in canonical form, so that exports of the same answers are
+// byte-identical and diff cleanly: keys in sorted order, the answers of each record sorted (they
+// are an unordered set when served), two-space indentation, and environment entries nested back
+// under "environments". Settings and rules keep their order, which matters. Loading the file gives
+// back the same answers, save for where each record came from.
+func (answers *Answers) Export() ([]byte, error) {
+	out := make(map[string]interface{})
+	environments := make(map[string]map[string]interface{})
+	for key, client := range *answers {
+		environment, clientKey := splitEnvironmentKey(key)
+		if environment == "" {
+			out[key] = exportClient(client)
+			continue
+		}
+		if environments[environment] == nil {
+			environments[environment] = make(map[string]interface{})
+		}
+		environments[environment][clientKey] = exportClient(client)
+	}
+	if len(environments) > 0 {
+		out[ENVIRONMENTS_KEY] = environments
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// The entry with the keys the answers file is read with: the lower case field names
+func exportClient(client ClientAnswers) map[string]interface{} {
+	out := make(map[string]interface{})
+	v := reflect.ValueOf(client)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		name := strings.ToLower(v.Type().Field(i).Name)
+		if (field.Kind() == reflect.Slice || field.Kind() == reflect.Map) && field.Len() == 0 {
+			continue
+		}
+		if (field.Kind() == reflect.Ptr && field.IsNil()) || (field.Kind() == reflect.String && field.String() == "") {
+			continue
+		}
+		switch name {
+		case "a", "cname", "ptr", "txt", "srv":
+			continue
+		}
+		out[name] = field.Interface()
+	}
+
+	a := make(map[string]exportRecord)
+	for name, rec := range client.A {
+		a[name] = exportRecord{sortedAnswer(rec.Answer), rec.Weights, rec.Check, rec.Ttl, rec.Comment}
+	}
+	cname := make(map[string]exportRecord)
+	for name, rec := range client.Cname {
+		cname[name] = exportRecord{rec.Answer, nil, nil, rec.Ttl, rec.Comment}
+	}
+	ptr := make(map[string]exportRecord)
+	for name, rec := range client.Ptr {
+		ptr[name] = exportRecord{rec.Answer, nil, nil, rec.Ttl, rec.Comment}
+	}
+	txt := make(map[string]exportRecord)
+	for name, rec := range client.Txt {
+		txt[name] = exportRecord{sortedAnswer(rec.Answer), nil, nil, rec.Ttl, rec.Comment}
+	}
+	srv := make(map[string]exportRecord)
+	for name, rec := range client.Srv {
+		srv[name] = exportRecord{sortedAnswer(rec.Answer), nil, nil, rec.Ttl, rec.Comment}
+	}
+	for name, recs := range map[string]map[string]exportRecord{"a": a, "cname": cname, "ptr": ptr, "txt": txt, "srv": srv} {
+		if len(recs) > 0 {
+			out[name] = recs
+		}
+	}
+	return out
+}
+
+func sortedAnswer(answer []string) []string {
+	sorted := append([]string{}, answer...)
+	sort.Strings(sorted)
+	return sorted
+}
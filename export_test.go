@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportAnswers(t *testing.T) {
+	ttl := uint32(42)
+	recursion := false
+	exported := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse:       []string{"8.8.8.8:53", "1.1.1.1:53"},
+			Authoritative: []string{"stack.internal."},
+			Recursion:     &recursion,
+			Suppress:      []SuppressRule{{Network: "10.42.99.0/24", Zone: "corp.internal"}},
+			A: map[string]RecordA{
+				"web.stack.internal.": {Answer: []string{"10.0.0.2", "10.0.0.1"}, Ttl: &ttl, Comment: "a<b & c"},
+				"db.stack.internal.":  {Answer: []string{"10.0.0.5"}},
+			},
+			Cname: map[string]RecordCname{"www.stack.internal.": {Answer: "web.stack.internal."}},
+			Ptr:   map[string]RecordPtr{"1.0.0.10.in-addr.arpa.": {Answer: "web.stack.internal."}},
+			Txt:   map[string]RecordTxt{"web.stack.internal.": {Answer: []string{"v=2", "v=1"}}},
+			Srv:   map[string]RecordSrv{"_http._tcp.stack.internal.": {Answer: []string{"10 5 80 web.stack.internal."}}},
+		},
+		"prod#default": ClientAnswers{
+			A: map[string]RecordA{"web.stack.internal.": {Answer: []string{"10.1.0.1"}}},
+		},
+	}
+
+	data, err := exported.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if again, _ := exported.Export(); string(again) != string(data) {
+			t.Fatalf("Expected repeated exports to be byte-identical")
+		}
+	}
+	if !strings.Contains(string(data), `"answer": [
+          "10.0.0.1",
+          "10.0.0.2"
+        ]`) || !strings.Contains(string(data), `"comment": "a<b & c"`) || !strings.Contains(string(data), `"environments"`) {
+		t.Fatalf("Expected sorted answers, unescaped text and nested environments, got %s", data)
+	}
+
+	// Loading the export gives back the same answers
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "answers.json")
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := ParseAnswers(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := loaded.Export(); string(again) != string(data) {
+		t.Fatalf("Expected the loaded export to export the same, got %s", again)
+	}
+	if changes := diffAnswers(exported, loaded); len(changes) != 0 {
+		t.Fatalf("Expected the loaded export to answer the same, got %+v", changes)
+	}
+	if !reflect.DeepEqual(loaded[DEFAULT_KEY].Recurse, exported[DEFAULT_KEY].Recurse) {
+		t.Fatalf("Expected the order of the recursers to be kept, got %v", loaded[DEFAULT_KEY].Recurse)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// How long to give the preferred path to an upstream before also trying the next one (RFC 8305)
+const HAPPY_EYEBALLS_DELAY = 250 * time.Millisecond
+
+// How long the addresses a recurser host name resolves to are reused
+const UPSTREAM_ADDRS_TTL = 60 * time.Second
+
+type upstreamHost struct {
+	addrs   []string
+	expires time.Time
+}
+
+// One way to reach an upstream: an address over a transport
+type upstreamPath struct {
+	transport string
+	addr      string
+}
+
+var (
+	upstreamHosts     = make(map[string]upstreamHost)
+	upstreamPreferred = make(map[string]upstreamPath)
+	upstreamMutex     sync.Mutex
+)
+
+// Returns the addresses to try for a recurser entry. Address literals are used as they are, host
+// names are looked up and return one IPv6 and one IPv4 address (whichever exist), preferred address
+// first if one has been learned.
+func upstreamAddrs(resolver string) []string {
+	addr := resolverAddr(resolver)
+	host, port, _ := net.SplitHostPort(addr)
+	if net.ParseIP(host) != nil {
+		return []string{addr}
+	}
+
+	upstreamMutex.Lock()
+	cached, ok := upstreamHosts[resolver]
+	upstreamMutex.Unlock()
+	if !ok || time.Now().After(cached.expires) {
+		ips, err := net.LookupIP(host)
+		if err != nil || len(ips) == 0 {
+			// Let the exchange fail with the real error
+			return []string{addr}
+		}
+
+		var v4, v6 string
+		for _, ip := range ips {
+			if ip.To4() != nil && v4 == "" {
+				v4 = net.JoinHostPort(ip.String(), port)
+			} else if ip.To4() == nil && v6 == "" {
+				v6 = net.JoinHostPort(ip.String(), port)
+			}
+		}
+		cached = upstreamHost{expires: time.Now().Add(UPSTREAM_ADDRS_TTL)}
+		for _, a := range []string{v6, v4} {
+			if a != "" {
+				cached.addrs = append(cached.addrs, a)
+			}
+		}
+
+		upstreamMutex.Lock()
+		upstreamHosts[resolver] = cached
+		upstreamMutex.Unlock()
+	}
+
+	addrs := append([]string{}, cached.addrs...)
+	upstreamMutex.Lock()
+	preferred := upstreamPreferred[resolver]
+	upstreamMutex.Unlock()
+	if len(addrs) > 1 && addrs[1] == preferred.addr {
+		addrs[0], addrs[1] = addrs[1], addrs[0]
+	}
+	return addrs
+}
+
+// Returns the paths to race for a recurser over the transport: each of its addresses and, for plain
+// DNS over UDP, the same addresses over TCP after them, unless probing found the recurser doesn't
+// take TCP. The transport that last answered first goes first.
+func upstreamPaths(resolver, transport string) []upstreamPath {
+	addrs := upstreamAddrs(resolver)
+	transports := []string{transport}
+	if transport == "udp" {
+		if caps, probed := upstreamCapabilitiesFor(resolver); !probed || caps.Tcp {
+			transports = append(transports, "tcp")
+		}
+	}
+	upstreamMutex.Lock()
+	preferred := upstreamPreferred[resolver]
+	upstreamMutex.Unlock()
+	if len(transports) > 1 && preferred.transport == transports[1] {
+		transports[0], transports[1] = transports[1], transports[0]
+	}
+
+	var paths []upstreamPath
+	for _, transport := range transports {
+		for _, addr := range addrs {
+			paths = append(paths, upstreamPath{transport, addr})
+		}
+	}
+	return paths
+}
+
+type raceResult struct {
+	path upstreamPath
+	resp *dns.Msg
+	err  error
+}
+
+// Sends the query over the first path and, if it hasn't answered within HAPPY_EYEBALLS_DELAY (or
+// has already failed), over the next one as well. The first successful answer wins and its path is
+// remembered as the preferred one for the upstream. A truncated answer doesn't win, as a path over
+// TCP may still bring the whole of it; it's only returned if nothing else answers.
+func raceExchange(req *dns.Msg, resolver string, paths []upstreamPath, send func(*dns.Msg, upstreamPath) (*dns.Msg, error)) (resp *dns.Msg, err error) {
+	results := make(chan raceResult, len(paths))
+	start := func(path upstreamPath) {
+		go func() {
+			resp, err := send(req.Copy(), path)
+			results <- raceResult{path, resp, err}
+		}()
+	}
+
+	var truncated *dns.Msg
+	start(paths[0])
+	started, finished := 1, 0
+	for finished < started {
+		var timer <-chan time.Time
+		if started < len(paths) {
+			timer = time.After(HAPPY_EYEBALLS_DELAY)
+		}
+
+		select {
+		case <-timer:
+			start(paths[started])
+			started++
+		case result := <-results:
+			finished++
+			resp, err = result.resp, result.err
+			if err == nil && resp != nil && resp.Truncated {
+				truncated = resp
+			} else if err == nil {
+				upstreamMutex.Lock()
+				upstreamPreferred[resolver] = result.path
+				upstreamMutex.Unlock()
+				log.WithFields(log.Fields{"resolver": resolver, "addr": result.path.addr, "transport": result.path.transport}).Debug("Upstream answered first")
+				return
+			}
+			if started < len(paths) {
+				start(paths[started])
+				started++
+			}
+		}
+	}
+
+	if truncated != nil {
+		return truncated, nil
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A local upstream answering with the address after the delay, over UDP and TCP on the same port.
+// With truncated, the UDP answers are truncated.
+func startDelayedUpstream(t *testing.T, answer string, udpDelay, tcpDelay time.Duration, truncated bool) (string, func()) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp4", conn.LocalAddr().String())
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	handler := func(delay time.Duration, truncate bool) dns.Handler {
+		return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			time.Sleep(delay)
+			m := new(dns.Msg)
+			m.SetReply(req)
+			if truncate {
+				m.Truncated = true
+			} else {
+				rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A " + answer)
+				m.Answer = []dns.RR{rr}
+			}
+			w.WriteMsg(m)
+		})
+	}
+	udp := &dns.Server{PacketConn: conn, Handler: handler(udpDelay, truncated)}
+	tcp := &dns.Server{Listener: listener, Handler: handler(tcpDelay, false)}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	return conn.LocalAddr().String(), func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}
+}
+
+func answeredBy(msg *dns.Msg) string {
+	if msg == nil || len(msg.Answer) != 1 {
+		return ""
+	}
+	return msg.Answer[0].(*dns.A).A.String()
+}
+
+func resetEyeballs() {
+	upstreamMutex.Lock()
+	upstreamHosts = make(map[string]upstreamHost)
+	upstreamPreferred = make(map[string]upstreamPath)
+	upstreamMutex.Unlock()
+}
+
+func TestRaceExchange(t *testing.T) {
+	defer resetEyeballs()
+	slow, stopSlow := startDelayedUpstream(t, "10.0.0.1", time.Second, time.Second, false)
+	defer stopSlow()
+	fast, stopFast := startDelayedUpstream(t, "10.0.0.2", 0, 0, false)
+	defer stopFast()
+
+	// A host name with two addresses, the slow one first
+	resolver := "upstream.test:53"
+	upstreamHosts[resolver] = upstreamHost{addrs: []string{slow, fast}, expires: time.Now().Add(time.Minute)}
+	send := func(req *dns.Msg, path upstreamPath) (*dns.Msg, error) {
+		return exchange(req, path.transport, path.addr)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	paths := []upstreamPath{{"udp", slow}, {"udp", fast}}
+	start := time.Now()
+	resp, err := raceExchange(req, resolver, paths, send)
+	if err != nil || answeredBy(resp) != "10.0.0.2" {
+		t.Fatalf("Expected the faster address to answer, got %v, %v", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed < HAPPY_EYEBALLS_DELAY || elapsed >= time.Second {
+		t.Fatalf("Expected the second address to be tried after %v, took %v", HAPPY_EYEBALLS_DELAY, elapsed)
+	}
+	if preferred := upstreamPreferred[resolver]; preferred != (upstreamPath{"udp", fast}) {
+		t.Fatalf("Expected the faster address to be learned, got %v", preferred)
+	}
+	if addrs := upstreamAddrs(resolver); len(addrs) != 2 || addrs[0] != fast || addrs[1] != slow {
+		t.Fatalf("Expected the preferred address first, got %v", addrs)
+	}
+
+	// A path that fails right away doesn't hold up the next one
+	closed, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := closed.Addr().String()
+	closed.Close()
+	start = time.Now()
+	resp, err = raceExchange(req, resolver, []upstreamPath{{"tcp", refused}, {"udp", fast}}, send)
+	if err != nil || answeredBy(resp) != "10.0.0.2" {
+		t.Fatalf("Expected the fallback to answer, got %v, %v", resp, err)
+	}
+	if elapsed := time.Since(start); elapsed >= HAPPY_EYEBALLS_DELAY {
+		t.Fatalf("Expected the fallback to be tried once the first path failed, took %v", elapsed)
+	}
+
+	// With every path failing, the error is returned
+	if _, err := raceExchange(req, resolver, []upstreamPath{{"tcp", refused}, {"tcp", refused}}, send); err == nil {
+		t.Fatalf("Expected an error with no path answering")
+	}
+}
+
+func TestRaceTransports(t *testing.T) {
+	defer resetEyeballs()
+	// Queries over UDP are lost for longer than TCP takes
+	addr, stop := startDelayedUpstream(t, "10.0.0.3", time.Second, 0, false)
+	defer stop()
+
+	if paths := upstreamPaths(addr, "udp"); len(paths) != 2 || paths[0] != (upstreamPath{"udp", addr}) || paths[1] != (upstreamPath{"tcp", addr}) {
+		t.Fatalf("Expected UDP then TCP, got %v", paths)
+	}
+	if paths := upstreamPaths(addr, TRANSPORT_TLS); len(paths) != 1 {
+		t.Fatalf("Expected no transport race for DNS over TLS, got %v", paths)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp, err := resolveTransport(req, "udp", addr)
+	if err != nil || answeredBy(resp) != "10.0.0.3" {
+		t.Fatalf("Expected the TCP answer, got %v, %v", resp, err)
+	}
+	if preferred := upstreamPreferred[addr]; preferred.transport != "tcp" {
+		t.Fatalf("Expected TCP to be learned, got %v", preferred)
+	}
+	if paths := upstreamPaths(addr, "udp"); len(paths) != 2 || paths[0].transport != "tcp" {
+		t.Fatalf("Expected TCP first once it won, got %v", paths)
+	}
+
+	// A truncated answer over UDP leaves the race to TCP
+	truncating, stopTruncating := startDelayedUpstream(t, "10.0.0.4", 0, 50*time.Millisecond, true)
+	defer stopTruncating()
+	resp, err = resolveTransport(req, "udp", truncating)
+	if err != nil || resp.Truncated || answeredBy(resp) != "10.0.0.4" {
+		t.Fatalf("Expected the whole answer over TCP, got %v, %v", resp, err)
+	}
+	if preferred := upstreamPreferred[truncating]; preferred.transport != "tcp" {
+		t.Fatalf("Expected the truncated answer not to win, got %v", preferred)
+	}
+}
@@ -16,6 +16,19 @@ const (
 	OLD_RANCHER_DOMAIN = "rancher.internal"
 )
 
+// What is done with the records of containers that are running but not healthy (initializing or
+// unhealthy) for --unhealthy-records
+const (
+	// Left out of service records unless none of the service's containers is healthy
+	UNHEALTHY_FALLBACK = "fallback"
+	// Published like healthy ones
+	UNHEALTHY_PUBLISH = "publish"
+	// Not published at all, not even under the container's own names
+	UNHEALTHY_HOLD = "hold"
+	// Published with --unhealthy-ttl, so clients come back soon for the healthy set
+	UNHEALTHY_LOW_TTL = "low-ttl"
+)
+
 var (
 	fallbackRecurse = []string{"8.8.8.8", "8.8.4.4"}
 )
@@ -134,6 +147,9 @@ func (c *ConfigGenerator) GenerateAnswers() (Answers, error) {
 			Recurse:       recurse,
 			Authoritative: []string{},
 		}
+		if *sameHostFirst {
+			a.Host = container.HostUUID
+		}
 		answers[uuid[:12]] = a
 		if container.PrimaryIp != "" {
 			answers[container.PrimaryIp] = a
@@ -153,17 +169,32 @@ func (c *ConfigGenerator) GenerateAnswers() (Answers, error) {
 		Recurse:       globalRecurse,
 		Authoritative: []string{getDefaultRancherNamespace()},
 	}
+	if *sameHostFirst {
+		a.Hosts = containerHosts(clientUuidToContainer)
+	}
 	answers["default"] = a
 
 	return answers, nil
 }
 
+// The hosts of the containers' addresses, for --same-host-first. The clients are the containers of
+// this host, so only their addresses are near any client.
+func containerHosts(containers map[string]metadata.Container) map[string]string {
+	hosts := make(map[string]string)
+	for _, container := range containers {
+		if container.PrimaryIp != "" && container.HostUUID != "" {
+			hosts[container.PrimaryIp] = container.HostUUID
+		}
+	}
+	return hosts
+}
+
 func invalidRecurse(dns string) bool {
 	result := false
 	for _, neverRecurseTo := range splitTrim(*neverRecurseTo, ",") {
 		result = result || dns == neverRecurseTo
 	}
-	return result || strings.HasPrefix(dns, "127.")
+	return result || strings.HasPrefix(dns, "127.") || dns == "::1"
 }
 
 func (c *ConfigGenerator) GetRecords() (map[string]RecordA, map[string]RecordCname, map[string]map[string]string, map[string]map[string]string, map[string]metadata.Container, map[string]metadata.Service, error) {
@@ -214,14 +245,11 @@ func (c *ConfigGenerator) GetRecords() (map[string]RecordA, map[string]RecordCna
 				cRecs[getServiceFqdn(&svc)] = cnameRec
 				continue
 			}
+			notReady := rec.IsRunning && !rec.IsHealthy
 			add := false
-			if rec.IsHealthy {
-				if rec.Container != nil {
-				}
+			if rec.IsHealthy || (notReady && (*unhealthyRecords == UNHEALTHY_PUBLISH || *unhealthyRecords == UNHEALTHY_LOW_TTL)) {
 				add = true
-			} else {
-				if rec.Container != nil {
-				}
+			} else if !notReady || *unhealthyRecords != UNHEALTHY_HOLD {
 				if i == len(records)-1 {
 					if existing, ok := aRecs[getServiceFqdn(&svc)]; ok {
 						if len(existing.Answer) == 0 {
@@ -236,19 +264,26 @@ func (c *ConfigGenerator) GetRecords() (map[string]RecordA, map[string]RecordCna
 				aRec := RecordA{
 					Answer: []string{rec.IP},
 				}
+				if notReady && *unhealthyRecords == UNHEALTHY_LOW_TTL {
+					aRec.Ttl = unhealthyTtl()
+				}
 				if existing, ok := aRecs[getServiceFqdn(&svc)]; ok {
 					aRec.Answer = append(aRec.Answer, existing.Answer...)
+					if existing.Ttl != nil {
+						aRec.Ttl = existing.Ttl
+					}
 				}
 				//add to the service record
 				aRecs[getServiceFqdn(&svc)] = aRec
 			}
 
 			if rec.Container != nil && rec.Container.PrimaryIp != "" {
-				aRec := RecordA{
-					Answer: []string{rec.Container.PrimaryIp},
-				}
+				aRec := containerRecord(rec.Container, &svc, rec.Container.PrimaryIp)
 				//add to container record
-				aRecs[getContainerFqdn(rec.Container, &svc)] = aRec
+				if aRec != nil {
+					aRecs[getContainerFqdn(rec.Container, &svc)] = *aRec
+					aRecs[getContainerServiceFqdn(rec.Container, &svc)] = *aRec
+				}
 				//client section only for the containers running on the same host
 				if rec.Container.HostUUID == host.UUID {
 					clientUuidToContainer[rec.Container.UUID] = (*rec.Container)
@@ -276,14 +311,16 @@ func (c *ConfigGenerator) GetRecords() (map[string]RecordA, map[string]RecordCna
 
 	for _, c := range cWithIps {
 		primaryIP := containerUUIDToContainerIP[c.UUID]
-		aRec := RecordA{
-			Answer: []string{primaryIP},
-		}
 		var svc metadata.Service
 		if c.ServiceUUID != "" {
 			svc = svcUUIDToSvc[c.ServiceUUID]
 		}
-		aRecs[getContainerFqdn(&c, &svc)] = aRec
+		if aRec := containerRecord(&c, &svc, primaryIP); aRec != nil {
+			aRecs[getContainerFqdn(&c, &svc)] = *aRec
+			if svc.Name != "" {
+				aRecs[getContainerServiceFqdn(&c, &svc)] = *aRec
+			}
+		}
 
 		//client section only for the containers running on the same host
 		if c.HostUUID == host.UUID && c.PrimaryIp != "" {
@@ -384,6 +421,16 @@ func getContainerFqdn(c *metadata.Container, s *metadata.Service) string {
 	return strings.ToLower(fmt.Sprintf("%s.%s.%s.%s.", c.Name, c.StackName, c.EnvironmentName, getDefaultRancherNamespace()))
 }
 
+// The container's name under its service, e.g. web-1.web.stack.env.discover.internal. Together with
+// the stack and environment search domains of each client, this makes "web-1.web" resolve for the
+// containers of the same stack and "web-1.web.stack" for the ones of the same environment.
+func getContainerServiceFqdn(c *metadata.Container, s *metadata.Service) string {
+	if strings.EqualFold(s.Kind, "kubernetesService") {
+		return getContainerFqdn(c, s)
+	}
+	return strings.ToLower(fmt.Sprintf("%s.%s", c.Name, getServiceFqdn(s)))
+}
+
 func (c *ConfigGenerator) getServiceEndpoints(svc *metadata.Service, uuidToPrimaryIp map[string]string, svcUUIDToSvc map[string]metadata.Service) ([]*Record, error) {
 	var records []*Record
 	var err error
@@ -415,8 +462,8 @@ func (c *ConfigGenerator) getRegularServiceEndpoints(svc *metadata.Service, uuid
 
 	//get containers if not vip
 	for i, c := range svc.Containers {
-		isRunning := strings.EqualFold(c.State, "running") || strings.EqualFold(c.State, "starting")
-		isHealthy := (strings.EqualFold(c.HealthState, "") && svc.HealthCheck.Port == 0) || strings.EqualFold(c.HealthState, "healthy") || strings.EqualFold(c.HealthState, "updating-healthy")
+		isRunning := containerRunning(&c)
+		isHealthy := containerHealthy(&c, svc)
 		primaryIP := c.PrimaryIp
 		if primaryIP == "" && c.NetworkFromContainerUUID != "" {
 			primaryIP = uuidToPrimaryIp[c.NetworkFromContainerUUID]
@@ -425,6 +472,7 @@ func (c *ConfigGenerator) getRegularServiceEndpoints(svc *metadata.Service, uuid
 			rec := &Record{
 				IP:        primaryIP,
 				IsHealthy: isHealthy && isRunning,
+				IsRunning: isRunning,
 				IsCname:   false,
 				Container: &svc.Containers[i],
 			}
@@ -434,6 +482,33 @@ func (c *ConfigGenerator) getRegularServiceEndpoints(svc *metadata.Service, uuid
 	return recs
 }
 
+func containerRunning(c *metadata.Container) bool {
+	return strings.EqualFold(c.State, "running") || strings.EqualFold(c.State, "starting")
+}
+
+func containerHealthy(c *metadata.Container, svc *metadata.Service) bool {
+	return (strings.EqualFold(c.HealthState, "") && svc.HealthCheck.Port == 0) || strings.EqualFold(c.HealthState, "healthy") || strings.EqualFold(c.HealthState, "updating-healthy")
+}
+
+// The record for the container's own names, nil when --unhealthy-records holds it back
+func containerRecord(c *metadata.Container, svc *metadata.Service, ip string) *RecordA {
+	rec := &RecordA{Answer: []string{ip}}
+	if containerRunning(c) && !containerHealthy(c, svc) {
+		switch *unhealthyRecords {
+		case UNHEALTHY_HOLD:
+			return nil
+		case UNHEALTHY_LOW_TTL:
+			rec.Ttl = unhealthyTtl()
+		}
+	}
+	return rec
+}
+
+func unhealthyTtl() *uint32 {
+	ttl := uint32(*unhealthyTtlSeconds)
+	return &ttl
+}
+
 func (c *ConfigGenerator) getExternalServiceEndpoints(svc *metadata.Service) []*Record {
 	var recs []*Record
 	for _, e := range svc.ExternalIps {
@@ -477,6 +552,8 @@ func (c *ConfigGenerator) getAliasServiceEndpoints(svc *metadata.Service, uuidTo
 type Record struct {
 	IP        string
 	IsHealthy bool
+	// Set for containers that are running, healthy or not
+	IsRunning bool
 	IsCname   bool
 	Container *metadata.Container
 }
@@ -49,6 +49,26 @@ func TestRegular(t *testing.T) {
 	}
 }
 
+func TestContainerUnderService(t *testing.T) {
+	answers, err := c.GenerateAnswers()
+	if err != nil {
+		t.Fatalf("Error generating answers %v", err)
+	}
+
+	a := getRecordAFromDefault(answers, "regular_container.regularsvc.foo.default.discover.internal.")
+	if len(a.Answer) != 1 {
+		t.Fatalf("Incorrect number of answers for container under its service [%v]", a.Answer)
+	}
+	if a.Answer[0] != "192.168.1.1" {
+		t.Fatalf("Incorrect answer for container under its service [%v]", a.Answer[0])
+	}
+
+	a = getRecordAFromDefault(answers, "sidekick.sidekick.primary.foo.default.discover.internal.")
+	if len(a.Answer) != 1 {
+		t.Fatalf("Incorrect number of answers for container under its sidekick service [%v]", a.Answer)
+	}
+}
+
 func TestStoppedContainer(t *testing.T) {
 	answers, err := c.GenerateAnswers()
 	if err != nil {
@@ -89,6 +109,35 @@ func TestOneUnhealthyContainer(t *testing.T) {
 	}
 }
 
+func TestUnhealthyRecords(t *testing.T) {
+	saved := *unhealthyRecords
+	defer func() { *unhealthyRecords = saved }()
+
+	cases := []struct {
+		mode    string
+		answers int
+		ttl     uint32
+	}{
+		{UNHEALTHY_PUBLISH, 2, 0},
+		{UNHEALTHY_HOLD, 1, 0},
+		{UNHEALTHY_LOW_TTL, 2, 5},
+	}
+	for _, tc := range cases {
+		*unhealthyRecords = tc.mode
+		answers, err := c.GenerateAnswers()
+		if err != nil {
+			t.Fatalf("Error generating answers %v", err)
+		}
+		a := getRecordAFromDefault(answers, "unhealthysvc.foo.default.discover.internal.")
+		if len(a.Answer) != tc.answers {
+			t.Fatalf("Incorrect number of answers with %s [%v]", tc.mode, a.Answer)
+		}
+		if (tc.ttl == 0 && a.Ttl != nil) || (tc.ttl != 0 && (a.Ttl == nil || *a.Ttl != tc.ttl)) {
+			t.Fatalf("Incorrect TTL with %s [%v]", tc.mode, a.Ttl)
+		}
+	}
+}
+
 func TestNoHealthStateWithHealthcheck(t *testing.T) {
 	answers, err := c.GenerateAnswers()
 	if err != nil {
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	HEALTH_CHECK_TCP  = "tcp"
+	HEALTH_CHECK_HTTP = "http"
+
+	// Defaults (in seconds) of checks without an interval or timeout
+	HEALTH_CHECK_INTERVAL = 10
+	HEALTH_CHECK_TIMEOUT  = 2
+)
+
+// Health checks, read from the "check" of an "a" entry, e.g. {"type": "http", "port": 8080, "path":
+// "/healthz"}: every address of the record is checked every interval by connecting to the port (tcp)
+// or by a GET of the path that has to succeed with a 2xx or 3xx status (http). Addresses failing their
+// last check are left out of the answers, unless all of the record's are, in which case all are
+// answered rather than none. Addresses that haven't been checked yet count as healthy.
+type healthChecker struct {
+	sync.RWMutex
+	targets map[string]*healthTarget
+	// Nothing is checked and every address counts as healthy, as when replaying queries
+	disabled bool
+}
+
+type healthTarget struct {
+	check   HealthCheck
+	address string
+	healthy bool
+	stop    chan bool
+}
+
+var healthChecks = &healthChecker{targets: make(map[string]*healthTarget)}
+
+func (check *HealthCheck) Validate(name string) error {
+	switch strings.ToLower(check.Type) {
+	case HEALTH_CHECK_TCP, HEALTH_CHECK_HTTP:
+	default:
+		return fmt.Errorf("invalid health check type for %s: %s, expected %s or %s", name, check.Type, HEALTH_CHECK_TCP, HEALTH_CHECK_HTTP)
+	}
+	if check.Port == 0 {
+		return fmt.Errorf("health check of %s without a port", name)
+	}
+	if check.Timeout > 0 && check.Interval > 0 && check.Timeout > check.Interval {
+		return fmt.Errorf("health check timeout of %s longer than its interval", name)
+	}
+	return nil
+}
+
+func (check *HealthCheck) interval() time.Duration {
+	if check.Interval == 0 {
+		return HEALTH_CHECK_INTERVAL * time.Second
+	}
+	return time.Duration(check.Interval) * time.Second
+}
+
+func (check *HealthCheck) timeout() time.Duration {
+	if check.Timeout == 0 {
+		return HEALTH_CHECK_TIMEOUT * time.Second
+	}
+	return time.Duration(check.Timeout) * time.Second
+}
+
+// Checks are shared by the records checking an address the same way
+func healthTargetKey(check HealthCheck, address string) string {
+	return fmt.Sprintf("%s %s %d %s %d %d", strings.ToLower(check.Type), address, check.Port, check.Path, check.Interval, check.Timeout)
+}
+
+// Checks the addresses of the records with a health check, stopping the checks no record asks for
+// anymore and keeping the state of those still asked for
+func (c *healthChecker) SetRecords(answers Answers) {
+	if c.disabled {
+		return
+	}
+	wanted := make(map[string]*healthTarget)
+	for _, client := range answers {
+		for _, rec := range client.A {
+			if rec.Check == nil {
+				continue
+			}
+			for _, address := range rec.Answer {
+				if ip := net.ParseIP(address); ip != nil {
+					wanted[healthTargetKey(*rec.Check, ip.String())] = &healthTarget{check: *rec.Check, address: ip.String(), healthy: true}
+				}
+			}
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for key, target := range c.targets {
+		if _, ok := wanted[key]; !ok {
+			close(target.stop)
+			delete(c.targets, key)
+		}
+	}
+	for key, target := range wanted {
+		if _, ok := c.targets[key]; !ok {
+			target.stop = make(chan bool)
+			c.targets[key] = target
+			go c.run(target)
+		}
+	}
+}
+
+func (c *healthChecker) run(target *healthTarget) {
+	ticker := time.NewTicker(target.check.interval())
+	defer ticker.Stop()
+	for {
+		err := target.check.probe(target.address)
+		c.Lock()
+		changed := target.healthy != (err == nil)
+		target.healthy = err == nil
+		c.Unlock()
+		if changed {
+			fields := log.Fields{"address": target.address, "type": target.check.Type, "port": target.check.Port}
+			if err != nil {
+				stats.incr("healthCheckFailures")
+				log.WithFields(fields).Warnf("Address failed its health check, withholding it: %v", err)
+			} else {
+				log.WithFields(fields).Info("Address passed its health check again")
+			}
+			// Responses cached for the clients may hold the address (or lack it)
+			clearClientSpecificCaches()
+		}
+
+		select {
+		case <-target.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (check *HealthCheck) probe(address string) error {
+	hostPort := net.JoinHostPort(address, strconv.Itoa(int(check.Port)))
+	if strings.ToLower(check.Type) == HEALTH_CHECK_TCP {
+		conn, err := net.DialTimeout("tcp", hostPort, check.timeout())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	path := check.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	client := &http.Client{Timeout: check.timeout()}
+	resp, err := client.Get("http://" + hostPort + path)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Whether the address passed its last check
+func (c *healthChecker) Healthy(check HealthCheck, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return true
+	}
+	c.RLock()
+	defer c.RUnlock()
+	target, ok := c.targets[healthTargetKey(check, ip.String())]
+	return !ok || target.healthy
+}
+
+// The addresses of the family (IPv4 or not) of the record to answer with: those that passed their
+// health check, or all of them when none did
+func (rec *RecordA) healthyAnswer(ipv4 bool) []string {
+	if rec.Check == nil {
+		return rec.Answer
+	}
+	var family, healthy []string
+	for _, address := range rec.Answer {
+		if ip := net.ParseIP(address); ip == nil || (ip.To4() != nil) != ipv4 {
+			continue
+		}
+		family = append(family, address)
+		if healthChecks.Healthy(*rec.Check, address) {
+			healthy = append(healthy, address)
+		}
+	}
+	if len(healthy) == 0 {
+		return family
+	}
+	return healthy
+}
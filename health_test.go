@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHealthCheckedAnswers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/healthz" {
+			http.NotFound(w, req)
+		}
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	_, portString, _ := net.SplitHostPort(u.Host)
+	port, _ := strconv.Atoi(portString)
+
+	// Only 127.0.0.1 listens on the port
+	check := &HealthCheck{Type: HEALTH_CHECK_HTTP, Port: uint16(port), Path: "/healthz", Interval: 1, Timeout: 1}
+	answers := Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{
+		"web.checked.": {Answer: []string{"127.0.0.1", "127.0.0.2", "fd00::1"}, Check: check},
+	}}}
+	healthChecks.SetRecords(answers)
+	defer healthChecks.SetRecords(Answers{})
+
+	deadline := time.Now().Add(3 * time.Second)
+	for healthChecks.Healthy(*check, "127.0.0.2") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	records, ok := answers.MatchingExact(dns.TypeA, DEFAULT_KEY, "web.checked.", "web.checked.")
+	if !ok || len(records) != 1 || records[0].(*dns.A).A.String() != "127.0.0.1" {
+		t.Fatalf("Expected the failing address to be withheld, got %v", records)
+	}
+	// When every address of the family fails, all of them are answered
+	if records, ok := answers.MatchingExact(dns.TypeAAAA, DEFAULT_KEY, "web.checked.", "web.checked."); !ok || len(records) != 1 {
+		t.Fatalf("Expected the failing IPv6 address to be answered, got %v", records)
+	}
+
+	// Another check of the record starts from scratch
+	other := *check
+	other.Path = "/missing"
+	rec := answers[DEFAULT_KEY].A["web.checked."]
+	rec.Check = &other
+	answers[DEFAULT_KEY].A["web.checked."] = rec
+	healthChecks.SetRecords(answers)
+	for healthChecks.Healthy(other, "127.0.0.1") && time.Now().Before(deadline.Add(3*time.Second)) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if records, ok := answers.MatchingExact(dns.TypeA, DEFAULT_KEY, "web.checked.", "web.checked."); !ok || len(records) != 2 {
+		t.Fatalf("Expected both addresses when both fail, got %v", records)
+	}
+
+	for _, invalid := range []HealthCheck{{Type: "icmp", Port: 80}, {Type: HEALTH_CHECK_TCP}, {Type: HEALTH_CHECK_TCP, Port: 80, Interval: 1, Timeout: 5}} {
+		if err := invalid.Validate("web.checked."); err == nil {
+			t.Fatalf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
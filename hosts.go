@@ -0,0 +1,62 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// With --same-host-first, the addresses of a name on the host of the querying client come first, so
+// multi-host services are reached without crossing the overlay network when a backend runs next to the
+// client. The "hosts" of the default entry map addresses to the host they live on and the "host" of a
+// client's entry names the client's own; in metadata mode both are generated from where containers run.
+// Addresses keep the order they'd have otherwise within the same-host ones and within the rest.
+
+func (answers *Answers) addressHosts() map[string]string {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.Hosts
+}
+
+// The host of the client with the key, if known
+func (answers *Answers) clientHost(clientKey string) string {
+	if client, ok := (*answers)[clientKey]; ok {
+		return client.Host
+	}
+	return ""
+}
+
+// Moves the addresses on the client's host in front of the others
+func (answers *Answers) sameHostFirst(query *QueryContext, records []dns.RR) {
+	host := answers.clientHost(query.ClientKey)
+	hosts := answers.addressHosts()
+	if host == "" || len(hosts) == 0 {
+		return
+	}
+
+	var near, far []dns.RR
+	start := -1
+	for i, record := range records {
+		var address string
+		switch record := record.(type) {
+		case *dns.A:
+			address = record.A.String()
+		case *dns.AAAA:
+			address = record.AAAA.String()
+		default:
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		if hosts[address] == host {
+			near = append(near, record)
+		} else {
+			far = append(far, record)
+		}
+	}
+	if len(near) == 0 || len(far) == 0 {
+		return
+	}
+	copy(records[start:], append(near, far...))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func TestSameHostFirst(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	savedSameHost, savedOrder := *sameHostFirst, *rrsetOrder
+	defer func() {
+		answers, environmentAnswers = saved, savedEnvironments
+		*sameHostFirst, *rrsetOrder = savedSameHost, savedOrder
+	}()
+	*sameHostFirst = true
+	*rrsetOrder = RRSET_ORDER_FIXED
+	answers = Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.": {Answer: []string{"10.0.1.1", "10.0.2.1", "10.0.1.2", "10.0.2.2"}},
+			},
+			Hosts: map[string]string{"10.0.1.1": "host-1", "10.0.1.2": "host-1", "10.0.2.1": "host-2", "10.0.2.2": "host-2"},
+		},
+		"10.0.2.9": ClientAnswers{Host: "host-2"},
+		"10.0.3.9": ClientAnswers{Host: "host-3"},
+	}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	for _, test := range []struct {
+		client   string
+		expected []string
+	}{
+		{"10.0.2.9", []string{"10.0.2.1", "10.0.2.2", "10.0.1.1", "10.0.1.2"}},
+		{"10.0.3.9", []string{"10.0.1.1", "10.0.2.1", "10.0.1.2", "10.0.2.2"}},
+		{"10.0.4.9", []string{"10.0.1.1", "10.0.2.1", "10.0.1.2", "10.0.2.2"}},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion("web.", dns.TypeA)
+		w := &testWriter{}
+		route(&queryWriter{ResponseWriter: w, client: test.client}, req)
+		if w.msg == nil || len(w.msg.Answer) != len(test.expected) {
+			t.Fatalf("Expected %v for %s, got %v", test.expected, test.client, w.msg)
+		}
+		for i, rr := range w.msg.Answer {
+			if got := rr.(*dns.A).A.String(); got != test.expected[i] {
+				t.Fatalf("Expected %v for %s, got %v", test.expected, test.client, w.msg.Answer)
+			}
+		}
+	}
+
+	hosts := containerHosts(map[string]metadata.Container{
+		"a": {PrimaryIp: "10.0.1.1", HostUUID: "host-1"},
+		"b": {PrimaryIp: "10.0.1.2"},
+	})
+	if len(hosts) != 1 || hosts["10.0.1.1"] != "host-1" {
+		t.Fatalf("Expected the hosts of the addresses, got %v", hosts)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Names of the CH-class TXT queries for the server's identity (RFC 4892) and version
+var (
+	identityNames = map[string]bool{"hostname.bind.": true, "id.server.": true}
+	versionNames  = map[string]bool{"version.bind.": true, "version.server.": true}
+)
+
+// The identity of the server, read from the "identity" stanza of the default entry. Without one,
+// SOA records name the zone itself as the primary server and mailbox, NSID isn't answered and CH-class
+// queries get NOTIMP like any other non-IN query.
+func (answers *Answers) Identity() *Identity {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.Identity
+}
+
+// The identity of the server answering from the answers: that of the environment or server block, or
+// the top-level one
+func identityFor(served Answers) *Identity {
+	if identity := served.Identity(); identity != nil {
+		return identity
+	}
+	return answers.Identity()
+}
+
+func (identity *Identity) Validate() error {
+	if identity.Hostname != "" {
+		if _, ok := dns.IsDomainName(identity.Hostname); !ok {
+			return fmt.Errorf("invalid identity hostname: %s", identity.Hostname)
+		}
+	}
+	if identity.Mbox != "" {
+		if !validMbox(identity.Mbox) {
+			return fmt.Errorf("invalid identity mbox: %s", identity.Mbox)
+		}
+	}
+	return nil
+}
+
+func (identity *Identity) mbox() string {
+	return mboxName(identity.Mbox)
+}
+
+// The mailbox as a domain name: "hostmaster@example.com" is "hostmaster.example.com."
+func mboxName(mbox string) string {
+	return dns.Fqdn(strings.Replace(mbox, "@", ".", 1))
+}
+
+func validMbox(mbox string) bool {
+	_, ok := dns.IsDomainName(mboxName(mbox))
+	return ok && strings.Count(mbox, "@") <= 1
+}
+
+// The NSID (RFC 5001) to send, the hostname unless one is configured
+func (identity *Identity) nsid() string {
+	if identity.Nsid != "" {
+		return identity.Nsid
+	}
+	return strings.TrimSuffix(identity.Hostname, ".")
+}
+
+// The SOA of a zone we are authoritative for
+func soaRecord(identity *Identity, zone string, serial uint32) *dns.SOA {
+	hdr := dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(*defaultTtl)}
+	record := &dns.SOA{Hdr: hdr, Ns: zone, Mbox: zone, Serial: serial, Refresh: DEFAULT_SOA_REFRESH, Retry: DEFAULT_SOA_RETRY, Expire: DEFAULT_SOA_EXPIRE, Minttl: DEFAULT_SOA_MINTTL}
+	if identity != nil && identity.Hostname != "" {
+		record.Ns = dns.Fqdn(identity.Hostname)
+	}
+	if identity != nil && identity.Mbox != "" {
+		record.Mbox = identity.mbox()
+	}
+	return record
+}
+
+// Has the NSID sent in the response when the query asks for it
+func requestNsid(w dns.ResponseWriter, req *dns.Msg, identity *Identity) {
+	qw, ok := w.(*queryWriter)
+	o := req.IsEdns0()
+	if !ok || o == nil || identity == nil || identity.nsid() == "" {
+		return
+	}
+	for _, option := range o.Option {
+		if option.Option() == dns.EDNS0NSID {
+			qw.nsid = identity.nsid()
+		}
+	}
+}
+
+func addNsid(m *dns.Msg, nsid string) {
+	addEdnsOption(m, &dns.EDNS0_NSID{Code: dns.EDNS0NSID, Nsid: hex.EncodeToString([]byte(nsid))})
+}
+
+// Answers CH-class queries for the identity and version of the server. Reports whether a response
+// was sent; queries for other names are left to be refused like other non-IN queries.
+func answerIdentity(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg, identity *Identity) bool {
+	question := req.Question[0]
+	fqdn := strings.ToLower(question.Name)
+	if identity == nil || question.Qclass != dns.ClassCHAOS {
+		return false
+	}
+
+	var value string
+	switch {
+	case identityNames[fqdn]:
+		value = identity.nsid()
+	case versionNames[fqdn]:
+		value = identity.Version
+	default:
+		return false
+	}
+
+	m.Authoritative = true
+	m.RecursionAvailable = false
+	if value == "" {
+		m.Rcode = dns.RcodeRefused
+	} else if question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeANY {
+		hdr := dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0}
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: []string{value}})
+	}
+	trace(w, "path=identity")
+	Respond(w, req, m)
+	log.WithFields(log.Fields{"question": fqdn, "type": dns.Type(question.Qtype).String()}).Debug("Answered identity query")
+	return true
+}
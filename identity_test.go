@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIdentity(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Authoritative: []string{"discover.internal."},
+		Identity:      &Identity{Hostname: "ns1.example.com", Mbox: "hostmaster@example.com", Version: "rancher-dns"},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	query := func(name string, qtype, qclass uint16, nsid bool) (*dns.Msg, *testWriter) {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.Question[0].Qclass = qclass
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		if nsid {
+			o := req.IsEdns0()
+			o.Option = append(o.Option, &dns.EDNS0_NSID{Code: dns.EDNS0NSID})
+		}
+		w := &testWriter{}
+		route(&queryWriter{ResponseWriter: w, edns: true}, req)
+		if w.msg == nil {
+			t.Fatalf("Expected a response for %s", name)
+		}
+		return req, w
+	}
+
+	// The SOA of an authoritative zone names the configured server and mailbox
+	_, w := query("missing.discover.internal.", dns.TypeA, dns.ClassINET, true)
+	if len(w.msg.Ns) != 1 {
+		t.Fatalf("Expected an SOA, got %v", w.msg)
+	}
+	if soa := w.msg.Ns[0].(*dns.SOA); soa.Ns != "ns1.example.com." || soa.Mbox != "hostmaster.example.com." {
+		t.Fatalf("Expected the configured identity in the SOA, got %v", soa)
+	}
+	var nsid string
+	for _, option := range w.msg.IsEdns0().Option {
+		if option, ok := option.(*dns.EDNS0_NSID); ok {
+			nsid = option.Nsid
+		}
+	}
+	if nsid != hex.EncodeToString([]byte("ns1.example.com")) {
+		t.Fatalf("Expected the hostname as NSID, got %q", nsid)
+	}
+
+	for _, test := range []struct {
+		name     string
+		expected string
+	}{
+		{"hostname.bind.", "ns1.example.com"},
+		{"ID.SERVER.", "ns1.example.com"},
+		{"version.bind.", "rancher-dns"},
+	} {
+		_, w := query(test.name, dns.TypeTXT, dns.ClassCHAOS, false)
+		if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.TXT).Txt[0] != test.expected {
+			t.Fatalf("Expected %q for %s, got %v", test.expected, test.name, w.msg)
+		}
+	}
+	if _, w := query("web.discover.internal.", dns.TypeTXT, dns.ClassCHAOS, false); w.msg.Rcode != dns.RcodeNotImplemented {
+		t.Fatalf("Expected other CH queries to be NOTIMP, got %v", w.msg)
+	}
+
+	// Without a version, version queries are refused
+	answers[DEFAULT_KEY].Identity.Version = ""
+	if _, w := query("version.server.", dns.TypeTXT, dns.ClassCHAOS, false); w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("Expected the version to be refused, got %v", w.msg)
+	}
+
+	for _, invalid := range []Identity{{Hostname: "ns1..example.com"}, {Mbox: "a@b@example.com"}} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Answer unknown instances with the records of their service (--unknown-instances)
+const UNKNOWN_INSTANCES_SERVICE = "service"
+
+// Instance names are those of their service with a number appended, e.g. "web-7" or "stack_web_7"
+var instanceLabel = regexp.MustCompile(`^.+[-_][0-9]+$`)
+
+func validateUnknownInstances(mode string) error {
+	if mode == "" || mode == UNKNOWN_INSTANCES_SERVICE {
+		return nil
+	}
+	for _, ip := range splitTrim(mode, ",") {
+		if parsed := net.ParseIP(ip); parsed == nil || parsed.To4() == nil {
+			return fmt.Errorf("expected %s or IPv4 addresses, got %s", UNKNOWN_INSTANCES_SERVICE, ip)
+		}
+	}
+	return nil
+}
+
+// Records for a name like web-7.web.stack.discover.internal. that doesn't exist while the service
+// web.stack.discover.internal. does, as happens for a little while after scaling down: the service's
+// records, or the catch-all addresses, depending on --unknown-instances. Named answerFqdn.
+func (answers *Answers) UnknownInstance(query *QueryContext, fqdn string, answerFqdn string) ([]dns.RR, bool) {
+	if *unknownInstances == "" {
+		return nil, false
+	}
+	labels := dns.SplitDomainName(fqdn)
+	if len(labels) < 2 || !instanceLabel.MatchString(labels[0]) {
+		return nil, false
+	}
+
+	service := strings.Join(labels[1:], ".") + "."
+	records, ok := answers.Addresses(dns.TypeA, query, service, answerFqdn, nil, 1)
+	if !ok || len(records) == 0 {
+		return nil, false
+	}
+	log.WithFields(log.Fields{"fqdn": fqdn, "service": service, "client": query.ClientKey}).Debug("Answered unknown instance")
+	if *unknownInstances == UNKNOWN_INSTANCES_SERVICE {
+		return records, true
+	}
+
+	var catchAll []dns.RR
+	for _, ip := range splitTrim(*unknownInstances, ",") {
+		hdr := dns.RR_Header{Name: answerFqdn, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: records[0].Header().Ttl}
+		catchAll = append(catchAll, &dns.A{Hdr: hdr, A: net.ParseIP(ip)})
+	}
+	return catchAll, true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUnknownInstance(t *testing.T) {
+	saved := *unknownInstances
+	defer func() { *unknownInstances = saved }()
+
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{
+				"web.stack.discover.internal.":       {Answer: []string{"10.42.0.1", "10.42.0.2"}},
+				"web-1.web.stack.discover.internal.": {Answer: []string{"10.42.0.1"}},
+			},
+		},
+	}
+	query := &QueryContext{ClientKey: DEFAULT_KEY}
+
+	*unknownInstances = ""
+	if _, ok := answers.UnknownInstance(query, "web-7.web.stack.discover.internal.", "web-7.web.stack.discover.internal."); ok {
+		t.Fatalf("Unknown instances should not be answered unless enabled")
+	}
+
+	*unknownInstances = UNKNOWN_INSTANCES_SERVICE
+	records, ok := answers.UnknownInstance(query, "web-7.web.stack.discover.internal.", "web-7.web.stack.discover.internal.")
+	if !ok || len(records) != 2 || records[0].Header().Name != "web-7.web.stack.discover.internal." {
+		t.Fatalf("Expected the service's records, got %v", records)
+	}
+	if _, ok := answers.UnknownInstance(query, "admin.web.stack.discover.internal.", "admin.web.stack.discover.internal."); ok {
+		t.Fatalf("Only names of instances should be answered")
+	}
+	if _, ok := answers.UnknownInstance(query, "db-2.db.stack.discover.internal.", "db-2.db.stack.discover.internal."); ok {
+		t.Fatalf("Instances of unknown services should not be answered")
+	}
+
+	*unknownInstances = "10.42.0.100"
+	records, ok = answers.UnknownInstance(query, "web_7.web.stack.discover.internal.", "web_7.web.stack.discover.internal.")
+	if !ok || len(records) != 1 || records[0].(*dns.A).A.String() != "10.42.0.100" {
+		t.Fatalf("Expected the catch-all address, got %v", records)
+	}
+
+	if validateUnknownInstances("service") != nil || validateUnknownInstances("10.0.0.1, 10.0.0.2") != nil || validateUnknownInstances("bogus") == nil {
+		t.Fatalf("Incorrect validation of --unknown-instances")
+	}
+}
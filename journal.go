@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Number of batches appended to the journal after which it is rewritten as a single batch
+const JOURNAL_COMPACT_AFTER = 1000
+
+// Append-only log of the record batches applied through the API (one JSON list of operations per
+// line), replayed at startup so runtime records survive a restart. Nil unless --journal is set.
+var journal *Journal
+
+type Journal struct {
+	sync.Mutex
+	path    string
+	file    *os.File
+	entries int
+}
+
+// Replays the journal at path into the dynamic records, compacts it and opens it for appending
+func openJournal(path string) (*Journal, error) {
+	replayed, batches, err := replayJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	dynamicRecords.Set(replayed)
+	log.WithFields(log.Fields{"journal": path, "batches": batches}).Info("Replayed record journal")
+
+	j := &Journal{path: path}
+	if err := j.compact(replayed); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+func replayJournal(path string) (Answers, int, error) {
+	replayed := make(Answers)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return replayed, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	batches := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var ops []RecordOp
+		if err := json.Unmarshal(scanner.Bytes(), &ops); err != nil {
+			// A torn last line from a crash mid-write; everything before it is intact
+			log.WithFields(log.Fields{"journal": path, "batch": batches + 1}).Warnf("Skipping unreadable journal entry: %v", err)
+			continue
+		}
+		for _, op := range ops {
+			if _, err := replayed.apply(op, SOURCE_DYNAMIC); err != nil {
+				log.WithFields(log.Fields{"journal": path, "batch": batches + 1}).Warnf("Skipping journal operation: %v", err)
+			}
+		}
+		batches++
+	}
+	return replayed, batches, scanner.Err()
+}
+
+// Appends an applied batch, synced to disk before the batch takes effect
+func (j *Journal) Append(ops []RecordOp) error {
+	j.Lock()
+	defer j.Unlock()
+	b, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	j.entries++
+	return nil
+}
+
+// Rewrites the journal once it has grown past JOURNAL_COMPACT_AFTER batches
+func (j *Journal) MaybeCompact(dynamic Answers) {
+	j.Lock()
+	entries := j.entries
+	j.Unlock()
+	if entries < JOURNAL_COMPACT_AFTER {
+		return
+	}
+	if err := j.compact(dynamic); err != nil {
+		log.WithFields(log.Fields{"journal": j.path}).Errorf("Failed to compact journal: %v", err)
+	}
+}
+
+// Replaces the journal with a single batch that recreates the dynamic records
+func (j *Journal) compact(dynamic Answers) error {
+	j.Lock()
+	defer j.Unlock()
+
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	entries := 0
+	if ops := dynamic.Ops(); len(ops) > 0 {
+		b, err := json.Marshal(ops)
+		if err == nil {
+			_, err = f.Write(append(b, '\n'))
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+		entries = 1
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, j.path); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("reopening %s: %v", j.path, err)
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	j.entries = entries
+	return nil
+}
+
+// Set operations that recreate every record of the answers, in a stable order
+func (answers *Answers) Ops() []RecordOp {
+	var ops []RecordOp
+	for key, client := range *answers {
+		for name, rec := range client.A {
+			ops = append(ops, RecordOp{Op: OP_SET, Client: key, Type: "A", Name: name, Answer: rec.Answer, Ttl: rec.Ttl, Comment: rec.Comment, Expires: rec.Expires})
+		}
+		for name, rec := range client.Cname {
+			ops = append(ops, RecordOp{Op: OP_SET, Client: key, Type: "CNAME", Name: name, Answer: []string{rec.Answer}, Ttl: rec.Ttl, Comment: rec.Comment, Expires: rec.Expires})
+		}
+		for name, rec := range client.Ptr {
+			ops = append(ops, RecordOp{Op: OP_SET, Client: key, Type: "PTR", Name: name, Answer: []string{rec.Answer}, Ttl: rec.Ttl, Comment: rec.Comment, Expires: rec.Expires})
+		}
+		for name, rec := range client.Txt {
+			ops = append(ops, RecordOp{Op: OP_SET, Client: key, Type: "TXT", Name: name, Answer: rec.Answer, Ttl: rec.Ttl, Comment: rec.Comment, Expires: rec.Expires})
+		}
+		for name, rec := range client.Srv {
+			ops = append(ops, RecordOp{Op: OP_SET, Client: key, Type: "SRV", Name: name, Answer: rec.Answer, Ttl: rec.Ttl, Comment: rec.Comment, Expires: rec.Expires})
+		}
+	}
+	sort.Sort(byOpClientName(ops))
+	return ops
+}
+
+type byOpClientName []RecordOp
+
+func (o byOpClientName) Len() int      { return len(o) }
+func (o byOpClientName) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o byOpClientName) Less(i, j int) bool {
+	if o[i].Client != o[j].Client {
+		return o[i].Client < o[j].Client
+	}
+	if o[i].Name != o[j].Name {
+		return o[i].Name < o[j].Name
+	}
+	return o[i].Type < o[j].Type
+}
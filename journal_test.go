@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJournalReplayAndCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "records.journal")
+
+	if err := setupSources(""); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { journal = nil }()
+	defer dynamicRecords.Set(make(Answers))
+
+	if journal, err = openJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	ApplyBatch([]RecordOp{{Op: OP_SET, Type: "A", Name: "web.", Answer: []string{"10.0.0.1"}, Comment: "OPS-1"}}, false)
+	ApplyBatch([]RecordOp{{Op: OP_SET, Type: "PTR", Name: "10.0.0.1", Answer: []string{"web."}}}, false)
+	ApplyBatch([]RecordOp{{Op: OP_SET, Type: "A", Name: "db.", Answer: []string{"10.0.0.2"}}}, false)
+	ApplyBatch([]RecordOp{{Op: OP_DELETE, Type: "A", Name: "db."}}, false)
+	// A torn write from a crash
+	journal.file.WriteString(`[{"op":"set","type":"A"`)
+	journal.file.Close()
+
+	dynamicRecords.Set(make(Answers))
+	if journal, err = openJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	client := dynamicRecords.Answers()[DEFAULT_KEY]
+	if rec := client.A["web."]; len(rec.Answer) != 1 || rec.Comment != "OPS-1" {
+		t.Fatalf("Expected web. to be replayed [%+v]", client)
+	}
+	if _, ok := client.A["db."]; ok {
+		t.Fatalf("Deleted record should not be replayed")
+	}
+	if rec := client.Ptr["1.0.0.10.in-addr.arpa."]; rec.Answer != "web." {
+		t.Fatalf("Expected the PTR record to be replayed [%+v]", client)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if lines := strings.Count(string(b), "\n"); lines != 1 {
+		t.Fatalf("Expected the journal to be compacted to one batch, got %d lines", lines)
+	}
+}
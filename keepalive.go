@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0 option code of edns-tcp-keepalive (RFC 7828)
+const EDNS0_TCP_KEEPALIVE = 11
+
+// How long a TCP connection may sit idle between queries before it's closed
+func tcpIdleTimeout() time.Duration {
+	return time.Duration(*tcpIdleTimeoutSeconds) * time.Second
+}
+
+// Reports whether the query carries the edns-tcp-keepalive option, and whether it's well-formed:
+// clients must send it without a TIMEOUT.
+func keepaliveRequested(req *dns.Msg) (requested bool, valid bool) {
+	o := req.IsEdns0()
+	if o == nil {
+		return false, true
+	}
+	for _, option := range o.Option {
+		if option.Option() != EDNS0_TCP_KEEPALIVE {
+			continue
+		}
+		if local, ok := option.(*dns.EDNS0_LOCAL); ok && len(local.Data) > 0 {
+			return true, false
+		}
+		return true, true
+	}
+	return false, true
+}
+
+// The option telling the client how long (in units of 100ms) the server keeps an idle connection open
+func keepaliveOption() *dns.EDNS0_LOCAL {
+	timeout := tcpIdleTimeout() / (100 * time.Millisecond)
+	if timeout > 0xffff {
+		timeout = 0xffff
+	}
+	data := make([]byte, 2)
+	binary.BigEndian.PutUint16(data, uint16(timeout))
+	return &dns.EDNS0_LOCAL{Code: EDNS0_TCP_KEEPALIVE, Data: data}
+}
+
+// Signals the idle timeout in the response, replacing a keepalive option a recurser might have sent
+func addKeepalive(m *dns.Msg) {
+	if o := m.IsEdns0(); o != nil {
+		options := o.Option[:0]
+		for _, option := range o.Option {
+			if option.Option() != EDNS0_TCP_KEEPALIVE {
+				options = append(options, option)
+			}
+		}
+		o.Option = options
+	}
+	addEdnsOption(m, keepaliveOption())
+}
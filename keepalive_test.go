@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestKeepalive(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("web.", dns.TypeA)
+	if requested, valid := keepaliveRequested(req); requested || !valid {
+		t.Fatalf("Query without EDNS0 doesn't ask for keepalive")
+	}
+
+	req.SetEdns0(4096, false)
+	o := req.IsEdns0()
+	o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: EDNS0_TCP_KEEPALIVE})
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Unpack(packed); err != nil {
+		t.Fatal(err)
+	}
+	if requested, valid := keepaliveRequested(req); !requested || !valid {
+		t.Fatalf("Expected a valid keepalive request [%v]", req)
+	}
+
+	req.IsEdns0().Option[0] = &dns.EDNS0_LOCAL{Code: EDNS0_TCP_KEEPALIVE, Data: []byte{0, 10}}
+	if _, valid := keepaliveRequested(req); valid {
+		t.Fatalf("Queries must not carry a TIMEOUT")
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.SetEdns0(4096, false)
+	m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_LOCAL{Code: EDNS0_TCP_KEEPALIVE, Data: []byte{0, 1}})
+	w := &queryWriter{ResponseWriter: &testWriter{}, keepalive: true}
+	w.WriteMsg(m)
+
+	options := w.msg.IsEdns0().Option
+	if len(w.msg.Extra) != 1 || len(options) != 1 {
+		t.Fatalf("Expected a single keepalive option [%v]", w.msg)
+	}
+	local, ok := options[0].(*dns.EDNS0_LOCAL)
+	if !ok || local.Code != EDNS0_TCP_KEEPALIVE || binary.BigEndian.Uint16(local.Data) != uint16(*tcpIdleTimeoutSeconds*10) {
+		t.Fatalf("Incorrect keepalive option %v", options[0])
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// A dynamic record set with a lease, as posted to --expiry-webhook once it expired
+type LeasedRecord struct {
+	Client  string    `json:"client"`
+	Type    string    `json:"type"`
+	Name    string    `json:"name"`
+	Answer  []string  `json:"answer"`
+	Comment string    `json:"comment,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// The dynamic records whose lease ran out by now
+func (answers *Answers) Expired(now time.Time) []LeasedRecord {
+	var expired []LeasedRecord
+	for _, rec := range answers.Leased() {
+		if !rec.Expires.After(now) {
+			expired = append(expired, rec)
+		}
+	}
+	return expired
+}
+
+// The records with a lease
+func (answers *Answers) Leased() []LeasedRecord {
+	var leased []LeasedRecord
+	add := func(key string, qtype string, name string, answer []string, comment string, expires int64) {
+		if expires > 0 {
+			leased = append(leased, LeasedRecord{key, qtype, name, answer, comment, time.Unix(expires, 0)})
+		}
+	}
+	for key, client := range *answers {
+		for name, rec := range client.A {
+			add(key, "A", name, rec.Answer, rec.Comment, rec.Expires)
+		}
+		for name, rec := range client.Cname {
+			add(key, "CNAME", name, []string{rec.Answer}, rec.Comment, rec.Expires)
+		}
+		for name, rec := range client.Ptr {
+			add(key, "PTR", name, []string{rec.Answer}, rec.Comment, rec.Expires)
+		}
+		for name, rec := range client.Txt {
+			add(key, "TXT", name, rec.Answer, rec.Comment, rec.Expires)
+		}
+		for name, rec := range client.Srv {
+			add(key, "SRV", name, rec.Answer, rec.Comment, rec.Expires)
+		}
+	}
+	return leased
+}
+
+// Removes the dynamic records whose lease ran out, like a batch of deletes sent to the API (so the
+// journal has them too), and returns them
+func expireDynamicRecords(now time.Time) []LeasedRecord {
+	batchMutex.Lock()
+	defer batchMutex.Unlock()
+
+	current := dynamicRecords.Answers()
+	expired := current.Expired(now)
+	if len(expired) == 0 {
+		return nil
+	}
+	var ops []RecordOp
+	for _, rec := range expired {
+		ops = append(ops, RecordOp{Op: OP_DELETE, Client: rec.Client, Type: rec.Type, Name: rec.Name})
+	}
+	planned, result := planBatch(ops)
+	if len(result.Errors) > 0 {
+		log.WithFields(log.Fields{"errors": result.Errors}).Error("Failed to remove expired dynamic records")
+		return nil
+	}
+	if journal != nil {
+		if err := journal.Append(ops); err != nil {
+			log.Errorf("Failed to journal the removal of expired dynamic records: %v", err)
+			return nil
+		}
+	}
+	dynamicRecords.Set(planned)
+	if journal != nil {
+		journal.MaybeCompact(planned)
+	}
+	return expired
+}
+
+// Starts sweeping the expired dynamic records, on the active instance only: a standby mirrors the
+// active's records, removals included, until it takes over
+func startLeaseSweeper() {
+	if *leaseSweepInterval == 0 {
+		return
+	}
+	go sweepDynamicRecords(time.Duration(*leaseSweepInterval)*time.Second, time.Duration(*leaseSummaryInterval)*time.Second, *expiryWebhook)
+}
+
+// Sweeps the expired dynamic records every interval, counting them as dynamicExpired in the stats and
+// posting each to the webhook if there is one. Every summary interval (if anything expired), logs how
+// many records expired since the last summary and how many leased records are left.
+func sweepDynamicRecords(interval time.Duration, summary time.Duration, webhook string) {
+	removed := 0
+	lastSummary := time.Now()
+	for now := range time.Tick(interval) {
+		for _, rec := range expireDynamicRecords(now) {
+			removed++
+			stats.incr("dynamicExpired")
+			log.WithFields(log.Fields{"client": rec.Client, "type": rec.Type, "name": rec.Name, "expires": rec.Expires.Format(time.RFC3339)}).Debug("Removed expired dynamic record")
+			if webhook != "" {
+				go notifyExpiry(webhook, rec)
+			}
+		}
+		if now.Sub(lastSummary) >= summary {
+			if removed > 0 {
+				log.WithFields(log.Fields{"expired": removed, "leased": len(leasedRecords()), "since": lastSummary.Format(time.RFC3339)}).Info("Removed expired dynamic records")
+			}
+			removed = 0
+			lastSummary = now
+		}
+	}
+}
+
+func leasedRecords() []LeasedRecord {
+	current := dynamicRecords.Answers()
+	return current.Leased()
+}
+
+func notifyExpiry(url string, rec LeasedRecord) {
+	body, err := json.Marshal(rec)
+	if err == nil {
+		var resp *http.Response
+		client := &http.Client{Timeout: 5 * time.Second}
+		if resp, err = client.Post(url, "application/json", bytes.NewReader(body)); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("unexpected status %s", resp.Status)
+			}
+		}
+	}
+	if err != nil {
+		stats.incr("dynamicExpiryWebhookErrors")
+		log.WithFields(log.Fields{"url": url, "name": rec.Name, "type": rec.Type}).Warnf("Failed to notify the expiry of a dynamic record: %v", err)
+	}
+}
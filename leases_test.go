@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExpireDynamicRecords(t *testing.T) {
+	if err := setupSources(""); err != nil {
+		t.Fatal(err)
+	}
+	dynamicRecords.Set(make(Answers))
+	defer dynamicRecords.Set(make(Answers))
+
+	result := ApplyBatch([]RecordOp{
+		{Op: OP_SET, Type: "A", Name: "leased", Answer: []string{"10.0.0.2"}, Lease: 60},
+		{Op: OP_SET, Type: "TXT", Name: "leased", Answer: []string{"v=1"}, Lease: 120},
+		{Op: OP_SET, Type: "A", Name: "kept", Answer: []string{"10.0.0.3"}},
+	}, false)
+	if !result.Applied {
+		t.Fatalf("Expected the batch to be applied [%+v]", result)
+	}
+	// The journal gets the time the lease runs out, not its length
+	if rec := answers[DEFAULT_KEY].A["leased."]; rec.Expires < time.Now().Add(59*time.Second).Unix() {
+		t.Fatalf("Expected the record to expire in a minute [%+v]", rec)
+	}
+	if ops := dynamicRecords.Answers(); len(ops.Ops()) != 3 || ops.Ops()[1].Expires == 0 {
+		t.Fatalf("Expected the leases to be kept by the journal's operations [%+v]", ops.Ops())
+	}
+
+	if expired := expireDynamicRecords(time.Now()); len(expired) != 0 {
+		t.Fatalf("Expected nothing to expire yet, got %+v", expired)
+	}
+	expired := expireDynamicRecords(time.Now().Add(90 * time.Second))
+	if len(expired) != 1 || expired[0].Type != "A" || expired[0].Name != "leased." {
+		t.Fatalf("Expected the A record to expire, got %+v", expired)
+	}
+	if _, ok := answers[DEFAULT_KEY].A["leased."]; ok {
+		t.Fatalf("Expected the expired record to be removed")
+	}
+	if _, ok := answers[DEFAULT_KEY].Txt["leased."]; !ok {
+		t.Fatalf("Expected the record with the longer lease to be kept")
+	}
+	if _, ok := answers[DEFAULT_KEY].A["kept."]; !ok {
+		t.Fatalf("Expected the record without a lease to be kept")
+	}
+
+	// Renewing a lease moves the expiry
+	ApplyBatch([]RecordOp{{Op: OP_SET, Type: "TXT", Name: "leased", Answer: []string{"v=1"}, Lease: 600}}, false)
+	if expired := expireDynamicRecords(time.Now().Add(150 * time.Second)); len(expired) != 0 {
+		t.Fatalf("Expected the renewed record to be kept, got %+v", expired)
+	}
+}
+
+func TestNotifyExpiry(t *testing.T) {
+	received := make(chan LeasedRecord, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var rec LeasedRecord
+		json.NewDecoder(req.Body).Decode(&rec)
+		received <- rec
+	}))
+	defer server.Close()
+
+	notifyExpiry(server.URL, LeasedRecord{Client: DEFAULT_KEY, Type: "A", Name: "leased.", Answer: []string{"10.0.0.2"}, Expires: time.Unix(1700000000, 0)})
+	select {
+	case rec := <-received:
+		if rec.Name != "leased." || rec.Type != "A" || rec.Expires.Unix() != 1700000000 {
+			t.Fatalf("Unexpected notification %+v", rec)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected a notification")
+	}
+}
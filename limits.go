@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// A recursive response that was refused for being larger than we are willing to relay or cache
+type upstreamLimitError struct {
+	limit string
+	value int
+	max   uint
+}
+
+func (e *upstreamLimitError) Error() string {
+	return fmt.Sprintf("recurser response exceeds %s limit (%d > %d)", e.limit, e.value, e.max)
+}
+
+// Checks a recursive response against --upstream-max-answers, --upstream-max-size and
+// --upstream-max-cname-chain, so a misbehaving or malicious upstream can't flood clients or fill
+// the cache with huge responses. A limit of 0 disables that check.
+func checkUpstreamLimits(req *dns.Msg, resp *dns.Msg) error {
+	if *upstreamMaxAnswers > 0 && uint(len(resp.Answer)) > *upstreamMaxAnswers {
+		return &upstreamLimitError{"answer records", len(resp.Answer), *upstreamMaxAnswers}
+	}
+	if *upstreamMaxSize > 0 {
+		if size := resp.Len(); uint(size) > *upstreamMaxSize {
+			return &upstreamLimitError{"message size", size, *upstreamMaxSize}
+		}
+	}
+	if *upstreamMaxCnameChain > 0 && len(req.Question) > 0 {
+		if length := cnameChainLength(req.Question[0].Name, resp.Answer); uint(length) > *upstreamMaxCnameChain {
+			return &upstreamLimitError{"CNAME chain length", length, *upstreamMaxCnameChain}
+		}
+	}
+	return nil
+}
+
+// The number of CNAMEs followed from name through the answer records. Loops stop the count.
+func cnameChainLength(name string, answer []dns.RR) int {
+	targets := make(map[string]string)
+	for _, rr := range answer {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			targets[canonicalName(cname.Hdr.Name)] = canonicalName(cname.Target)
+		}
+	}
+
+	length := 0
+	seen := make(map[string]bool)
+	for name = canonicalName(name); !seen[name]; length++ {
+		seen[name] = true
+		target, ok := targets[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return length
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamLimits(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = []dns.RR{
+		mustRR(t, "www.example.com. 60 IN CNAME a.example.com."),
+		mustRR(t, "a.example.com. 60 IN CNAME b.example.com."),
+		mustRR(t, "b.example.com. 60 IN CNAME a.example.com."),
+	}
+	if err := checkUpstreamLimits(req, resp); err != nil {
+		t.Fatalf("Unexpected error for a looping chain of 3: %v", err)
+	}
+	if length := cnameChainLength("www.example.com.", resp.Answer); length != 3 {
+		t.Fatalf("Incorrect chain length %d", length)
+	}
+
+	resp.Answer = nil
+	for i := 0; i < 10; i++ {
+		resp.Answer = append(resp.Answer, mustRR(t, fmt.Sprintf("c%d.example.com. 60 IN CNAME c%d.example.com.", i, i+1)))
+	}
+	resp.Answer[0].Header().Name = "www.example.com."
+	if err, ok := checkUpstreamLimits(req, resp).(*upstreamLimitError); !ok || err.limit != "CNAME chain length" {
+		t.Fatalf("Expected the chain to be rejected, got %v", err)
+	}
+
+	resp.Answer = nil
+	for i := 0; i < 101; i++ {
+		resp.Answer = append(resp.Answer, mustRR(t, fmt.Sprintf("www.example.com. 60 IN A 10.0.%d.%d", i/256, i%256)))
+	}
+	if err, ok := checkUpstreamLimits(req, resp).(*upstreamLimitError); !ok || err.limit != "answer records" {
+		t.Fatalf("Expected too many answers to be rejected, got %v", err)
+	}
+
+	resp.Answer = []dns.RR{mustRR(t, "www.example.com. 60 IN A 10.0.0.1")}
+	for i := 0; i < 80; i++ {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "www.example.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+			Txt: []string{fmt.Sprintf("%0250d", i)},
+		})
+	}
+	if err, ok := checkUpstreamLimits(req, resp).(*upstreamLimitError); !ok || err.limit != "message size" {
+		t.Fatalf("Expected an oversized message to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	LOG_STDOUT = "stdout"
+	LOG_STDERR = "stderr"
+	LOG_SYSLOG = "syslog"
+)
+
+// Where entries of a level and the levels more severe are written, e.g. "error=stderr" or
+// "debug=/var/log/rancher-dns.log"
+type logRoute struct {
+	level       log.Level
+	destination string
+	output      logDestination
+}
+
+// A log destination; syslog keeps the level as the priority of the line
+type logDestination interface {
+	WriteLevel(level log.Level, line []byte) error
+}
+
+type writerDestination struct {
+	io.Writer
+}
+
+func (d writerDestination) WriteLevel(level log.Level, line []byte) error {
+	_, err := d.Write(line)
+	return err
+}
+
+// Parses the comma-separated LEVEL=DESTINATION routes of --log-output, a destination being stdout,
+// stderr (or "-"), syslog or the path of a file. Nothing is opened yet.
+func parseLogOutputs(spec string) ([]logRoute, error) {
+	var routes []logRoute
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid log output %q, expected LEVEL=DESTINATION", item)
+		}
+		level, err := log.ParseLevel(strings.ToLower(strings.TrimSpace(parts[0])))
+		if err != nil {
+			return nil, fmt.Errorf("invalid level in log output %q", item)
+		}
+		destination := strings.TrimSpace(parts[1])
+		if destination == "-" {
+			destination = LOG_STDERR
+		}
+		routes = append(routes, logRoute{level: level, destination: destination})
+	}
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("no log outputs in %q", spec)
+	}
+	return routes, nil
+}
+
+func (route *logRoute) open() error {
+	switch route.destination {
+	case LOG_STDOUT:
+		route.output = writerDestination{os.Stdout}
+	case LOG_STDERR:
+		route.output = writerDestination{os.Stderr}
+	case LOG_SYSLOG:
+		output, err := openSyslog()
+		if err != nil {
+			return err
+		}
+		route.output = output
+	default:
+		output, err := os.OpenFile(route.destination, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		route.output = writerDestination{output}
+	}
+	return nil
+}
+
+// routingFormatter writes each entry to the routes taking its level and leaves nothing for the
+// logger's own output. It wraps the formatter rather than being a hook so that an entry is formatted
+// once, whatever the number of routes, which keeps the dedupFormatter's counts right.
+type routingFormatter struct {
+	log.Formatter
+	sync.Mutex
+	routes []logRoute
+}
+
+func (f *routingFormatter) Format(entry *log.Entry) ([]byte, error) {
+	line, err := f.Formatter.Format(entry)
+	if err != nil || len(line) == 0 {
+		return []byte{}, err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	for _, route := range f.routes {
+		if entry.Level <= route.level {
+			if err := route.output.WriteLevel(entry.Level, line); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write to log output %s: %v\n", route.destination, err)
+			}
+		}
+	}
+	return []byte{}, nil
+}
+
+// Routes the standard logger's entries to the destinations of --log-output. The logger logs at the
+// most verbose level of the routes (or --debug), the others filtering their own.
+func setupLogOutputs(spec string) error {
+	routes, err := parseLogOutputs(spec)
+	if err != nil {
+		return err
+	}
+	level := log.GetLevel()
+	for i := range routes {
+		if err := routes[i].open(); err != nil {
+			return fmt.Errorf("failed to open log output %s: %v", routes[i].destination, err)
+		}
+		if routes[i].level > level {
+			level = routes[i].level
+		}
+	}
+	log.SetLevel(level)
+	log.SetFormatter(&routingFormatter{Formatter: log.StandardLogger().Formatter, routes: routes})
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestParseLogOutputs(t *testing.T) {
+	routes, err := parseLogOutputs("error=-, Debug=/var/log/rancher-dns.log,warning=syslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []logRoute{{level: log.ErrorLevel, destination: LOG_STDERR}, {level: log.DebugLevel, destination: "/var/log/rancher-dns.log"}, {level: log.WarnLevel, destination: LOG_SYSLOG}}
+	if len(routes) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, routes)
+	}
+	for i := range expected {
+		if routes[i].level != expected[i].level || routes[i].destination != expected[i].destination {
+			t.Fatalf("Expected %v, got %v", expected, routes)
+		}
+	}
+
+	for _, invalid := range []string{"", "stderr", "verbose=stderr", "error=", ","} {
+		if _, err := parseLogOutputs(invalid); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestRoutingFormatter(t *testing.T) {
+	var errors, all, out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Level = log.DebugLevel
+	logger.Formatter = &routingFormatter{
+		Formatter: &log.TextFormatter{DisableColors: true},
+		routes: []logRoute{
+			{level: log.ErrorLevel, destination: "errors", output: writerDestination{&errors}},
+			{level: log.DebugLevel, destination: "all", output: writerDestination{&all}},
+		},
+	}
+
+	logger.Debug("looking up web")
+	logger.Warn("recurser timed out")
+	logger.Error("failed to reload")
+
+	if strings.Contains(errors.String(), "looking up web") || strings.Contains(errors.String(), "recurser timed out") || !strings.Contains(errors.String(), "failed to reload") {
+		t.Fatalf("Expected only the error in the error output, got %q", errors.String())
+	}
+	if strings.Count(all.String(), "\n") != 3 {
+		t.Fatalf("Expected every entry in the debug output, got %q", all.String())
+	}
+	if out.Len() != 0 {
+		t.Fatalf("Expected nothing in the logger's own output, got %q", out.String())
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log/syslog"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type syslogDestination struct {
+	*syslog.Writer
+}
+
+func openSyslog() (logDestination, error) {
+	writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "rancher-dns")
+	if err != nil {
+		return nil, err
+	}
+	return syslogDestination{writer}, nil
+}
+
+func (d syslogDestination) WriteLevel(level log.Level, line []byte) error {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return d.Crit(string(line))
+	case log.ErrorLevel:
+		return d.Err(string(line))
+	case log.WarnLevel:
+		return d.Warning(string(line))
+	case log.InfoLevel:
+		return d.Info(string(line))
+	}
+	return d.Debug(string(line))
+}
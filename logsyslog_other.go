@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+)
+
+func openSyslog() (logDestination, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// How long the neighbor table read for --client-mac is used before it's read again
+const NEIGHBOR_REFRESH = 5 * time.Second
+
+// With --client-mac, answers entries can also be keyed by MAC address ("52:54:00:12:34:56"): a client
+// on the local network is looked up in the host's neighbor (ARP) table, and the entry of its MAC
+// address is its entry, ahead of those of its IP and network. Lab devices keep their answers when DHCP
+// hands them another address. Only IPv4 neighbors on Linux are known.
+type neighborTable struct {
+	sync.Mutex
+	macs map[string]string
+	read time.Time
+}
+
+var neighbors = &neighborTable{}
+
+// The MAC address of the neighbor with the IP, empty if it isn't one
+func (t *neighborTable) mac(ip string) string {
+	t.Lock()
+	defer t.Unlock()
+	if t.macs == nil || now().Sub(t.read) > NEIGHBOR_REFRESH {
+		macs, err := readNeighbors()
+		if err != nil {
+			log.Warnf("Failed to read the neighbor table: %v", err)
+			macs = make(map[string]string)
+		}
+		t.macs, t.read = macs, now()
+	}
+	return t.macs[ip]
+}
+
+// Reads the IP to MAC address entries of /proc/net/arp, leaving out incomplete ones
+func parseArpTable(r io.Reader) map[string]string {
+	macs := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Scan() // The header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[2] == "0x0" {
+			continue
+		}
+		ip, mac := net.ParseIP(fields[0]), macKey(fields[3])
+		if ip == nil || mac == "" || mac == "00:00:00:00:00:00" {
+			continue
+		}
+		macs[ip.String()] = mac
+	}
+	return macs
+}
+
+// The MAC address in the form answers are keyed by, empty if key isn't one
+func macKey(key string) string {
+	if strings.Count(key, ":")+strings.Count(key, "-") != 5 {
+		return ""
+	}
+	mac, err := net.ParseMAC(key)
+	if err != nil || len(mac) != 6 {
+		return ""
+	}
+	return mac.String()
+}
+
+// The answers key of the client by its MAC address, if it's a neighbor with an entry
+func (answers *Answers) macClientKey(clientIp string) string {
+	mac := neighbors.mac(clientIp)
+	if mac == "" {
+		return ""
+	}
+	if _, ok := (*answers)[mac]; ok {
+		return mac
+	}
+	return ""
+}
+
+// Brings the MAC address keys of the entries into the form they are looked up in
+func normalizeMacKeys(answers Answers) {
+	for key, client := range answers {
+		environment, clientKey := splitEnvironmentKey(key)
+		if mac := macKey(clientKey); mac != "" && mac != clientKey {
+			delete(answers, key)
+			answers[environmentKey(environment, mac)] = client
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"os"
+)
+
+func readNeighbors() (map[string]string, error) {
+	file, err := os.Open("/proc/net/arp")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseArpTable(file), nil
+}
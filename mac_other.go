@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func readNeighbors() (map[string]string, error) {
+	return nil, errors.New("the neighbor table is only available on Linux")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseArpTable(t *testing.T) {
+	table := `IP address       HW type     Flags       HW address            Mask     Device
+10.1.1.1         0x1         0x2         52:54:00:AB:cd:01     *        eth0
+10.1.1.2         0x1         0x0         00:00:00:00:00:00     *        eth0
+10.1.1.3         0x1         0x2         52:54:00:ab:cd:03     *        eth1
+`
+	macs := parseArpTable(strings.NewReader(table))
+	if len(macs) != 2 || macs["10.1.1.1"] != "52:54:00:ab:cd:01" || macs["10.1.1.3"] != "52:54:00:ab:cd:03" {
+		t.Fatalf("Unexpected neighbors %v", macs)
+	}
+	for key, mac := range map[string]string{"52-54-00-AB-CD-01": "52:54:00:ab:cd:01", "10.1.1.1": "", "fd00::1:2:3:4": "", "default": ""} {
+		if macKey(key) != mac {
+			t.Fatalf("Expected %q for %s, got %q", mac, key, macKey(key))
+		}
+	}
+}
+
+func TestMacClientKeys(t *testing.T) {
+	saved, savedEnvironments, savedMac := answers, environmentAnswers, *clientMac
+	defer func() {
+		answers, environmentAnswers, *clientMac = saved, savedEnvironments, savedMac
+		neighbors.macs = nil
+	}()
+	out, err := parseAnswersData([]byte(`{
+		"52-54-00-AB-CD-01": {"a": {"lab.internal.": {"answer": ["10.9.0.1"]}}},
+		"10.1.0.0/16": {"a": {"lab.internal.": {"answer": ["10.9.0.2"]}}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := out["52:54:00:ab:cd:01"]; !ok {
+		t.Fatalf("Expected the MAC address key in normal form, got %v", out)
+	}
+	answers = out
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	// The testWriter's client, 10.1.1.1, is a neighbor with that address
+	neighbors.Lock()
+	neighbors.macs, neighbors.read = map[string]string{"10.1.1.1": "52:54:00:ab:cd:01"}, now()
+	neighbors.Unlock()
+	query := func() string {
+		req := new(dns.Msg)
+		req.SetQuestion("lab.internal.", dns.TypeA)
+		w := &testWriter{}
+		route(&queryWriter{ResponseWriter: w}, req)
+		return w.msg.Answer[0].(*dns.A).A.String()
+	}
+	*clientMac = false
+	if answer := query(); answer != "10.9.0.2" {
+		t.Fatalf("Expected the network's answer without --client-mac, got %s", answer)
+	}
+	*clientMac = true
+	clearClientSpecificCaches()
+	if answer := query(); answer != "10.9.0.1" {
+		t.Fatalf("Expected the MAC address's answer, got %s", answer)
+	}
+}
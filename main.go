@@ -1,12 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
@@ -26,21 +24,99 @@ import (
 )
 
 var (
-	showVersion     = flag.Bool("version", false, "Show version")
-	debug           = flag.Bool("debug", false, "Debug")
-	listen          = flag.String("listen", ":53", "Address to listen to (TCP and UDP)")
-	listenReload    = flag.String("listenReload", "127.0.0.1:8113", "Address to listen to for reload requests (TCP)")
-	answersFile     = flag.String("answers", "./answers.yaml", "File containing the answers to respond with")
-	defaultTtl      = flag.Uint("ttl", 600, "TTL for answers")
-	recurserTimeout = flag.Uint("recurser-timeout", 2, "timeout (in seconds) for recurser")
-	ndots           = flag.Uint("ndots", 0, "Queries with more than this number of dots will not use search paths")
-	cacheCapacity   = flag.Uint("cache-capacity", 1000, "Cache capacity")
-	logFile         = flag.String("log", "", "Log file")
-	pidFile         = flag.String("pid-file", "", "PID to write to")
-	metadataServer  = flag.String("metadata-server", "", "Metadata server url")
-	metadataAnswer  = flag.String("rancher-metadata-answer", "169.254.169.250", "Metadata IP address(es), comma-delimited (adds static A records)")
-	neverRecurseTo  = flag.String("never-recurse-to", "169.254.169.250", "Never recurse to IP address(es), comma-delimited")
-	namespace       = flag.String("namespace", "discover.internal", "Global namespace")
+	showVersion           = flag.Bool("version", false, "Show version")
+	debug                 = flag.Bool("debug", false, "Debug")
+	accessLog             = flag.Bool("access-log", false, "Log every query with response size and transport at info level")
+	listen                = flag.String("listen", ":53", "Address(es) to listen to (TCP and UDP), comma-delimited")
+	listenReload          = flag.String("listenReload", "127.0.0.1:8113", "Address to listen to for reload requests (TCP)")
+	answersFile           = flag.String("answers", "./answers.yaml", "File containing the answers to respond with, or an http(s) URL to fetch them from")
+	answersFallback       = flag.String("answers-fallback", "", "Answers file served while the --answers file is missing, or when it fails to load at startup")
+	answersCache          = flag.String("answers-cache", "", "File to keep the answers served from an --answers URL in, loaded at startup when the URL can't be fetched")
+	defaultTtl            = flag.Uint("ttl", 600, "TTL for answers")
+	minimalResponses      = flag.Bool("minimal-responses", false, "Omit the authority and additional sections unless they are needed (negative answers, referrals)")
+	clientMaxInflight     = flag.Uint("client-max-inflight", 0, "Most queries of a single client IP answered at the same time, 0 for no limit")
+	dohListen             = flag.String("doh-listen", "", "Address to serve DNS over HTTPS (RFC 8484) on, e.g. :443")
+	dohCert               = flag.String("doh-cert", "", "PEM certificate (chain) of the DNS over HTTPS listener, plain HTTP without it")
+	dohKey                = flag.String("doh-key", "", "PEM private key of --doh-cert")
+	dohPath               = flag.String("doh-path", "/dns-query", "URL path of DNS over HTTPS queries")
+	upstreamTlsCa         = flag.String("upstream-tls-ca", "", "PEM file of the CA certificates to verify tls:// recursers against instead of the system's")
+	upstreamDohHeaders    = flag.String("upstream-doh-headers", "", "File of HTTP headers added to the requests to DNS over HTTPS recursers, one \"[URL] Name: value\" line per header")
+	transportRateLimits   = flag.String("transport-rate-limits", "", "Server-wide rate limits of the queries of each transport, comma-delimited TRANSPORT=QPS entries (udp, tcp, doh)")
+	clientMac             = flag.Bool("client-mac", false, "Look clients up in the neighbor (ARP) table and answer them from the entry of their MAC address, if there is one")
+	clientOverflow        = flag.String("client-overflow", CLIENT_OVERFLOW_REFUSED, "Response to queries of a client over --client-max-inflight: refused, servfail or drop (no response)")
+	multiQuestion         = flag.String("multi-question", MULTI_QUESTION_FORMERR, "How to handle messages with more than one question: formerr or first (answer the first question only)")
+	ednsUdpSize           = flag.Uint("edns-udp-size", 1232, "Largest UDP payload advertised in EDNS0 responses, and sent to clients that advertise a larger buffer")
+	strictAnswers         = flag.Bool("strict-answers", false, "Reject the \"records\" shorthand in answers files, requiring every record under its type")
+	compress              = flag.Bool("compress", true, "Use name compression in responses")
+	recurserTimeout       = flag.Uint("recurser-timeout", 2, "timeout (in seconds) for recurser")
+	upstreamProbeInterval = flag.Uint("upstream-probe-interval", 300, "Seconds between probes of the recursers for EDNS0 and TCP support, 0 to disable")
+	recurseSource         = flag.String("recurse-source", "", "Source address(es) of queries to recursers, at most one IPv4 and one IPv6 address, comma-delimited")
+	recurseInterface      = flag.String("recurse-interface", "", "Network interface to send queries to recursers out of (Linux only)")
+	upstreamMaxAnswers    = flag.Uint("upstream-max-answers", 100, "Reject recursive responses with more answer records than this, 0 for no limit")
+	upstreamMaxSize       = flag.Uint("upstream-max-size", 16384, "Reject recursive responses larger than this many bytes, 0 for no limit")
+	upstreamMaxCnameChain = flag.Uint("upstream-max-cname-chain", 8, "Reject recursive responses with a longer CNAME chain than this, 0 for no limit")
+	gomaxprocs            = flag.Uint("gomaxprocs", 0, "Maximum number of CPUs running queries at once, 0 for all of them (or those of --cpu-affinity)")
+	gcPercent             = flag.Int("gc-percent", 100, "Garbage collection target percentage (GOGC), -1 to disable the collector")
+	cpuAffinity           = flag.String("cpu-affinity", "", "CPUs to run on, e.g. 0-3,6 (Linux only)")
+	udpReaders            = flag.Uint("udp-readers", 1, "Sockets reading queries for each UDP listen address in parallel (SO_REUSEPORT, Linux only)")
+	udpBatch              = flag.Uint("udp-batch", 1, "Read and write UDP packets in batches of up to this many with recvmmsg/sendmmsg (Linux only), 1 to disable")
+	reloadDebounce        = flag.Uint("reload-debounce", 250, "Milliseconds without another reload request (e.g. SIGHUP) to wait for before reloading, so a burst results in one reload")
+	reloadMaxDelay        = flag.Uint("reload-max-delay", 2000, "Longest time (in milliseconds) a reload is put off by further requests")
+	unknownInstances      = flag.String("unknown-instances", "", "Answer A queries for unknown instances of a known service (web-7.web...) with the service's records ('service') or these IPv4 address(es), comma-delimited")
+	sameHostFirst         = flag.Bool("same-host-first", false, "Order the addresses on the host of the querying client first, as far as the answers (or metadata) say where clients and addresses are")
+	rrsetMaxAnswers       = flag.Uint("rrset-max-answers", 0, "Most records of a name and type in a response, handed out a page at a time in turn; 0 for no limit")
+	rrsetOrder            = flag.String("rrset-order", RRSET_ORDER_RANDOM, "Order of the address records of a name in responses: random (shuffled), cyclic (rotated by one for every response) or fixed (as configured)")
+	unhealthyRecords      = flag.String("unhealthy-records", UNHEALTHY_FALLBACK, "Records of containers that are running but initializing or unhealthy (metadata mode): fallback (only when a service has no healthy container), publish, hold or low-ttl")
+	unhealthyTtlSeconds   = flag.Uint("unhealthy-ttl", 5, "TTL of the records of initializing or unhealthy containers with --unhealthy-records=low-ttl")
+	tcpIdleTimeoutSeconds = flag.Uint("tcp-idle-timeout", 8, "Seconds a TCP connection may be idle between queries before it's closed")
+	ednsTcpKeepalive      = flag.Bool("edns-tcp-keepalive", true, "Tell TCP clients that send the edns-tcp-keepalive option (RFC 7828) the idle timeout")
+	writeTimeout          = flag.Uint("write-timeout", 2, "timeout (in seconds) for writing a UDP response to a client")
+	ndots                 = flag.Uint("ndots", 0, "Queries with more than this number of dots will not use search paths")
+	cacheCapacity         = flag.Uint("cache-capacity", 1000, "Cache capacity")
+	cacheMaxBytes         = flag.Uint("cache-max-bytes", 0, "Approximate bytes each cache may hold before its least recently used entries are evicted, 0 for no limit besides --cache-capacity")
+	cacheTtl              = flag.Uint("cache-ttl", 0, "Longest time (in seconds) positive responses are cached, 0 for --ttl")
+	negativeCacheTtl      = flag.Uint("negative-cache-ttl", 60, "Longest time (in seconds) NXDOMAIN and NODATA responses are cached")
+	logFile               = flag.String("log", "", "Log file")
+	logOutputs            = flag.String("log-output", "", "Comma-separated LEVEL=DESTINATION routes of the logs (instead of --log), e.g. 'error=stderr,debug=/var/log/rancher-dns.log'; destinations are stdout, stderr, syslog or a file, and get the entries of their level and more severe")
+	secondaries           = flag.String("secondary", "", "Zones to mirror from their primary server by zone transfers, comma-delimited ZONE@PRIMARY[:PORT][/KEY] entries")
+	dnssecSign            = flag.Bool("dnssec", false, "Sign the answers of the declared zones for queries with the DO bit (RRSIG, NSEC3 for denials)")
+	dnssecKsk             = flag.String("dnssec-ksk", "", "PEM file of the DNSSEC key signing key (ECDSA P-256, P-384 or RSA), generated at startup when not given")
+	dnssecZsk             = flag.String("dnssec-zsk", "", "PEM file of the DNSSEC zone signing key (ECDSA P-256, P-384 or RSA), generated at startup when not given")
+	dnssecResignInterval  = flag.Uint("dnssec-resign-interval", 0, "Seconds between passes signing the RRsets again whose signatures are past half of their validity, ahead of the queries; 0 to sign them again when queried only")
+	dnssecValidate        = flag.Bool("dnssec-validate", false, "Validate the DNSSEC signatures of recursed responses up to the trust anchors, setting AD on those that validate")
+	dnssecFailClosed      = flag.Bool("dnssec-fail-closed", false, "Answer SERVFAIL instead of recursed responses that fail DNSSEC validation, unless the query has the CD bit")
+	dnssecTrustAnchors    = flag.String("dnssec-trust-anchors", "", "File of the DS or DNSKEY records to validate from, one per line, instead of the root zone's keys")
+	tsigKeysFile          = flag.String("tsig-keys", "", "File of the TSIG keys authenticating zone transfers and NOTIFY, one NAME ALGORITHM SECRET line per key")
+	upstreamSpoofDetect   = flag.Bool("upstream-spoof-detect", false, "Watch queries to recursers over UDP for responses from other addresses, with the wrong ID or question, and duplicates, and count them")
+	upstreamLogFile       = flag.String("upstream-log", "", "File to log every query forwarded to a recurser to, '-' for stderr")
+	logDedupWindow        = flag.Uint("log-dedup-window", 10, "Window (in seconds) in which repeats of the same warning are suppressed, 0 to disable")
+	standbyOf             = flag.String("standby-of", "", "Run as the standby of the instance with this reload listener address: mirror its answers and only start listening when it stops responding")
+	heartbeatInterval     = flag.Uint("heartbeat-interval", 1, "Interval (in seconds) at which a standby checks on (and copies the state of) the active instance")
+	failoverTimeout       = flag.Uint("failover-timeout", 3, "Seconds without a heartbeat from the active instance after which a standby takes over")
+	shutdownDelay         = flag.Uint("shutdown-delay", 0, "Seconds to keep answering after SIGTERM (with /v1/health failing) before closing the listeners")
+	deregisterUrl         = flag.String("deregister-url", "", "URL to send a request to on shutdown to deregister from service discovery")
+	deregisterMethod      = flag.String("deregister-method", "PUT", "HTTP method of the deregistration request")
+	pidFile               = flag.String("pid-file", "", "PID to write to")
+	metadataServer        = flag.String("metadata-server", "", "Metadata server url")
+	metadataAnswer        = flag.String("rancher-metadata-answer", "169.254.169.250", "Metadata IP address(es), comma-delimited (adds static A records)")
+	debugQueries          = flag.Bool("debug-queries", false, "Honor debug queries (EDNS option 65431): bypass the caches and describe how the query was answered in a TXT record")
+	nodataForLocalNames   = flag.Bool("nodata-for-local-names", false, "Answer queries for types a locally known name doesn't have with NODATA instead of recursing")
+	neverRecurseTo        = flag.String("never-recurse-to", "169.254.169.250", "Never recurse to IP address(es), comma-delimited")
+	leaseSweepInterval    = flag.Uint("lease-sweep-interval", 5, "Interval (in seconds) at which dynamic records whose lease ran out are removed, 0 to never remove them")
+	leaseSummaryInterval  = flag.Uint("lease-summary-interval", 300, "Interval (in seconds) at which the number of expired dynamic records is logged")
+	expiryWebhook         = flag.String("expiry-webhook", "", "URL to POST every expired dynamic record to, as JSON")
+	journalFile           = flag.String("journal", "", "File to journal records set through the API to, replayed at startup")
+	trustedProxyList      = flag.String("trusted-proxies", "", "Addresses or networks of forwarders whose client subnet (ECS) option identifies the client, comma-delimited; ECS from anyone else is ignored and dropped")
+	forwardClientSubnet   = flag.Bool("forward-client-subnet", false, "Send the client's network (/24 or /56) to the recursers in a client subnet (ECS) option; responses for that network only aren't cached for everyone")
+	clientSubnetFallback  = flag.Bool("client-subnet-fallback", false, "Pick the client entry of the trusted proxy for clients it names (by ECS or PROXY protocol) that have no entry of their own")
+	proxyProtocol         = flag.Bool("proxy-protocol", false, "Expect a PROXY protocol (v1 or v2) header naming the client on TCP connections from the --proxy-protocol-from load balancers")
+	proxyProtocolFrom     = flag.String("proxy-protocol-from", "", "Addresses or networks of the load balancers whose TCP connections start with a PROXY protocol header, comma-delimited")
+	recursionBudget       = flag.Uint("recursion-budget", 0, "Milliseconds to wait for the recursers when a stale cached response or a local answer of a zone falling back to local answers could answer instead; 0 to always wait")
+	rateLimitStale        = flag.Uint("rate-limit-stale", 300, "Seconds past their expiry recursive responses are kept for answering queries of zones over their rate limit")
+	serveStale            = flag.Uint("serve-stale", 0, "Seconds past their expiry recursive responses are kept for answering queries the recursers fail to answer (0 doesn't)")
+	serversFile           = flag.String("servers", "", "File declaring several logical servers (listeners, environment, recursers and policies) run by this process")
+	sources               = flag.String("sources", "", "Answer sources in priority order, comma-delimited (default dynamic,file or dynamic,metadata)")
+	namespace             = flag.String("namespace", "discover.internal", "Global namespace")
 
 	answers                   Answers
 	globalCache               *cache.Cache
@@ -57,13 +133,45 @@ func metadataDriven() bool {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(runCtl(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "diff" {
+		os.Exit(runDiff(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+
 	parseFlags()
 
+	if err := setupSources(*sources); err != nil {
+		log.Fatalf("Cannot startup: %v", err)
+	}
+	if err := loadServerBlocks(*serversFile); err != nil {
+		log.Fatalf("Cannot startup: invalid server blocks: %v", err)
+	}
+
 	log.Infof("Starting rancher-dns %s", VERSION)
 	err := loadAnswers()
+	if err != nil && *answersFallback != "" && !metadataDriven() {
+		err = loadFallbackAnswers()
+	}
 	if err != nil {
 		log.Fatal("Cannot startup without a valid Answers file")
 	}
+	if err := checkUpstreamHeaders(configuredRecursers()); err != nil {
+		log.Fatalf("Invalid --upstream-doh-headers: %v", err)
+	}
+
+	if *journalFile != "" {
+		if journal, err = openJournal(*journalFile); err != nil {
+			log.Fatalf("Cannot startup: failed to open record journal: %v", err)
+		}
+	}
 
 	if *showVersion {
 		fmt.Printf("%s\n", VERSION)
@@ -80,33 +188,142 @@ func main() {
 
 	watchSignals()
 	watchHttp()
+	startSecondaries()
 
 	seed := time.Now().UTC().UnixNano()
 	log.Debug("Set random seed to ", seed)
-	rand.Seed(seed)
+	random.Seed(seed)
 
-	udpServer := &dns.Server{Addr: *listen, Net: "udp"}
-	tcpServer := &dns.Server{Addr: *listen, Net: "tcp"}
-
-	globalCache = cache.New(int(*cacheCapacity), int(*defaultTtl))
+	globalCache = newCache(true)
 	clientSpecificCaches = make(map[string]*cache.Cache)
 
-	dns.HandleFunc(".", route)
+	dns.HandleFunc(".", handleQuery)
+	if *upstreamProbeInterval > 0 {
+		go probeUpstreams()
+	}
+	if dnssecSigner != nil && *dnssecResignInterval > 0 {
+		go watchSignatures(time.Duration(*dnssecResignInterval) * time.Second)
+	}
+
+	watchShutdown()
+	if *standbyOf != "" {
+		go runStandby(*standbyOf)
+	} else {
+		for _, addr := range listenAddrs() {
+			if err := listenDns(addr); err != nil {
+				log.Fatalf("Cannot listen on %s: %v", addr, err)
+			}
+		}
+		if *dohListen != "" {
+			if err := listenDoh(*dohListen); err != nil {
+				log.Fatalf("Cannot listen for DNS over HTTPS on %s: %v", *dohListen, err)
+			}
+		}
+		startLeaseSweeper()
+	}
 
-	go func() {
-		log.Fatal(udpServer.ListenAndServe())
-	}()
-	log.Info("Listening on ", *listen)
-	log.Fatal(tcpServer.ListenAndServe())
+	select {}
 }
 
 func parseFlags() {
 	flag.Parse()
+	applyFlags()
+}
 
+// Checks and applies the flags as parsed
+func applyFlags() {
 	if *debug {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	switch *clientOverflow {
+	case CLIENT_OVERFLOW_REFUSED, CLIENT_OVERFLOW_SERVFAIL, CLIENT_OVERFLOW_DROP:
+	default:
+		log.Fatalf("Invalid --client-overflow %q, expected %s, %s or %s", *clientOverflow, CLIENT_OVERFLOW_REFUSED, CLIENT_OVERFLOW_SERVFAIL, CLIENT_OVERFLOW_DROP)
+	}
+	if *ednsUdpSize < EDNS_MIN_UDP_SIZE || *ednsUdpSize > dns.MaxMsgSize {
+		log.Fatalf("Invalid --edns-udp-size %d, expected %d to %d", *ednsUdpSize, EDNS_MIN_UDP_SIZE, dns.MaxMsgSize)
+	}
+	if limits, err := parseTransportLimits(*transportRateLimits); err != nil {
+		log.Fatalf("Invalid --transport-rate-limits: %v", err)
+	} else {
+		transportLimits.SetLimits(limits)
+	}
+	if *multiQuestion != MULTI_QUESTION_FORMERR && *multiQuestion != MULTI_QUESTION_FIRST {
+		log.Fatalf("Invalid --multi-question %q, expected %s or %s", *multiQuestion, MULTI_QUESTION_FORMERR, MULTI_QUESTION_FIRST)
+	}
+
+	switch *rrsetOrder {
+	case RRSET_ORDER_RANDOM, RRSET_ORDER_CYCLIC, RRSET_ORDER_FIXED:
+	default:
+		log.Fatalf("Invalid --rrset-order %q, expected %s, %s or %s", *rrsetOrder, RRSET_ORDER_RANDOM, RRSET_ORDER_CYCLIC, RRSET_ORDER_FIXED)
+	}
+
+	switch *unhealthyRecords {
+	case UNHEALTHY_FALLBACK, UNHEALTHY_PUBLISH, UNHEALTHY_HOLD, UNHEALTHY_LOW_TTL:
+	default:
+		log.Fatalf("Invalid --unhealthy-records %q, expected %s, %s, %s or %s", *unhealthyRecords, UNHEALTHY_FALLBACK, UNHEALTHY_PUBLISH, UNHEALTHY_HOLD, UNHEALTHY_LOW_TTL)
+	}
+
+	if err := validateUnknownInstances(*unknownInstances); err != nil {
+		log.Fatalf("Invalid --unknown-instances: %v", err)
+	}
+
+	if *clientMac {
+		if _, err := readNeighbors(); err != nil {
+			log.Fatalf("Cannot use --client-mac: %v", err)
+		}
+	}
+	if err := setupTrustedProxies(); err != nil {
+		log.Fatalf("Invalid --trusted-proxies: %v", err)
+	}
+	if err := setupProxyProtocol(); err != nil {
+		log.Fatalf("Invalid --proxy-protocol-from: %v", err)
+	}
+	if err := setupOutbound(); err != nil {
+		log.Fatalf("Invalid outbound settings: %v", err)
+	}
+	if err := setupUpstreamTls(*upstreamTlsCa); err != nil {
+		log.Fatalf("Invalid --upstream-tls-ca: %v", err)
+	}
+	if err := loadUpstreamHeaders(*upstreamDohHeaders); err != nil {
+		log.Fatalf("Invalid --upstream-doh-headers: %v", err)
+	}
+	if err := loadTsigKeys(*tsigKeysFile); err != nil {
+		log.Fatalf("Invalid --tsig-keys: %v", err)
+	}
+	if *dnssecSign {
+		if err := setupDnssec(*dnssecKsk, *dnssecZsk); err != nil {
+			log.Fatalf("Invalid DNSSEC keys: %v", err)
+		}
+	}
+	if *dnssecValidate {
+		if err := setupValidation(*dnssecTrustAnchors); err != nil {
+			log.Fatalf("Invalid --dnssec-trust-anchors: %v", err)
+		}
+	} else if *dnssecFailClosed {
+		log.Fatalf("--dnssec-fail-closed requires --dnssec-validate")
+	}
+	if err := setupSecondaries(*secondaries); err != nil {
+		log.Fatalf("Invalid --secondary: %v", err)
+	}
+	if err := applyTuning(); err != nil {
+		log.Fatalf("Invalid tuning: %v", err)
+	}
+
+	if *logDedupWindow > 0 {
+		log.SetFormatter(newDedupFormatter(log.StandardLogger().Formatter, time.Duration(*logDedupWindow)*time.Second))
+	}
+
+	if *logOutputs != "" {
+		if *logFile != "" {
+			log.Fatalf("--log and --log-output can't be used together")
+		}
+		if err := setupLogOutputs(*logOutputs); err != nil {
+			log.Fatalf("Invalid --log-output: %v", err)
+		}
+	}
+
 	if *logFile != "" {
 		if output, err := os.OpenFile(*logFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666); err != nil {
 			log.Fatalf("Failed to log to file %s: %v", *logFile, err)
@@ -115,6 +332,12 @@ func parseFlags() {
 		}
 	}
 
+	if *upstreamLogFile != "" {
+		if err := openUpstreamLog(*upstreamLogFile); err != nil {
+			log.Fatalf("Failed to log upstream queries to file %s: %v", *upstreamLogFile, err)
+		}
+	}
+
 	if *pidFile != "" {
 		log.Infof("Writing pid %d to %s", os.Getpid(), *pidFile)
 		if err := ioutil.WriteFile(*pidFile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
@@ -124,23 +347,30 @@ func parseFlags() {
 }
 
 func loadAnswersFromMeta(name string) {
-	newAnswers, err := configGenerator.GenerateAnswers()
+	reloadFromMeta()
+}
+
+func reloadFromMeta() error {
+	newAnswers, err := loadCandidate()
 	if err != nil {
 		log.Errorf("Failed to generate answers: %v", err)
-		return
+		return err
 	}
-	ConvertPtrIps(&newAnswers)
 
-	if reflect.DeepEqual(newAnswers, answers) {
+	baseMutex.Lock()
+	defer baseMutex.Unlock()
+	if reflect.DeepEqual(newAnswers, metadataRecords.Answers()) {
 		log.Debug("No changes in dns data")
-		return
+		return nil
 	}
 
 	log.Infof("Reloading answers")
-	clearClientSpecificCaches()
-	answers = newAnswers
+	if err := applyBaseAnswers(newAnswers); err != nil {
+		log.WithFields(log.Fields{"stage": reloadStage(err)}).Errorf("Failed to reload answers: %v", err)
+		return err
+	}
 	// write to file (debugging purposes)
-	b, err := json.Marshal(answers)
+	b, err := newAnswers.Export()
 	if err != nil {
 		log.Errorf("Failed to marshall answers: %v", err)
 	}
@@ -149,17 +379,21 @@ func loadAnswersFromMeta(name string) {
 		log.Errorf("Failed to write answers to file: %v", err)
 	}
 	log.Infof("Reloaded answers")
+	return nil
 }
 
 func loadAnswers() (err error) {
 	log.Debug("Loading answers")
-	temp, err := ParseAnswers(*answersFile)
+	temp, err := loadCandidate()
+	if err == nil {
+		baseMutex.Lock()
+		err = applyBaseAnswers(temp)
+		baseMutex.Unlock()
+	}
 	if err == nil {
-		clearClientSpecificCaches()
-		answers = temp
 		log.Infof("Loaded answers")
 	} else {
-		log.Errorf("Failed to load answers: %v", err)
+		log.WithFields(log.Fields{"file": *answersFile, "stage": reloadStage(err)}).Errorf("Failed to load answers: %v", err)
 	}
 
 	return err
@@ -178,22 +412,31 @@ func watchSignals() {
 				reloadChan <- nil
 			}
 		}()
-
-		go func() {
-			for resp := range reloadChan {
-				err := loadAnswers()
-				if resp != nil {
-					resp <- err
-				}
-			}
-		}()
 	}
 
+	go serveReloads(reloadChan, func() error {
+		if metadataDriven() {
+			return reloadFromMeta()
+		}
+		return loadAnswers()
+	})
 }
 
 func watchHttp() {
 	reloadRouter := mux.NewRouter()
 	reloadRouter.HandleFunc("/v1/reload", httpReload).Methods("POST")
+	reloadRouter.HandleFunc("/reload", httpReloadResult).Methods("POST")
+	reloadRouter.HandleFunc("/v1/stats", httpStats).Methods("GET")
+	reloadRouter.HandleFunc("/v1/health", httpHealth).Methods("GET")
+	reloadRouter.HandleFunc("/v1/state", httpState).Methods("GET")
+	reloadRouter.HandleFunc("/v1/dump", httpDump).Methods("GET")
+	reloadRouter.HandleFunc("/v1/lookup", httpLookup).Methods("GET")
+	reloadRouter.HandleFunc("/v1/records", httpRecords).Methods("POST")
+	reloadRouter.HandleFunc("/v1/capture", httpCapture).Methods("GET", "POST", "DELETE")
+	reloadRouter.HandleFunc("/v1/pins", httpPins).Methods("GET", "POST", "DELETE")
+	reloadRouter.HandleFunc("/v1/upstreams", httpUpstreams).Methods("GET")
+	reloadRouter.HandleFunc("/v1/version", httpVersion).Methods("GET")
+	reloadRouter.HandleFunc("/v1/blocklists", httpBlocklists).Methods("GET", "POST")
 	log.Info("Listening for Reload on ", *listenReload)
 	go http.ListenAndServe(*listenReload, reloadRouter)
 }
@@ -255,12 +498,47 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 	m.RecursionAvailable = true
 	m.Compress = true
 
-	clientIp, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	clientIp := clientAddr(w)
 
 	// One question at a time please
-	if len(req.Question) != 1 {
-		dns.HandleFailed(w, req)
-		log.WithFields(log.Fields{"client": clientIp}).Warn("Rejected multi-question query")
+	req, ok := singleQuestion(req)
+	if !ok {
+		f := new(dns.Msg)
+		f.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(f)
+		log.WithFields(log.Fields{"client": clientIp, "questions": len(req.Question)}).Warn("Rejected query without exactly one question")
+		return
+	}
+
+	// Clients mustn't send a TIMEOUT in edns-tcp-keepalive; over UDP the option is ignored
+	if _, valid := keepaliveRequested(req); !valid && isTcp(w) {
+		f := new(dns.Msg)
+		f.SetRcode(req, dns.RcodeFormatError)
+		w.WriteMsg(f)
+		log.WithFields(log.Fields{"client": clientIp}).Warn("Rejected query with a TIMEOUT in edns-tcp-keepalive")
+		return
+	}
+
+	if unsupportedEdnsVersion(req) {
+		answerBadVersion(w, req)
+		log.WithFields(log.Fields{"client": clientIp, "version": req.IsEdns0().Version()}).Debug("Rejected query of an unsupported EDNS version")
+		return
+	}
+
+	// Signed queries are answered signed, and only when the signature checks out
+	if key, err := verifyTsig(w, req); err != nil {
+		refuseTsig(w, req, err)
+		return
+	} else if qw, ok := w.(*queryWriter); ok {
+		qw.tsig = key
+	}
+
+	if req.Opcode == dns.OpcodeNotify {
+		answerNotify(w, req)
+		return
+	}
+	if qtype := req.Question[0].Qtype; qtype == dns.TypeAXFR || qtype == dns.TypeIXFR {
+		answerTransfer(w, req)
 		return
 	}
 
@@ -270,8 +548,60 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 	// We are assuming the config has all names as lower case
 	fqdn := strings.ToLower(question.Name)
 
+	// Queries for an environment are answered from its answers alone, which shadow the top-level ones
+	// for the rest of the lookup
+	environment := answers.EnvironmentFor(clientIp, listenerAddr(w))
+	block := serverBlockFor(listenerAddr(w))
+	if block != nil {
+		environment = block.Environment
+	}
+	answers := answersFor(environment)
+	if block != nil {
+		answers = serverBlockAnswers[block.Name]
+	}
+
 	//Figure out client uuid
 	clientUUID := getClientUUID(clientIp, fqdn)
+	if clientUUID == clientIp {
+		clientUUID = answers.ClientKey(clientIp)
+		if *clientMac {
+			if key := answers.macClientKey(clientIp); key != "" {
+				clientUUID = key
+			}
+		}
+		// A client named by a trusted proxy without an entry of its own gets the proxy's
+		if _, known := answers[clientUUID]; !known && *clientSubnetFallback {
+			if via := proxyAddr(w); via != "" {
+				clientUUID = answers.ClientKey(via)
+			}
+		}
+	}
+	m.RecursionAvailable = answers.Recursion(clientUUID)
+	query := newQueryContext(w, clientUUID)
+	query.Environment = environment
+	query.View = viewName(block, environment)
+	cacheKey := environmentKey(environment, clientUUID)
+	if block != nil {
+		// Blocks sharing a view answer with their own policies, so they don't share cached answers
+		cacheKey = block.Name + "/" + cacheKey
+	}
+	trace(w, "client=%s", clientUUID)
+	if via := proxyAddr(w); via != "" {
+		trace(w, "via=%s", via)
+	}
+	if block != nil {
+		trace(w, "server=%s", block.Name)
+	}
+	if environment != "" {
+		trace(w, "environment=%s", environment)
+	}
+
+	// The server's identity and version, for the CH-class queries asking for them
+	identity := identityFor(answers)
+	requestNsid(w, req, identity)
+	if answerIdentity(w, req, m, identity) {
+		return
+	}
 
 	// Internets only
 	if question.Qclass != dns.ClassINET {
@@ -279,6 +609,7 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 		m.RecursionDesired = false
 		m.RecursionAvailable = false
 		m.Rcode = dns.RcodeNotImplemented
+		setExtendedError(w, EDE_NOT_SUPPORTED, "only class IN is supported")
 		w.WriteMsg(m)
 		log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientUUID}).Warn("Rejected non-inet query")
 		return
@@ -290,120 +621,362 @@ func route(w dns.ResponseWriter, req *dns.Msg) {
 		m.RecursionDesired = false
 		m.RecursionAvailable = false
 		m.Rcode = dns.RcodeNotImplemented
+		setExtendedError(w, EDE_NOT_SUPPORTED, "ANY queries are not supported")
 		w.WriteMsg(m)
 		log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientUUID}).Warn("Rejected ANY query")
 		return
 	}
 
-	proto := "UDP"
-	if isTcp(w) {
-		proto = "TCP"
+	log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientUUID, "proto": transport(w), "tag": queryTag(w)}).Debug("Request")
+
+	// Zones suppressed for the client's network, checked before any local data or recursion
+	if answers.Suppressed(clientIp, fqdn) {
+		trace(w, "path=suppressed")
+		setExtendedError(w, EDE_BLOCKED, "blocked by policy")
+		m.Rcode = dns.RcodeNameError
+		Respond(w, req, m)
+		log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientUUID}).Debug("Suppressed")
+		return
 	}
 
-	log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientUUID, "proto": proto}).Debug("Request")
+	// Names on the client's blocklist subscriptions, like suppressed zones, or without data for NODATA
+	// policies
+	if list, action, ok := blocklists.Blocked(clientIp, fqdn); ok {
+		trace(w, "path=blocklisted")
+		trace(w, "blocklist=%s", list)
+		setExtendedError(w, EDE_BLOCKED, "blocked by blocklist "+list)
+		stats.incr("blocklisted")
+		m.Rcode = dns.RcodeNameError
+		if action == BLOCK_NODATA {
+			m.Rcode = dns.RcodeSuccess
+		}
+		Respond(w, req, m)
+		log.WithFields(log.Fields{"question": fqdn, "type": rrString, "client": clientUUID, "blocklist": list}).Debug("Blocklisted")
+		return
+	}
 
-	if msg, exp := clientSpecificCacheHit(clientUUID, req); msg != nil {
+	// Local answers and recursion, in the order configured for the zone
+	order := answers.OrderFor(fqdn)
+	for i, stage := range order {
+		fallback := i < len(order)-1
+		if stage == ORDER_LOCAL && answerLocally(w, req, m, answers, query, cacheKey) {
+			return
+		}
+		if stage == ORDER_RECURSE && answerRecursively(w, req, answers, query, fallback) {
+			return
+		}
+	}
+
+	// Local names that couldn't be answered with other data are still known not to have the type
+	if answers.orderHas(fqdn, ORDER_LOCAL) && answers.Exists(query, formatFqdn(clientUUID, fqdn), fqdn) {
+		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Not resolved, but the name exists locally with other types, no error and empty answer")
+		answerNodata(w, req, m, answers, cacheKey)
+		return
+	}
+
+	// I give up
+	log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Info("No answer found")
+	trace(w, "path=miss")
+	switch answers.Miss(clientUUID) {
+	case MISS_NXDOMAIN:
+		m.Rcode = dns.RcodeNameError
+		Respond(w, req, m)
+	case MISS_REFUSED:
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		setExtendedError(w, EDE_PROHIBITED, "refused by policy")
+		Respond(w, req, m)
+	default:
+		dns.HandleFailed(w, req)
+	}
+}
+
+// Answers the query from the client's and the default records (or the client-specific cache), or
+// with NXDOMAIN for names in an authoritative zone. Reports whether a response was sent.
+func answerLocally(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg, answers Answers, query *QueryContext, cacheKey string) bool {
+	question := req.Question[0]
+	rrString := dns.Type(question.Qtype).String()
+	fqdn := strings.ToLower(question.Name)
+	clientUUID := query.ClientKey
+
+	if debugging(w) {
+		trace(w, "cache=bypassed")
+	} else if msg, exp := clientSpecificCacheHit(cacheKey, req); msg != nil {
 		update(msg, exp)
 		Respond(w, req, msg)
 		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent client-specific cached response")
-		return
+		return true
 	}
 
-	// A records may return CNAME answer(s) plus A answer(s)
-	if question.Qtype == dns.TypeA {
-		// ipv4
-		found, ok := answers.Addresses(clientUUID, formatFqdn(clientUUID, fqdn), fqdn, nil, 1)
+	if answerZoneApex(w, req, m, answers, query) {
+		return true
+	}
+
+	// A and AAAA records may return CNAME answer(s) plus address answer(s)
+	if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
+		found, ok := answers.Addresses(question.Qtype, query, formatFqdn(clientUUID, fqdn), fqdn, nil, 1)
 		if ok && len(found) > 0 {
+			if *sameHostFirst {
+				answers.sameHostFirst(query, found)
+			}
 			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn, "answers": len(found)}).Debug("Answered locally")
+			answers.ApplyTtl(clientUUID, found)
 			m.Answer = found
-			addToClientSpecificCache(clientUUID, req, m)
+			setMatch(w, answers.MatchKind(question.Qtype, query, formatFqdn(clientUUID, fqdn), fqdn))
+			if debugging(w) {
+				trace(w, "path=local")
+				trace(w, "source=%s", localSource(query, formatFqdn(clientUUID, fqdn), question.Qtype))
+			}
+			addToClientSpecificCache(cacheKey, req, m)
 			Respond(w, req, m)
-			return
+			return true
+		}
+	}
+	if question.Qtype == dns.TypeA {
+		if found, ok := answers.UnknownInstance(query, formatFqdn(clientUUID, fqdn), fqdn); ok {
+			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn, "answers": len(found)}).Debug("Answered unknown instance from its service")
+			answers.ApplyTtl(clientUUID, found)
+			m.Answer = found
+			trace(w, "path=unknown-instance")
+			addToClientSpecificCache(cacheKey, req, m)
+			Respond(w, req, m)
+			return true
+		}
+	}
+	if question.Qtype == dns.TypeA || question.Qtype == dns.TypeAAAA {
+		// Local CNAMEs whose final target has no addresses of the type (or couldn't be resolved) are
+		// still answered with the chain, as stubs don't always look the target up themselves
+		if chain, target := answers.CnameChain(query, formatFqdn(clientUUID, fqdn), fqdn); len(chain) > 0 {
+			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn, "target": target}).Debug("Answered locally with the CNAME chain only")
+			trace(w, "path=local-cname")
+			answers.ApplyTtl(clientUUID, chain)
+			m.Answer = chain
+			if answers.Authoritative(target) && !answers.Exists(query, target, target) {
+				m.Rcode = dns.RcodeNameError
+				answers.addNegativeSoa(m, target)
+			}
+			addToClientSpecificCache(cacheKey, req, m)
+			Respond(w, req, m)
+			return true
+		}
+
+		// Names with addresses of the other family only
+		var ok bool
+		if question.Qtype == dns.TypeA {
+			ok = answers.hasOtherFamily(dns.TypeA, query, formatFqdn(clientUUID, fqdn))
+		} else {
+			_, ok = answers.Addresses(dns.TypeA, query, formatFqdn(clientUUID, fqdn), fqdn, nil, 1)
+			if !ok {
+				_, ok = answers.UnknownInstance(query, formatFqdn(clientUUID, fqdn), fqdn)
+			}
 		}
-	} else if question.Qtype == dns.TypeAAAA {
-		// ipv6
-		_, ok := answers.Addresses(clientUUID, formatFqdn(clientUUID, fqdn), fqdn, nil, 1)
 		if ok {
 			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Answered locally, no error and empty answer")
+			trace(w, "path=local-nodata")
 			m.Authoritative = true
 			m.Rcode = dns.RcodeSuccess
-			addToClientSpecificCache(clientUUID, req, m)
+			answers.addNegativeSoa(m, fqdn)
+			addToClientSpecificCache(cacheKey, req, m)
 			Respond(w, req, m)
-			return
+			return true
 		}
 	} else {
 		// Specific request for another kind of record
 		keys := []string{clientUUID, DEFAULT_KEY}
 		for _, key := range keys {
 			// Client-specific answers
-			found, ok := answers.Matching(question.Qtype, key, formatFqdn(clientUUID, fqdn), fqdn)
+			found, ok := answers.Matching(question.Qtype, query.ForKey(key), formatFqdn(clientUUID, fqdn), fqdn)
 			if ok {
 				log.WithFields(log.Fields{"client": key, "type": rrString, "question": fqdn, "answers": len(found)}).Debug("Answered from config for ", key)
+				answers.ApplyTtl(clientUUID, found)
 				m.Answer = found
-				addToClientSpecificCache(clientUUID, req, m)
+				setMatch(w, answers.MatchKind(question.Qtype, query.ForKey(key), formatFqdn(clientUUID, fqdn), fqdn))
+				if debugging(w) {
+					trace(w, "path=local")
+					trace(w, "source=%s", localSource(query.ForKey(key), formatFqdn(clientUUID, fqdn), question.Qtype))
+				}
+				addToClientSpecificCache(cacheKey, req, m)
 				Respond(w, req, m)
-				return
+				return true
 			}
 		}
 
 		log.Debug("No match found in config")
 	}
 
-	if msg, exp := globalCacheHit(req); msg != nil {
-		update(msg, exp)
-		Respond(w, req, msg)
-		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent globally cached response")
-		return
+	// The name is ours, just not with this type: don't let the query leak out to the recursers,
+	// which might come back with conflicting public data.
+	if *nodataForLocalNames && answers.Exists(query, formatFqdn(clientUUID, fqdn), fqdn) {
+		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Name exists locally with other types, no error and empty answer")
+		answerNodata(w, req, m, answers, cacheKey)
+		return true
+	}
+
+	// The apex of a declared zone exists, with the SOA and NS records
+	if answers.zoneApex(fqdn) != nil {
+		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Zone apex without records of the type, no error and empty answer")
+		trace(w, "path=local-nodata")
+		m.Authoritative = true
+		m.RecursionAvailable = false
+		m.Rcode = dns.RcodeSuccess
+		answers.addNegativeSoa(m, fqdn)
+		Respond(w, req, m)
+		return true
 	}
 
 	// If we are authoritative for a suffix the label has, there's no point trying the recursive DNS
 	authoritativeFor := answers.AuthoritativeSuffixes()
 	for _, suffix := range authoritativeFor {
 		if strings.HasSuffix(fqdn, suffix) {
+			// Names with records of other types, or only names under them, exist
+			if answers.Exists(query, formatFqdn(clientUUID, fqdn), fqdn) || answers.HasDescendants(clientUUID, fqdn) {
+				log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debugf("Name exists in %s without records of the type, no error and empty answer", suffix)
+				answerNodata(w, req, m, answers, cacheKey)
+				return true
+			}
 			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debugf("Not answered locally, but I am authoritative for %s", suffix)
+			trace(w, "path=authoritative")
+			trace(w, "zone=%s", strings.TrimLeft(suffix, "."))
 			m.Authoritative = true
 			m.RecursionAvailable = false
 			m.Rcode = dns.RcodeNameError
-			me := strings.TrimLeft(suffix, ".")
-			hdr := dns.RR_Header{Name: me, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(*defaultTtl)}
-			serial++
-			record := &dns.SOA{Hdr: hdr, Ns: me, Mbox: me, Serial: serial, Refresh: 60, Retry: 10, Expire: 86400, Minttl: 1}
-			m.Ns = append(m.Ns, record)
+			answers.addNegativeSoa(m, fqdn)
 			Respond(w, req, m)
-			return
+			return true
+		}
+	}
+
+	return false
+}
+
+// Answers with NODATA, authoritatively: no error and no answer, the negative answer nevertheless
+// carrying an SOA, as resolvers need one to cache it
+func answerNodata(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg, answers Answers, cacheKey string) {
+	trace(w, "path=local-nodata")
+	m.Authoritative = true
+	m.Rcode = dns.RcodeSuccess
+	m.Answer = nil
+	answers.addNegativeSoa(m, strings.ToLower(req.Question[0].Name))
+	addToClientSpecificCache(cacheKey, req, m)
+	Respond(w, req, m)
+}
+
+// Answers the query from the recursive cache of the query's view or the recursers. Reports whether a
+// response was sent.
+// With fallback set, local answers are tried next, so recursion not being allowed for the client is
+// no error and only responses with answers are sent.
+func answerRecursively(w dns.ResponseWriter, req *dns.Msg, answers Answers, query *QueryContext, fallback bool) bool {
+	clientUUID := query.ClientKey
+	question := req.Question[0]
+	rrString := dns.Type(question.Qtype).String()
+	fqdn := strings.ToLower(question.Name)
+
+	// Clients that may not recurse don't get recursed answers from the cache either
+	if answers.Recursion(clientUUID) && !debugging(w) {
+		if msg, exp := recursionCacheHit(query.View, req); msg != nil {
+			if fallback && !hasAnswers(msg) {
+				trace(w, "recursion=%s", dns.RcodeToString[msg.Rcode])
+				return false
+			}
+			update(msg, exp)
+			Respond(w, req, msg)
+			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent cached recursive response")
+			return true
 		}
 	}
 
 	// Phone a friend - Forward original query
-	msg, err := ResolveTryAll(req, answers.Recursers(clientUUID))
-	if err == nil && msg != nil {
-		msg.Compress = true
-		msg.Id = req.Id
+	if !answers.Recursion(clientUUID) {
+		if fallback {
+			return false
+		}
+		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Recursion not allowed for client")
+		trace(w, "recursion=denied")
+		setExtendedError(w, EDE_PROHIBITED, "recursion not allowed for client")
+		return false
+	}
 
-		// We don't support AAAA, but an NXDOMAIN from the recursive resolver
-		// doesn't necessarily mean there are never any records for that domain,
-		// so rewrite the response code to NOERROR.
-		if (question.Qtype == dns.TypeAAAA) && (msg.Rcode == dns.RcodeNameError) {
-			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Rewrote AAAA NXDOMAIN to NOERROR")
-			msg.Rcode = dns.RcodeSuccess
+	resolvers := answers.RecursersFor(clientUUID, question)
+	upstream := forwardedQuery(req, clientAddr(w))
+	if validator != nil {
+		upstream = validatingQuery(upstream)
+	}
+	msg, substitute, err := resolveWithinBudget(w, req, upstream, resolvers, answers, query, fallback)
+	if substitute == SUBSTITUTE_STALE {
+		return true
+	} else if substitute == SUBSTITUTE_LOCAL {
+		return false
+	}
+	if _, limited := err.(*rateLimitedError); limited && !debugging(w) {
+		if stale := staleCacheHit(query.View, req, time.Duration(*rateLimitStale)*time.Second); stale != nil && (!fallback || hasAnswers(stale)) {
+			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent cached response, zone over its rate limit")
+			trace(w, "path=rate-limited-cache")
+			setExtendedError(w, EDE_STALE_ANSWER, "recursion rate limited")
+			Respond(w, req, stale)
+			return true
+		}
+		if !fallback {
+			// Whatever the miss behavior, the name isn't known not to exist
+			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Info("Zone over its rate limit, no cached response")
+			trace(w, "path=rate-limited")
+			setExtendedError(w, EDE_OTHER, "recursion rate limited")
+			dns.HandleFailed(w, req)
+			return true
+		}
+	}
+	if serveStaleOnFailure(w, req, msg, err, query, fallback) {
+		return true
+	}
+	if err != nil || msg == nil {
+		code, text := recursionError(err)
+		setExtendedError(w, code, text)
+		return false
+	}
+	msg.Compress = true
+	msg.Id = req.Id
+	// Clients that set CD validate for themselves
+	unvalidated := validator != nil && req.CheckingDisabled
+	if validator != nil && !unvalidated {
+		result, err := validator.Validate(msg, resolvers)
+		stats.incr("dnssec" + strings.ToUpper(result[:1]) + result[1:])
+		trace(w, "dnssec=%s", result)
+		if err != nil {
+			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Warnf("Recursive response failed DNSSEC validation: %v", err)
+			if *dnssecFailClosed {
+				setExtendedError(w, EDE_DNSSEC_BOGUS, err.Error())
+				dns.HandleFailed(w, req)
+				return true
+			}
 		}
+	}
+	specific := subnetSpecific(msg)
+	restoreClientSubnet(req, msg)
+
+	// Responses for the client's subnet only aren't cached for everyone, nor are those left unvalidated
+	if !specific && !unvalidated {
+		addToRecursionCache(query.View, req, msg)
+	}
+	if fallback && !hasAnswers(msg) {
+		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn, "rcode": dns.RcodeToString[msg.Rcode]}).Debug("No recursive answer, falling back to local answers")
+		trace(w, "recursion=%s", dns.RcodeToString[msg.Rcode])
+		return false
+	}
+	trace(w, "path=recursion")
+	trace(w, "recursers=%s", strings.Join(resolvers, ","))
 
-		addToGlobalCache(req, msg)
-		if msg, exp := globalCacheHit(req); msg != nil {
+	// The cache keeps an existing entry rather than this response, so debug queries skip it
+	if !debugging(w) && !specific && !unvalidated {
+		if msg, exp := recursionCacheHit(query.View, req); msg != nil {
 			update(msg, exp)
 			Respond(w, req, msg)
 			log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent recursive response")
-			return
+			return true
 		}
-		// For very small TTLs, globalCacheHit above could fail despite adding - respond with the original msg.
-		Respond(w, req, msg)
-		log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent recursive response")
-		return
 	}
-
-	// I give up
-	log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Info("No answer found")
-	dns.HandleFailed(w, req)
+	// For very small TTLs, recursionCacheHit above could fail despite adding - respond with the original msg.
+	Respond(w, req, msg)
+	log.WithFields(log.Fields{"client": clientUUID, "type": rrString, "question": fqdn}).Debug("Sent recursive response")
+	return true
 }
 
 func isTcp(w dns.ResponseWriter) bool {
@@ -415,8 +988,13 @@ func update(msg *dns.Msg, exp time.Time) {
 	if len(msg.Answer) > 1 {
 		shuffle(&msg.Answer)
 	}
+	// The cache counted the TTLs down, no record outlives the entry though
 	var ttl = uint32(time.Until(exp).Seconds())
-	for i := 0; i < len(msg.Answer); i++ {
-		msg.Answer[i].Header().Ttl = ttl
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if header := rr.Header(); header.Rrtype != dns.TypeOPT && header.Ttl > ttl {
+				header.Ttl = ttl
+			}
+		}
 	}
 }
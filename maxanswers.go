@@ -0,0 +1,81 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Page counters of --rrset-max-answers, shared by names like the rotation counters of the cyclic order
+var answerPages [RRSET_ORDER_COUNTERS]uint32
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// Cuts every RRset of the answer section with more than --rrset-max-answers records down to a page of
+// that many, the next page for each response: of the records in a fixed order (by their data), so
+// every one of hundreds of backends of a name is handed out in turn while responses stay small. The
+// pages keep the order of the response. RRsets with a signature are left whole, as it covers them all.
+func capAnswers(m *dns.Msg) {
+	max := int(*rrsetMaxAnswers)
+	if max == 0 || len(m.Answer) <= max {
+		return
+	}
+
+	var keys []rrsetKey
+	sets := make(map[rrsetKey][]dns.RR)
+	signed := make(map[rrsetKey]bool)
+	for _, rr := range m.Answer {
+		header := rr.Header()
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			signed[rrsetKey{strings.ToLower(header.Name), sig.TypeCovered}] = true
+			continue
+		}
+		key := rrsetKey{strings.ToLower(header.Name), header.Rrtype}
+		if _, ok := sets[key]; !ok {
+			keys = append(keys, key)
+		}
+		sets[key] = append(sets[key], rr)
+	}
+
+	dropped := make(map[dns.RR]bool)
+	for _, key := range keys {
+		records := sets[key]
+		if len(records) <= max || signed[key] {
+			continue
+		}
+		ordered := append([]dns.RR{}, records...)
+		sort.SliceStable(ordered, func(i, j int) bool { return rdata(ordered[i]) < rdata(ordered[j]) })
+
+		hash := fnv.New32a()
+		hash.Write([]byte(key.name))
+		counter := &answerPages[(hash.Sum32()+uint32(key.rrtype))%RRSET_ORDER_COUNTERS]
+		page := atomic.AddUint32(counter, 1) - 1
+		start := int(uint64(page) * uint64(max) % uint64(len(ordered)))
+		for i := max; i < len(ordered); i++ {
+			dropped[ordered[(start+i)%len(ordered)]] = true
+		}
+	}
+	if len(dropped) == 0 {
+		return
+	}
+
+	answer := make([]dns.RR, 0, len(m.Answer)-len(dropped))
+	for _, rr := range m.Answer {
+		if !dropped[rr] {
+			answer = append(answer, rr)
+		}
+	}
+	m.Answer = answer
+	stats.incr("answersCapped")
+}
+
+// The record without its header, e.g. "10.0.0.1" for an A record
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCapAnswers(t *testing.T) {
+	defer func(saved uint) { *rrsetMaxAnswers = saved }(*rrsetMaxAnswers)
+	*rrsetMaxAnswers = 2
+	answerPages = [RRSET_ORDER_COUNTERS]uint32{}
+
+	response := func() *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.com.", dns.TypeA)
+		m.Answer = []dns.RR{mustRR(t, "www.example.com. 60 IN CNAME web.example.com.")}
+		for _, i := range []int{5, 3, 1, 4, 2} {
+			m.Answer = append(m.Answer, mustRR(t, fmt.Sprintf("web.example.com. 60 IN A 10.0.0.%d", i)))
+		}
+		return m
+	}
+
+	seen := make(map[string]bool)
+	for _, expected := range [][]string{{"10.0.0.1", "10.0.0.2"}, {"10.0.0.3", "10.0.0.4"}, {"10.0.0.5", "10.0.0.1"}} {
+		m := response()
+		capAnswers(m)
+		if len(m.Answer) != 3 || m.Answer[0].Header().Rrtype != dns.TypeCNAME {
+			t.Fatalf("Expected the CNAME and a page of 2 addresses, got %v", m.Answer)
+		}
+		page := map[string]bool{m.Answer[1].(*dns.A).A.String(): true, m.Answer[2].(*dns.A).A.String(): true}
+		if !page[expected[0]] || !page[expected[1]] {
+			t.Fatalf("Expected the page %v, got %v", expected, m.Answer[1:])
+		}
+		for addr := range page {
+			seen[addr] = true
+		}
+	}
+	if len(seen) != 5 {
+		t.Fatalf("Expected every address to be handed out in turn, got %v", seen)
+	}
+
+	// The pages keep the order of the response
+	m := response()
+	capAnswers(m)
+	if a, b := m.Answer[1].(*dns.A).A.String(), m.Answer[2].(*dns.A).A.String(); a != "10.0.0.3" || b != "10.0.0.2" {
+		t.Fatalf("Expected the response's order, got %s %s", a, b)
+	}
+
+	signed := response()
+	signed.Answer = append(signed.Answer, &dns.RRSIG{Hdr: dns.RR_Header{Name: "web.example.com.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET}, TypeCovered: dns.TypeA})
+	capAnswers(signed)
+	if len(signed.Answer) != 7 {
+		t.Fatalf("Expected a signed RRset to be left whole, got %v", signed.Answer)
+	}
+
+	*rrsetMaxAnswers = 0
+	m = response()
+	capAnswers(m)
+	if len(m.Answer) != 6 {
+		t.Fatalf("Expected no limit by default")
+	}
+}
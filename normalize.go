@@ -0,0 +1,230 @@
+package main
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Queries are matched against the answers by their lower case, fully qualified, ASCII form. Brings
+// the names of the loaded answers (record names, CNAME and PTR targets, search and authoritative
+// suffixes) into that form, logging every name that wasn't, since they would never have matched.
+func normalizeAnswers(answers Answers) {
+	for key, client := range answers {
+		client.A = normalizeA(key, client.A)
+		client.Cname = normalizeCname(key, client.Cname)
+		client.Ptr = normalizePtr(key, client.Ptr)
+		client.Txt = normalizeTxt(key, client.Txt)
+		client.Srv = normalizeSrv(key, client.Srv)
+		for i, suffix := range client.Search {
+			client.Search[i] = normalizedSuffix(key, "search", suffix)
+		}
+		for i, suffix := range client.Authoritative {
+			client.Authoritative[i] = normalizedSuffix(key, "authoritative", suffix)
+		}
+		answers[key] = client
+	}
+}
+
+// The name in normal form, logging the change if there was one
+func normalizedName(client string, kind string, name string) string {
+	normal := normalName(name)
+	if normal != name {
+		log.WithFields(log.Fields{"client": client, "type": kind, "name": name, "normalized": normal}).Warn("Normalized answers name")
+	}
+	return normal
+}
+
+// Suffixes are matched with or without the trailing dot, so only their case and encoding matter
+func normalizedSuffix(client string, kind string, suffix string) string {
+	normal := normalName(suffix)
+	if !strings.HasSuffix(suffix, ".") {
+		normal = strings.TrimSuffix(normal, ".")
+	}
+	if normal != suffix {
+		log.WithFields(log.Fields{"client": client, "type": kind, "name": suffix, "normalized": normal}).Warn("Normalized answers name")
+	}
+	return normal
+}
+
+// Whether a record called name can be added under its normal form, which another record may have
+// been given already
+func normalizedKey(client string, kind string, name string, exists func(string) bool) (string, bool) {
+	normal := normalizedName(client, kind, name)
+	if normal != name && exists(normal) {
+		log.WithFields(log.Fields{"client": client, "type": kind, "name": name, "normalized": normal}).Warn("Ignored record duplicating one with the normalized name")
+		return normal, false
+	}
+	return normal, true
+}
+
+func normalizeA(client string, records map[string]RecordA) map[string]RecordA {
+	if records == nil {
+		return nil
+	}
+	out := make(map[string]RecordA, len(records))
+	for name, record := range records {
+		if normal, ok := normalizedKey(client, "A", name, func(n string) bool { _, ok := records[n]; return ok }); ok {
+			out[normal] = record
+		}
+	}
+	return out
+}
+
+func normalizeCname(client string, records map[string]RecordCname) map[string]RecordCname {
+	if records == nil {
+		return nil
+	}
+	out := make(map[string]RecordCname, len(records))
+	for name, record := range records {
+		if normal, ok := normalizedKey(client, "CNAME", name, func(n string) bool { _, ok := records[n]; return ok }); ok {
+			record.Answer = normalizedName(client, "CNAME target", record.Answer)
+			out[normal] = record
+		}
+	}
+	return out
+}
+
+// PTR keys can also be addresses, which ConvertPtrIps turns into names afterwards; only the
+// reverse names are touched
+func normalizePtr(client string, records map[string]RecordPtr) map[string]RecordPtr {
+	if records == nil {
+		return nil
+	}
+	out := make(map[string]RecordPtr, len(records))
+	for name, record := range records {
+		normal := name
+		if lower := strings.ToLower(strings.TrimSuffix(name, ".")); strings.HasSuffix(lower, "in-addr.arpa") || strings.HasSuffix(lower, "ip6.arpa") {
+			var ok bool
+			if normal, ok = normalizedKey(client, "PTR", name, func(n string) bool { _, ok := records[n]; return ok }); !ok {
+				continue
+			}
+		}
+		record.Answer = normalizedName(client, "PTR target", record.Answer)
+		out[normal] = record
+	}
+	return out
+}
+
+func normalizeTxt(client string, records map[string]RecordTxt) map[string]RecordTxt {
+	if records == nil {
+		return nil
+	}
+	out := make(map[string]RecordTxt, len(records))
+	for name, record := range records {
+		if normal, ok := normalizedKey(client, "TXT", name, func(n string) bool { _, ok := records[n]; return ok }); ok {
+			out[normal] = record
+		}
+	}
+	return out
+}
+
+// Lower case, with a trailing dot, and internationalized labels in their "xn--" (punycode) form
+func normalName(name string) string {
+	if name == "" {
+		return name
+	}
+	labels := dns.SplitDomainName(strings.TrimSpace(name))
+	for i, label := range labels {
+		labels[i] = asciiLabel(strings.ToLower(label))
+	}
+	return dns.Fqdn(strings.Join(labels, "."))
+}
+
+func asciiLabel(label string) string {
+	for i := 0; i < len(label); i++ {
+		if label[i] >= utf8.RuneSelf {
+			return "xn--" + punycode(label)
+		}
+	}
+	return label
+}
+
+// Punycode encoding of a label (RFC 3492, section 6.3)
+func punycode(label string) string {
+	const (
+		base        = 36
+		tmin        = 1
+		tmax        = 26
+		skew        = 38
+		damp        = 700
+		initialBias = 72
+		initialN    = 128
+	)
+	digit := func(d int) byte {
+		if d < 26 {
+			return byte('a' + d)
+		}
+		return byte('0' + d - 26)
+	}
+	adapt := func(delta, points int, first bool) int {
+		if first {
+			delta /= damp
+		} else {
+			delta /= 2
+		}
+		delta += delta / points
+		k := 0
+		for delta > ((base-tmin)*tmax)/2 {
+			delta /= base - tmin
+			k += base
+		}
+		return k + (base-tmin+1)*delta/(delta+skew)
+	}
+
+	runes := []rune(label)
+	var out []byte
+	for _, r := range runes {
+		if r < initialN {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := initialN, 0, initialBias
+	for handled < len(runes) {
+		m := int(^uint(0) >> 1)
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tmin {
+					t = tmin
+				} else if t > tmax {
+					t = tmax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, digit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			out = append(out, digit(q))
+			bias = adapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
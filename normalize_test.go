@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestNormalName(t *testing.T) {
+	cases := map[string]string{
+		"Web.Example.COM":   "web.example.com.",
+		"web.example.com.":  "web.example.com.",
+		"bücher.example":    "xn--bcher-kva.example.",
+		"BÜCHER.example.":   "xn--bcher-kva.example.",
+		"例え.テスト":            "xn--r8jz45g.xn--zckzah.",
+		"münchen-ost.de":    "xn--mnchen-ost-9db.de.",
+		" padded.example. ": "padded.example.",
+	}
+	for name, expected := range cases {
+		if normal := normalName(name); normal != expected {
+			t.Fatalf("Incorrect normal form of %q: expected %s, got %s", name, expected, normal)
+		}
+	}
+}
+
+func TestNormalizeAnswers(t *testing.T) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Search: []string{"Rancher.Internal"},
+			A: map[string]RecordA{
+				"Web.":  {Answer: []string{"10.1.1.1"}},
+				"DB":    {Answer: []string{"10.1.1.2"}},
+				"db.":   {Answer: []string{"10.1.1.3"}},
+				"name.": {Answer: []string{"10.1.1.4"}},
+			},
+			Cname: map[string]RecordCname{"WWW": {Answer: "Web"}},
+			Ptr: map[string]RecordPtr{
+				"10.1.1.1":              {Answer: "Web"},
+				"2.1.1.10.IN-ADDR.ARPA": {Answer: "db."},
+			},
+		},
+	}
+	normalizeAnswers(answers)
+	ConvertPtrIps(&answers)
+
+	client := answers[DEFAULT_KEY]
+	if client.Search[0] != "rancher.internal" {
+		t.Fatalf("Incorrect search suffix %v", client.Search)
+	}
+	if len(client.A) != 3 || client.A["web."].Answer[0] != "10.1.1.1" || client.A["db."].Answer[0] != "10.1.1.3" {
+		t.Fatalf("Incorrect A records %v", client.A)
+	}
+	if client.Cname["www."].Answer != "web." {
+		t.Fatalf("Incorrect CNAME records %v", client.Cname)
+	}
+	if client.Ptr["1.1.1.10.in-addr.arpa."].Answer != "web." || client.Ptr["2.1.1.10.in-addr.arpa."].Answer != "db." {
+		t.Fatalf("Incorrect PTR records %v", client.Ptr)
+	}
+	if client.Txt != nil {
+		t.Fatalf("Missing records should stay nil")
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NSEC3 flag marking that insecure delegations may be left out of the chain (RFC 5155, section 3.1.2.1)
+const NSEC3_OPT_OUT = 1
+
+// Validators treat chains with more iterations as insecure (RFC 9276, section 3.2)
+const MAX_NSEC3_ITERATIONS = 150
+
+// How the owner names of a signed zone are hashed for authenticated denial of existence. Hashing
+// (with a salt) keeps the contents of the zone from being walked the way a plain NSEC chain can be.
+type NSEC3Params struct {
+	// Hex encoded, empty for no salt
+	Salt       string
+	Iterations uint16
+	OptOut     bool
+}
+
+// A salt of n random bytes, hex encoded. Rotating it whenever the chain is rebuilt makes
+// precomputed dictionaries of hashes useless.
+func randomSalt(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return strings.ToUpper(hex.EncodeToString(b))
+}
+
+// An NSEC3 chain of a zone, sorted by hashed owner name
+type nsec3Chain struct {
+	zone    string
+	params  NSEC3Params
+	records []*dns.NSEC3
+}
+
+// Builds the chain for the zone from the types present at each owner name. Empty non-terminals
+// between the apex and the owners get records without types, as RFC 5155 (section 7.1) requires.
+// With opt-out, delegations (no DS is ever published for them) are left out, and so are the empty
+// non-terminals only they had.
+func newNSEC3Chain(zone string, owners map[string][]uint16, params NSEC3Params, ttl uint32) *nsec3Chain {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	types := make(map[string][]uint16)
+	types[zone] = nil
+	for owner, ownerTypes := range owners {
+		owner = strings.ToLower(dns.Fqdn(owner))
+		if !dns.IsSubDomain(zone, owner) {
+			continue
+		}
+		if params.OptOut && owner != zone && delegationTypes(ownerTypes) && !typeInBitmap(ownerTypes, dns.TypeDS) {
+			continue
+		}
+		types[owner] = append(types[owner], ownerTypes...)
+		for name := parentName(owner); name != "" && name != zone && dns.IsSubDomain(zone, name); name = parentName(name) {
+			if _, ok := types[name]; !ok {
+				types[name] = nil
+			}
+		}
+	}
+
+	flags := uint8(0)
+	if params.OptOut {
+		flags = NSEC3_OPT_OUT
+	}
+	hashes := make(map[string]string)
+	var sorted []string
+	for name := range types {
+		hash := dns.HashName(name, dns.SHA1, params.Iterations, params.Salt)
+		hashes[hash] = name
+		sorted = append(sorted, hash)
+	}
+	sort.Strings(sorted)
+
+	chain := &nsec3Chain{zone: zone, params: params}
+	for i, hash := range sorted {
+		bitmap := append([]uint16{}, types[hashes[hash]]...)
+		if len(bitmap) > 0 {
+			bitmap = append(bitmap, dns.TypeRRSIG)
+		}
+		chain.records = append(chain.records, &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(hash) + "." + zone, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: ttl},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			Iterations: params.Iterations,
+			SaltLength: uint8(len(params.Salt) / 2),
+			Salt:       params.Salt,
+			HashLength: 20,
+			NextDomain: sorted[(i+1)%len(sorted)],
+			TypeBitMap: sortedTypes(bitmap),
+		})
+	}
+	return chain
+}
+
+func sortedTypes(types []uint16) []uint16 {
+	seen := make(map[uint16]bool)
+	var out []uint16
+	for _, t := range types {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	sort.Sort(uint16s(out))
+	return out
+}
+
+type uint16s []uint16
+
+func (u uint16s) Len() int           { return len(u) }
+func (u uint16s) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
+func (u uint16s) Less(i, j int) bool { return u[i] < u[j] }
+
+// The name with its first label removed, "" for the root
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return ""
+}
+
+func (c *nsec3Chain) matching(name string) *dns.NSEC3 {
+	for _, rr := range c.records {
+		if rr.Match(name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+func (c *nsec3Chain) covering(name string) *dns.NSEC3 {
+	for _, rr := range c.records {
+		if nsec3Covers(rr, name) {
+			return rr
+		}
+	}
+	return nil
+}
+
+// Records proving that the name doesn't exist (RFC 5155, section 7.2.2): the record matching the
+// closest encloser, the one covering the next closer name and the one covering the wildcard at the
+// closest encloser. For a name that exists (NODATA), the record matching it.
+func (c *nsec3Chain) Denial(name string) []dns.RR {
+	name = strings.ToLower(dns.Fqdn(name))
+	if rr := c.matching(name); rr != nil {
+		return []dns.RR{rr}
+	}
+
+	nextCloser := name
+	for encloser := parentName(name); encloser != "" && dns.IsSubDomain(c.zone, encloser); encloser = parentName(encloser) {
+		match := c.matching(encloser)
+		if match == nil {
+			nextCloser = encloser
+			continue
+		}
+		var proof []dns.RR
+		added := map[string]bool{}
+		for _, rr := range []*dns.NSEC3{match, c.covering(nextCloser), c.covering("*." + encloser)} {
+			if rr != nil && !added[rr.Hdr.Name] {
+				added[rr.Hdr.Name] = true
+				proof = append(proof, rr)
+			}
+		}
+		return proof
+	}
+	return nil
+}
+
+// Whether the hash of the name falls strictly between the hashed owner and the next hash, the last
+// record of the chain wrapping around to the first
+func nsec3Covers(rr *dns.NSEC3, name string) bool {
+	hash, ok := nsec3Hash(rr, name)
+	if !ok {
+		return false
+	}
+	owner, next := nsec3Owner(rr), strings.ToUpper(rr.NextDomain)
+	if owner < next {
+		return owner < hash && hash < next
+	}
+	return hash != owner && (owner < hash || hash < next)
+}
+
+func nsec3Hash(rr *dns.NSEC3, name string) (string, bool) {
+	if rr.Hash != dns.SHA1 {
+		return "", false
+	}
+	hash := dns.HashName(name, rr.Hash, rr.Iterations, rr.Salt)
+	return hash, hash != ""
+}
+
+func nsec3Owner(rr *dns.NSEC3) string {
+	return strings.ToUpper(dns.SplitDomainName(rr.Hdr.Name)[0])
+}
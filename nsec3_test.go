@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestNSEC3Chain(t *testing.T) {
+	owners := map[string][]uint16{
+		"discover.internal.":           {dns.TypeSOA, dns.TypeNS},
+		"web.stack.discover.internal.": {dns.TypeA},
+		"db.discover.internal.":        {dns.TypeA, dns.TypeTXT},
+	}
+	params := NSEC3Params{Salt: "AABBCCDD", Iterations: 5, OptOut: true}
+	chain := newNSEC3Chain("discover.internal", owners, params, 60)
+
+	// The apex, two owners and the empty non-terminal stack.discover.internal.
+	if len(chain.records) != 4 {
+		t.Fatalf("Incorrect number of NSEC3 records %v", chain.records)
+	}
+	for i, rr := range chain.records {
+		next := chain.records[(i+1)%len(chain.records)]
+		if strings.ToUpper(dns.SplitDomainName(next.Hdr.Name)[0]) != rr.NextDomain {
+			t.Fatalf("Broken chain at %v", rr)
+		}
+		if rr.Flags != NSEC3_OPT_OUT || rr.Salt != "AABBCCDD" || rr.Iterations != 5 {
+			t.Fatalf("Incorrect parameters %v", rr)
+		}
+	}
+	if ent := chain.matching("stack.discover.internal."); ent == nil || len(ent.TypeBitMap) != 0 {
+		t.Fatalf("Expected an empty non-terminal record, got %v", ent)
+	}
+	if db := chain.matching("db.discover.internal."); db == nil || len(db.TypeBitMap) != 3 {
+		t.Fatalf("Expected A, TXT and RRSIG for db., got %v", db)
+	}
+
+	if proof := chain.Denial("db.discover.internal."); len(proof) != 1 {
+		t.Fatalf("Expected a single matching record for NODATA, got %v", proof)
+	}
+	proof := chain.Denial("missing.stack.discover.internal.")
+	if len(proof) < 2 || !proof[0].(*dns.NSEC3).Match("stack.discover.internal.") {
+		t.Fatalf("Expected the closest encloser proof, got %v", proof)
+	}
+	for _, rr := range proof[1:] {
+		if nsec3 := rr.(*dns.NSEC3); !nsec3Covers(nsec3, "missing.stack.discover.internal.") && !nsec3Covers(nsec3, "*.stack.discover.internal.") {
+			t.Fatalf("Unexpected record in the proof %v", rr)
+		}
+	}
+
+	// Every name without a record is covered, those hashed past the last owner included
+	for c := 'a'; c <= 'z'; c++ {
+		name := string(c) + ".discover.internal."
+		if chain.matching(name) == nil && chain.covering(name) == nil {
+			t.Fatalf("Expected a record covering %s", name)
+		}
+	}
+}
+
+func TestRandomSalt(t *testing.T) {
+	if a, b := randomSalt(8), randomSalt(8); len(a) != 16 || a == b {
+		t.Fatalf("Expected two different 8 byte salts, got %s and %s", a, b)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Stages of answering a query, in the order given by the zone's "order" rule
+const (
+	ORDER_LOCAL   = "local"
+	ORDER_RECURSE = "recurse"
+)
+
+var DEFAULT_ORDER = []string{ORDER_LOCAL, ORDER_RECURSE}
+
+// Resolution order rules, read from the "order" list of the default entry. A query is answered by
+// the stages of the rule with the most specific zone containing the name, in order, each one only
+// if the previous ones had nothing: e.g. ["recurse", "local"] asks the recursers first and uses the
+// local answers as a fallback, ["local"] never recurses.
+func (answers *Answers) OrderRules() []OrderRule {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.Order
+}
+
+func (answers *Answers) OrderFor(fqdn string) []string {
+	order := DEFAULT_ORDER
+	longest := -1
+	for _, rule := range answers.OrderRules() {
+		if inZone(fqdn, rule.Zone) && len(rule.Zone) > longest {
+			order = rule.Order
+			longest = len(rule.Zone)
+		}
+	}
+	return order
+}
+
+// Whether the stage answers queries for the name
+func (answers *Answers) orderHas(fqdn string, stage string) bool {
+	for _, s := range answers.OrderFor(fqdn) {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *OrderRule) Validate() error {
+	if rule.Zone == "" {
+		return fmt.Errorf("order rule without a zone: %+v", *rule)
+	}
+	if len(rule.Order) == 0 {
+		return fmt.Errorf("empty order for zone %s", rule.Zone)
+	}
+	seen := make(map[string]bool)
+	for _, stage := range rule.Order {
+		if stage != ORDER_LOCAL && stage != ORDER_RECURSE {
+			return fmt.Errorf("invalid stage for zone %s: %s, expected %s or %s", rule.Zone, stage, ORDER_LOCAL, ORDER_RECURSE)
+		}
+		if seen[stage] {
+			return fmt.Errorf("stage %s given twice for zone %s", stage, rule.Zone)
+		}
+		seen[stage] = true
+	}
+	return nil
+}
+
+// Whether a response has answers, rather than being negative or an error
+func hasAnswers(msg *dns.Msg) bool {
+	return msg.Rcode == dns.RcodeSuccess && len(msg.Answer) > 0
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestOrderFor(t *testing.T) {
+	answers := Answers{DEFAULT_KEY: ClientAnswers{Order: []OrderRule{
+		{Zone: "legacy.example.com", Order: []string{ORDER_RECURSE, ORDER_LOCAL}},
+		{Zone: "local.legacy.example.com.", Order: []string{ORDER_LOCAL}},
+	}}}
+	if order := answers.OrderFor("web.example.com."); len(order) != 2 || order[0] != ORDER_LOCAL {
+		t.Fatalf("Expected the default order, got %v", order)
+	}
+	if order := answers.OrderFor("web.legacy.example.com."); len(order) != 2 || order[0] != ORDER_RECURSE {
+		t.Fatalf("Expected recursion first, got %v", order)
+	}
+	if order := answers.OrderFor("web.local.legacy.example.com."); len(order) != 1 {
+		t.Fatalf("Expected the most specific zone's order, got %v", order)
+	}
+
+	for _, rule := range []OrderRule{
+		{Order: []string{ORDER_LOCAL}},
+		{Zone: "example.com"},
+		{Zone: "example.com", Order: []string{"cache"}},
+		{Zone: "example.com", Order: []string{ORDER_LOCAL, ORDER_LOCAL}},
+	} {
+		if err := rule.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", rule)
+		}
+	}
+}
+
+func TestRecurseFirst(t *testing.T) {
+	dns.HandleFunc("legacy.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.Question[0].Name == "upstream.legacy.test." {
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("10.9.9.9"),
+			}}
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("legacy.test.")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	saved, savedEnvironments, savedCache := answers, environmentAnswers, globalCache
+	defer func() { answers, environmentAnswers, globalCache = saved, savedEnvironments, savedCache }()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Recurse: []string{conn.LocalAddr().String()},
+		Order:   []OrderRule{{Zone: "legacy.test", Order: []string{ORDER_RECURSE, ORDER_LOCAL}}},
+		A: map[string]RecordA{
+			"upstream.legacy.test.": {Answer: []string{"10.0.0.1"}},
+			"local.legacy.test.":    {Answer: []string{"10.0.0.2"}},
+		},
+	}}
+	environmentAnswers = nil
+	globalCache = cache.New(10, 600)
+	clearClientSpecificCaches()
+
+	for name, expected := range map[string]string{"upstream.legacy.test.": "10.9.9.9", "local.legacy.test.": "10.0.0.2"} {
+		// Twice, the second time from the caches
+		for i := 0; i < 2; i++ {
+			req := new(dns.Msg)
+			req.SetQuestion(name, dns.TypeA)
+			w := &testWriter{}
+			route(w, req)
+			if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != expected {
+				t.Fatalf("Expected %s for %s, got %v", expected, name, w.msg)
+			}
+		}
+	}
+}
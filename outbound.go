@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// Source addresses of queries to recursers (--recurse-source), per address family
+	recurseSource4, recurseSource6 net.IP
+)
+
+// Checks --recurse-source and --recurse-interface. Called once when parsing flags.
+func setupOutbound() error {
+	recurseSource4, recurseSource6 = nil, nil
+	for _, s := range splitTrim(*recurseSource, ",") {
+		if s == "" {
+			continue
+		}
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+			return fmt.Errorf("invalid source address %s", s)
+		case ip.To4() != nil && recurseSource4 == nil:
+			recurseSource4 = ip
+		case ip.To4() == nil && recurseSource6 == nil:
+			recurseSource6 = ip
+		default:
+			return fmt.Errorf("more than one source address of the family of %s", s)
+		}
+	}
+	if *recurseInterface != "" {
+		if _, err := net.InterfaceByName(*recurseInterface); err != nil {
+			return fmt.Errorf("unknown interface %s: %v", *recurseInterface, err)
+		}
+	}
+	return nil
+}
+
+// The dialer for queries to the recurser, bound to the configured source address of its family and
+// interface; nil when neither is configured, so the system picks them.
+func outboundDialer(transport, resolver string, timeout time.Duration) *net.Dialer {
+	if recurseSource4 == nil && recurseSource6 == nil && *recurseInterface == "" {
+		return nil
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	host, _, _ := net.SplitHostPort(resolver)
+	source := recurseSource6
+	if ip := net.ParseIP(host); ip == nil || ip.To4() != nil {
+		source = recurseSource4
+	}
+	if source != nil {
+		if transport == "tcp" {
+			dialer.LocalAddr = &net.TCPAddr{IP: source}
+		} else {
+			dialer.LocalAddr = &net.UDPAddr{IP: source}
+		}
+	}
+	if iface := *recurseInterface; iface != "" {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			return bindToDevice(c, iface)
+		}
+	}
+	return dialer
+}
+
+// Like dns.Client.Exchange, over a connection from the dialer
+func exchangeFrom(dialer *net.Dialer, req *dns.Msg, transport, resolver string, timeout time.Duration) (*dns.Msg, error) {
+	conn, err := dialer.Dial(transport, resolver)
+	if err != nil {
+		return nil, err
+	}
+	co := &dns.Conn{Conn: conn}
+	defer co.Close()
+	if o := req.IsEdns0(); o != nil && o.UDPSize() >= dns.MinMsgSize {
+		co.UDPSize = o.UDPSize()
+	}
+
+	co.SetWriteDeadline(time.Now().Add(timeout))
+	if err := co.WriteMsg(req); err != nil {
+		return nil, err
+	}
+	co.SetReadDeadline(time.Now().Add(timeout))
+	resp, err := co.ReadMsg()
+	if err == nil && resp.Id != req.Id {
+		err = dns.ErrId
+	}
+	return resp, err
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"syscall"
+)
+
+func bindToDevice(c syscall.RawConn, iface string) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	}); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecurseSource(t *testing.T) {
+	saved := *recurseSource
+	defer func() {
+		*recurseSource = saved
+		setupOutbound()
+	}()
+
+	for _, invalid := range []string{"not-an-ip", "10.0.0.1,10.0.0.2", "::1,fe80::1"} {
+		*recurseSource = invalid
+		if err := setupOutbound(); err == nil {
+			t.Fatalf("Expected %s to be rejected", invalid)
+		}
+	}
+	*recurseSource = "::1, 127.0.0.2"
+	if err := setupOutbound(); err != nil || !recurseSource4.Equal(net.ParseIP("127.0.0.2")) || !recurseSource6.Equal(net.ParseIP("::1")) {
+		t.Fatalf("Expected one source address per family [%v %v %v]", recurseSource4, recurseSource6, err)
+	}
+
+	dns.HandleFunc("source.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{w.RemoteAddr().(*net.UDPAddr).IP.String()},
+		}}
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("source.test.")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	req := new(dns.Msg)
+	req.SetQuestion("source.test.", dns.TypeTXT)
+	resp, err := exchange(req, "udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txt, ok := resp.Answer[0].(*dns.TXT); !ok || txt.Txt[0] != "127.0.0.2" {
+		t.Fatalf("Expected the query to come from the source address [%v]", resp)
+	}
+}
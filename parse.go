@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -9,25 +10,191 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
-func ParseAnswers(path string) (out Answers, err error) {
-	out = make(Answers)
+func ParseAnswers(path string) (Answers, error) {
+	if isAnswersUrl(path) {
+		return parseSnapshot(path, *answersCache)
+	}
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			log.Warn("Failed to find: ", path)
-			return out, nil
+			return make(Answers), nil
 		}
 		return nil, err
 	}
+	out, err := parseAnswersData(data)
+	if err != nil {
+		return nil, err
+	}
+	out.SetSource(fileSource(path))
+	return out, nil
+}
+
+// Reads, validates and normalizes answers in the answers file format
+func parseAnswersData(data []byte) (out Answers, err error) {
+	out = make(Answers)
+
+	if data, err = flattenEnvironments(data, out); err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
 
-	if yaml.Unmarshal(data, &out); err != nil {
+	if err := expandShorthand(out); err != nil {
 		return nil, err
 	}
 
+	for key, client := range out {
+		switch strings.ToLower(client.Miss) {
+		case "", MISS_SERVFAIL, MISS_NXDOMAIN, MISS_REFUSED:
+		default:
+			return nil, fmt.Errorf("invalid miss behavior for %s: %s", key, client.Miss)
+		}
+		if _, clientKey := splitEnvironmentKey(key); strings.Contains(clientKey, "/") && parseNetwork(clientKey) == nil {
+			return nil, fmt.Errorf("invalid client network: %s", key)
+		}
+		for _, rule := range client.Patterns {
+			if err := rule.Validate(); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		for name, rec := range client.A {
+			if err := rec.ValidateWeights(name); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+			if rec.Check != nil {
+				if err := rec.Check.Validate(name); err != nil {
+					return nil, fmt.Errorf("%s: %v", key, err)
+				}
+			}
+		}
+	}
+
+	for _, rule := range out.EnvironmentRules() {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validateRules(out); err != nil {
+		return nil, err
+	}
+	for _, environment := range out.Environments() {
+		if err := validateRules(environment); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := checkRecursers(out); err != nil {
+		return nil, err
+	}
+	if err := validateSrvRecords(out); err != nil {
+		return nil, err
+	}
+
+	normalizeMacKeys(out)
+	normalizeAnswers(out)
 	ConvertPtrIps(&out)
 	return out, nil
 }
 
+// Moves the answers of each environment under the top-level "environments" key into out, as
+// "<environment>#<client>" entries. Returns the rest of the config.
+func flattenEnvironments(data []byte, out Answers) ([]byte, error) {
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	section, ok := config[ENVIRONMENTS_KEY]
+	if !ok {
+		return data, nil
+	}
+
+	var environments map[string]Answers
+	sectionData, err := yaml.Marshal(section)
+	if err == nil {
+		err = yaml.Unmarshal(sectionData, &environments)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid environments: %v", err)
+	}
+	for name, environment := range environments {
+		if name == "" || strings.Contains(name, ENVIRONMENT_SEPARATOR) {
+			return nil, fmt.Errorf("invalid environment name: %s", name)
+		}
+		for key, client := range environment {
+			out[environmentKey(name, key)] = client
+		}
+	}
+
+	delete(config, ENVIRONMENTS_KEY)
+	return yaml.Marshal(config)
+}
+
+// Checks the rules read from the default entry
+func validateRules(answers Answers) error {
+	for _, rule := range answers.TagRules() {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range answers.RouteRules() {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range answers.SuppressRules() {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range answers.OrderRules() {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, rule := range answers.RateLimitRules() {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, rule := range answers.BlocklistRules() {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("duplicate blocklist %s", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	zones := make(map[string]bool)
+	for _, rule := range answers.ZoneRules() {
+		if err := rule.Validate(); err != nil {
+			return err
+		}
+		if zones[rule.name()] {
+			return fmt.Errorf("duplicate zone %s", rule.name())
+		}
+		zones[rule.name()] = true
+	}
+
+	if identity := answers.Identity(); identity != nil {
+		if err := identity.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func ConvertPtrIps(answers *Answers) {
 	// Convert PTR keys that are IP addresses into "4.3.2.1.in-addr.arpa." form.
 	for _, client := range *answers {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Pattern rules, read from the "patterns" list of a client entry: names (lower case, without the
+// trailing dot) matching the regular expression get the answer, in which $1, ${2} or ${name} are
+// replaced by what the groups of the expression captured, e.g. "^pr-(\d+)\.build\.internal$" answering
+// "10.99.0.$1". Patterns are tried after exact and wildcard names, those of the client's entry first,
+// and the first matching rule of the type wins. "A" rules answer AAAA queries with IPv6 answers too.
+
+var (
+	patternsMutex sync.Mutex
+	// Compiled expressions, keyed by their source
+	compiledPatterns = make(map[string]*regexp.Regexp)
+)
+
+func compilePattern(expr string) (*regexp.Regexp, error) {
+	patternsMutex.Lock()
+	defer patternsMutex.Unlock()
+	if re, ok := compiledPatterns[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	compiledPatterns[expr] = re
+	return re, nil
+}
+
+func (rule *PatternRule) Validate() error {
+	if _, err := compilePattern(rule.Match); err != nil {
+		return fmt.Errorf("invalid pattern %s: %v", rule.Match, err)
+	}
+	switch strings.ToUpper(rule.Type) {
+	case "A", "TXT", "SRV":
+		if len(rule.Answer) == 0 {
+			return fmt.Errorf("pattern %s without an answer", rule.Match)
+		}
+	case "CNAME", "PTR":
+		if len(rule.Answer) != 1 {
+			return fmt.Errorf("pattern %s must have a single %s answer", rule.Match, strings.ToUpper(rule.Type))
+		}
+	default:
+		return fmt.Errorf("invalid type for pattern %s: %s", rule.Match, rule.Type)
+	}
+	return nil
+}
+
+// Whether the rule answers queries of the type
+func (rule *PatternRule) answers(qtype uint16) bool {
+	ruleType := dns.StringToType[strings.ToUpper(rule.Type)]
+	return ruleType == qtype || (ruleType == dns.TypeA && qtype == dns.TypeAAAA)
+}
+
+// The records of the first pattern rule of the client's or the default entry matching the name
+func (answers *Answers) MatchingPatterns(qtype uint16, clientUUID string, fqdn string, answerFqdn string) (records []dns.RR, ok bool) {
+	keys := []string{clientUUID}
+	if clientUUID != DEFAULT_KEY {
+		keys = append(keys, DEFAULT_KEY)
+	}
+	name := strings.TrimSuffix(fqdn, ".")
+	for _, key := range keys {
+		for _, rule := range (*answers)[key].Patterns {
+			if !rule.answers(qtype) {
+				continue
+			}
+			re, err := compilePattern(rule.Match)
+			if err != nil {
+				continue
+			}
+			match := re.FindStringSubmatchIndex(name)
+			if match == nil {
+				continue
+			}
+
+			// The expanded answer is served like a record of the name
+			var answer []string
+			for _, template := range rule.Answer {
+				answer = append(answer, string(re.ExpandString(nil, template, name, match)))
+			}
+			client := ClientAnswers{}
+			switch strings.ToUpper(rule.Type) {
+			case "A":
+				client.A = map[string]RecordA{fqdn: {Answer: answer, Ttl: rule.Ttl}}
+			case "CNAME":
+				client.Cname = map[string]RecordCname{fqdn: {Answer: dns.Fqdn(answer[0]), Ttl: rule.Ttl}}
+			case "PTR":
+				client.Ptr = map[string]RecordPtr{fqdn: {Answer: dns.Fqdn(answer[0]), Ttl: rule.Ttl}}
+			case "TXT":
+				client.Txt = map[string]RecordTxt{fqdn: {Answer: answer, Ttl: rule.Ttl}}
+			case "SRV":
+				client.Srv = map[string]RecordSrv{fqdn: {Answer: answer, Ttl: rule.Ttl}}
+			}
+			expanded := Answers{key: client}
+			if records, ok = expanded.MatchingExact(qtype, key, fqdn, answerFqdn); ok {
+				log.WithFields(log.Fields{"fqdn": fqdn, "client": key, "pattern": rule.Match, "answer": answer}).Debug("Matched pattern")
+				return
+			}
+		}
+	}
+	return nil, false
+}
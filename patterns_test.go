@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPatternAnswers(t *testing.T) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A: map[string]RecordA{"pr-1.build.internal.": {Answer: []string{"10.0.0.1"}}},
+			Patterns: []PatternRule{
+				{Match: `^pr-(\d+)\.build\.internal$`, Type: "A", Answer: []string{"10.99.0.$1", "fd00:99::$1"}},
+				{Match: `^(?P<branch>[a-z0-9-]+)\.ci\.internal$`, Type: "CNAME", Answer: []string{"${branch}.runners.internal"}},
+				{Match: `^(.+)\.txt\.internal$`, Type: "TXT", Answer: []string{"env=$1"}},
+				{Match: `^bad-(.+)\.build\.internal$`, Type: "A", Answer: []string{"10.99.0.$1"}},
+			},
+		},
+		"10.1.1.1": ClientAnswers{
+			Patterns: []PatternRule{
+				{Match: `^pr-7\.build\.internal$`, Type: "A", Answer: []string{"10.1.0.7"}},
+			},
+		},
+	}
+
+	for _, test := range []struct {
+		client   string
+		name     string
+		qtype    uint16
+		expected string
+	}{
+		{"10.2.2.2", "pr-42.build.internal.", dns.TypeA, "10.99.0.42"},
+		{"10.2.2.2", "pr-42.build.internal.", dns.TypeAAAA, "fd00:99::42"},
+		{"10.2.2.2", "feature-x.ci.internal.", dns.TypeCNAME, "feature-x.runners.internal."},
+		{"10.2.2.2", "staging.txt.internal.", dns.TypeTXT, "env=staging"},
+		// The client's own patterns come first
+		{"10.1.1.1", "pr-7.build.internal.", dns.TypeA, "10.1.0.7"},
+		{"10.2.2.2", "pr-7.build.internal.", dns.TypeA, "10.99.0.7"},
+		// Exact names win, even for the types they don't have
+		{"10.2.2.2", "pr-1.build.internal.", dns.TypeA, "10.0.0.1"},
+		{"10.2.2.2", "pr-1.build.internal.", dns.TypeAAAA, ""},
+		// Expansions that aren't valid answers of the type answer nothing
+		{"10.2.2.2", "bad-x.build.internal.", dns.TypeA, ""},
+		{"10.2.2.2", "pr-42.build.internal.", dns.TypeTXT, ""},
+	} {
+		records, ok := answers.Matching(test.qtype, &QueryContext{ClientKey: test.client}, test.name, test.name)
+		if test.expected == "" {
+			if ok {
+				t.Fatalf("Expected nothing for %s %s, got %v", dns.TypeToString[test.qtype], test.name, records)
+			}
+			continue
+		}
+		if !ok || len(records) != 1 || records[0].Header().Name != test.name {
+			t.Fatalf("Expected %s for %s %s, got %v", test.expected, dns.TypeToString[test.qtype], test.name, records)
+		}
+		var got string
+		switch record := records[0].(type) {
+		case *dns.A:
+			got = record.A.String()
+		case *dns.AAAA:
+			got = record.AAAA.String()
+		case *dns.CNAME:
+			got = record.Target
+		case *dns.TXT:
+			got = record.Txt[0]
+		}
+		if got != test.expected {
+			t.Fatalf("Expected %s for %s %s, got %v", test.expected, dns.TypeToString[test.qtype], test.name, records)
+		}
+	}
+
+	for _, invalid := range []PatternRule{
+		{Match: `^(.+\.build$`, Type: "A", Answer: []string{"10.0.0.1"}},
+		{Match: `^(.+)\.build$`, Type: "MX", Answer: []string{"mail.$1"}},
+		{Match: `^(.+)\.build$`, Type: "A"},
+		{Match: `^(.+)\.build$`, Type: "CNAME", Answer: []string{"a.$1", "b.$1"}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
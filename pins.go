@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const SOURCE_PINS = "pins"
+
+const (
+	DEFAULT_PIN_DURATION = 30 * time.Minute
+	MAX_PIN_DURATION     = 24 * time.Hour
+)
+
+// A temporary override set through POST /v1/pins. Pins take priority over every configured source,
+// expire on their own and are never journaled or copied to a standby.
+type Pin struct {
+	Client  string    `json:"client"`
+	Type    string    `json:"type"`
+	Name    string    `json:"name"`
+	Answer  []string  `json:"answer"`
+	Ttl     uint32    `json:"ttl"`
+	Comment string    `json:"comment,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// Body of POST /v1/pins: the record to pin and for how long ("30m", default 30 minutes)
+type PinRequest struct {
+	RecordOp
+	For string `json:"for,omitempty"`
+}
+
+var (
+	pinRecords = &recordSource{name: SOURCE_PINS, answers: make(Answers)}
+
+	pinsMutex sync.Mutex
+	// Live pins, keyed by client, type and name
+	pins     = make(map[string]Pin)
+	pinTimer *time.Timer
+)
+
+func pinKey(client, qtype, name string) string {
+	return client + " " + qtype + " " + name
+}
+
+// Pins a record until the requested duration has passed, replacing any pin of the same record
+func AddPin(req PinRequest) (Pin, error) {
+	duration := DEFAULT_PIN_DURATION
+	if req.For != "" {
+		var err error
+		if duration, err = time.ParseDuration(req.For); err != nil {
+			return Pin{}, fmt.Errorf("invalid duration %s", req.For)
+		}
+	}
+	if duration <= 0 || duration > MAX_PIN_DURATION {
+		return Pin{}, fmt.Errorf("pin duration must be between 0 and %s", MAX_PIN_DURATION)
+	}
+
+	// The pinned answer is validated and normalized the same way as a runtime record
+	op := req.RecordOp
+	op.Op = OP_SET
+	scratch := make(Answers)
+	change, err := scratch.apply(op, SOURCE_PINS)
+	if err != nil {
+		return Pin{}, err
+	}
+
+	// Resolvers shouldn't keep the pinned answer much past the pin
+	ttl := uint32(*defaultTtl)
+	if op.Ttl != nil {
+		ttl = *op.Ttl
+	}
+	if seconds := uint32(duration.Seconds()); seconds > 0 && ttl > seconds {
+		ttl = seconds
+	}
+
+	pin := Pin{
+		Client:  change.Client,
+		Type:    change.Type,
+		Name:    change.Name,
+		Answer:  change.After,
+		Ttl:     ttl,
+		Comment: op.Comment,
+		Expires: now().Add(duration),
+	}
+
+	pinsMutex.Lock()
+	pins[pinKey(pin.Client, pin.Type, pin.Name)] = pin
+	refreshPins()
+	pinsMutex.Unlock()
+
+	log.WithFields(log.Fields{"client": pin.Client, "type": pin.Type, "name": pin.Name, "answer": pin.Answer,
+		"expires": pin.Expires.Format(time.RFC3339)}).Warn("Pinned record")
+	return pin, nil
+}
+
+// Removes a pin before it expires
+func RemovePin(client, qtype, name string) (Pin, error) {
+	op := RecordOp{Client: client, Type: qtype, Name: name}
+	if err := op.normalize(); err != nil {
+		return Pin{}, err
+	}
+
+	pinsMutex.Lock()
+	defer pinsMutex.Unlock()
+	key := pinKey(op.Client, op.Type, op.Name)
+	pin, ok := pins[key]
+	if !ok {
+		return Pin{}, fmt.Errorf("no pinned %s record for %s (client %s)", op.Type, op.Name, op.Client)
+	}
+	delete(pins, key)
+	refreshPins()
+
+	log.WithFields(log.Fields{"client": pin.Client, "type": pin.Type, "name": pin.Name}).Warn("Unpinned record")
+	return pin, nil
+}
+
+// The live pins, soonest to expire first
+func Pins() []Pin {
+	pinsMutex.Lock()
+	defer pinsMutex.Unlock()
+	out := []Pin{}
+	now := now()
+	for _, pin := range pins {
+		if pin.Expires.After(now) {
+			out = append(out, pin)
+		}
+	}
+	sort.Sort(byExpiry(out))
+	return out
+}
+
+type byExpiry []Pin
+
+func (p byExpiry) Len() int           { return len(p) }
+func (p byExpiry) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byExpiry) Less(i, j int) bool { return p[i].Expires.Before(p[j].Expires) }
+
+func expirePins() {
+	pinsMutex.Lock()
+	refreshPins()
+	pinsMutex.Unlock()
+}
+
+// Drops expired pins, serves the rest and schedules the next expiry. Must be called with pinsMutex held.
+func refreshPins() {
+	now := now()
+	var next time.Time
+	pinned := make(Answers)
+	for key, pin := range pins {
+		if !pin.Expires.After(now) {
+			log.WithFields(log.Fields{"client": pin.Client, "type": pin.Type, "name": pin.Name}).Warn("Pin expired")
+			delete(pins, key)
+			continue
+		}
+		ttl := pin.Ttl
+		op := RecordOp{Op: OP_SET, Client: pin.Client, Type: pin.Type, Name: pin.Name, Answer: pin.Answer, Ttl: &ttl, Comment: pin.Comment}
+		if _, err := pinned.apply(op, SOURCE_PINS); err != nil {
+			log.WithFields(log.Fields{"name": pin.Name}).Error("Failed to apply pin: ", err)
+			continue
+		}
+		if next.IsZero() || pin.Expires.Before(next) {
+			next = pin.Expires
+		}
+	}
+
+	if pinTimer != nil {
+		pinTimer.Stop()
+		pinTimer = nil
+	}
+	if !next.IsZero() {
+		pinTimer = time.AfterFunc(next.Sub(now), expirePins)
+	}
+	pinRecords.Set(pinned)
+}
+
+func httpPins(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch req.Method {
+	case "GET":
+		json.NewEncoder(w).Encode(Pins())
+	case "POST":
+		var pinReq PinRequest
+		if err := json.NewDecoder(req.Body).Decode(&pinReq); err != nil {
+			http.Error(w, "Invalid pin: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		pin, err := AddPin(pinReq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		json.NewEncoder(w).Encode(pin)
+	case "DELETE":
+		query := req.URL.Query()
+		pin, err := RemovePin(query.Get("client"), query.Get("type"), query.Get("name"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pin)
+	}
+}
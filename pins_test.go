@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPins(t *testing.T) {
+	if err := setupSources(""); err != nil {
+		t.Fatal(err)
+	}
+	dynamicRecords.Set(make(Answers))
+	setBaseAnswers(Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"api.stack.internal.": {Answer: []string{"10.42.0.1"}}}}})
+
+	if _, err := AddPin(PinRequest{RecordOp: RecordOp{Type: "A", Name: "api", Answer: []string{"10.42.0.7"}}, For: "48h"}); err == nil {
+		t.Fatalf("Pins longer than %s should be rejected", MAX_PIN_DURATION)
+	}
+	if _, err := AddPin(PinRequest{RecordOp: RecordOp{Type: "A", Name: "api", Answer: []string{"not-an-ip"}}}); err == nil {
+		t.Fatalf("Invalid answers should be rejected")
+	}
+
+	pin, err := AddPin(PinRequest{RecordOp: RecordOp{Type: "a", Name: "API.stack.internal", Answer: []string{"10.42.0.7"}}, For: "30m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pin.Client != DEFAULT_KEY || pin.Name != "api.stack.internal." || pin.Ttl != uint32(*defaultTtl) {
+		t.Fatalf("Incorrect pin [%+v]", pin)
+	}
+	if rec := answers[DEFAULT_KEY].A["api.stack.internal."]; len(rec.Answer) != 1 || rec.Answer[0] != "10.42.0.7" || rec.Source != SOURCE_PINS {
+		t.Fatalf("Pin should override the answers file [%+v]", rec)
+	}
+
+	// Pins survive reloads of the answers file, and are never journaled
+	setBaseAnswers(Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"api.stack.internal.": {Answer: []string{"10.42.0.2"}}}}})
+	if rec := answers[DEFAULT_KEY].A["api.stack.internal."]; rec.Answer[0] != "10.42.0.7" {
+		t.Fatalf("Pin should survive a reload [%+v]", rec)
+	}
+	if len(dynamicRecords.Answers()) != 0 {
+		t.Fatalf("Pins should not be runtime records")
+	}
+
+	if _, err := RemovePin("", "A", "api.stack.internal"); err != nil {
+		t.Fatal(err)
+	}
+	if rec := answers[DEFAULT_KEY].A["api.stack.internal."]; rec.Answer[0] != "10.42.0.2" {
+		t.Fatalf("Unpinning should restore the record [%+v]", rec)
+	}
+	if _, err := RemovePin("", "A", "api.stack.internal"); err == nil {
+		t.Fatalf("Unpinning twice should fail")
+	}
+
+	if _, err := AddPin(PinRequest{RecordOp: RecordOp{Type: "A", Name: "api.stack.internal", Answer: []string{"10.42.0.7"}}, For: "50ms"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(Pins()) > 0 || pinRecords.Answers()[DEFAULT_KEY].A != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Pin should have expired [%+v]", Pins())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	answersMutex.Lock()
+	defer answersMutex.Unlock()
+	if rec := answers[DEFAULT_KEY].A["api.stack.internal."]; rec.Answer[0] != "10.42.0.2" {
+		t.Fatalf("Expired pin should no longer be served [%+v]", rec)
+	}
+}
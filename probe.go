@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// What a recurser was found to support by the last probe
+type upstreamCapabilities struct {
+	Reachable bool      `json:"reachable"`
+	Edns      bool      `json:"edns"`
+	Tcp       bool      `json:"tcp"`
+	Probed    time.Time `json:"probed"`
+}
+
+var (
+	upstreamProbes      = make(map[string]upstreamCapabilities)
+	upstreamProbesMutex sync.RWMutex
+)
+
+// Probes the recursers of the answers at startup and then every --upstream-probe-interval seconds
+func probeUpstreams() {
+	for {
+		recursers := configuredRecursers()
+		for _, resolver := range recursers {
+			caps := probeUpstream(resolver)
+			upstreamProbesMutex.Lock()
+			previous, known := upstreamProbes[resolver]
+			upstreamProbes[resolver] = caps
+			upstreamProbesMutex.Unlock()
+
+			if !known || previous.Reachable != caps.Reachable || previous.Edns != caps.Edns || previous.Tcp != caps.Tcp {
+				log.WithFields(log.Fields{"resolver": resolver, "reachable": caps.Reachable, "edns": caps.Edns, "tcp": caps.Tcp}).Info("Probed recurser")
+			}
+		}
+
+		// Forget recursers that are no longer configured
+		configured := make(map[string]bool)
+		for _, resolver := range recursers {
+			configured[resolver] = true
+		}
+		upstreamProbesMutex.Lock()
+		for resolver := range upstreamProbes {
+			if !configured[resolver] {
+				delete(upstreamProbes, resolver)
+			}
+		}
+		upstreamProbesMutex.Unlock()
+
+		time.Sleep(time.Duration(*upstreamProbeInterval) * time.Second)
+	}
+}
+
+// Every recurser of the client entries and routes, once
+func configuredRecursers() []string {
+	answersMutex.Lock()
+	current := answers
+	answersMutex.Unlock()
+
+	seen := make(map[string]bool)
+	var out []string
+	for _, resolver := range serverBlockRecursers() {
+		if !seen[resolver] {
+			seen[resolver] = true
+			out = append(out, resolver)
+		}
+	}
+	for _, client := range current {
+		recurse := append([]string{}, client.Recurse...)
+		for _, rule := range client.Routes {
+			recurse = append(recurse, rule.Recurse...)
+		}
+		for _, resolver := range recurse {
+			if !seen[resolver] {
+				seen[resolver] = true
+				out = append(out, resolver)
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Asks the recurser for the root NS records with and without EDNS0 over UDP, and over TCP. A recurser
+// that answers the plain query but fails the EDNS0 one (FORMERR, NOTIMP, no or a broken response)
+// doesn't support EDNS0. TLS and DoH recursers are only asked over TLS or HTTPS, streams like TCP.
+func probeUpstream(resolver string) upstreamCapabilities {
+	caps := upstreamCapabilities{Probed: time.Now()}
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+	if isTlsRecurser(resolver) || isDohRecurser(resolver) {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		var resp *dns.Msg
+		var err error
+		if isDohRecurser(resolver) {
+			resp, err = exchangeDoh(req, resolver)
+		} else {
+			_, name := tlsRecurser(resolver)
+			resp, err = exchangeTls(req, upstreamAddrs(resolver)[0], name)
+		}
+		caps.Reachable = err == nil && resp != nil
+		caps.Edns = !caps.Reachable || (resp.Rcode != dns.RcodeFormatError && resp.Rcode != dns.RcodeNotImplemented)
+		caps.Tcp = caps.Reachable
+		return caps
+	}
+
+	addr := upstreamAddrs(resolver)[0]
+	plain, err := exchange(req, "udp", addr)
+	caps.Reachable = err == nil && plain != nil
+
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	resp, err := exchange(req, "udp", addr)
+	caps.Edns = err == nil && resp != nil && resp.Rcode != dns.RcodeFormatError && resp.Rcode != dns.RcodeNotImplemented
+	if caps.Edns {
+		caps.Reachable = true
+	} else if !caps.Reachable {
+		// Nothing to tell about a recurser that can't be reached at all
+		caps.Edns = true
+	}
+
+	resp, err = exchange(req, "tcp", addr)
+	caps.Tcp = err == nil && resp != nil
+	return caps
+}
+
+// The probed capabilities of the recurser, or false if it hasn't been probed
+func upstreamCapabilitiesFor(resolver string) (upstreamCapabilities, bool) {
+	upstreamProbesMutex.RLock()
+	defer upstreamProbesMutex.RUnlock()
+	caps, ok := upstreamProbes[resolver]
+	return caps, ok
+}
+
+// A copy of the query without its OPT record, for recursers that don't support EDNS0
+func withoutEdns(req *dns.Msg) *dns.Msg {
+	out := req.Copy()
+	extra := out.Extra[:0]
+	for _, rr := range out.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	out.Extra = extra
+	return out
+}
+
+func httpUpstreams(w http.ResponseWriter, req *http.Request) {
+	upstreamProbesMutex.RLock()
+	defer upstreamProbesMutex.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(upstreamProbes)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestProbeUpstream(t *testing.T) {
+	// A legacy resolver that chokes on OPT records and only listens on UDP
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if req.IsEdns0() != nil {
+			m.Rcode = dns.RcodeFormatError
+		}
+		w.WriteMsg(m)
+	})
+	server := &dns.Server{PacketConn: conn, Handler: mux}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	resolver := conn.LocalAddr().String()
+	caps := probeUpstream(resolver)
+	if !caps.Reachable || caps.Edns || caps.Tcp {
+		t.Fatalf("Expected a reachable recurser without EDNS0 and TCP support [%+v]", caps)
+	}
+
+	upstreamProbesMutex.Lock()
+	upstreamProbes[resolver] = caps
+	upstreamProbesMutex.Unlock()
+	defer func() {
+		upstreamProbesMutex.Lock()
+		delete(upstreamProbes, resolver)
+		upstreamProbesMutex.Unlock()
+	}()
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	resp, err := Resolve(req, resolver)
+	if err != nil || resp.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected the query to be sent without EDNS0 [%v %v]", resp, err)
+	}
+	if req.IsEdns0() == nil {
+		t.Fatalf("The client's query should not be changed")
+	}
+}
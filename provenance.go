@@ -0,0 +1,51 @@
+package main
+
+// Where records came from, recorded on each of them so conflicting data can be traced back
+const (
+	SOURCE_FILE     = "file"
+	SOURCE_METADATA = "metadata"
+)
+
+// Marks every record that doesn't know where it came from yet as coming from source
+func (answers *Answers) SetSource(source string) {
+	for _, client := range *answers {
+		for key, rec := range client.A {
+			if rec.Source == "" {
+				rec.Source = source
+				client.A[key] = rec
+			}
+		}
+		for key, rec := range client.Cname {
+			if rec.Source == "" {
+				rec.Source = source
+				client.Cname[key] = rec
+			}
+		}
+		for key, rec := range client.Ptr {
+			if rec.Source == "" {
+				rec.Source = source
+				client.Ptr[key] = rec
+			}
+		}
+		for key, rec := range client.Txt {
+			if rec.Source == "" {
+				rec.Source = source
+				client.Txt[key] = rec
+			}
+		}
+		for key, rec := range client.Srv {
+			if rec.Source == "" {
+				rec.Source = source
+				client.Srv[key] = rec
+			}
+		}
+	}
+}
+
+func fileSource(path string) string {
+	return SOURCE_FILE + ":" + path
+}
+
+func metadataSource(server string) string {
+	return SOURCE_METADATA + ":" + server
+}
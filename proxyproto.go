@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// With --proxy-protocol, TCP connections from the --proxy-protocol-from load balancers start with a
+// PROXY protocol header, version 1 (text) or 2 (binary), naming the client the connection was
+// accepted from. That client stands in for the load balancer for every query on the connection.
+// Connections from those load balancers without a valid header are closed; anyone else's connections
+// (the --trusted-proxies sending ECS included) are plain DNS over TCP.
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var proxyProtocolPeers []*net.IPNet
+
+func setupProxyProtocol() error {
+	peers, err := parseNetworkList(*proxyProtocolFrom, "PROXY protocol load balancer")
+	if err != nil {
+		return err
+	}
+	if *proxyProtocol && len(peers) == 0 {
+		return fmt.Errorf("--proxy-protocol requires --proxy-protocol-from")
+	}
+	if !*proxyProtocol && len(peers) > 0 {
+		return fmt.Errorf("--proxy-protocol-from requires --proxy-protocol")
+	}
+	proxyProtocolPeers = peers
+	return nil
+}
+
+// Longest version 1 header, including the CRLF
+const PROXY_V1_MAX_LENGTH = 107
+
+// Reads the PROXY protocol header at the start of r and returns the client address in it: nil when
+// the header doesn't name one (UNKNOWN in version 1, LOCAL or an unsupported family in version 2).
+func readProxyHeader(r io.Reader) (net.IP, error) {
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+
+	if bytes.Equal(start, proxyV2Signature) {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		if header[0]>>4 != 2 {
+			return nil, fmt.Errorf("unsupported PROXY protocol version %d", header[0]>>4)
+		}
+		body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, err
+		}
+		// LOCAL connections are the load balancer's own, e.g. health checks
+		if header[0]&0xf == 0 {
+			return nil, nil
+		}
+		switch header[1] >> 4 {
+		case 1:
+			if len(body) < 12 {
+				return nil, fmt.Errorf("short PROXY protocol IPv4 addresses")
+			}
+			return net.IP(body[:4]), nil
+		case 2:
+			if len(body) < 36 {
+				return nil, fmt.Errorf("short PROXY protocol IPv6 addresses")
+			}
+			return net.IP(body[:16]), nil
+		}
+		return nil, nil
+	}
+
+	if !bytes.HasPrefix(start, []byte("PROXY ")) {
+		return nil, fmt.Errorf("no PROXY protocol header")
+	}
+	line := start
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= PROXY_V1_MAX_LENGTH {
+			return nil, fmt.Errorf("PROXY protocol header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	return parseProxyV1(strings.TrimSuffix(string(line), "\r\n"))
+}
+
+// "PROXY TCP4 <client> <server> <client port> <server port>" or "PROXY UNKNOWN ..."
+func parseProxyV1(line string) (net.IP, error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid client address in PROXY protocol header %q", line)
+	}
+	return ip, nil
+}
+
+// A connection from a load balancer and the client it was accepted from
+type proxiedConn struct {
+	conn   *net.TCPConn
+	client string
+}
+
+var (
+	proxiedConnsMutex sync.Mutex
+	// Keyed by the local and remote address of the connection
+	proxiedConns = make(map[string]proxiedConn)
+)
+
+func proxiedConnKey(local, remote net.Addr) string {
+	return local.String() + " " + remote.String()
+}
+
+// proxyReader reads the PROXY protocol header of connections from the --proxy-protocol-from load
+// balancers before their first query
+type proxyReader struct {
+	dns.Reader
+}
+
+func (r *proxyReader) ReadTCP(conn *net.TCPConn, timeout time.Duration) ([]byte, error) {
+	key := proxiedConnKey(conn.LocalAddr(), conn.RemoteAddr())
+	proxiedConnsMutex.Lock()
+	known, ok := proxiedConns[key]
+	proxiedConnsMutex.Unlock()
+
+	// A connection we haven't seen yet, rather than one that reuses the address of an earlier one
+	if (!ok || known.conn != conn) && inNetworks(proxyProtocolPeers, conn.RemoteAddr().(*net.TCPAddr).IP.String()) {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		ip, err := readProxyHeader(conn)
+		if err != nil {
+			log.WithFields(log.Fields{"proxy": conn.RemoteAddr().String()}).Warn("Closing connection without a valid PROXY protocol header: ", err)
+			stats.incr("proxyProtocolErrors")
+			conn.Close()
+			return nil, err
+		}
+		proxied := proxiedConn{conn: conn}
+		if ip != nil {
+			proxied.client = ip.String()
+		}
+		proxiedConnsMutex.Lock()
+		proxiedConns[key] = proxied
+		proxiedConnsMutex.Unlock()
+	}
+
+	m, err := r.Reader.ReadTCP(conn, timeout)
+	if err != nil {
+		proxiedConnsMutex.Lock()
+		if known, ok := proxiedConns[key]; ok && known.conn == conn {
+			delete(proxiedConns, key)
+		}
+		proxiedConnsMutex.Unlock()
+	}
+	return m, err
+}
+
+// The client a load balancer accepted the TCP connection of the query from, if it came through one
+func proxyProtocolClient(w dns.ResponseWriter) string {
+	if !*proxyProtocol || !isTcp(w) {
+		return ""
+	}
+	proxiedConnsMutex.Lock()
+	defer proxiedConnsMutex.Unlock()
+	return proxiedConns[proxiedConnKey(w.LocalAddr(), w.RemoteAddr())].client
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func proxyV2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := append(append(net.ParseIP("10.42.1.7").To4(), net.ParseIP("10.0.0.1").To4()...), 0x30, 0x39, 0, 53)
+	v6 := append(append(net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1")...), 0x30, 0x39, 0, 53)
+	for _, test := range []struct {
+		header   []byte
+		expected string
+	}{
+		{[]byte("PROXY TCP4 10.42.1.7 10.0.0.1 12345 53\r\n"), "10.42.1.7"},
+		{[]byte("PROXY TCP6 2001:db8::7 2001:db8::1 12345 53\r\n"), "2001:db8::7"},
+		{[]byte("PROXY UNKNOWN\r\n"), ""},
+		{proxyV2Header(1, 0x11, v4), "10.42.1.7"},
+		{proxyV2Header(1, 0x21, append(v6, 0x04, 0, 1, 0)), "2001:db8::7"},
+		{proxyV2Header(0, 0, nil), ""},
+	} {
+		// The query that follows the header is left for the DNS reader
+		r := bytes.NewReader(append(test.header, "query"...))
+		ip, err := readProxyHeader(r)
+		if err != nil {
+			t.Fatalf("Unexpected error for %q: %v", test.header, err)
+		}
+		if (test.expected == "" && ip != nil) || (test.expected != "" && ip.String() != test.expected) {
+			t.Fatalf("Expected %q for %q, got %v", test.expected, test.header, ip)
+		}
+		if r.Len() != len("query") {
+			t.Fatalf("Expected the header of %q to be consumed exactly, %d bytes left", test.header, r.Len())
+		}
+	}
+
+	for _, invalid := range [][]byte{
+		[]byte("\x00\x1d\xbe\xef\x01\x00\x00\x01\x00\x00\x00\x00"),
+		[]byte("PROXY TCP4 10.42.1.7 10.0.0.1 12345\r\n"),
+		[]byte("PROXY TCP4 2001:db8::7 2001:db8::1 12345 53\r\n"),
+		[]byte("PROXY TCP4 10.42.1.7 10.0.0.1 12345 53" + string(bytes.Repeat([]byte(" "), 100)) + "\r\n"),
+		proxyV2Header(1, 0x11, v4[:8]),
+		append(proxyV2Header(1, 0x11, v4)[:12], 0x11, 0x11, 0, 12),
+	} {
+		if _, err := readProxyHeader(bytes.NewReader(invalid)); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	savedProxyProtocol, savedFrom, savedProxies := *proxyProtocol, *proxyProtocolFrom, *trustedProxyList
+	defer func() {
+		*proxyProtocol, *proxyProtocolFrom, *trustedProxyList = savedProxyProtocol, savedFrom, savedProxies
+		setupTrustedProxies()
+		setupProxyProtocol()
+	}()
+	*proxyProtocol = true
+	*proxyProtocolFrom = ""
+	if err := setupProxyProtocol(); err == nil {
+		t.Fatalf("Expected --proxy-protocol to require --proxy-protocol-from")
+	}
+	*proxyProtocolFrom = "127.0.0.1"
+	// A forwarder trusted with ECS isn't a load balancer sending headers
+	*trustedProxyList = "127.0.0.1,127.0.0.3"
+	setupTrustedProxies()
+	if err := setupProxyProtocol(); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := newTcpServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := make(chan string, 10)
+	server.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		clients <- proxyProtocolClient(w)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	addr := server.Listener.Addr().String()
+
+	query := func(conn *dns.Conn) (string, error) {
+		req := new(dns.Msg)
+		req.SetQuestion("web.", dns.TypeA)
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.WriteMsg(req); err != nil {
+			return "", err
+		}
+		if _, err := conn.ReadMsg(); err != nil {
+			return "", err
+		}
+		return <-clients, nil
+	}
+
+	// Connections from anyone but the load balancers are plain DNS, those of ECS forwarders included
+	for _, local := range []string{"127.0.0.2", "127.0.0.3"} {
+		dialer := &net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}
+		if conn, err := dialer.Dial("tcp", addr); err == nil {
+			if client, err := query(&dns.Conn{Conn: conn}); err != nil || client != "" {
+				t.Fatalf("Expected a query from %s without a proxied client, got %q (%v)", local, client, err)
+			}
+			conn.Close()
+		} else {
+			t.Logf("Skipping the connection from %s: %v", local, err)
+		}
+	}
+
+	// The client of the header is that of every query on the connection
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("PROXY TCP4 10.42.1.7 10.0.0.1 12345 53\r\n"))
+	for i := 0; i < 2; i++ {
+		if client, err := query(&dns.Conn{Conn: conn}); err != nil || client != "10.42.1.7" {
+			t.Fatalf("Expected the client of the header, got %q (%v)", client, err)
+		}
+	}
+	conn.Close()
+
+	// Connections from the load balancers without a header are closed
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := query(&dns.Conn{Conn: conn}); err == nil {
+		t.Fatalf("Expected a connection without a header to be closed")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Who is asking and how the query arrived. Passed to the answer lookups, so policies and views can
+// key off more than the client's answers entry.
+type QueryContext struct {
+	// Answers key the client's records are looked up under (IP, network, UUID prefix or default)
+	ClientKey string
+	ClientIp  string
+	// "udp", "tcp" or the transport named by the writer
+	Transport string
+	// Local address the query arrived on
+	Listener string
+	// Environment the query is answered from, empty for the top-level answers
+	Environment string
+	// Recursive cache the query's recursed answers are kept in (see viewName), empty for the global cache
+	View string
+	// Key name of a verified TSIG signature, empty for unsigned queries
+	TsigName string
+}
+
+func newQueryContext(w dns.ResponseWriter, clientKey string) *QueryContext {
+	query := &QueryContext{
+		ClientKey: clientKey,
+		ClientIp:  clientAddr(w),
+		Transport: transport(w),
+		TsigName:  requestKey(w),
+	}
+	query.Listener = listenerAddr(w)
+	return query
+}
+
+func listenerAddr(w dns.ResponseWriter) string {
+	if addr := w.LocalAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// The same query, looked up under another answers key
+func (query *QueryContext) ForKey(key string) *QueryContext {
+	q := *query
+	q.ClientKey = key
+	return &q
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// TTL of the records of a cached response served after it expired (RFC 8767 recommends 30 seconds)
+const STALE_TTL = 30
+
+// Upstream rate limit rules, read from the "ratelimits" list of the default entry: at most qps queries
+// a second for names in the zone are forwarded to the recursers (the rule with the most specific zone
+// applies), with bursts of up to a second's worth (at least one query). Queries over the limit are answered from the
+// cache, even with a response that expired up to --rate-limit-stale seconds ago, or get SERVFAIL.
+func (answers *Answers) RateLimitRules() []RateLimitRule {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.RateLimits
+}
+
+func (rule *RateLimitRule) Validate() error {
+	if rule.Zone == "" {
+		return fmt.Errorf("rate limit rule without a zone: %+v", *rule)
+	}
+	if rule.Qps <= 0 {
+		return fmt.Errorf("invalid qps for zone %s: %v", rule.Zone, rule.Qps)
+	}
+	return nil
+}
+
+// Error of a query that wasn't forwarded because its zone is over the rate limit
+type rateLimitedError struct {
+	zone string
+}
+
+func (e *rateLimitedError) Error() string {
+	return fmt.Sprintf("recursion rate limit of zone %s exceeded", e.zone)
+}
+
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// Takes a token if there is one, after refilling the bucket for the time since the last call
+func (b *tokenBucket) take(now time.Time) bool {
+	// Limits under 1 qps still allow a single query at a time
+	burst := math.Max(b.rate, 1)
+	b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*b.rate, burst)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type upstreamLimiter struct {
+	sync.Mutex
+	rules   []RateLimitRule
+	buckets map[string]*tokenBucket
+}
+
+var rateLimiter = &upstreamLimiter{buckets: make(map[string]*tokenBucket)}
+
+// Replaces the rules, keeping the state of the zones whose limit didn't change
+func (l *upstreamLimiter) SetRules(rules []RateLimitRule) {
+	l.Lock()
+	defer l.Unlock()
+	buckets := make(map[string]*tokenBucket)
+	for _, rule := range rules {
+		zone := rateLimitZone(rule.Zone)
+		if bucket, ok := l.buckets[zone]; ok && bucket.rate == rule.Qps {
+			buckets[zone] = bucket
+		} else {
+			buckets[zone] = &tokenBucket{rate: rule.Qps, tokens: math.Max(rule.Qps, 1), last: time.Now()}
+		}
+	}
+	l.rules = rules
+	l.buckets = buckets
+}
+
+// Whether a query for the name may be forwarded now, and the zone of the limit that applies
+func (l *upstreamLimiter) Allow(fqdn string) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	zone := ""
+	for _, rule := range l.rules {
+		if inZone(fqdn, rule.Zone) && len(rateLimitZone(rule.Zone)) > len(zone) {
+			zone = rateLimitZone(rule.Zone)
+		}
+	}
+	if zone == "" {
+		return "", true
+	}
+	return zone, l.buckets[zone].take(time.Now())
+}
+
+func rateLimitZone(zone string) string {
+	return strings.ToLower(dns.Fqdn(zone))
+}
+
+// A cached recursive response for the query in the view's cache, expired at most maxStale ago or not
+// at all, with the TTLs of a stale answer
+func staleCacheHit(view string, req *dns.Msg, maxStale time.Duration) *dns.Msg {
+	msg, exp := recursionCache(view).Stale(req.Question[0], false, false, req.MsgHdr.Id)
+	if msg == nil || time.Since(exp) > maxStale {
+		return nil
+	}
+	if time.Until(exp) > STALE_TTL*time.Second {
+		update(msg, exp)
+		return msg
+	}
+	for _, rr := range msg.Answer {
+		rr.Header().Ttl = STALE_TTL
+	}
+	return msg
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{rate: 2, tokens: 2, last: now}
+	if !b.take(now) || !b.take(now) || b.take(now) {
+		t.Fatalf("Expected a burst of 2 queries")
+	}
+	if !b.take(now.Add(500*time.Millisecond)) || b.take(now.Add(500*time.Millisecond)) {
+		t.Fatalf("Expected one more query after half a second")
+	}
+
+	slow := &tokenBucket{rate: 0.5, tokens: 1, last: now}
+	if !slow.take(now) || slow.take(now.Add(time.Second)) || !slow.take(now.Add(2*time.Second)) {
+		t.Fatalf("Expected one query every 2 seconds")
+	}
+}
+
+func TestRateLimiterZones(t *testing.T) {
+	l := &upstreamLimiter{buckets: make(map[string]*tokenBucket)}
+	l.SetRules([]RateLimitRule{{Zone: "Partner.com", Qps: 1}, {Zone: "api.partner.com", Qps: 2}})
+
+	if zone, ok := l.Allow("www.example.com."); !ok || zone != "" {
+		t.Fatalf("Expected names outside of the zones not to be limited")
+	}
+	if zone, ok := l.Allow("x.api.partner.com."); !ok || zone != "api.partner.com." {
+		t.Fatalf("Expected the most specific zone, got %s", zone)
+	}
+	if _, ok := l.Allow("www.partner.com."); !ok {
+		t.Fatalf("Expected the first query to be allowed")
+	}
+	if _, ok := l.Allow("mail.partner.com."); ok {
+		t.Fatalf("Expected the second query to be limited")
+	}
+
+	// Unchanged limits keep their state across reloads
+	l.SetRules([]RateLimitRule{{Zone: "partner.com", Qps: 1}})
+	if _, ok := l.Allow("mail.partner.com."); ok {
+		t.Fatalf("Expected the zone to still be limited")
+	}
+	l.SetRules([]RateLimitRule{{Zone: "partner.com", Qps: 5}})
+	if _, ok := l.Allow("mail.partner.com."); !ok {
+		t.Fatalf("Expected a new limit to start over")
+	}
+
+	for _, invalid := range []RateLimitRule{{Qps: 1}, {Zone: "partner.com"}, {Zone: "partner.com", Qps: -1}} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestRateLimitedRecursion(t *testing.T) {
+	dns.HandleFunc("partner.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("10.9.9.9"),
+		}}
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("partner.test.")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	saved, savedEnvironments, savedCache := answers, environmentAnswers, globalCache
+	defer func() {
+		answers, environmentAnswers, globalCache = saved, savedEnvironments, savedCache
+		rateLimiter.SetRules(nil)
+	}()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Recurse:    []string{conn.LocalAddr().String()},
+		RateLimits: []RateLimitRule{{Zone: "partner.test", Qps: 1}},
+	}}
+	environmentAnswers = nil
+	globalCache = cache.New(10, 600)
+	globalCache.SetStale(time.Minute)
+	clearClientSpecificCaches()
+	rateLimiter.SetRules(answers.RateLimitRules())
+
+	// A response that expired a little while ago
+	expired := new(dns.Msg)
+	expired.SetQuestion("old.partner.test.", dns.TypeA)
+	expired.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: "old.partner.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("10.8.8.8"),
+	}}
+	globalCache.InsertMessage(cache.Key(expired.Question[0], false, false), expired, -time.Second)
+
+	for _, test := range []struct {
+		name   string
+		rcode  int
+		answer string
+		ttl    uint32
+	}{
+		{"a.partner.test.", dns.RcodeSuccess, "10.9.9.9", 60},
+		{"b.partner.test.", dns.RcodeServerFailure, "", 0},
+		{"old.partner.test.", dns.RcodeSuccess, "10.8.8.8", STALE_TTL},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(test.name, dns.TypeA)
+		w := &testWriter{}
+		route(w, req)
+		if w.msg == nil || w.msg.Rcode != test.rcode {
+			t.Fatalf("Expected %s for %s, got %v", dns.RcodeToString[test.rcode], test.name, w.msg)
+		}
+		if test.answer == "" {
+			continue
+		}
+		if len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != test.answer || w.msg.Answer[0].Header().Ttl > test.ttl {
+			t.Fatalf("Expected %s for %s, got %v", test.answer, test.name, w.msg.Answer)
+		}
+	}
+}
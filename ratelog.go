@@ -0,0 +1,73 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const SUPPRESSED_FIELD = "suppressed"
+
+var digits = regexp.MustCompile("[0-9]+")
+
+// dedupFormatter lets the first of a run of similar warnings through and swallows the rest until the
+// window closes, at which point a single summary line says how many were dropped. Warnings are
+// similar when their messages only differ in numbers (ports, addresses, counts).
+type dedupFormatter struct {
+	log.Formatter
+	sync.Mutex
+	seen map[string]*dedupState
+}
+
+type dedupState struct {
+	first      string
+	suppressed int
+}
+
+func newDedupFormatter(formatter log.Formatter, window time.Duration) *dedupFormatter {
+	f := &dedupFormatter{
+		Formatter: formatter,
+		seen:      make(map[string]*dedupState),
+	}
+	go f.summarize(window)
+	return f
+}
+
+func (f *dedupFormatter) Format(entry *log.Entry) ([]byte, error) {
+	if entry.Level != log.WarnLevel {
+		return f.Formatter.Format(entry)
+	}
+	if _, ok := entry.Data[SUPPRESSED_FIELD]; ok {
+		return f.Formatter.Format(entry)
+	}
+
+	key := digits.ReplaceAllString(entry.Message, "#")
+	f.Lock()
+	state, ok := f.seen[key]
+	if ok {
+		state.suppressed++
+		f.Unlock()
+		return []byte{}, nil
+	}
+	f.seen[key] = &dedupState{first: entry.Message}
+	f.Unlock()
+
+	return f.Formatter.Format(entry)
+}
+
+func (f *dedupFormatter) summarize(window time.Duration) {
+	for _ = range time.Tick(window) {
+		f.Lock()
+		seen := f.seen
+		f.seen = make(map[string]*dedupState)
+		f.Unlock()
+
+		for _, state := range seen {
+			if state.suppressed > 0 {
+				log.WithField(SUPPRESSED_FIELD, state.suppressed).Warnf("Suppressed %d similar messages: %s", state.suppressed, state.first)
+			}
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestDedupSimilarWarnings(t *testing.T) {
+	f := newDedupFormatter(&log.TextFormatter{DisableColors: true}, time.Hour)
+	warn := func(msg string) []byte {
+		b, err := f.Format(&log.Entry{Logger: log.StandardLogger(), Level: log.WarnLevel, Message: msg, Data: log.Fields{}})
+		if err != nil {
+			t.Fatalf("Error formatting %v", err)
+		}
+		return b
+	}
+
+	if len(warn("Recurser error: read udp 10.0.0.1:40001->8.8.8.8:53: i/o timeout")) == 0 {
+		t.Fatalf("First warning should be logged")
+	}
+	if len(warn("Recurser error: read udp 10.0.0.1:40002->8.8.8.8:53: i/o timeout")) != 0 {
+		t.Fatalf("Similar warning should be suppressed")
+	}
+	if len(warn("Rejected ANY query")) == 0 {
+		t.Fatalf("Different warning should be logged")
+	}
+
+	for _, state := range f.seen {
+		if state.first == "Recurser error: read udp 10.0.0.1:40001->8.8.8.8:53: i/o timeout" && state.suppressed != 1 {
+			t.Fatalf("Expected 1 suppressed, got %d", state.suppressed)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Checks the recurse lists of the client entries and routes when the answers are loaded: entries
+// must be an address or host name with an optional port (or a tls:// one, or an https:// URL), address literals are brought into their
+// canonical form and duplicates are dropped. Entries pointing back at this server are only warned
+// about, since the listen address might be forwarded elsewhere.
+func checkRecursers(answers Answers) error {
+	for key, client := range answers {
+		recurse, err := cleanRecursers(key, client.Recurse)
+		if err != nil {
+			return err
+		}
+		client.Recurse = recurse
+
+		if len(client.Routes) > 0 {
+			routes := make([]RouteRule, len(client.Routes))
+			for i, rule := range client.Routes {
+				if rule.Recurse, err = cleanRecursers(key, rule.Recurse); err != nil {
+					return err
+				}
+				routes[i] = rule
+			}
+			client.Routes = routes
+		}
+		answers[key] = client
+	}
+	return nil
+}
+
+func cleanRecursers(key string, recurse []string) ([]string, error) {
+	if len(recurse) == 0 {
+		return recurse, nil
+	}
+
+	var out []string
+	seen := make(map[string]bool)
+	for _, entry := range recurse {
+		clean, err := canonicalRecurser(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recurser for %s: %v", key, err)
+		}
+		addr := resolverAddr(clean)
+		if seen[addr] {
+			log.WithFields(log.Fields{"client": key, "recurser": entry}).Warn("Dropped duplicate recurser")
+			continue
+		}
+		seen[addr] = true
+		if selfReferential(addr) {
+			log.WithFields(log.Fields{"client": key, "recurser": entry}).Warn("Recurser is this server's own listen address")
+		}
+		out = append(out, clean)
+	}
+	return out, nil
+}
+
+// The entry with its address (if it's a literal) in canonical form, keeping the port if given
+func canonicalRecurser(entry string) (string, error) {
+	entry = strings.TrimSpace(entry)
+	if isTlsRecurser(entry) {
+		return canonicalTlsRecurser(entry)
+	}
+	if isDohRecurser(entry) {
+		return canonicalDohRecurser(entry)
+	}
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		host, port = strings.Trim(entry, "[]"), ""
+	}
+	if port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("invalid port in %q", entry)
+		}
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else if _, ok := dns.IsDomainName(host); !ok || host == "" || strings.ContainsAny(host, " /:[]") {
+		return "", fmt.Errorf("%q is neither an address nor a host name", entry)
+	}
+
+	if port == "" {
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// Whether the recurser address is one of the addresses this server listens on
+func selfReferential(addr string) bool {
+	host, port, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, l := range listenAddrs() {
+		listenHost, listenPort, err := net.SplitHostPort(l)
+		if err != nil || listenPort != port {
+			continue
+		}
+		listenIp := net.ParseIP(listenHost)
+		if listenIp != nil && !listenIp.IsUnspecified() {
+			if listenIp.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		// Listening on every address
+		if ip.IsLoopback() || ip.IsUnspecified() || localAddress(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func localAddress(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCheckRecursers(t *testing.T) {
+	saved := *listen
+	defer func() { *listen = saved }()
+	*listen = ":53"
+
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{" 8.8.8.8", "8.8.8.8:53", "2001:DB8::0001", "[2001:db8::1]:5353", "dns.example.com:5353", "127.0.0.1"},
+			Routes:  []RouteRule{{Suffix: "corp.internal", Recurse: []string{"10.0.0.53", "10.0.0.53"}}},
+		},
+	}
+	if err := checkRecursers(answers); err != nil {
+		t.Fatal(err)
+	}
+	recurse := answers[DEFAULT_KEY].Recurse
+	expected := []string{"8.8.8.8", "2001:db8::1", "[2001:db8::1]:5353", "dns.example.com:5353", "127.0.0.1"}
+	if len(recurse) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, recurse)
+	}
+	for i := range expected {
+		if recurse[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, recurse)
+		}
+	}
+	if routes := answers[DEFAULT_KEY].Routes; len(routes[0].Recurse) != 1 {
+		t.Fatalf("Expected the route's duplicate to be dropped %v", routes)
+	}
+
+	for _, invalid := range []string{"8.8.8.8:0", "8.8.8.8:dns", "bad host", "", "[::1]:53:53"} {
+		if err := checkRecursers(Answers{DEFAULT_KEY: ClientAnswers{Recurse: []string{invalid}}}); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+
+	if !selfReferential("127.0.0.1:53") || selfReferential("127.0.0.1:5353") || selfReferential("8.8.8.8:53") {
+		t.Fatalf("Incorrect detection of this server as a recurser")
+	}
+	*listen = "10.0.0.5:53"
+	if !selfReferential("10.0.0.5:53") || selfReferential("127.0.0.1:53") {
+		t.Fatalf("Incorrect detection of this server as a recurser")
+	}
+}
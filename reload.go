@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Outcome of a reload triggered through POST /reload
+type ReloadResult struct {
+	Ok         bool           `json:"ok"`
+	Error      string         `json:"error,omitempty"`
+	Stage      string         `json:"stage,omitempty"`
+	DryRun     bool           `json:"dryRun,omitempty"`
+	Zone       string         `json:"zone,omitempty"`
+	Clients    int            `json:"clients"`
+	Records    map[string]int `json:"records"`
+	Generation uint64         `json:"generation"`
+	Checksum   string         `json:"checksum"`
+	DurationMs float64        `json:"durationMs"`
+}
+
+// Number of records of each type across all clients
+func (answers *Answers) Counts() map[string]int {
+	counts := map[string]int{"A": 0, "CNAME": 0, "PTR": 0, "TXT": 0, "SRV": 0}
+	for _, client := range *answers {
+		counts["A"] += len(client.A)
+		counts["CNAME"] += len(client.Cname)
+		counts["PTR"] += len(client.Ptr)
+		counts["TXT"] += len(client.Txt)
+		counts["SRV"] += len(client.Srv)
+	}
+	return counts
+}
+
+// Runs the reloads requested through requests (reloadChan) one at a time. A request waits for --reload-debounce
+// without another one coming in (at most --reload-max-delay) before load runs, and every request
+// received meanwhile, or while the previous reload ran, is answered by that single load of the final
+// state of the answers.
+func serveReloads(requests chan chan error, load func() error) {
+	for first := range requests {
+		waiters := collectReloads(requests, []chan error{first}, time.Duration(*reloadDebounce)*time.Millisecond, time.Duration(*reloadMaxDelay)*time.Millisecond)
+		if len(waiters) > 1 {
+			log.WithFields(log.Fields{"requests": len(waiters)}).Info("Coalesced reload requests")
+		}
+		err := load()
+		for _, waiter := range waiters {
+			if waiter != nil {
+				waiter <- err
+			}
+		}
+	}
+}
+
+func collectReloads(requests chan chan error, waiters []chan error, quiet time.Duration, maxDelay time.Duration) []chan error {
+	deadline := time.NewTimer(maxDelay)
+	defer deadline.Stop()
+	for {
+		timer := time.NewTimer(quiet)
+		select {
+		case waiter := <-requests:
+			timer.Stop()
+			waiters = append(waiters, waiter)
+		case <-timer.C:
+			return waiters
+		case <-deadline.C:
+			timer.Stop()
+			return waiters
+		}
+	}
+}
+
+// Reloads the answers and waits for the outcome. On failure the previous answers stay in place,
+// and the counts describe those; the stage says where the reload failed.
+func reload() ReloadResult {
+	start := time.Now()
+	respChan := make(chan error)
+	reloadChan <- respChan
+	err := <-respChan
+
+	answersMutex.Lock()
+	result := ReloadResult{
+		Ok:         err == nil,
+		Clients:    len(answers),
+		Records:    answers.Counts(),
+		Generation: answersVersion.Generation,
+		Checksum:   answersVersion.Checksum,
+		DurationMs: durationMs(time.Since(start)),
+	}
+	answersMutex.Unlock()
+	if err != nil {
+		result.Error = err.Error()
+		result.Stage = reloadStage(err)
+	}
+	return result
+}
+
+// POST /reload reloads the answers file, POST /reload?zone=ZONE the zone from the fragment in the body
+// and POST /reload?validate=true only checks the answers file
+func httpReloadResult(w http.ResponseWriter, req *http.Request) {
+	var result ReloadResult
+	zone := req.URL.Query().Get("zone")
+	validate, _ := strconv.ParseBool(req.URL.Query().Get("validate"))
+	if validate && zone != "" {
+		http.Error(w, "zone fragments can't be validated only", http.StatusBadRequest)
+		return
+	}
+	if validate {
+		result = validateReload()
+	} else if zone != "" {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		result = reloadZone(zone, data)
+	} else {
+		result = reload()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !result.Ok {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestReloadResult(t *testing.T) {
+	saved := answers
+	defer func() { answers = saved }()
+	answers = Answers{
+		DEFAULT_KEY: ClientAnswers{
+			A:     map[string]RecordA{"web.": {Answer: []string{"10.1.1.1"}}, "db.": {Answer: []string{"10.1.1.2"}}},
+			Cname: map[string]RecordCname{"www.": {Answer: "web."}},
+		},
+		"10.1.1.3": ClientAnswers{
+			Txt: map[string]RecordTxt{"info.": {Answer: []string{"x"}}},
+		},
+	}
+
+	go func() {
+		resp := <-reloadChan
+		resp <- errors.New("bad answers file")
+	}()
+	result := reload()
+	if result.Ok || result.Error != "bad answers file" {
+		t.Fatalf("Expected a failed reload, got %+v", result)
+	}
+	if result.Clients != 2 || result.Records["A"] != 2 || result.Records["CNAME"] != 1 || result.Records["PTR"] != 0 || result.Records["TXT"] != 1 {
+		t.Fatalf("Incorrect counts %+v", result)
+	}
+
+	go func() {
+		resp := <-reloadChan
+		resp <- nil
+	}()
+	if result = reload(); !result.Ok || result.Error != "" {
+		t.Fatalf("Expected a successful reload, got %+v", result)
+	}
+}
+
+func TestServeReloadsCoalesces(t *testing.T) {
+	savedDebounce, savedMaxDelay := *reloadDebounce, *reloadMaxDelay
+	defer func() { *reloadDebounce, *reloadMaxDelay = savedDebounce, savedMaxDelay }()
+	*reloadDebounce, *reloadMaxDelay = 50, 1000
+
+	requests := make(chan chan error)
+	defer close(requests)
+	loads := make(chan int, 10)
+	count := 0
+	go serveReloads(requests, func() error {
+		count++
+		loads <- count
+		return nil
+	})
+
+	// A burst of signals and an API request in the middle of it
+	resp := make(chan error, 1)
+	for i := 0; i < 5; i++ {
+		if i == 2 {
+			requests <- resp
+		} else {
+			requests <- nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := <-resp; err != nil {
+		t.Fatalf("Unexpected reload error: %v", err)
+	}
+	if n := <-loads; n != 1 {
+		t.Fatalf("Expected a single load, got %d", n)
+	}
+	select {
+	case n := <-loads:
+		t.Fatalf("Unexpected load %d", n)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+// "rancher-dns replay" answers the queries of a file the way the server would, through the whole of
+// routing and policy, and prints the responses, for golden-file tests of answers files: the clock is
+// fixed (-now), the randomness seeded (-seed), health checks are off (every address is healthy) and the
+// recursers are replaced by the canned responses of the -upstreams file. Queries are answered one after
+// another, in the order of the file.
+const (
+	REPLAY_CLIENT = "127.0.0.1"
+	REPLAY_NOW    = "2020-01-01T00:00:00Z"
+)
+
+// A query to replay. In the dig-style format, a line of "NAME [TYPE] [from=CLIENT] [+tcp] [+edns]
+// [+dnssec]"; in JSON, an array or stream of these objects.
+type replayQuery struct {
+	Name   string `json:"name"`
+	Type   string `json:"type,omitempty"`
+	Client string `json:"client,omitempty"`
+	Tcp    bool   `json:"tcp,omitempty"`
+	Edns   bool   `json:"edns,omitempty"`
+	Dnssec bool   `json:"dnssec,omitempty"`
+}
+
+// A canned recurser response of the -upstreams file, by "NAME TYPE", with the records in zone file form
+type replayUpstream struct {
+	Rcode      string   `json:"rcode,omitempty"`
+	Answer     []string `json:"answer,omitempty"`
+	Authority  []string `json:"authority,omitempty"`
+	Additional []string `json:"additional,omitempty"`
+}
+
+// A response as printed with -json
+type replayResponse struct {
+	Query         replayQuery `json:"query"`
+	Rcode         string      `json:"rcode,omitempty"`
+	Authoritative bool        `json:"authoritative,omitempty"`
+	Truncated     bool        `json:"truncated,omitempty"`
+	Answer        []string    `json:"answer,omitempty"`
+	Authority     []string    `json:"authority,omitempty"`
+	Additional    []string    `json:"additional,omitempty"`
+	Dropped       bool        `json:"dropped,omitempty"`
+}
+
+type replayUpstreams map[string]*dns.Msg
+
+// The recursers while replaying, when set
+var fakeUpstreams replayUpstreams
+
+func (u replayUpstreams) exchange(req *dns.Msg) (*dns.Msg, error) {
+	question := req.Question[0]
+	canned, ok := u[replayUpstreamKey(question.Name, question.Qtype)]
+	if !ok {
+		return nil, fmt.Errorf("no upstream response for %s %s", question.Name, dns.TypeToString[question.Qtype])
+	}
+	resp := canned.Copy()
+	resp.SetReply(req)
+	resp.Rcode = canned.Rcode
+	resp.RecursionAvailable = true
+	return resp, nil
+}
+
+func replayUpstreamKey(name string, qtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + " " + dns.TypeToString[qtype]
+}
+
+func readReplayUpstreams(path string) (replayUpstreams, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[string]replayUpstream
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	upstreams := make(replayUpstreams)
+	for key, upstream := range file {
+		fields := strings.Fields(key)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s: expected \"NAME TYPE\", got %q", path, key)
+		}
+		qtype, ok := dns.StringToType[strings.ToUpper(fields[1])]
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid type in %q", path, key)
+		}
+		m := new(dns.Msg)
+		if upstream.Rcode != "" {
+			rcode, ok := dns.StringToRcode[strings.ToUpper(upstream.Rcode)]
+			if !ok {
+				return nil, fmt.Errorf("%s: invalid rcode for %q: %s", path, key, upstream.Rcode)
+			}
+			m.Rcode = rcode
+		}
+		for _, section := range []struct {
+			records []string
+			into    *[]dns.RR
+		}{{upstream.Answer, &m.Answer}, {upstream.Authority, &m.Ns}, {upstream.Additional, &m.Extra}} {
+			for _, record := range section.records {
+				rr, err := dns.NewRR(record)
+				if err != nil || rr == nil {
+					return nil, fmt.Errorf("%s: invalid record for %q: %s", path, key, record)
+				}
+				*section.into = append(*section.into, rr)
+			}
+		}
+		upstreams[replayUpstreamKey(fields[0], qtype)] = m
+	}
+	return upstreams, nil
+}
+
+// Reads the queries, as JSON when the file starts with "[" or "{", otherwise dig-style lines, skipping
+// blank lines and # comments
+func readReplayQueries(path string) ([]replayQuery, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var queries []replayQuery
+	trimmed := bytes.TrimSpace(data)
+	if bytes.HasPrefix(trimmed, []byte("[")) {
+		if err := json.Unmarshal(trimmed, &queries); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	} else if bytes.HasPrefix(trimmed, []byte("{")) {
+		decoder := json.NewDecoder(bytes.NewReader(trimmed))
+		for {
+			var query replayQuery
+			if err := decoder.Decode(&query); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			queries = append(queries, query)
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for line := 1; scanner.Scan(); line++ {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+				continue
+			}
+			query := replayQuery{Name: fields[0]}
+			for _, field := range fields[1:] {
+				switch {
+				case strings.HasPrefix(field, "from="):
+					query.Client = strings.TrimPrefix(field, "from=")
+				case field == "+tcp":
+					query.Tcp = true
+				case field == "+edns":
+					query.Edns = true
+				case field == "+dnssec":
+					query.Dnssec = true
+				case query.Type == "":
+					query.Type = field
+				default:
+					return nil, fmt.Errorf("%s:%d: unexpected %q", path, line, field)
+				}
+			}
+			queries = append(queries, query)
+		}
+	}
+
+	for i := range queries {
+		query := &queries[i]
+		if _, ok := dns.IsDomainName(query.Name); !ok || query.Name == "" {
+			return nil, fmt.Errorf("%s: invalid name %q", path, query.Name)
+		}
+		if query.Type == "" {
+			query.Type = "A"
+		}
+		if _, ok := dns.StringToType[strings.ToUpper(query.Type)]; !ok {
+			return nil, fmt.Errorf("%s: invalid type %q of %s", path, query.Type, query.Name)
+		}
+		query.Type = strings.ToUpper(query.Type)
+		if query.Client == "" {
+			query.Client = REPLAY_CLIENT
+		}
+		if net.ParseIP(query.Client) == nil {
+			return nil, fmt.Errorf("%s: invalid client %q of %s", path, query.Client, query.Name)
+		}
+	}
+	return queries, nil
+}
+
+// The message of the query, with the ID of its position in the file
+func (query *replayQuery) msg(id uint16) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(query.Name), dns.StringToType[query.Type])
+	req.Id = id
+	if query.Edns || query.Dnssec {
+		req.SetEdns0(dns.DefaultMsgSize, query.Dnssec)
+	}
+	return req
+}
+
+// Receives the response of a replayed query, sent from its client
+type replayWriter struct {
+	query *replayQuery
+	msg   *dns.Msg
+}
+
+func (w *replayWriter) LocalAddr() net.Addr {
+	if w.query.Tcp {
+		return &net.TCPAddr{IP: net.ParseIP(REPLAY_CLIENT), Port: 53}
+	}
+	return &net.UDPAddr{IP: net.ParseIP(REPLAY_CLIENT), Port: 53}
+}
+
+func (w *replayWriter) RemoteAddr() net.Addr {
+	if w.query.Tcp {
+		return &net.TCPAddr{IP: net.ParseIP(w.query.Client), Port: 5353}
+	}
+	return &net.UDPAddr{IP: net.ParseIP(w.query.Client), Port: 5353}
+}
+
+func (w *replayWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func (w *replayWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+
+func (w *replayWriter) Close() error        { return nil }
+func (w *replayWriter) TsigStatus() error   { return nil }
+func (w *replayWriter) TsigTimersOnly(bool) {}
+func (w *replayWriter) Hijack()             {}
+
+// Answers the queries in order, returning the responses (nil for those dropped)
+func replayQueries(queries []replayQuery) []*dns.Msg {
+	responses := make([]*dns.Msg, len(queries))
+	for i := range queries {
+		w := &replayWriter{query: &queries[i]}
+		handleQuery(w, queries[i].msg(uint16(i+1)))
+		responses[i] = w.msg
+	}
+	return responses
+}
+
+func recordStrings(records []dns.RR) []string {
+	var out []string
+	for _, record := range records {
+		if record.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		out = append(out, record.String())
+	}
+	return out
+}
+
+// Entry point of "rancher-dns replay", which takes the server's flags as well, e.g. --answers
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) {
+		flags.Var(f.Value, f.Name, f.Usage)
+	})
+	queriesFile := flags.String("queries", "", "File with the queries to replay, dig-style lines or JSON")
+	upstreamsFile := flags.String("upstreams", "", "JSON file of the responses of the recursers, by \"NAME TYPE\"; other recursive queries fail")
+	at := flags.String("now", REPLAY_NOW, "Time (RFC 3339) the clock is fixed at")
+	seed := flags.Int64("seed", 1, "Seed of the randomness of answers (the order of addresses)")
+	asJson := flags.Bool("json", false, "Print the responses as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay -queries FILE [-upstreams FILE] [options] [server options]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	fixed, err := time.Parse(time.RFC3339, *at)
+	if *queriesFile == "" || flags.NArg() > 0 || err != nil {
+		flags.Usage()
+		return 2
+	}
+	if metadataDriven() {
+		fmt.Fprintln(os.Stderr, "replay needs an answers file rather than --metadata-server")
+		return 2
+	}
+
+	// Only errors would get in the way of the responses, unless the flags ask for more
+	if !*debug {
+		log.SetLevel(log.ErrorLevel)
+	}
+	applyFlags()
+	now = func() time.Time { return fixed }
+	random.Seed(*seed)
+	healthChecks = &healthChecker{targets: make(map[string]*healthTarget), disabled: true}
+	fakeUpstreams = make(replayUpstreams)
+	if *upstreamsFile != "" {
+		if fakeUpstreams, err = readReplayUpstreams(*upstreamsFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	queries, err := readReplayQueries(*queriesFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if err := setupSources(*sources); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := loadServerBlocks(*serversFile); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid server blocks: %v\n", err)
+		return 2
+	}
+	if err := loadAnswers(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *answersFile, err)
+		return 2
+	}
+	globalCache = newCache(true)
+	clearViewCaches()
+	clientSpecificCaches = make(map[string]*cache.Cache)
+
+	responses := replayQueries(queries)
+	if *asJson {
+		out := make([]replayResponse, len(queries))
+		for i, resp := range responses {
+			out[i].Query = queries[i]
+			if resp == nil {
+				out[i].Dropped = true
+				continue
+			}
+			out[i].Rcode = dns.RcodeToString[resp.Rcode]
+			out[i].Authoritative = resp.Authoritative
+			out[i].Truncated = resp.Truncated
+			out[i].Answer = recordStrings(resp.Answer)
+			out[i].Authority = recordStrings(resp.Ns)
+			out[i].Additional = recordStrings(resp.Extra)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(out)
+		return 0
+	}
+	for i, resp := range responses {
+		query := queries[i]
+		transport := "udp"
+		if query.Tcp {
+			transport = "tcp"
+		}
+		fmt.Printf(";; %s %s from %s over %s\n", dns.Fqdn(query.Name), query.Type, query.Client, transport)
+		if resp == nil {
+			fmt.Printf(";; no response\n\n")
+			continue
+		}
+		fmt.Printf("%s\n", resp.String())
+	}
+	return 0
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestReadReplayQueries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for format, content := range map[string]string{
+		"dig":   "# comment\nweb.internal\n\nweb.internal aaaa from=10.1.1.1 +tcp +dnssec\n",
+		"array": `[{"name": "web.internal"}, {"name": "web.internal", "type": "AAAA", "client": "10.1.1.1", "tcp": true, "dnssec": true}]`,
+		"lines": "{\"name\": \"web.internal\"}\n{\"name\": \"web.internal\", \"type\": \"aaaa\", \"client\": \"10.1.1.1\", \"tcp\": true, \"dnssec\": true}\n",
+	} {
+		path := filepath.Join(dir, format)
+		ioutil.WriteFile(path, []byte(content), 0644)
+		queries, err := readReplayQueries(path)
+		if err != nil {
+			t.Fatalf("Failed to read the %s queries: %v", format, err)
+		}
+		expected := []replayQuery{
+			{Name: "web.internal", Type: "A", Client: REPLAY_CLIENT},
+			{Name: "web.internal", Type: "AAAA", Client: "10.1.1.1", Tcp: true, Dnssec: true},
+		}
+		if len(queries) != 2 || queries[0] != expected[0] || queries[1] != expected[1] {
+			t.Fatalf("Incorrect %s queries %+v", format, queries)
+		}
+	}
+
+	for _, invalid := range []string{"web.internal BOGUS\n", "web.internal A from=nowhere\n", "web.internal A AAAA\n", `[{"type": "A"}]`} {
+		path := filepath.Join(dir, "invalid")
+		ioutil.WriteFile(path, []byte(invalid), 0644)
+		if _, err := readReplayQueries(path); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestReplayQueries(t *testing.T) {
+	saved, savedEnvironments, savedUpstreams, savedCache := answers, environmentAnswers, fakeUpstreams, globalCache
+	defer func() {
+		answers, environmentAnswers, fakeUpstreams, globalCache = saved, savedEnvironments, savedUpstreams, savedCache
+	}()
+	globalCache = cache.New(10, 600)
+	answers = Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"192.0.2.53"},
+			A:       map[string]RecordA{"web.internal.": {Answer: []string{"10.0.0.1"}}},
+		},
+		"10.1.1.1": ClientAnswers{A: map[string]RecordA{"web.internal.": {Answer: []string{"10.9.9.9"}}}},
+	}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	dir, err := ioutil.TempDir("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "upstreams.json")
+	ioutil.WriteFile(path, []byte(`{"www.example.com. A": {"answer": ["www.example.com. 300 IN A 192.0.2.1"]}, "gone.example.com A": {"rcode": "NXDOMAIN"}}`), 0644)
+	if fakeUpstreams, err = readReplayUpstreams(path); err != nil {
+		t.Fatal(err)
+	}
+
+	responses := replayQueries([]replayQuery{
+		{Name: "web.internal", Type: "A", Client: REPLAY_CLIENT},
+		{Name: "web.internal", Type: "A", Client: "10.1.1.1", Tcp: true},
+		{Name: "www.example.com", Type: "A", Client: REPLAY_CLIENT},
+		{Name: "gone.example.com", Type: "A", Client: REPLAY_CLIENT},
+		{Name: "unknown.example.com", Type: "A", Client: REPLAY_CLIENT},
+	})
+	for i, expected := range []struct {
+		rcode  int
+		answer string
+	}{
+		{dns.RcodeSuccess, "10.0.0.1"},
+		{dns.RcodeSuccess, "10.9.9.9"},
+		{dns.RcodeSuccess, "192.0.2.1"},
+		{dns.RcodeNameError, ""},
+		// No canned response: the recurser fails
+		{dns.RcodeServerFailure, ""},
+	} {
+		resp := responses[i]
+		if resp == nil || resp.Id != uint16(i+1) || resp.Rcode != expected.rcode {
+			t.Fatalf("Expected %s for query %d, got %v", dns.RcodeToString[expected.rcode], i+1, resp)
+		}
+		if expected.answer != "" && (len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != expected.answer) {
+			t.Fatalf("Expected %s for query %d, got %v", expected.answer, i+1, resp)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Signatures that are this close to their expiry when served, or found by a re-signing pass, are
+// reported as expiring: validators start failing the zone once they expire.
+const DNSSEC_SIGNATURE_WARNING = 24 * time.Hour
+
+// A signature made for an RRset, with what it takes to make it again
+type cachedSignature struct {
+	sig   *dns.RRSIG
+	zone  string
+	key   *signingKey
+	rrset []dns.RR
+}
+
+// When an RRset can't be signed again, its previous signature keeps being served while it's valid
+// (counted as dnssecStaleSignatures), warning about it; an expired one is not, as validators would
+// fail on it, and is counted as dnssecExpiredSignatures.
+func servePreviousSignature(cached *cachedSignature, current time.Time, err error) bool {
+	expiration := time.Unix(int64(cached.sig.Expiration), 0)
+	fields := log.Fields{"zone": cached.zone, "rrset": rrsetName(cached.rrset), "expiration": expiration.UTC()}
+	if !expiration.After(current) {
+		stats.incr("dnssecExpiredSignatures")
+		log.WithFields(fields).Errorf("Failed to sign again, the previous signature has expired: %v", err)
+		return false
+	}
+	stats.incr("dnssecStaleSignatures")
+	if expiration.Sub(current) < DNSSEC_SIGNATURE_WARNING {
+		stats.incr("dnssecExpiringSignatures")
+		log.WithFields(fields).Errorf("Failed to sign again, serving the previous signature about to expire: %v", err)
+	} else {
+		log.WithFields(fields).Warnf("Failed to sign again, serving the previous signature: %v", err)
+	}
+	return true
+}
+
+func rrsetName(rrset []dns.RR) string {
+	return rrset[0].Header().Name + " " + dns.Type(rrset[0].Header().Rrtype).String()
+}
+
+// Makes the signatures past half of their validity again ahead of the queries that would, every
+// --dnssec-resign-interval seconds. Those that can't be made again are dropped once expired.
+func watchSignatures(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		dnssecSigner.resign()
+	}
+}
+
+func (s *zoneSigner) resign() (resigned int, failed int) {
+	current := now()
+	s.Lock()
+	stale := make(map[string]*cachedSignature)
+	for cacheKey, cached := range s.signatures {
+		if !freshSignature(cached.sig, current) {
+			stale[cacheKey] = cached
+		}
+	}
+	s.Unlock()
+
+	for cacheKey, cached := range stale {
+		sig, err := signRrset(cached.zone, cached.key, cached.rrset, current)
+		if err != nil {
+			failed++
+			if !servePreviousSignature(cached, current, err) {
+				s.Lock()
+				delete(s.signatures, cacheKey)
+				s.Unlock()
+			}
+			continue
+		}
+		resigned++
+		s.cacheSignature(cacheKey, &cachedSignature{sig: sig, zone: cached.zone, key: cached.key, rrset: cached.rrset})
+	}
+	if resigned > 0 || failed > 0 {
+		log.WithFields(log.Fields{"resigned": resigned, "failed": failed}).Info("Signed RRsets again")
+	}
+	return resigned, failed
+}
+
+// The number of signatures in the cache, those expiring within DNSSEC_SIGNATURE_WARNING and the
+// earliest expiry, for the stats
+func (s *zoneSigner) gauges() map[string]interface{} {
+	current := now()
+	s.Lock()
+	defer s.Unlock()
+	expiring := 0
+	var earliest time.Time
+	for _, cached := range s.signatures {
+		expiration := time.Unix(int64(cached.sig.Expiration), 0)
+		if expiration.Sub(current) < DNSSEC_SIGNATURE_WARNING {
+			expiring++
+		}
+		if earliest.IsZero() || expiration.Before(earliest) {
+			earliest = expiration
+		}
+	}
+	out := map[string]interface{}{"signatures": len(s.signatures), "expiring": expiring}
+	if !earliest.IsZero() {
+		out["earliestExpiration"] = earliest.UTC()
+	}
+	return out
+}
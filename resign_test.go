@@ -0,0 +1,136 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSignatureExpiry(t *testing.T) {
+	defer func(saved func() time.Time) { now, dnssecSigner = saved, nil }(now)
+	start := time.Now()
+	now = func() time.Time { return start }
+	if err := setupDnssec("", ""); err != nil {
+		t.Fatal(err)
+	}
+	s := dnssecSigner
+	counter := func(name string) uint64 {
+		stats.Lock()
+		defer stats.Unlock()
+		return stats.counters[name]
+	}
+	rrset := []dns.RR{mustRR(t, "web.example.internal. 300 IN A 10.0.0.1")}
+	zone := "example.internal."
+	day := 24 * time.Hour
+
+	first, err := s.signature(zone, s.zsk, rrset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = func() time.Time { return start.Add(4 * day) }
+	second, err := s.signature(zone, s.zsk, rrset)
+	if err != nil || second.Inception == first.Inception {
+		t.Fatalf("Expected the signature to be made again past half of its validity (%v)", err)
+	}
+
+	// The key can't sign any more
+	broken := &signingKey{dnskey: s.zsk.dnskey}
+	stale, expiring, expired := counter("dnssecStaleSignatures"), counter("dnssecExpiringSignatures"), counter("dnssecExpiredSignatures")
+	now = func() time.Time { return start.Add(8 * day) }
+	if sig, err := s.signature(zone, broken, rrset); err != nil || sig != second {
+		t.Fatalf("Expected the previous signature to be served while valid (%v)", err)
+	}
+	now = func() time.Time { return start.Add(10*day + 12*time.Hour) }
+	if sig, err := s.signature(zone, broken, rrset); err != nil || sig != second {
+		t.Fatalf("Expected the previous signature to be served until it expires (%v)", err)
+	}
+	if gauges := s.gauges(); gauges["signatures"] != 1 || gauges["expiring"] != 1 {
+		t.Fatalf("Expected the expiring signature in the gauges, got %v", gauges)
+	}
+	now = func() time.Time { return start.Add(12 * day) }
+	if _, err := s.signature(zone, broken, rrset); err == nil {
+		t.Fatalf("Expected an expired signature not to be served")
+	}
+	if counter("dnssecStaleSignatures")-stale != 2 || counter("dnssecExpiringSignatures")-expiring != 1 || counter("dnssecExpiredSignatures")-expired != 1 {
+		t.Fatalf("Expected the stale, expiring and expired signatures to be counted")
+	}
+
+	// A pass signs the stale ones again ahead of the queries
+	now = func() time.Time { return start.Add(4 * day) }
+	s.signatures = nil
+	s.signature(zone, s.zsk, rrset)
+	now = func() time.Time { return start.Add(8 * day) }
+	if resigned, failed := s.resign(); resigned != 1 || failed != 0 {
+		t.Fatalf("Expected the signature to be made again, got %d (%d failed)", resigned, failed)
+	}
+	for _, cached := range s.signatures {
+		if !freshSignature(cached.sig, now()) {
+			t.Fatalf("Expected a fresh signature after the pass")
+		}
+	}
+	if resigned, _ := s.resign(); resigned != 0 {
+		t.Fatalf("Expected fresh signatures to be left alone")
+	}
+}
+
+func TestSignaturesAcrossGenerations(t *testing.T) {
+	saved, savedEnvironments, savedVersion := answers, environmentAnswers, currentAnswersVersion()
+	defer func() {
+		answers, environmentAnswers, dnssecSigner = saved, savedEnvironments, nil
+		answersMutex.Lock()
+		answersVersion = savedVersion
+		answersMutex.Unlock()
+	}()
+	if err := setupDnssec("", ""); err != nil {
+		t.Fatal(err)
+	}
+	s := dnssecSigner
+	zone := "example.internal."
+	setAnswers := func(db string) {
+		answers = Answers{DEFAULT_KEY: ClientAnswers{
+			Zones: []ZoneRule{{Zone: "example.internal", Ns: []string{"ns1.example.internal"}}},
+			A: map[string]RecordA{
+				"web.example.internal.": {Answer: []string{"10.0.0.1"}},
+				"db.example.internal.":  {Answer: []string{db}},
+			},
+		}}
+		answersMutex.Lock()
+		answersVersion.Generation++
+		answersMutex.Unlock()
+	}
+	environmentAnswers = nil
+	setAnswers("10.0.0.2")
+	s.chain(zone)
+
+	web := []dns.RR{mustRR(t, "web.example.internal. 300 IN A 10.0.0.1")}
+	db := []dns.RR{mustRR(t, "db.example.internal. 300 IN A 10.0.0.2")}
+	first, err := s.signature(zone, s.zsk, web)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.signature(zone, s.zsk, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// The same RRset with a lower TTL is served the same signature, a higher one needs another
+	lower, err := s.signature(zone, s.zsk, []dns.RR{mustRR(t, "web.example.internal. 60 IN A 10.0.0.1")})
+	if err != nil || lower.Signature != first.Signature || lower.Hdr.Ttl != 60 || first.Hdr.Ttl != 300 {
+		t.Fatalf("Expected the signature with the lower TTL, got %v (%v)", lower, err)
+	}
+	higher, err := s.signature(zone, s.zsk, []dns.RR{mustRR(t, "web.example.internal. 600 IN A 10.0.0.1")})
+	if err != nil || higher.OrigTtl != 600 {
+		t.Fatalf("Expected a signature for the higher TTL, got %v (%v)", higher, err)
+	}
+
+	// A new generation only drops the signatures of the RRsets it changed
+	setAnswers("10.0.0.3")
+	s.chain(zone)
+	s.Lock()
+	_, webKept := s.signatures[signatureKey(zone, s.zsk, web)]
+	_, dbKept := s.signatures[signatureKey(zone, s.zsk, db)]
+	s.Unlock()
+	if !webKept || dbKept {
+		t.Fatalf("Expected only the unchanged RRset's signature to be kept, got %v and %v", webKept, dbKept)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -9,6 +10,11 @@ import (
 )
 
 func ResolveTryAll(req *dns.Msg, resolvers []string) (resp *dns.Msg, err error) {
+	if zone, ok := rateLimiter.Allow(req.Question[0].Name); !ok {
+		log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "zone": zone}).Debug("Not recursing, zone over its rate limit")
+		stats.incr("rateLimited")
+		return nil, &rateLimitedError{zone}
+	}
 	for _, resolver := range resolvers {
 		log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "resolver": resolver}).Debug("Recursing")
 		resp, err = Resolve(req, resolver)
@@ -22,33 +28,108 @@ func ResolveTryAll(req *dns.Msg, resolvers []string) (resp *dns.Msg, err error)
 
 // Proxy a request to an external server
 func Resolve(req *dns.Msg, resolver string) (resp *dns.Msg, err error) {
-	resp, err = resolveTransport(req, "udp", resolver)
+	start := time.Now()
+	caps, probed := upstreamCapabilitiesFor(resolver)
+	if probed && !caps.Edns && req.IsEdns0() != nil {
+		req = withoutEdns(req)
+	}
+
+	transport := "udp"
+	if isTlsRecurser(resolver) {
+		// Never in plain text, so no UDP first
+		transport = TRANSPORT_TLS
+	} else if isDohRecurser(resolver) {
+		transport = TRANSPORT_HTTPS
+	}
+	resp, err = resolveTransport(req, transport, resolver)
 	if err != nil {
-		if resp != nil && resp.Truncated {
+		if transport == TRANSPORT_TLS || transport == TRANSPORT_HTTPS {
+			log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "resolver": resolver}).Warn("Recurser error: ", err)
+		} else if resp != nil && resp.Truncated && probed && !caps.Tcp {
+			log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "resolver": resolver}).Debug("Response truncated, but the recurser doesn't support TCP")
+			err = nil
+		} else if resp != nil && resp.Truncated {
 			log.Debug("Response truncated, retrying with TCP")
-			resp, err = resolveTransport(req, "tcp", resolver)
+			transport = "tcp"
+			resp, err = resolveTransport(req, transport, resolver)
 		} else {
 			log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "resolver": resolver}).Warn("Recurser error: ", err)
 		}
 	}
 
+	if err == nil && resp != nil {
+		if err = checkUpstreamLimits(req, resp); err != nil {
+			log.WithFields(log.Fields{"fqdn": req.Question[0].Name, "resolver": resolver}).Warn("Rejected recursive response: ", err)
+			resp = nil
+		}
+	}
+
+	stats.recordUpstream(resolver, resp, err)
+	logUpstream(req, resolver, transport, resp, err, time.Since(start))
+	if err == nil && resp != nil {
+		enforceBailiwick(req, resp)
+	}
+
 	return
 }
 
 func resolveTransport(req *dns.Msg, transport, resolver string) (resp *dns.Msg, err error) {
-	// Default to port 53
-	if !strings.Contains(resolver, ":") {
-		resolver = resolver + ":53"
+	if fakeUpstreams != nil {
+		return fakeUpstreams.exchange(req)
+	}
+	if transport == TRANSPORT_HTTPS {
+		// The HTTP client picks between the host's addresses and keeps the connections
+		return exchangeDoh(req, resolver)
+	}
+	send := func(req *dns.Msg, path upstreamPath) (*dns.Msg, error) {
+		return exchange(req, path.transport, path.addr)
 	}
+	if transport == TRANSPORT_TLS {
+		_, name := tlsRecurser(resolver)
+		send = func(req *dns.Msg, path upstreamPath) (*dns.Msg, error) { return exchangeTls(req, path.addr, name) }
+	}
+	paths := upstreamPaths(resolver, transport)
+	if len(paths) > 1 {
+		return raceExchange(req, resolver, paths, send)
+	}
+	return send(req, paths[0])
+}
 
+func exchange(req *dns.Msg, transport, resolver string) (resp *dns.Msg, err error) {
 	t := time.Duration(*recurserTimeout) * time.Second
-	c := &dns.Client{
-		Net:          transport,
-		DialTimeout:  t,
-		ReadTimeout:  t,
-		WriteTimeout: t,
+	if *upstreamSpoofDetect && transport == "udp" {
+		return exchangeWatched(req, resolver, t)
+	}
+	if dialer := outboundDialer(transport, resolver, t); dialer != nil {
+		resp, err = exchangeFrom(dialer, req, transport, resolver, t)
+	} else {
+		c := &dns.Client{
+			Net:          transport,
+			DialTimeout:  t,
+			ReadTimeout:  t,
+			WriteTimeout: t,
+		}
+		resp, _, err = c.Exchange(req, resolver)
+	}
+	if err == dns.ErrId {
+		recordSpoofing(resolver, resolver, SPOOF_ID_MISMATCH)
 	}
-
-	resp, _, err = c.Exchange(req, resolver)
 	return
 }
+
+// Adds the default port 53 to a recurser entry that doesn't have one. Entries can be host names,
+// IPv4 addresses or IPv6 addresses, with ("[2001:db8::1]:53") or without brackets. TLS recursers
+// default to port 853, DoH ones to 443.
+func resolverAddr(resolver string) string {
+	if isDohRecurser(resolver) {
+		return dohRecurserAddr(resolver)
+	}
+	if isTlsRecurser(resolver) {
+		addr, _ := tlsRecurser(resolver)
+		return addr
+	}
+	if _, _, err := net.SplitHostPort(resolver); err == nil {
+		return resolver
+	}
+	return net.JoinHostPort(strings.Trim(resolver, "[]"), "53")
+}
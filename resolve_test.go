@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestResolverAddr(t *testing.T) {
+	cases := map[string]string{
+		"8.8.8.8":              "8.8.8.8:53",
+		"8.8.8.8:5353":         "8.8.8.8:5353",
+		"dns.example.com":      "dns.example.com:53",
+		"2001:4860:4860::8888": "[2001:4860:4860::8888]:53",
+		"[2001:db8::1]":        "[2001:db8::1]:53",
+		"[2001:db8::1]:5353":   "[2001:db8::1]:5353",
+	}
+	for in, expected := range cases {
+		if actual := resolverAddr(in); actual != expected {
+			t.Fatalf("Incorrect address for %s: expected %s, got %s", in, expected, actual)
+		}
+	}
+}
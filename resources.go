@@ -0,0 +1,75 @@
+package main
+
+import (
+	"runtime"
+)
+
+// Gauges of the resources the process holds, reported under "runtime" in the stats so leaks show up
+// long before limits are hit. File descriptor and socket counts are only available on Linux.
+type resourceGauges struct {
+	Goroutines int          `json:"goroutines"`
+	OpenFds    *int         `json:"openFds,omitempty"`
+	FdLimit    *int         `json:"fdLimit,omitempty"`
+	UdpSockets *int         `json:"udpSockets,omitempty"`
+	TcpSockets *int         `json:"tcpSockets,omitempty"`
+	Memory     memoryGauges `json:"memory"`
+}
+
+// Bytes in use, by the Go runtime and by the subsystems holding the most data
+type memoryGauges struct {
+	Sys                uint64 `json:"sys"`
+	HeapAlloc          uint64 `json:"heapAlloc"`
+	HeapInuse          uint64 `json:"heapInuse"`
+	StackInuse         uint64 `json:"stackInuse"`
+	GcCycles           uint32 `json:"gcCycles"`
+	GlobalCacheEntries int    `json:"globalCacheEntries"`
+	GlobalCache        int    `json:"globalCache"`
+	ViewCacheEntries   int    `json:"viewCacheEntries"`
+	ViewCache          int    `json:"viewCache"`
+	ClientCaches       int    `json:"clientCaches"`
+	ClientCacheEntries int    `json:"clientCacheEntries"`
+	ClientCache        int    `json:"clientCache"`
+	Capture            int    `json:"capture"`
+}
+
+func readResourceGauges() resourceGauges {
+	gauges := resourceGauges{Goroutines: runtime.NumGoroutine()}
+	if fds, limit, err := fdUsage(); err == nil {
+		gauges.OpenFds, gauges.FdLimit = &fds, &limit
+	}
+	if udp, tcp, err := socketUsage(); err == nil {
+		gauges.UdpSockets, gauges.TcpSockets = &udp, &tcp
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gauges.Memory = memoryGauges{
+		Sys:        mem.Sys,
+		HeapAlloc:  mem.HeapAlloc,
+		HeapInuse:  mem.HeapInuse,
+		StackInuse: mem.StackInuse,
+		GcCycles:   mem.NumGC,
+	}
+	if globalCache != nil {
+		gauges.Memory.GlobalCacheEntries, gauges.Memory.GlobalCache = globalCache.Len()
+	}
+	viewCachesMutex.RLock()
+	for _, c := range viewCaches {
+		entries, size := c.Len()
+		gauges.Memory.ViewCacheEntries += entries
+		gauges.Memory.ViewCache += size
+	}
+	viewCachesMutex.RUnlock()
+	clientSpecificCachesMutex.RLock()
+	gauges.Memory.ClientCaches = len(clientSpecificCaches)
+	for _, c := range clientSpecificCaches {
+		entries, size := c.Len()
+		gauges.Memory.ClientCacheEntries += entries
+		gauges.Memory.ClientCache += size
+	}
+	clientSpecificCachesMutex.RUnlock()
+	if c := capturing(); c != nil {
+		gauges.Memory.Capture = c.Size()
+	}
+	return gauges
+}
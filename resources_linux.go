@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+)
+
+// Open file descriptors and the limit on them
+func fdUsage() (int, int, error) {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, 0, err
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, 0, err
+	}
+	return len(fds), int(limit.Cur), nil
+}
+
+// UDP and TCP sockets (of any state) held by the process
+func socketUsage() (int, int, error) {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, 0, err
+	}
+	inodes := make(map[string]bool)
+	for _, fd := range fds {
+		link, err := os.Readlink("/proc/self/fd/" + fd.Name())
+		if err == nil && strings.HasPrefix(link, "socket:[") {
+			inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+		}
+	}
+
+	count := func(tables ...string) int {
+		n := 0
+		for _, table := range tables {
+			f, err := os.Open("/proc/self/net/" + table)
+			if err != nil {
+				continue
+			}
+			scanner := bufio.NewScanner(f)
+			scanner.Scan() // header
+			for scanner.Scan() {
+				// sl local_address rem_address st tx_queue:rx_queue tr:tm->when retrnsmt uid timeout inode
+				if fields := strings.Fields(scanner.Text()); len(fields) > 9 && inodes[fields[9]] {
+					n++
+				}
+			}
+			f.Close()
+		}
+		return n
+	}
+	return count("udp", "udp6"), count("tcp", "tcp6"), nil
+}
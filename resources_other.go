@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func fdUsage() (int, int, error) {
+	return 0, 0, errors.New("file descriptor usage is only available on Linux")
+}
+
+func socketUsage() (int, int, error) {
+	return 0, 0, errors.New("socket usage is only available on Linux")
+}
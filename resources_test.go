@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestResourceGauges(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	saved := globalCache
+	defer func() { globalCache = saved }()
+	globalCache = cache.New(10, 600)
+	m := new(dns.Msg)
+	m.SetQuestion("web.example.com.", dns.TypeA)
+	globalCache.InsertMessage("web", m, 0)
+
+	gauges := readResourceGauges()
+	if gauges.Goroutines < 1 || gauges.Memory.HeapAlloc == 0 {
+		t.Fatalf("Expected runtime gauges [%+v]", gauges)
+	}
+	if gauges.Memory.GlobalCacheEntries != 1 || gauges.Memory.GlobalCache < m.Len() {
+		t.Fatalf("Expected the cached message to be counted [%+v]", gauges.Memory)
+	}
+	if runtime.GOOS == "linux" && (gauges.OpenFds == nil || *gauges.OpenFds < 1 || gauges.UdpSockets == nil || *gauges.UdpSockets < 1) {
+		t.Fatalf("Expected the open socket to be counted [%+v]", gauges)
+	}
+}
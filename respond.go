@@ -6,42 +6,106 @@ import (
 )
 
 func Respond(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg) {
-	// Figure out the max response size
-	bufsize := uint16(512)
 	tcp := isTcp(w)
+	bufsize := udpPayloadSize(req, tcp)
 
-	if o := req.IsEdns0(); o != nil {
-		bufsize = o.UDPSize()
+	m.Compress = *compress
+	rotateAnswers(m)
+	capAnswers(m)
+	presentDnssec(req, m)
+	if *minimalResponses {
+		minimize(m)
+	}
+	if dnssecSigner != nil {
+		m = dnssecSigner.signResponse(req, m)
+	}
+	setResponseOpt(req, m)
+	fit(req, m, bufsize-writeOverhead(w, m), tcp)
+
+	err := w.WriteMsg(m)
+	if err != nil {
+		log.Warn("Failed to return reply: ", err, m.Len())
+	}
+
+}
+
+// Make sure the payload fits the buffer size. If the message is too large the Additional section is
+// dropped first (except for the OPT record), then the Authority section. If it's still too large,
+// answers are removed from the end until it fits and the message is marked truncated for UDP
+// queries, so the client retries over TCP. For TCP queries, where there is nothing to retry with,
+// the response is turned into a ServerFailure instead.
+func fit(req *dns.Msg, m *dns.Msg, bufsize int, tcp bool) {
+	if m.Len() <= bufsize {
+		return
+	}
+
+	fqdn := dns.Fqdn(req.Question[0].Name)
+	log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response too big, dropping Additional")
+	var extra []dns.RR
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+	if m.Len() <= bufsize {
+		return
+	}
+
+	log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response still too big, dropping Authority")
+	m.Ns = nil
+	if m.Len() <= bufsize {
+		return
 	}
 
 	if tcp {
-		bufsize = dns.MaxMsgSize - 1
-	} else if bufsize < 512 {
-		bufsize = 512
-	}
-
-	// Make sure the payload fits the buffer size. If the message is too large we strip the Extra section.
-	// If it's still too large we return a truncated message for UDP queries and ServerFailure for TCP queries.
-	if m.Len() > int(bufsize) {
-		fqdn := dns.Fqdn(req.Question[0].Name)
-		log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response too big, dropping Authority and Extra")
-		m.Extra = nil
-		if m.Len() > int(bufsize) {
-			if tcp {
-				log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response still too big, return ServerFailure")
-				m = new(dns.Msg)
-				m.SetRcode(req, dns.RcodeServerFailure)
-			} else {
-				log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response still too big, return truncated message")
-				m.Answer = nil
-				m.Truncated = true
+		log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response still too big, return ServerFailure")
+		compressed := m.Compress
+		*m = dns.Msg{}
+		m.SetRcode(req, dns.RcodeServerFailure)
+		m.Compress = compressed
+		return
+	}
+
+	log.WithFields(log.Fields{"fqdn": fqdn}).Debug("Response still too big, return truncated message")
+	m.Truncated = true
+	for len(m.Answer) > 0 && m.Len() > bufsize {
+		m.Answer = m.Answer[:len(m.Answer)-1]
+	}
+}
+
+// Drops the authority and additional sections unless they are needed: the SOA of negative answers
+// (for negative caching) and the NS records and glue of referrals. The OPT record is always kept.
+func minimize(m *dns.Msg) {
+	referral := len(m.Answer) == 0 && m.Rcode == dns.RcodeSuccess && hasType(m.Ns, dns.TypeNS)
+	if referral {
+		return
+	}
+
+	var ns []dns.RR
+	if len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				ns = append(ns, rr)
 			}
 		}
 	}
+	m.Ns = ns
 
-	err := w.WriteMsg(m)
-	if err != nil {
-		log.Warn("Failed to return reply: ", err, m.Len())
+	var extra []dns.RR
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
 	}
+	m.Extra = extra
+}
 
+func hasType(records []dns.RR, rrtype uint16) bool {
+	for _, rr := range records {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+	return false
 }
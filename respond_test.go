@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func bigResponse(t *testing.T, answers int) (*dns.Msg, *dns.Msg) {
+	req := new(dns.Msg)
+	req.SetQuestion("big.discover.internal.", dns.TypeA)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Compress = true
+	for i := 0; i < answers; i++ {
+		m.Answer = append(m.Answer, mustRR(t, fmt.Sprintf("big.discover.internal. 60 IN A 10.0.0.%d", i)))
+	}
+	m.Ns = []dns.RR{mustRR(t, "discover.internal. 60 IN NS ns.discover.internal.")}
+	m.Extra = []dns.RR{mustRR(t, "ns.discover.internal. 60 IN A 10.0.1.1")}
+	return req, m
+}
+
+func TestFitDropsAdditionalFirst(t *testing.T) {
+	req, m := bigResponse(t, 29)
+	fit(req, m, m.Len()-1, false)
+	if len(m.Extra) != 0 || len(m.Ns) != 1 || len(m.Answer) != 29 || m.Truncated {
+		t.Fatalf("Expected only the additional section to be dropped [%v]", m)
+	}
+}
+
+func TestFitTruncatesAnswers(t *testing.T) {
+	req, m := bigResponse(t, 100)
+	fit(req, m, 512, false)
+	if !m.Truncated {
+		t.Fatalf("Expected a truncated response")
+	}
+	if len(m.Ns) != 0 || len(m.Extra) != 0 {
+		t.Fatalf("Expected authority and additional to be dropped [%v]", m)
+	}
+	if len(m.Answer) == 0 || m.Len() > 512 {
+		t.Fatalf("Expected as many answers as fit in 512 bytes, got %d (%d bytes)", len(m.Answer), m.Len())
+	}
+}
+
+// The extended error, EDNS options, debug record and TSIG the writer adds still fit the buffer size
+func TestRespondLeavesRoomForWriter(t *testing.T) {
+	tsigKeys = map[string]tsigKey{"transfer.key.": {name: "transfer.key.", algorithm: dns.HmacSHA512, secret: testTsigSecret}}
+	defer func() { tsigKeys = nil }()
+	req, m := bigResponse(t, 100)
+	req.SetEdns0(512, false)
+	w := &testWriter{}
+	qw := &queryWriter{ResponseWriter: w, edns: true, keepalive: true, nsid: "ns1.discover.internal", tsig: "transfer.key.",
+		debug: &queryDebug{notes: []string{"path=local", "answers=100"}}}
+	setExtendedError(qw, EDE_BLOCKED, "blocked by policy")
+	Respond(qw, req, m)
+	if w.msg == nil || !w.msg.Truncated || w.msg.IsTsig() == nil {
+		t.Fatalf("Expected a truncated, signed response [%v]", w.msg)
+	}
+	if size := w.msg.Len() + TSIG_MAX_MAC_SIZE; size > 512 {
+		t.Fatalf("Expected the response to fit 512 bytes with its MAC, got %d", size)
+	}
+}
+
+func TestFitTcpServerFailure(t *testing.T) {
+	req, m := bigResponse(t, 100)
+	fit(req, m, 512, true)
+	if m.Rcode != dns.RcodeServerFailure || len(m.Answer) != 0 {
+		t.Fatalf("Expected a ServerFailure [%v]", m)
+	}
+}
+
+func TestMinimize(t *testing.T) {
+	_, m := bigResponse(t, 2)
+	m.SetEdns0(4096, false)
+	minimize(m)
+	if len(m.Answer) != 2 || len(m.Ns) != 0 || len(m.Extra) != 1 || m.Extra[0].Header().Rrtype != dns.TypeOPT {
+		t.Fatalf("Expected only the answers and OPT to be kept [%v]", m)
+	}
+
+	_, m = bigResponse(t, 0)
+	minimize(m)
+	if len(m.Ns) != 1 || len(m.Extra) != 1 {
+		t.Fatalf("Expected the referral to be kept whole [%v]", m)
+	}
+
+	_, m = bigResponse(t, 0)
+	m.Rcode = dns.RcodeNameError
+	m.Ns = append(m.Ns, mustRR(t, "discover.internal. 60 IN SOA discover.internal. discover.internal. 1 60 10 86400 1"))
+	minimize(m)
+	if len(m.Ns) != 1 || m.Ns[0].Header().Rrtype != dns.TypeSOA || len(m.Extra) != 0 {
+		t.Fatalf("Expected only the SOA of the negative answer to be kept [%v]", m)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream routing rules, read from the "routes" list of the default entry. The first rule whose
+// suffix and type (each optional) match the query sends it to the rule's recursers instead of the
+// client's.
+func (answers *Answers) RouteRules() []RouteRule {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.Routes
+}
+
+// Recursive servers for the query: those of the first matching route, or the client's
+func (answers *Answers) RecursersFor(clientUUID string, question dns.Question) []string {
+	for _, rule := range answers.RouteRules() {
+		if rule.Matches(question) {
+			return rule.Recurse
+		}
+	}
+	return answers.Recursers(clientUUID)
+}
+
+func (rule *RouteRule) Matches(question dns.Question) bool {
+	if rule.Suffix != "" && !inZone(question.Name, rule.Suffix) {
+		return false
+	}
+	if rule.Qtype != "" && !strings.EqualFold(rule.Qtype, dns.Type(question.Qtype).String()) {
+		return false
+	}
+	return true
+}
+
+func (rule *RouteRule) Validate() error {
+	if len(rule.Recurse) == 0 {
+		return fmt.Errorf("route without recursers: %+v", *rule)
+	}
+	if rule.Qtype != "" {
+		if _, ok := dns.StringToType[strings.ToUpper(rule.Qtype)]; !ok {
+			return fmt.Errorf("invalid type for route to %v: %s", rule.Recurse, rule.Qtype)
+		}
+	}
+	return nil
+}
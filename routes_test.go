@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecursersFor(t *testing.T) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"8.8.8.8"},
+			Routes: []RouteRule{
+				{Qtype: "ptr", Recurse: []string{"10.0.0.53"}},
+				{Suffix: "corp.internal", Recurse: []string{"10.0.0.54"}},
+			},
+		},
+		"10.1.1.1": ClientAnswers{Recurse: []string{"10.1.1.53"}},
+	}
+
+	cases := []struct {
+		client   string
+		name     string
+		qtype    uint16
+		recurser string
+	}{
+		{"10.1.1.2", "4.3.2.1.in-addr.arpa.", dns.TypePTR, "10.0.0.53"},
+		{"10.1.1.2", "db.CORP.internal.", dns.TypeA, "10.0.0.54"},
+		{"10.1.1.2", "google.com.", dns.TypeA, "8.8.8.8"},
+		{"10.1.1.1", "google.com.", dns.TypeA, "10.1.1.53"},
+	}
+	for _, tc := range cases {
+		q := dns.Question{Name: tc.name, Qtype: tc.qtype, Qclass: dns.ClassINET}
+		if recursers := answers.RecursersFor(tc.client, q); recursers[0] != tc.recurser {
+			t.Fatalf("Incorrect recursers for %s %s: expected %s, got %v", tc.client, tc.name, tc.recurser, recursers)
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Zones mirrored from a primary server (--secondary), served as the "secondary" source: the zone is
+// transferred in full (AXFR) at startup, then its changes (IXFR) every refresh interval of its SOA, every
+// retry interval while the primary can't be reached, or right away when the primary sends a NOTIFY. The
+// records of the types answers have (A, AAAA, CNAME, PTR, TXT and SRV) are served as records of the
+// "default" entry; when the primary hasn't been reached for the expire interval, the zone is dropped.
+// With a TSIG key, the transfers are signed with it and NOTIFYs not signed with it are refused.
+const (
+	SOURCE_SECONDARY = "secondary"
+	XFR_TIMEOUT      = 10 * time.Second
+)
+
+type secondaryZone struct {
+	sync.Mutex
+	zone    string
+	primary string
+	// TSIG key of the transfers and NOTIFYs, empty for none
+	key string
+	// The SOA and records of the zone as last transferred, nil before the first transfer
+	soa       *dns.SOA
+	records   map[string]dns.RR
+	refreshed time.Time
+	notify    chan bool
+}
+
+var (
+	secondaryRecords = &recordSource{name: SOURCE_SECONDARY, answers: make(Answers)}
+	secondaryZones   []*secondaryZone
+)
+
+// Parses --secondary, comma-delimited ZONE@PRIMARY[/KEY] entries. Called once when parsing flags, after
+// the TSIG keys are loaded.
+func setupSecondaries(spec string) error {
+	secondaryZones = nil
+	for _, entry := range splitTrim(spec, ",") {
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "@", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("expected ZONE@PRIMARY, got %q", entry)
+		}
+		zone := strings.ToLower(dns.Fqdn(strings.Trim(parts[0], ".")))
+		if _, ok := dns.IsDomainName(zone); !ok || zone == "." {
+			return fmt.Errorf("invalid zone in %q", entry)
+		}
+		server, key := parts[1], ""
+		if i := strings.Index(server, "/"); i >= 0 {
+			server, key = server[:i], tsigKeyName(server[i+1:])
+			if !knownTsigKey(key) {
+				return fmt.Errorf("unknown TSIG key in %q", entry)
+			}
+		}
+		primary, err := canonicalRecurser(server)
+		if err != nil {
+			return fmt.Errorf("invalid primary in %q: %v", entry, err)
+		}
+		secondaryZones = append(secondaryZones, &secondaryZone{zone: zone, primary: resolverAddr(primary), key: key, notify: make(chan bool, 1)})
+	}
+	return nil
+}
+
+// Starts mirroring the secondary zones
+func startSecondaries() {
+	for _, zone := range secondaryZones {
+		go zone.run()
+	}
+}
+
+func (z *secondaryZone) run() {
+	for {
+		wait := time.Duration(DEFAULT_SOA_RETRY) * time.Second
+		if err := z.refresh(); err != nil {
+			stats.incr("secondaryTransferErrors")
+			log.WithFields(log.Fields{"zone": z.zone, "primary": z.primary}).Warnf("Failed to transfer zone: %v", err)
+			if soa := z.currentSoa(); soa != nil {
+				wait = time.Duration(soa.Retry) * time.Second
+				if time.Since(z.lastRefreshed()) > time.Duration(soa.Expire)*time.Second {
+					log.WithFields(log.Fields{"zone": z.zone, "primary": z.primary}).Warn("Zone expired, no longer serving it")
+					z.expire()
+					serveSecondaries()
+				}
+			}
+		} else if soa := z.currentSoa(); soa != nil {
+			wait = time.Duration(soa.Refresh) * time.Second
+		}
+
+		select {
+		case <-z.notify:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (z *secondaryZone) currentSoa() *dns.SOA {
+	z.Lock()
+	defer z.Unlock()
+	return z.soa
+}
+
+func (z *secondaryZone) lastRefreshed() time.Time {
+	z.Lock()
+	defer z.Unlock()
+	return z.refreshed
+}
+
+func (z *secondaryZone) expire() {
+	z.Lock()
+	z.soa, z.records = nil, nil
+	z.Unlock()
+}
+
+// Transfers the changes of the zone (all of it the first time) and serves them
+func (z *secondaryZone) refresh() error {
+	req := new(dns.Msg)
+	current := z.currentSoa()
+	if current == nil {
+		req.SetAxfr(z.zone)
+	} else {
+		req.SetIxfr(z.zone, current.Serial, current.Ns, current.Mbox)
+	}
+	if z.key != "" {
+		signMsg(req, z.key)
+	}
+	transfer := &dns.Transfer{DialTimeout: XFR_TIMEOUT, ReadTimeout: XFR_TIMEOUT, WriteTimeout: XFR_TIMEOUT, TsigSecret: tsigSecrets()}
+	envelopes, err := transfer.In(req, z.primary)
+	if err != nil {
+		return err
+	}
+	var records []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return envelope.Error
+		}
+		records = append(records, envelope.RR...)
+	}
+
+	changed, err := z.apply(records)
+	if err != nil {
+		return err
+	}
+	stats.incr("secondaryTransfers")
+	if changed {
+		log.WithFields(log.Fields{"zone": z.zone, "primary": z.primary, "serial": z.currentSoa().Serial}).Info("Transferred zone")
+		serveSecondaries()
+	}
+	return nil
+}
+
+// Applies the records of a transfer: a single SOA when the zone is unchanged, the whole zone between
+// two SOAs, or the deletions and additions of each version (RFC 1995). Reports whether the zone
+// changed.
+func (z *secondaryZone) apply(records []dns.RR) (bool, error) {
+	if len(records) == 0 {
+		return false, fmt.Errorf("empty transfer")
+	}
+	soa, ok := records[0].(*dns.SOA)
+	if !ok {
+		return false, fmt.Errorf("transfer doesn't start with an SOA")
+	}
+
+	z.Lock()
+	defer z.Unlock()
+	z.refreshed = time.Now()
+	if len(records) == 1 {
+		if z.soa == nil {
+			return false, fmt.Errorf("transfer without the zone")
+		}
+		return false, nil
+	}
+	last, ok := records[len(records)-1].(*dns.SOA)
+	if !ok || last.Serial != soa.Serial {
+		return false, fmt.Errorf("transfer doesn't end with the SOA")
+	}
+
+	body := records[1 : len(records)-1]
+	if _, incremental := records[1].(*dns.SOA); !incremental || z.records == nil {
+		contents := make(map[string]dns.RR)
+		for _, record := range body {
+			if _, ok := record.(*dns.SOA); !ok && inZone(record.Header().Name, z.zone) {
+				contents[recordKey(record)] = record
+			}
+		}
+		z.soa, z.records = soa, contents
+		return true, nil
+	}
+
+	deleting := false
+	for _, record := range body {
+		if _, ok := record.(*dns.SOA); ok {
+			deleting = !deleting
+			continue
+		}
+		if deleting {
+			delete(z.records, recordKey(record))
+		} else if inZone(record.Header().Name, z.zone) {
+			z.records[recordKey(record)] = record
+		}
+	}
+	z.soa = soa
+	return true, nil
+}
+
+// The record without its TTL, which doesn't make it another record
+func recordKey(record dns.RR) string {
+	copied := dns.Copy(record)
+	copied.Header().Ttl = 0
+	copied.Header().Name = strings.ToLower(copied.Header().Name)
+	return copied.String()
+}
+
+// Serves the records of every secondary zone as the secondary source
+func serveSecondaries() {
+	client := ClientAnswers{
+		A:     make(map[string]RecordA),
+		Cname: make(map[string]RecordCname),
+		Ptr:   make(map[string]RecordPtr),
+		Txt:   make(map[string]RecordTxt),
+		Srv:   make(map[string]RecordSrv),
+	}
+	for _, zone := range secondaryZones {
+		zone.Lock()
+		for _, record := range zone.records {
+			name := strings.ToLower(record.Header().Name)
+			ttl := record.Header().Ttl
+			source := SOURCE_SECONDARY + ":" + zone.zone
+			switch record := record.(type) {
+			case *dns.A:
+				rec := client.A[name]
+				rec.Answer, rec.Ttl, rec.Source = append(rec.Answer, record.A.String()), &ttl, source
+				client.A[name] = rec
+			case *dns.AAAA:
+				rec := client.A[name]
+				rec.Answer, rec.Ttl, rec.Source = append(rec.Answer, record.AAAA.String()), &ttl, source
+				client.A[name] = rec
+			case *dns.CNAME:
+				client.Cname[name] = RecordCname{Answer: record.Target, Ttl: &ttl, Source: source}
+			case *dns.PTR:
+				client.Ptr[name] = RecordPtr{Answer: record.Ptr, Ttl: &ttl, Source: source}
+			case *dns.TXT:
+				rec := client.Txt[name]
+				rec.Answer, rec.Ttl, rec.Source = append(rec.Answer, strings.Join(record.Txt, "")), &ttl, source
+				client.Txt[name] = rec
+			case *dns.SRV:
+				rec := client.Srv[name]
+				answer := fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, record.Target)
+				rec.Answer, rec.Ttl, rec.Source = append(rec.Answer, answer), &ttl, source
+				client.Srv[name] = rec
+			}
+		}
+		zone.Unlock()
+	}
+	secondaryRecords.Set(Answers{DEFAULT_KEY: client})
+}
+
+// Answers a NOTIFY of a change of a secondary zone from its primary (the peer sending it, not a client
+// a proxy names) by transferring the change
+func answerNotify(w dns.ResponseWriter, req *dns.Msg) {
+	zone := strings.ToLower(req.Question[0].Name)
+	clientIp := peerAddr(w)
+	m := new(dns.Msg)
+	m.SetReply(req)
+	for _, secondary := range secondaryZones {
+		if secondary.zone != zone || !secondary.isPrimary(clientIp) || requestKey(w) != secondary.key {
+			continue
+		}
+		m.Authoritative = true
+		w.WriteMsg(m)
+		log.WithFields(log.Fields{"zone": zone, "primary": clientIp}).Debug("Received NOTIFY")
+		select {
+		case secondary.notify <- true:
+		default:
+		}
+		return
+	}
+	log.WithFields(log.Fields{"zone": zone, "client": clientIp}).Warn("Refused NOTIFY not from the primary of the zone, or not signed with its key")
+	m.Rcode = dns.RcodeRefused
+	w.WriteMsg(m)
+}
+
+// Whether the address is (one of those of) the primary
+func (z *secondaryZone) isPrimary(clientIp string) bool {
+	host, _, _ := net.SplitHostPort(z.primary)
+	client := net.ParseIP(clientIp)
+	addresses := []net.IP{net.ParseIP(host)}
+	if addresses[0] == nil {
+		addresses, _ = net.LookupIP(host)
+	}
+	for _, address := range addresses {
+		if client != nil && address.Equal(client) {
+			return true
+		}
+	}
+	return false
+}
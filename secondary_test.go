@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSecondaryZones(t *testing.T) {
+	defer func() { secondaryZones = nil }()
+
+	// A primary serving serial 1 of the zone, later serial 2 with web moved
+	serial := uint32(1)
+	soa := func(serial uint32) dns.RR {
+		rr, _ := dns.NewRR("mirror.corp. 3600 IN SOA ns1.mirror.corp. hostmaster.mirror.corp. 1 3600 600 86400 60")
+		rr.(*dns.SOA).Serial = serial
+		return rr
+	}
+	rr := func(s string) dns.RR {
+		record, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		version := rr("web.mirror.corp. 300 IN A 10.0.0.1")
+		if serial == 2 {
+			version = rr("web.mirror.corp. 300 IN A 10.0.0.2")
+		}
+		switch {
+		case req.Question[0].Qtype == dns.TypeAXFR:
+			m.Answer = []dns.RR{soa(serial), version, rr("_http._tcp.mirror.corp. 300 IN SRV 10 5 80 web.mirror.corp."), rr("web.elsewhere. 300 IN A 10.6.6.6"), rr("mirror.corp. 300 IN MX 10 mail.mirror.corp."), soa(serial)}
+		case req.Ns[0].(*dns.SOA).Serial == serial:
+			m.Answer = []dns.RR{soa(serial)}
+		default:
+			m.Answer = []dns.RR{soa(2), soa(1), rr("web.mirror.corp. 300 IN A 10.0.0.1"), soa(2), version, rr("www.mirror.corp. 60 IN CNAME web.mirror.corp."), soa(2)}
+		}
+		w.WriteMsg(m)
+	})}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	if err := setupSecondaries("Mirror.Corp@" + listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	zone := secondaryZones[0]
+	if zone.zone != "mirror.corp." {
+		t.Fatalf("Incorrect zone %s", zone.zone)
+	}
+	served := func() ClientAnswers {
+		return secondaryRecords.Answers()[DEFAULT_KEY]
+	}
+
+	if err := zone.refresh(); err != nil {
+		t.Fatalf("Failed to transfer the zone: %v", err)
+	}
+	client := served()
+	if web := client.A["web.mirror.corp."]; len(web.Answer) != 1 || web.Answer[0] != "10.0.0.1" || *web.Ttl != 300 || web.Source != "secondary:mirror.corp." {
+		t.Fatalf("Expected web from the transfer, got %+v", web)
+	}
+	if srv := client.Srv["_http._tcp.mirror.corp."]; len(srv.Answer) != 1 || srv.Answer[0] != "10 5 80 web.mirror.corp." {
+		t.Fatalf("Expected the SRV record, got %+v", srv)
+	}
+	if _, ok := client.A["web.elsewhere."]; ok {
+		t.Fatalf("Expected records outside of the zone to be left out")
+	}
+
+	// The changes since serial 1, then nothing
+	serial = 2
+	if err := zone.refresh(); err != nil {
+		t.Fatalf("Failed to transfer the changes: %v", err)
+	}
+	client = served()
+	if web := client.A["web.mirror.corp."]; len(web.Answer) != 1 || web.Answer[0] != "10.0.0.2" || client.Cname["www.mirror.corp."].Answer != "web.mirror.corp." {
+		t.Fatalf("Expected the changes, got %+v", client)
+	}
+	if err := zone.refresh(); err != nil || zone.currentSoa().Serial != 2 {
+		t.Fatalf("Expected the zone to be up to date, got %v", err)
+	}
+
+	// NOTIFY from the primary only
+	notify := new(dns.Msg)
+	notify.SetNotify("mirror.corp.")
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}}
+	answerNotify(&queryWriter{ResponseWriter: w}, notify)
+	if w.msg.Rcode != dns.RcodeSuccess || len(zone.notify) != 1 {
+		t.Fatalf("Expected the NOTIFY to be accepted, got %v", w.msg)
+	}
+	w = &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("10.2.2.2"), Port: 5353}}
+	answerNotify(&queryWriter{ResponseWriter: w}, notify)
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("Expected the NOTIFY to be refused, got %v", w.msg)
+	}
+	// Even when a proxy (by ECS or the PROXY protocol) says it's from the primary
+	answerNotify(&queryWriter{ResponseWriter: w, client: "127.0.0.1"}, notify)
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("Expected the proxied NOTIFY to be refused, got %v", w.msg)
+	}
+
+	for _, invalid := range []string{"mirror.corp", "@10.0.0.53", "mirror.corp@10.0.0.53:99999"} {
+		if err := setupSecondaries(invalid); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
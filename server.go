@@ -0,0 +1,326 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// queryWriter wraps the ResponseWriter handed to route so the reply that was
+// actually sent can be inspected once the query has been handled.
+type queryWriter struct {
+	dns.ResponseWriter
+	msg   *dns.Msg
+	tag   string
+	debug *queryDebug
+	ede   *extendedError
+	edns  bool
+	// Whether to signal the TCP idle timeout (edns-tcp-keepalive) in the response
+	keepalive bool
+	// The client a trusted proxy sent the query on behalf of, which stands in for the socket source
+	client string
+	// The NSID (RFC 5001) to send, when the query asked for it
+	nsid string
+	// How the local answer was found (MATCH_*), empty for other answers
+	match string
+	// The TSIG key the query was signed with, which signs the responses
+	tsig string
+}
+
+func (w *queryWriter) WriteMsg(m *dns.Msg) error {
+	w.decorate(m)
+	if w.tsig != "" && m.IsTsig() == nil {
+		// The TSIG goes last, on a copy as the message may be cached
+		m = m.Copy()
+		signMsg(m, w.tsig)
+	}
+	w.msg = m
+	captureMsg(w.LocalAddr(), w.RemoteAddr(), m)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Adds the extended error, OPT record, EDNS options and debug record of the query to the response
+func (w *queryWriter) decorate(m *dns.Msg) {
+	if w.ede != nil && w.edns {
+		w.ede.addTo(m)
+	}
+	if w.edns && m.IsEdns0() == nil {
+		m.Extra = append(m.Extra, newOpt())
+	}
+	if w.keepalive {
+		addKeepalive(m)
+	}
+	if w.nsid != "" && w.edns {
+		addNsid(m, w.nsid)
+	}
+	if w.debug != nil {
+		m.Extra = append(m.Extra, w.debug.record())
+	}
+}
+
+// Bytes WriteMsg adds to the response, which fit leaves room for: what decorate adds, measured on a
+// copy of the question and additional section, and the TSIG with the largest MAC
+func (w *queryWriter) overhead(m *dns.Msg) int {
+	probe := &dns.Msg{Question: m.Question, Extra: make([]dns.RR, 0, len(m.Extra))}
+	probe.Compress = m.Compress
+	for _, rr := range m.Extra {
+		// The options of the OPT record are changed in place
+		if o, ok := rr.(*dns.OPT); ok {
+			rr = &dns.OPT{Hdr: o.Hdr, Option: append([]dns.EDNS0(nil), o.Option...)}
+		}
+		probe.Extra = append(probe.Extra, rr)
+	}
+	before := probe.Len()
+	w.decorate(probe)
+	if w.tsig != "" && m.IsTsig() == nil {
+		signMsg(probe, w.tsig)
+		if probe.IsTsig() != nil {
+			return probe.Len() - before + TSIG_MAX_MAC_SIZE
+		}
+	}
+	return probe.Len() - before
+}
+
+// Bytes the writer adds to the response as it's written
+func writeOverhead(w dns.ResponseWriter, m *dns.Msg) int {
+	if qw, ok := w.(*queryWriter); ok {
+		return qw.overhead(m)
+	}
+	return 0
+}
+
+func (w *queryWriter) Transport() string {
+	return transport(w.ResponseWriter)
+}
+
+func handleQuery(w dns.ResponseWriter, req *dns.Msg) {
+	start := time.Now()
+	captureMsg(w.RemoteAddr(), w.LocalAddr(), req)
+	qw := &queryWriter{ResponseWriter: w, tag: UNTAGGED}
+	qw.client = proxyProtocolClient(w)
+	// The sender of the query is the client named by the PROXY protocol header, if there was one
+	if client := proxiedClient(qw, req); client != "" {
+		qw.client = client
+	}
+	if len(req.Question) > 0 {
+		qw.tag = answers.Classify(clientAddr(qw), req.Question[0])
+	}
+	qw.edns = req.IsEdns0() != nil
+	if requested, _ := keepaliveRequested(req); requested && *ednsTcpKeepalive && transport(w) == "tcp" {
+		qw.keepalive = true
+	}
+	if isDebugQuery(req) {
+		qw.debug = &queryDebug{start: start}
+	}
+
+	answer := route
+	if *clientMaxInflight > 0 {
+		answer = limitedRoute
+	}
+	transportLimitedRoute(qw, req, answer)
+	elapsed := time.Since(start)
+
+	logQuery(qw, req, elapsed)
+	if len(req.Question) > 0 && qw.msg != nil {
+		stats.recordQuery(statsZone(req.Question[0].Name), qw.tag, qw.msg.Rcode, qw.match, elapsed)
+	}
+}
+
+// Ways of handling messages with more than one question (--multi-question)
+const (
+	MULTI_QUESTION_FORMERR = "formerr"
+	MULTI_QUESTION_FIRST   = "first"
+)
+
+// singleQuestion returns the query to answer for req: req itself when it has exactly one question,
+// its first question alone for multi-question messages with --multi-question=first, or false when
+// the message has to be rejected with FORMERR.
+func singleQuestion(req *dns.Msg) (*dns.Msg, bool) {
+	switch {
+	case len(req.Question) == 1:
+		return req, true
+	case len(req.Question) > 1 && *multiQuestion == MULTI_QUESTION_FIRST:
+		first := req.Copy()
+		first.Question = first.Question[:1]
+		return first, true
+	default:
+		return req, false
+	}
+}
+
+// queryTag returns the classification tag of the query being answered through w
+func queryTag(w dns.ResponseWriter) string {
+	if qw, ok := w.(*queryWriter); ok {
+		return qw.tag
+	}
+	return UNTAGGED
+}
+
+// transport names the transport a query arrived on. Writers for transports other
+// than plain UDP/TCP identify themselves by implementing Transport().
+func transport(w dns.ResponseWriter) string {
+	if t, ok := w.(interface {
+		Transport() string
+	}); ok {
+		return t.Transport()
+	}
+	if isTcp(w) {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// newUdpServer binds the UDP socket itself so that responses written to it can be given a
+// write deadline. A handler should never be stuck behind a client that can't be written to.
+// With --udp-batch, the socket is served by a batchServer instead of a dns.Server.
+func newUdpServer(addr string) (dnsServer, *net.UDPConn, error) {
+	network := listenNet("udp", addr)
+	a, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := listenUDP(network, a)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if *udpBatch > 1 {
+		server, err := newBatchServer(conn, int(*udpBatch))
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		return server, conn, nil
+	}
+
+	return &dns.Server{
+		Net:        network,
+		PacketConn: conn,
+		UDPSize:    dns.DefaultMsgSize,
+		TsigSecret: tsigSecrets(),
+		DecorateWriter: func(w dns.Writer) dns.Writer {
+			return &deadlineWriter{Writer: w, conn: conn}
+		},
+	}, conn, nil
+}
+
+// newTcpServer binds the TCP listener up front, so a failure to bind is reported to the caller
+// instead of by the serving goroutine.
+func newTcpServer(addr string) (*dns.Server, error) {
+	network := listenNet("tcp", addr)
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &dns.Server{Net: network, Listener: l, IdleTimeout: tcpIdleTimeout, TsigSecret: tsigSecrets()}
+	if *proxyProtocol {
+		server.DecorateReader = func(r dns.Reader) dns.Reader { return &proxyReader{r} }
+	}
+	return server, nil
+}
+
+// listenDns binds UDP and TCP on the address and starts serving queries on both
+func listenDns(addr string) error {
+	var servers []dnsServer
+	var conns []*net.UDPConn
+	closeAll := func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+	for i := uint(0); i == 0 || i < *udpReaders; i++ {
+		udpServer, conn, err := newUdpServer(addr)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		// The other readers (and TCP) share the port the first one got, should addr not name one
+		if host, port, err := net.SplitHostPort(addr); err == nil && port == "0" {
+			_, port, _ = net.SplitHostPort(conn.LocalAddr().String())
+			addr = net.JoinHostPort(host, port)
+		}
+		servers = append(servers, udpServer)
+		conns = append(conns, conn)
+	}
+	tcpServer, err := newTcpServer(addr)
+	if err != nil {
+		closeAll()
+		return err
+	}
+	servers = append(servers, tcpServer)
+
+	for _, server := range servers {
+		go serve(server.ActivateAndServe)
+	}
+	dnsServersMutex.Lock()
+	dnsServers = append(dnsServers, servers...)
+	dnsServersMutex.Unlock()
+	log.Info("Listening on ", addr)
+	return nil
+}
+
+// deadlineWriter arms a write deadline on the shared UDP socket before every write, so a write
+// that would block is dropped instead of wedging the handler.
+type deadlineWriter struct {
+	dns.Writer
+	conn *net.UDPConn
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(time.Duration(*writeTimeout) * time.Second))
+	n, err := w.Writer.Write(b)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		stats.incr("writeTimeouts")
+	}
+	return n, err
+}
+
+// listenNet picks the network to bind for a listen address. Literal IPv6 addresses are bound v6-only
+// so that "0.0.0.0:53,[::]:53" can be used side by side; an empty host (":53") leaves it to the
+// system, which gives a dual-stack socket where IPv6 is available, and IPv4 or IPv6 alone otherwise.
+func listenNet(proto string, addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return proto
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return proto
+	}
+	if ip.To4() != nil {
+		return proto + "4"
+	}
+	return proto + "6"
+}
+
+// clientAddr returns the querying client's address in the form used for answers keys. IPv4 clients
+// reaching a dual-stack socket show up as v4-mapped IPv6 addresses and are turned back into plain
+// IPv4, IPv6 zones are dropped and IPv6 addresses are written in their canonical (compressed, lower
+// case) form. For queries a trusted proxy sent on behalf of a client (by ECS or a PROXY protocol header), that's
+// the client's address.
+func clientAddr(w dns.ResponseWriter) string {
+	if qw, ok := w.(*queryWriter); ok && qw.client != "" {
+		return qw.client
+	}
+	return peerAddr(w)
+}
+
+// peerAddr returns the address the query came from on the socket, in the same form, whatever client a
+// trusted proxy says it's sending it for. Access to whole zones (transfers, NOTIFY) is checked against
+// it: a proxy vouching for a client's answers doesn't make it a secondary or a primary.
+func peerAddr(w dns.ResponseWriter) string {
+	host, _, err := net.SplitHostPort(w.RemoteAddr().String())
+	if err != nil {
+		host = w.RemoteAddr().String()
+	}
+	if i := strings.Index(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
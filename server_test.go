@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Records the reply written by route
+type testWriter struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+	// 10.1.1.1 over UDP if not set
+	remote net.Addr
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	if w.remote != nil {
+		return w.remote
+	}
+	return &net.UDPAddr{IP: net.ParseIP("10.1.1.1"), Port: 5353}
+}
+func (w *testWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.ParseIP("10.1.1.53"), Port: 53}
+}
+
+func (w *testWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+
+func TestSingleQuestion(t *testing.T) {
+	saved := *multiQuestion
+	defer func() { *multiQuestion = saved }()
+
+	multi := new(dns.Msg)
+	multi.SetQuestion("web.", dns.TypeA)
+	multi.Question = append(multi.Question, dns.Question{Name: "db.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+
+	*multiQuestion = MULTI_QUESTION_FORMERR
+	if _, ok := singleQuestion(multi); ok {
+		t.Fatalf("Multi-question message should be rejected")
+	}
+
+	*multiQuestion = MULTI_QUESTION_FIRST
+	first, ok := singleQuestion(multi)
+	if !ok || len(first.Question) != 1 || first.Question[0].Name != "web." || len(multi.Question) != 2 {
+		t.Fatalf("Expected the first question only, without changing the message [%v]", first)
+	}
+
+	if _, ok := singleQuestion(new(dns.Msg)); ok {
+		t.Fatalf("Message without a question should be rejected")
+	}
+}
+
+func TestRouteRejectsEmptyQuestion(t *testing.T) {
+	req := new(dns.Msg)
+	req.Id = 42
+	w := &testWriter{}
+	route(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeFormatError || w.msg.Id != 42 {
+		t.Fatalf("Expected FORMERR [%v]", w.msg)
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	query := newQueryContext(&testWriter{}, "10.1.0.0/16")
+	if query.ClientKey != "10.1.0.0/16" || query.ClientIp != "10.1.1.1" || query.Transport != "udp" || query.Listener != "10.1.1.53:53" {
+		t.Fatalf("Incorrect query context %+v", query)
+	}
+	if d := query.ForKey(DEFAULT_KEY); d.ClientKey != DEFAULT_KEY || d.ClientIp != query.ClientIp || query.ClientKey != "10.1.0.0/16" {
+		t.Fatalf("Incorrect query context for the default key %+v", d)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// A logical server declared in the --servers file: its own listeners, answered from one environment of
+// the answers (the view) with its own recursers and policies. The policies take the place of the view's
+// "default" settings; client entries of the view still override them.
+type ServerBlock struct {
+	Name        string   `json:"name"`
+	Listen      []string `json:"listen"`
+	Environment string   `json:"environment,omitempty"`
+	Recurse     []string `json:"recurse,omitempty"`
+	Recursion   *bool    `json:"recursion,omitempty"`
+	Miss        string   `json:"miss,omitempty"`
+}
+
+var (
+	serverBlocks []ServerBlock
+	// The answers of each server block's view with its policies applied, rebuilt with the answers
+	serverBlockAnswers = make(map[string]Answers)
+)
+
+// Reads and validates the server blocks of a YAML or JSON file
+func ParseServerBlocks(path string) ([]ServerBlock, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var blocks []ServerBlock
+	if err := yaml.Unmarshal(data, &blocks); err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	listeners := make(map[string]string)
+	for i := range blocks {
+		block := &blocks[i]
+		if block.Name == "" {
+			return nil, fmt.Errorf("server block %d has no name", i+1)
+		}
+		if names[block.Name] {
+			return nil, fmt.Errorf("duplicate server block %s", block.Name)
+		}
+		names[block.Name] = true
+
+		if len(block.Listen) == 0 {
+			return nil, fmt.Errorf("server block %s has no listen addresses", block.Name)
+		}
+		for _, addr := range block.Listen {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return nil, fmt.Errorf("invalid listen address %s of server block %s", addr, block.Name)
+			}
+			if other, ok := listeners[addr]; ok {
+				return nil, fmt.Errorf("listen address %s is in server blocks %s and %s", addr, other, block.Name)
+			}
+			listeners[addr] = block.Name
+		}
+
+		if strings.Contains(block.Environment, ENVIRONMENT_SEPARATOR) {
+			return nil, fmt.Errorf("invalid environment %s of server block %s", block.Environment, block.Name)
+		}
+		block.Miss = strings.ToLower(block.Miss)
+		switch block.Miss {
+		case "", MISS_SERVFAIL, MISS_NXDOMAIN, MISS_REFUSED:
+		default:
+			return nil, fmt.Errorf("invalid miss behavior for server block %s: %s", block.Name, block.Miss)
+		}
+		if block.Recurse, err = cleanRecursers("server block "+block.Name, block.Recurse); err != nil {
+			return nil, err
+		}
+	}
+	return blocks, nil
+}
+
+// Loads the --servers file. Without one the process is a single server on the --listen addresses.
+func loadServerBlocks(path string) error {
+	if path == "" {
+		return nil
+	}
+	blocks, err := ParseServerBlocks(path)
+	if err != nil {
+		return err
+	}
+	serverBlocks = blocks
+	for _, block := range blocks {
+		log.WithFields(log.Fields{"server": block.Name, "listen": block.Listen, "environment": block.Environment}).Info("Loaded server block")
+	}
+	return nil
+}
+
+// The addresses to listen on: those of --listen, unless server blocks are configured and --listen wasn't
+// given explicitly, and those of every server block
+func listenAddrs() []string {
+	var addrs []string
+	if len(serverBlocks) == 0 || flagGiven("listen") {
+		addrs = append(addrs, splitTrim(*listen, ",")...)
+	}
+	for _, block := range serverBlocks {
+		addrs = append(addrs, block.Listen...)
+	}
+	return addrs
+}
+
+func flagGiven(name string) (given bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return
+}
+
+// The server block a query arriving on the listener address belongs to, if any. A block listening on
+// an unspecified address (":53", "0.0.0.0:53") gets the queries arriving on that port.
+func serverBlockFor(listener string) *ServerBlock {
+	host, port, err := net.SplitHostPort(listener)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	var wildcard *ServerBlock
+	for i := range serverBlocks {
+		block := &serverBlocks[i]
+		for _, addr := range block.Listen {
+			blockHost, blockPort, _ := net.SplitHostPort(addr)
+			if blockPort != port {
+				continue
+			}
+			blockIp := net.ParseIP(blockHost)
+			if blockHost == "" || (blockIp != nil && blockIp.IsUnspecified()) {
+				if wildcard == nil {
+					wildcard = block
+				}
+			} else if blockIp != nil && ip != nil && blockIp.Equal(ip) {
+				return block
+			}
+		}
+	}
+	return wildcard
+}
+
+// The block's view with its recursers and policies in the "default" entry. Must be called with the
+// environment answers already rebuilt.
+func (block *ServerBlock) view(top Answers, environments map[string]Answers) Answers {
+	base := top
+	if block.Environment != "" {
+		base = environments[block.Environment]
+	}
+	if len(block.Recurse) == 0 && block.Recursion == nil && block.Miss == "" {
+		return base
+	}
+
+	view := make(Answers, len(base)+1)
+	for key, client := range base {
+		view[key] = client
+	}
+	def := view[DEFAULT_KEY]
+	if len(block.Recurse) > 0 {
+		def.Recurse = block.Recurse
+	}
+	if block.Recursion != nil {
+		def.Recursion = block.Recursion
+	}
+	if block.Miss != "" {
+		def.Miss = block.Miss
+	}
+	view[DEFAULT_KEY] = def
+	return view
+}
+
+func rebuildServerBlockAnswers(top Answers, environments map[string]Answers) {
+	serverBlockAnswers = serverBlockViews(top, environments)
+}
+
+// The answers served on the listeners of each server block
+func serverBlockViews(top Answers, environments map[string]Answers) map[string]Answers {
+	views := make(map[string]Answers)
+	for i := range serverBlocks {
+		block := &serverBlocks[i]
+		if _, ok := environments[block.Environment]; block.Environment != "" && !ok {
+			log.WithFields(log.Fields{"server": block.Name, "environment": block.Environment}).Warn("Server block environment isn't in the answers")
+		}
+		views[block.Name] = block.view(top, environments)
+	}
+	return views
+}
+
+// The recursers of every server block, for probing
+func serverBlockRecursers() []string {
+	var out []string
+	for _, block := range serverBlocks {
+		out = append(out, block.Recurse...)
+	}
+	return out
+}
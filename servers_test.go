@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeServerBlocks(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestParseServerBlocks(t *testing.T) {
+	path := writeServerBlocks(t, `
+- name: internal
+  listen: ["10.0.0.53:53", "[fd00::53]:53"]
+  environment: prod
+  recurse: [10.42.0.2, 10.42.0.2]
+  miss: NXDOMAIN
+- name: public
+  listen: [":5353"]
+  recursion: false
+`)
+	defer os.Remove(path)
+
+	blocks, err := ParseServerBlocks(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 2 {
+		t.Fatalf("Expected 2 server blocks, got %v", blocks)
+	}
+	internal := blocks[0]
+	if internal.Environment != "prod" || internal.Miss != MISS_NXDOMAIN || len(internal.Recurse) != 1 {
+		t.Fatalf("Incorrect server block %+v", internal)
+	}
+	if public := blocks[1]; public.Recursion == nil || *public.Recursion {
+		t.Fatalf("Incorrect server block %+v", public)
+	}
+
+	for _, invalid := range []string{
+		`[{listen: [":53"]}]`,
+		`[{name: a}]`,
+		`[{name: a, listen: ["10.0.0.53"]}]`,
+		`[{name: a, listen: [":53"]}, {name: a, listen: [":54"]}]`,
+		`[{name: a, listen: [":53"]}, {name: b, listen: [":53"]}]`,
+		`[{name: a, listen: [":53"], miss: ignore}]`,
+		`[{name: a, listen: [":53"], environment: "a#b"}]`,
+		`[{name: a, listen: [":53"], recurse: ["8.8.8.8:0"]}]`,
+	} {
+		path := writeServerBlocks(t, invalid)
+		if _, err := ParseServerBlocks(path); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestServerBlockFor(t *testing.T) {
+	saved := serverBlocks
+	defer func() { serverBlocks = saved }()
+	serverBlocks = []ServerBlock{
+		{Name: "internal", Listen: []string{"10.0.0.53:53", "[fd00::53]:53"}},
+		{Name: "public", Listen: []string{":53"}},
+		{Name: "admin", Listen: []string{"0.0.0.0:5353"}},
+	}
+
+	for listener, expected := range map[string]string{
+		"10.0.0.53:53":   "internal",
+		"[fd00::53]:53":  "internal",
+		"192.0.2.1:53":   "public",
+		"[::]:53":        "public",
+		"127.0.0.1:5353": "admin",
+		"127.0.0.1:8053": "",
+		"":               "",
+	} {
+		name := ""
+		if block := serverBlockFor(listener); block != nil {
+			name = block.Name
+		}
+		if name != expected {
+			t.Errorf("Expected a query on %q for %q, got %q", listener, expected, name)
+		}
+	}
+}
+
+func TestServerBlockView(t *testing.T) {
+	saved, savedAnswers := serverBlocks, serverBlockAnswers
+	defer func() { serverBlocks, serverBlockAnswers = saved, savedAnswers }()
+	recursion := false
+	serverBlocks = []ServerBlock{
+		{Name: "internal", Listen: []string{":53"}, Environment: "prod", Recurse: []string{"10.42.0.2"}, Miss: MISS_NXDOMAIN},
+		{Name: "public", Listen: []string{":5353"}, Recursion: &recursion},
+	}
+
+	top := Answers{
+		DEFAULT_KEY:              ClientAnswers{Recurse: []string{"8.8.8.8"}},
+		"prod#" + DEFAULT_KEY:    ClientAnswers{Recurse: []string{"10.42.0.1"}, Search: []string{"prod.internal."}},
+		"prod#10.42.1.0/24":      ClientAnswers{Recurse: []string{"10.42.1.2"}},
+		"staging#" + DEFAULT_KEY: ClientAnswers{},
+		"prod#10.42.2.0/24":      ClientAnswers{Miss: MISS_REFUSED},
+		"prod#10.42.3.0/24":      ClientAnswers{Recursion: &recursion},
+	}
+	environments := top.Environments()
+	rebuildServerBlockAnswers(top, environments)
+
+	internal := serverBlockAnswers["internal"]
+	if recurse := internal.Recursers("10.42.9.0/24"); len(recurse) != 1 || recurse[0] != "10.42.0.2" {
+		t.Fatalf("Expected the block's recursers, got %v", recurse)
+	}
+	if recurse := internal.Recursers("10.42.1.0/24"); len(recurse) != 2 || recurse[0] != "10.42.1.2" {
+		t.Fatalf("Expected the client's recursers first, got %v", recurse)
+	}
+	if internal.Miss(DEFAULT_KEY) != MISS_NXDOMAIN || internal.Miss("10.42.2.0/24") != MISS_REFUSED {
+		t.Fatalf("Expected the block's miss behavior unless the client overrides it")
+	}
+	if search := internal.SearchSuffixes(DEFAULT_KEY); len(search) != 1 {
+		t.Fatalf("Expected the environment's settings to be kept, got %v", search)
+	}
+	prod := environments["prod"]
+	if recurse := prod.Recursers("10.42.9.0/24"); recurse[0] != "10.42.0.1" {
+		t.Fatalf("Expected the environment itself to be left alone, got %v", recurse)
+	}
+
+	public := serverBlockAnswers["public"]
+	if public.Recursion(DEFAULT_KEY) || !top.Recursion(DEFAULT_KEY) {
+		t.Fatalf("Expected recursion to be off for the public block only")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// With --serve-stale, a query the recursers fail to answer (every one of them errs, times out or
+// answers SERVFAIL) is answered from the cache instead, with a response that expired up to that many
+// seconds ago (RFC 8767), so that an upstream blip doesn't become an outage of the names in use. It's
+// served with a TTL of STALE_TTL seconds and the "Stale Answer" extended error, and counted as
+// servedStale. Queries over their zone's rate limit are left to --rate-limit-stale.
+func serveStaleOnFailure(w dns.ResponseWriter, req *dns.Msg, msg *dns.Msg, err error, query *QueryContext, fallback bool) bool {
+	if *serveStale == 0 || debugging(w) {
+		return false
+	}
+	if _, limited := err.(*rateLimitedError); limited {
+		return false
+	}
+	if err == nil && msg != nil && msg.Rcode != dns.RcodeServerFailure {
+		return false
+	}
+	stale := staleCacheHit(query.View, req, time.Duration(*serveStale)*time.Second)
+	if stale == nil || (fallback && !hasAnswers(stale)) {
+		return false
+	}
+
+	reason := "recursers answered SERVFAIL"
+	if err != nil || msg == nil {
+		_, reason = recursionError(err)
+	}
+	log.WithFields(log.Fields{"client": query.ClientKey, "type": dns.Type(req.Question[0].Qtype).String(), "question": strings.ToLower(req.Question[0].Name)}).Infof("Sent cached response, %s", reason)
+	trace(w, "path=stale-cache")
+	stats.incr("servedStale")
+	setExtendedError(w, EDE_STALE_ANSWER, reason)
+	Respond(w, req, stale)
+	return true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestServeStale(t *testing.T) {
+	dns.HandleFunc("down.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("down.test.")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	saved, savedEnvironments, savedCache, savedServeStale := answers, environmentAnswers, globalCache, *serveStale
+	defer func() {
+		answers, environmentAnswers, globalCache, *serveStale = saved, savedEnvironments, savedCache, savedServeStale
+	}()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{Recurse: []string{conn.LocalAddr().String()}}}
+	environmentAnswers = nil
+	globalCache = cache.New(10, 600)
+	globalCache.SetStale(time.Hour)
+	clearClientSpecificCaches()
+
+	expire := func(name string, ago time.Duration) {
+		expired := new(dns.Msg)
+		expired.SetQuestion(name, dns.TypeA)
+		expired.Answer = []dns.RR{mustRR(t, name+" 60 IN A 10.0.0.1")}
+		globalCache.InsertMessage(cache.Key(expired.Question[0], false, false), expired, -ago)
+	}
+	expire("web.down.test.", time.Minute)
+	expire("old.down.test.", 10*time.Minute)
+	expire("off.down.test.", time.Minute)
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		w := &testWriter{}
+		route(w, req)
+		if w.msg == nil {
+			t.Fatalf("Expected a response for %s", name)
+		}
+		return w.msg
+	}
+
+	*serveStale = 0
+	if msg := query("off.down.test."); msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL without --serve-stale, got %v", msg)
+	}
+
+	*serveStale = 300
+	msg := query("web.down.test.")
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 || msg.Answer[0].Header().Ttl != STALE_TTL {
+		t.Fatalf("Expected the stale answer with a TTL of %d, got %v", STALE_TTL, msg)
+	}
+	if msg := query("old.down.test."); msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL for a response expired past --serve-stale, got %v", msg)
+	}
+
+	// A recurser that can't be reached at all
+	server.Shutdown()
+	if msg := query("web.down.test."); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Expected the stale answer with the recurser down, got %v", msg)
+	}
+}
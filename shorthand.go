@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The "records" of an entry are shorthand for hand-written answers files: a name maps to a value or
+// list of values whose record type follows from their form. IP addresses become the name's "a"
+// record (answering A or AAAA queries by family), "target:port" entries its SRV records (priority and
+// weight 0) and a single host name its CNAME. With --strict-answers, shorthand is rejected.
+
+func expandShorthand(answers Answers) error {
+	for key, client := range answers {
+		if len(client.Records) == 0 {
+			continue
+		}
+		if *strictAnswers {
+			return fmt.Errorf("%s: \"records\" shorthand is not allowed with --strict-answers", key)
+		}
+		for name, value := range client.Records {
+			if err := client.expandRecord(normalName(name), value); err != nil {
+				return fmt.Errorf("%s: record %s: %v", key, name, err)
+			}
+		}
+		// Only the expanded records are kept, as dump and export show them
+		client.Records = nil
+		answers[key] = client
+	}
+	return nil
+}
+
+// Shorthand values are a string or a list of strings
+func shorthandValues(value interface{}) ([]string, error) {
+	switch value := value.(type) {
+	case string:
+		return []string{value}, nil
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected strings, got %v", v)
+			}
+			values = append(values, s)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("no values")
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("expected a string or a list of strings, got %v", value)
+}
+
+func (client *ClientAnswers) expandRecord(name string, value interface{}) error {
+	values, err := shorthandValues(value)
+	if err != nil {
+		return err
+	}
+
+	var addresses, srv []string
+	cname := ""
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if ip := net.ParseIP(v); ip != nil {
+			addresses = append(addresses, ip.String())
+			continue
+		}
+		if host, port, err := net.SplitHostPort(v); err == nil {
+			n, err := strconv.ParseUint(port, 10, 16)
+			if err != nil || n == 0 {
+				return fmt.Errorf("invalid port in %q", v)
+			}
+			if net.ParseIP(host) != nil || !validName(host) {
+				return fmt.Errorf("SRV target of %q must be a host name", v)
+			}
+			srv = append(srv, fmt.Sprintf("0 0 %d %s", n, normalName(host)))
+			continue
+		}
+		if !validName(v) {
+			return fmt.Errorf("%q is neither an address, a target:port nor a host name", v)
+		}
+		if cname != "" || len(values) > 1 {
+			return fmt.Errorf("a CNAME (%s) must be the only value", v)
+		}
+		cname = normalName(v)
+	}
+
+	if _, ok := client.Cname[name]; ok && len(addresses)+len(srv) > 0 {
+		return fmt.Errorf("also given under \"cname\", which can't have other records")
+	}
+	if len(addresses) > 0 {
+		if _, ok := client.A[name]; ok {
+			return fmt.Errorf("also given under \"a\"")
+		}
+		if client.A == nil {
+			client.A = make(map[string]RecordA)
+		}
+		client.A[name] = RecordA{Answer: addresses}
+	}
+	if len(srv) > 0 {
+		if _, ok := client.Srv[name]; ok {
+			return fmt.Errorf("also given under \"srv\"")
+		}
+		if client.Srv == nil {
+			client.Srv = make(map[string]RecordSrv)
+		}
+		client.Srv[name] = RecordSrv{Answer: srv}
+	}
+	if cname != "" {
+		_, a := client.A[name]
+		_, srv := client.Srv[name]
+		_, txt := client.Txt[name]
+		if _, ok := client.Cname[name]; ok || a || srv || txt {
+			return fmt.Errorf("a CNAME can't have other records")
+		}
+		if client.Cname == nil {
+			client.Cname = make(map[string]RecordCname)
+		}
+		client.Cname[name] = RecordCname{Answer: cname}
+	}
+	return nil
+}
+
+// A host name shorthand can stand for: labels of letters, digits, hyphens and underscores
+func validName(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c > 127) {
+				return false
+			}
+		}
+	}
+	return true
+}
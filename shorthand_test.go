@@ -0,0 +1,57 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecordsShorthand(t *testing.T) {
+	defer func(strict bool) { *strictAnswers = strict }(*strictAnswers)
+	*strictAnswers = false
+
+	out, err := parseAnswersData([]byte(`{"default": {
+		"a": {"db.internal.": {"answer": ["10.0.0.9"]}},
+		"records": {
+			"web.internal": ["10.0.0.1", "fd00::1"],
+			"API.internal.": "10.0.0.2",
+			"www.internal.": "Web.Internal",
+			"_ldap._tcp.internal.": ["ldap1.internal:389", "ldap2.internal.:636"]
+		}
+	}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := out[DEFAULT_KEY]
+	if !reflect.DeepEqual(client.A["web.internal."].Answer, []string{"10.0.0.1", "fd00::1"}) || len(client.A["api.internal."].Answer) != 1 || len(client.A["db.internal."].Answer) != 1 {
+		t.Fatalf("Expected the addresses as A records, got %v", client.A)
+	}
+	if client.Cname["www.internal."].Answer != "web.internal." {
+		t.Fatalf("Expected the host name as a CNAME, got %v", client.Cname)
+	}
+	if srv := client.Srv["_ldap._tcp.internal."].Answer; !reflect.DeepEqual(srv, []string{"0 0 389 ldap1.internal.", "0 0 636 ldap2.internal."}) {
+		t.Fatalf("Expected the targets as SRV records, got %v", srv)
+	}
+	if client.Records != nil {
+		t.Fatalf("Expected the shorthand to be expanded, got %v", client.Records)
+	}
+
+	for _, records := range []string{
+		`{"db.internal.": "10.0.0.10"}`,
+		`{"www.internal.": ["web.internal.", "10.0.0.1"]}`,
+		`{"web.internal.": "10.0.0.1:80"}`,
+		`{"web.internal.": "web.internal:http"}`,
+		`{"web.internal.": "not a name"}`,
+		`{"web.internal.": []}`,
+		`{"web.internal.": 42}`,
+	} {
+		data := `{"default": {"a": {"db.internal.": {"answer": ["10.0.0.9"]}}, "records": ` + records + `}}`
+		if _, err := parseAnswersData([]byte(data)); err == nil {
+			t.Fatalf("Expected %s to be rejected", records)
+		}
+	}
+
+	*strictAnswers = true
+	if _, err := parseAnswersData([]byte(`{"default": {"records": {"web.internal.": "10.0.0.1"}}}`)); err == nil {
+		t.Fatalf("Expected the shorthand to be rejected with --strict-answers")
+	}
+}
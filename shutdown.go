@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+var (
+	// Set once a graceful shutdown has started
+	draining      bool
+	drainingMutex sync.RWMutex
+
+	// Servers started by listenDns
+	dnsServers      []dnsServer
+	dnsServersMutex sync.Mutex
+)
+
+// A DNS server started by listenDns: a dns.Server, or a batchServer for UDP with --udp-batch
+type dnsServer interface {
+	ActivateAndServe() error
+	Shutdown() error
+}
+
+func isDraining() bool {
+	drainingMutex.RLock()
+	defer drainingMutex.RUnlock()
+	return draining
+}
+
+// Runs a DNS server until it fails, which is fatal unless the server is being shut down
+func serve(start func() error) {
+	err := start()
+	if !isDraining() {
+		log.Fatal(err)
+	}
+}
+
+// On SIGTERM or SIGINT: report unhealthy, deregister from service discovery, keep answering for
+// --shutdown-delay so clients and load balancers can steer away, then close the servers.
+func watchShutdown() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		sig := <-c
+		log.Infof("Received %v, shutting down", sig)
+		drainingMutex.Lock()
+		draining = true
+		drainingMutex.Unlock()
+
+		if *deregisterUrl != "" {
+			if err := deregister(*deregisterMethod, *deregisterUrl); err != nil {
+				log.Errorf("Failed to deregister: %v", err)
+			} else {
+				log.Infof("Deregistered")
+			}
+		}
+
+		if *shutdownDelay > 0 {
+			log.Infof("Answering for another %ds before closing", *shutdownDelay)
+			time.Sleep(time.Duration(*shutdownDelay) * time.Second)
+		}
+
+		dnsServersMutex.Lock()
+		for _, server := range dnsServers {
+			if err := server.Shutdown(); err != nil {
+				log.Warnf("Failed to shut down server: %v", err)
+			}
+		}
+		dnsServersMutex.Unlock()
+		log.Info("Stopped")
+		os.Exit(0)
+	}()
+}
+
+func deregister(method string, url string) error {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("deregistration failed: %s", resp.Status)
+	}
+	return nil
+}
+
+// GET /v1/health: 200 while serving, 503 once shutting down
+func httpHealth(w http.ResponseWriter, req *http.Request) {
+	if isDraining() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("OK"))
+}
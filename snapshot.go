@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// An http(s) URL as --answers is a snapshot of the answers, fetched at startup and on every reload. With
+// --answers-cache, each snapshot served is kept in that file (one that fails validation as served,
+// or is only validated, never replaces it), and until a snapshot has been served the cached one is
+// loaded when the URL can't be fetched: the server starts with the last answers it had while the
+// control plane serving them is down. Once a snapshot has been served, failures to fetch are reload
+// failures, which keep the served answers.
+const SNAPSHOT_FETCH_TIMEOUT = 10 * time.Second
+
+var snapshots = struct {
+	sync.Mutex
+	// Whether a snapshot was served since startup
+	fetched bool
+	// The last snapshot fetched, with the checksum of its answers, until they are served
+	pending         []byte
+	pendingChecksum string
+}{}
+
+func isAnswersUrl(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+func fetchSnapshot(url string) ([]byte, error) {
+	client := &http.Client{Timeout: SNAPSHOT_FETCH_TIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Fetches and parses the snapshot at the URL, falling back to the cached copy until one is served
+func parseSnapshot(url, cache string) (Answers, error) {
+	data, err := fetchSnapshot(url)
+	if err == nil {
+		out, err := parseAnswersData(data)
+		if err != nil {
+			// An invalid snapshot is a failed reload, not a reason to serve the cached one
+			return nil, err
+		}
+		out.SetSource(fileSource(url))
+		snapshots.Lock()
+		snapshots.pending, snapshots.pendingChecksum = data, answersChecksum(out)
+		snapshots.Unlock()
+		return out, nil
+	}
+
+	snapshots.Lock()
+	fetched := snapshots.fetched
+	snapshots.Unlock()
+	if cache == "" || fetched {
+		return nil, err
+	}
+	cached, cacheErr := ioutil.ReadFile(cache)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%v, and no cached snapshot: %v", err, cacheErr)
+	}
+	out, cacheErr := parseAnswersData(cached)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("%v, and invalid cached snapshot: %v", err, cacheErr)
+	}
+	stats.incr("snapshotFallbacks")
+	log.WithFields(log.Fields{"url": url, "file": cache}).Warnf("Failed to fetch the answers, loading the cached snapshot: %v", err)
+	out.SetSource(fileSource(cache))
+	return out, nil
+}
+
+// Keeps the snapshot the answers of the base source were parsed from in --answers-cache, now that
+// they are served. Answers of other files, or of an older fetch, leave the cache as it is.
+func snapshotServed(candidate Answers) {
+	snapshots.Lock()
+	data, checksum := snapshots.pending, snapshots.pendingChecksum
+	if data == nil || checksum != answersChecksum(candidate) {
+		snapshots.Unlock()
+		return
+	}
+	snapshots.pending, snapshots.pendingChecksum, snapshots.fetched = nil, "", true
+	snapshots.Unlock()
+
+	if *answersCache == "" {
+		return
+	}
+	if err := saveSnapshot(*answersCache, data); err != nil {
+		log.WithFields(log.Fields{"file": *answersCache}).Warnf("Failed to cache the answers snapshot: %v", err)
+	}
+}
+
+// Replaces the cached snapshot, so a crash halfway through leaves the previous one
+func saveSnapshot(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
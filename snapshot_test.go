@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSnapshot(t *testing.T) {
+	defer func() { snapshots.fetched = false }()
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "answers.json")
+
+	body := `{"default": {"a": {"web.internal.": {"answer": ["10.0.0.1"]}}}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+
+	// Nothing fetched nor cached yet
+	down := "http://127.0.0.1:1/answers.json"
+	if _, err := parseSnapshot(down, cache); err == nil {
+		t.Fatalf("Expected the load to fail without a cached snapshot")
+	}
+
+	savedCache := *answersCache
+	defer func() { *answersCache = savedCache }()
+	*answersCache = cache
+	out, err := parseSnapshot(server.URL, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if web := out[DEFAULT_KEY].A["web.internal."]; len(web.Answer) != 1 || web.Source != fileSource(server.URL) {
+		t.Fatalf("Expected the fetched answers, got %+v", web)
+	}
+	if _, err := os.Stat(cache); !os.IsNotExist(err) {
+		t.Fatalf("Expected the snapshot not to be cached before it's served, got %v", err)
+	}
+	snapshotServed(out)
+	if cached, _ := ioutil.ReadFile(cache); string(cached) != body {
+		t.Fatalf("Expected the served snapshot to be cached, got %q", cached)
+	}
+
+	// An invalid snapshot isn't cached
+	body = `{"default": {"miss": "bogus"}}`
+	if _, err := parseSnapshot(server.URL, cache); err == nil {
+		t.Fatalf("Expected the invalid snapshot to be rejected")
+	}
+	server.Close()
+
+	// Once fetched, failures are failures; at startup, the cached snapshot stands in
+	if _, err := parseSnapshot(down, cache); err == nil {
+		t.Fatalf("Expected the load to fail once a snapshot was fetched")
+	}
+	snapshots.fetched = false
+	out, err = parseSnapshot(down, cache)
+	if err != nil {
+		t.Fatalf("Expected the cached snapshot, got %v", err)
+	}
+	if web := out[DEFAULT_KEY].A["web.internal."]; len(web.Answer) != 1 || web.Answer[0] != "10.0.0.1" || web.Source != fileSource(cache) {
+		t.Fatalf("Expected the cached answers, got %+v", web)
+	}
+}
+
+func TestSnapshotCachedOnceServed(t *testing.T) {
+	defer func() { snapshots.fetched, snapshots.pending = false, nil }()
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cache := filepath.Join(dir, "answers.json")
+
+	body := `{"default": {"a": {"web.internal.": {"answer": ["10.0.0.1"]}}}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	savedFile, savedCache := *answersFile, *answersCache
+	defer func() { *answersFile, *answersCache = savedFile, savedCache }()
+	*answersFile, *answersCache = server.URL, cache
+	if err := setupSources(""); err != nil {
+		t.Fatal(err)
+	}
+	defer setBaseAnswers(make(Answers))
+
+	if err := loadAnswers(); err != nil {
+		t.Fatalf("Failed to load answers: %v", err)
+	}
+	good := body
+	cached := func() string {
+		data, _ := ioutil.ReadFile(cache)
+		return string(data)
+	}
+	if cached() != good {
+		t.Fatalf("Expected the served snapshot to be cached, got %q", cached())
+	}
+
+	// Neither a dry run nor a snapshot failing validation as served replaces the cached one
+	body = `{"default": {"a": {"db.internal.": {"answer": ["10.0.0.2"]}}}}`
+	if result := validateReload(); !result.Ok {
+		t.Fatalf("Expected the snapshot to validate, got %+v", result)
+	}
+	body = `{"default": {"zones": [{"zone": "example.internal", "ns": ["ns1.example.internal"], "tsig": "unknown.key"}]}}`
+	if err := loadAnswers(); err == nil || reloadStage(err) != RELOAD_STAGE_VALIDATE {
+		t.Fatalf("Expected the snapshot to fail validation, got %v", err)
+	}
+	if cached() != good {
+		t.Fatalf("Expected the cached snapshot to stay, got %q", cached())
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// A backend that answers come from. The served answers are composed from the configured sources
+// (--sources) in priority order, so a new backend only has to implement this and be registered in
+// answerSources.
+type AnswerSource interface {
+	Name() string
+	// Records of the type the source has for the name, as configured for the query's client key
+	Lookup(query *QueryContext, fqdn string, qtype uint16) ([]dns.RR, bool)
+	// Everything the source contributes (records and client settings), used to compose the served answers
+	Answers() Answers
+	// Calls changed after every change of the source's answers
+	Watch(changed func())
+}
+
+// A source that holds a complete set of answers, replaced as a whole by whatever feeds it
+type recordSource struct {
+	sync.RWMutex
+	name    string
+	answers Answers
+	changed func()
+}
+
+var (
+	fileRecords     = &recordSource{name: SOURCE_FILE, answers: make(Answers)}
+	metadataRecords = &recordSource{name: SOURCE_METADATA, answers: make(Answers)}
+	dynamicRecords  = &recordSource{name: SOURCE_DYNAMIC, answers: make(Answers)}
+
+	answerSources = map[string]AnswerSource{
+		SOURCE_FILE:      fileRecords,
+		SOURCE_METADATA:  metadataRecords,
+		SOURCE_DYNAMIC:   dynamicRecords,
+		SOURCE_SECONDARY: secondaryRecords,
+	}
+
+	// Configured sources, highest priority first
+	sourceChain []AnswerSource
+)
+
+func (s *recordSource) Name() string {
+	return s.name
+}
+
+func (s *recordSource) Lookup(query *QueryContext, fqdn string, qtype uint16) ([]dns.RR, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.answers.MatchingExact(qtype, environmentKey(query.Environment, query.ClientKey), fqdn, fqdn)
+}
+
+func (s *recordSource) Answers() Answers {
+	s.RLock()
+	defer s.RUnlock()
+	return s.answers
+}
+
+func (s *recordSource) Watch(changed func()) {
+	s.Lock()
+	s.changed = changed
+	s.Unlock()
+}
+
+func (s *recordSource) Set(answers Answers) {
+	s.Lock()
+	s.answers = answers
+	changed := s.changed
+	s.Unlock()
+	if changed != nil {
+		changed()
+	}
+}
+
+// Sets up the source chain from a comma-delimited list of source names, highest priority first.
+// An empty list means the runtime records on top of the answers file, or of metadata, on top of the
+// secondary zones if there are any. Pins always come first.
+func setupSources(spec string) error {
+	if spec == "" {
+		spec = SOURCE_DYNAMIC + "," + SOURCE_FILE
+		if metadataDriven() {
+			spec = SOURCE_DYNAMIC + "," + SOURCE_METADATA
+		}
+		if len(secondaryZones) > 0 {
+			spec += "," + SOURCE_SECONDARY
+		}
+	}
+
+	// Pins override every configured source
+	chain := []AnswerSource{pinRecords}
+	for _, name := range splitTrim(spec, ",") {
+		source, ok := answerSources[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown answers source: %s", name)
+		}
+		chain = append(chain, source)
+	}
+
+	answersMutex.Lock()
+	sourceChain = chain
+	for _, source := range chain {
+		source.Watch(func() {
+			answersMutex.Lock()
+			rebuildAnswers()
+			answersMutex.Unlock()
+		})
+	}
+	rebuildAnswers()
+	answersMutex.Unlock()
+	return nil
+}
+
+// The source the answers file (or metadata) is loaded into
+func baseSource() *recordSource {
+	if metadataDriven() {
+		return metadataRecords
+	}
+	return fileRecords
+}
+
+// Replaces the loaded answers and rebuilds the answers that are served
+func setBaseAnswers(newAnswers Answers) {
+	baseMutex.Lock()
+	defer baseMutex.Unlock()
+	baseSource().Set(newAnswers)
+}
+
+// Composes the served answers from the source chain: for each client entry, records of a higher
+// priority source replace those of a lower one, and the settings (search, recurse, ...) are those
+// of the highest priority source that has any. Must be called with answersMutex held.
+func rebuildAnswers() {
+	serveAnswers(indexAnswers(composeAnswers(nil, nil)))
+}
+
+// The answers of the source chain merged, with the candidate answers in place of those of the
+// replaced source, if any
+func composeAnswers(replaced AnswerSource, candidate Answers) Answers {
+	merged := make(Answers)
+	for i := len(sourceChain) - 1; i >= 0; i-- {
+		sourceAnswers := sourceChain[i].Answers()
+		if replaced != nil && sourceChain[i] == replaced {
+			sourceAnswers = candidate
+		}
+		for key, client := range sourceAnswers {
+			merged.mergeClient(key, client)
+		}
+	}
+	return merged
+}
+
+// The served answers with the entries of the keys composed again from the source chain, as by
+// composeAnswers. The other entries are shared with the served ones, which have to be composed from
+// the same sources. Must be called with answersMutex held.
+func recomposeKeys(keys map[string]bool, replaced AnswerSource, candidate Answers) Answers {
+	merged := make(Answers, len(answers))
+	for key, client := range answers {
+		if !keys[key] {
+			merged[key] = client
+		}
+	}
+	for i := len(sourceChain) - 1; i >= 0; i-- {
+		sourceAnswers := sourceChain[i].Answers()
+		if replaced != nil && sourceChain[i] == replaced {
+			sourceAnswers = candidate
+		}
+		for key := range keys {
+			if client, ok := sourceAnswers[key]; ok {
+				merged.mergeClient(key, client)
+			}
+		}
+	}
+	return merged
+}
+
+// Merges a higher priority source's entry into the key's
+func (merged Answers) mergeClient(key string, client ClientAnswers) {
+	c, ok := merged[key]
+	if !ok || client.hasSettings() {
+		records := c
+		c = client
+		c.A, c.Cname, c.Ptr, c.Txt, c.Srv = records.A, records.Cname, records.Ptr, records.Txt, records.Srv
+	}
+	c.mergeRecords(&client)
+	merged[key] = c
+}
+
+func (s *recordSource) replace(answers Answers) {
+	s.Lock()
+	s.answers = answers
+	s.Unlock()
+}
+
+// Whether the entry has anything besides records
+func (client *ClientAnswers) hasSettings() bool {
+	c := *client
+	c.A, c.Cname, c.Ptr, c.Txt, c.Srv = nil, nil, nil, nil, nil
+	return !reflect.DeepEqual(c, ClientAnswers{})
+}
+
+// The first source in priority order with records of the type for the query's client and the name
+func lookupSources(query *QueryContext, fqdn string, qtype uint16) (AnswerSource, []dns.RR) {
+	for _, source := range sourceChain {
+		if records, ok := source.Lookup(query, fqdn, qtype); ok {
+			return source, records
+		}
+	}
+	return nil, nil
+}
+
+// Lookup result of GET /v1/lookup
+type SourceLookup struct {
+	Source  string   `json:"source"`
+	Records []string `json:"records"`
+}
+
+func httpLookup(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	client := query.Get("client")
+	if client == "" {
+		client = DEFAULT_KEY
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(query.Get("type"))]
+	if !ok || query.Get("name") == "" {
+		http.Error(w, "name and a valid type are required", http.StatusBadRequest)
+		return
+	}
+
+	answersMutex.Lock()
+	source, records := lookupSources(&QueryContext{ClientKey: client, Transport: "http"}, dns.Fqdn(strings.ToLower(query.Get("name"))), qtype)
+	answersMutex.Unlock()
+	if source == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	result := SourceLookup{Source: source.Name(), Records: []string{}}
+	for _, rr := range records {
+		result.Records = append(result.Records, rr.String())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
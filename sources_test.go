@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSourcePriority(t *testing.T) {
+	defer setupSources("")
+	if err := setupSources("dynamic,metadata,file"); err != nil {
+		t.Fatal(err)
+	}
+	fileRecords.Set(Answers{DEFAULT_KEY: ClientAnswers{
+		Search: []string{"file.internal"},
+		A:      map[string]RecordA{"web.": {Answer: []string{"10.0.0.1"}}, "db.": {Answer: []string{"10.0.0.5"}}},
+	}})
+	metadataRecords.Set(Answers{DEFAULT_KEY: ClientAnswers{
+		Search: []string{"meta.internal"},
+		A:      map[string]RecordA{"web.": {Answer: []string{"10.0.0.2"}}},
+	}})
+	dynamicRecords.Set(Answers{DEFAULT_KEY: ClientAnswers{
+		Cname: map[string]RecordCname{"www.": {Answer: "web."}},
+	}})
+	defer fileRecords.Set(make(Answers))
+	defer metadataRecords.Set(make(Answers))
+	defer dynamicRecords.Set(make(Answers))
+
+	client := answers[DEFAULT_KEY]
+	if len(client.Search) != 1 || client.Search[0] != "meta.internal" {
+		t.Fatalf("Settings should come from the metadata source, got %v", client.Search)
+	}
+	if rec := client.A["web."]; rec.Answer[0] != "10.0.0.2" {
+		t.Fatalf("Incorrect web. record %v", rec)
+	}
+	if _, ok := client.A["db."]; !ok {
+		t.Fatalf("Records only in the file source should be kept")
+	}
+	if _, ok := client.Cname["www."]; !ok {
+		t.Fatalf("Records of the dynamic source should be kept")
+	}
+
+	source, records := lookupSources(&QueryContext{ClientKey: DEFAULT_KEY}, "web.", dns.TypeA)
+	if source != AnswerSource(metadataRecords) || len(records) != 1 {
+		t.Fatalf("Incorrect lookup of web.: %v %v", source, records)
+	}
+
+	if err := setupSources("file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := answers[DEFAULT_KEY].Cname["www."]; ok {
+		t.Fatalf("Sources left out of the chain should not be served")
+	}
+	if err := setupSources("file,bogus"); err == nil {
+		t.Fatalf("Expected an error for an unknown source")
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Detection of suspicious responses to queries sent to recursers (--upstream-spoof-detect). Queries over
+// UDP are sent from an unconnected socket, so packets from other addresses than the recurser's reach us
+// instead of being dropped by the kernel. Packets that don't answer the query (another source, ID or
+// question) are counted and ignored while waiting for the response, and the socket stays open for a while
+// after it to count the duplicate responses that arrive, which are the tell of an on-path device racing
+// the real recurser. The counters are under "spoofing" in the statistics, per recurser address.
+const (
+	SPOOF_UNEXPECTED_SOURCE       = "unexpectedSource"
+	SPOOF_ID_MISMATCH             = "idMismatches"
+	SPOOF_QUESTION_MISMATCH       = "questionMismatches"
+	SPOOF_MALFORMED               = "malformed"
+	SPOOF_DUPLICATE               = "duplicates"
+	SPOOF_CONFLICTING_DUPLICATE   = "conflictingDuplicates"
+	UPSTREAM_DUPLICATE_WINDOW     = 250 * time.Millisecond
+	UPSTREAM_MAX_UNEXPECTED_READS = 16
+)
+
+// Like exchange over UDP, on an unconnected socket that's watched for spoofed and duplicate responses
+func exchangeWatched(req *dns.Msg, resolver string, timeout time.Duration) (*dns.Msg, error) {
+	raddr, err := net.ResolveUDPAddr("udp", resolver)
+	if err != nil {
+		return nil, err
+	}
+	network, local := "udp4", ""
+	if raddr.IP.To4() == nil {
+		network = "udp6"
+	}
+	config := net.ListenConfig{}
+	if dialer := outboundDialer("udp", resolver, timeout); dialer != nil {
+		config.Control = dialer.Control
+		if dialer.LocalAddr != nil {
+			local = dialer.LocalAddr.String()
+		}
+	}
+	conn, err := config.ListenPacket(context.Background(), network, local)
+	if err != nil {
+		return nil, err
+	}
+
+	packed, err := req.Pack()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.WriteTo(packed, raddr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	buf := make([]byte, dns.MaxMsgSize)
+	for reads := 0; ; reads++ {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		resp, unpackErr := unpackResponse(buf[:n])
+		if event := spoofEvent(req, raddr, from, resp); event != "" {
+			recordSpoofing(resolver, from.String(), event)
+			// Don't let a flood of junk hold the query until the timeout
+			if reads < UPSTREAM_MAX_UNEXPECTED_READS {
+				continue
+			}
+			conn.Close()
+			return nil, dns.ErrId
+		}
+		go watchDuplicates(conn, req, raddr, resolver, append([]byte{}, buf[:n]...))
+		return resp, unpackErr
+	}
+}
+
+// Keeps reading the socket of an answered query for a while, counting what else arrives on it, then
+// closes it
+func watchDuplicates(conn net.PacketConn, req *dns.Msg, raddr *net.UDPAddr, resolver string, accepted []byte) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(UPSTREAM_DUPLICATE_WINDOW))
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp, _ := unpackResponse(buf[:n])
+		if event := spoofEvent(req, raddr, from, resp); event != "" {
+			recordSpoofing(resolver, from.String(), event)
+			continue
+		}
+		recordSpoofing(resolver, from.String(), SPOOF_DUPLICATE)
+		if !bytes.Equal(buf[:n], accepted) {
+			recordSpoofing(resolver, from.String(), SPOOF_CONFLICTING_DUPLICATE)
+		}
+	}
+}
+
+// Like dns.Conn.ReadMsg, truncated responses are returned with ErrTruncated
+func unpackResponse(packet []byte) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	if err := resp.Unpack(packet); err != nil && err != dns.ErrTruncated {
+		return nil, err
+	} else if err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// Why the packet isn't the response to the query, if it isn't
+func spoofEvent(req *dns.Msg, raddr *net.UDPAddr, from net.Addr, resp *dns.Msg) string {
+	if source, ok := from.(*net.UDPAddr); !ok || !source.IP.Equal(raddr.IP) || source.Port != raddr.Port {
+		return SPOOF_UNEXPECTED_SOURCE
+	}
+	if resp == nil {
+		return SPOOF_MALFORMED
+	}
+	if resp.Id != req.Id {
+		return SPOOF_ID_MISMATCH
+	}
+	if len(resp.Question) != 1 || !sameQuestion(resp.Question[0], req.Question[0]) {
+		return SPOOF_QUESTION_MISMATCH
+	}
+	return ""
+}
+
+func sameQuestion(a, b dns.Question) bool {
+	return a.Qtype == b.Qtype && a.Qclass == b.Qclass && strings.EqualFold(a.Name, b.Name)
+}
+
+func recordSpoofing(resolver string, from string, event string) {
+	stats.recordSpoofing(resolver, event)
+	log.WithFields(log.Fields{"resolver": resolver, "from": from, "event": event}).Warn("Suspicious response from upstream")
+}
+
+func (s *Stats) recordSpoofing(resolver string, event string) {
+	s.Lock()
+	defer s.Unlock()
+	if s.spoofing == nil {
+		s.spoofing = make(map[string]map[string]uint64)
+	}
+	counters, ok := s.spoofing[resolver]
+	if !ok {
+		counters = make(map[string]uint64)
+		s.spoofing[resolver] = counters
+	}
+	counters[event]++
+}
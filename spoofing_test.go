@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestExchangeWatched(t *testing.T) {
+	savedStats := stats
+	defer func() { stats = savedStats }()
+	stats = &Stats{}
+
+	recurser, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recurser.Close()
+	other, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	// Before the response: a packet from another address, one with the wrong ID and one for another
+	// question; after it, the same response again and a different one
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, client, err := recurser.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		req.Unpack(buf[:n])
+		reply := func(conn net.PacketConn, change func(*dns.Msg)) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Answer = []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.0.0.1")}}
+			change(m)
+			packed, _ := m.Pack()
+			conn.WriteTo(packed, client)
+		}
+		reply(other, func(m *dns.Msg) {})
+		reply(recurser, func(m *dns.Msg) { m.Id++ })
+		reply(recurser, func(m *dns.Msg) { m.Question[0].Name = "other.example.com." })
+		reply(recurser, func(m *dns.Msg) {})
+		reply(recurser, func(m *dns.Msg) {})
+		reply(recurser, func(m *dns.Msg) { m.Answer[0].(*dns.A).A = net.ParseIP("10.6.6.6") })
+	}()
+
+	req := new(dns.Msg)
+	req.SetQuestion("web.example.com.", dns.TypeA)
+	resolver := recurser.LocalAddr().String()
+	resp, err := exchangeWatched(req, resolver, time.Second)
+	if err != nil || resp.Id != req.Id || resp.Answer[0].(*dns.A).A.String() != "10.0.0.1" {
+		t.Fatalf("Expected the real response, got %v %v", resp, err)
+	}
+
+	time.Sleep(UPSTREAM_DUPLICATE_WINDOW + 50*time.Millisecond)
+	stats.Lock()
+	counters := stats.spoofing[resolver]
+	stats.Unlock()
+	for event, expected := range map[string]uint64{
+		SPOOF_UNEXPECTED_SOURCE:     1,
+		SPOOF_ID_MISMATCH:           1,
+		SPOOF_QUESTION_MISMATCH:     1,
+		SPOOF_DUPLICATE:             2,
+		SPOOF_CONFLICTING_DUPLICATE: 1,
+	} {
+		if counters[event] != expected {
+			t.Fatalf("Expected %d %s, got %v", expected, event, counters)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// SRV answers are written as in zone files: "<priority> <weight> <port> <target>", e.g.
+// "10 5 8080 web.stack.discover.internal."
+func parseSrvAnswer(answer string) (*dns.SRV, error) {
+	fields := strings.Fields(answer)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("invalid SRV answer %q, expected \"<priority> <weight> <port> <target>\"", answer)
+	}
+	var values [3]uint16
+	for i, field := range fields[:3] {
+		n, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SRV answer %q: %s is not a number from 0 to 65535", answer, field)
+		}
+		values[i] = uint16(n)
+	}
+	target := fields[3]
+	if _, ok := dns.IsDomainName(target); !ok {
+		return nil, fmt.Errorf("invalid SRV target %s", target)
+	}
+	return &dns.SRV{Priority: values[0], Weight: values[1], Port: values[2], Target: dns.Fqdn(target)}, nil
+}
+
+func formatSrvAnswer(srv *dns.SRV) string {
+	return fmt.Sprintf("%d %d %d %s", srv.Priority, srv.Weight, srv.Port, srv.Target)
+}
+
+// Checks the SRV answers of every entry when the answers are loaded
+func validateSrvRecords(answers Answers) error {
+	for key, client := range answers {
+		for name, rec := range client.Srv {
+			if len(rec.Answer) == 0 {
+				return fmt.Errorf("no answer for SRV record %s of %s", name, key)
+			}
+			for _, answer := range rec.Answer {
+				if _, err := parseSrvAnswer(answer); err != nil {
+					return fmt.Errorf("%v (record %s of %s)", err, name, key)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// The answers with their targets in normal form, for answers that have been validated
+func normalizeSrvAnswers(answers []string) []string {
+	out := make([]string, len(answers))
+	for i, answer := range answers {
+		out[i] = answer
+		if srv, err := parseSrvAnswer(answer); err == nil {
+			srv.Target = normalName(srv.Target)
+			out[i] = formatSrvAnswer(srv)
+		}
+	}
+	return out
+}
+
+func normalizeSrv(client string, records map[string]RecordSrv) map[string]RecordSrv {
+	if records == nil {
+		return nil
+	}
+	out := make(map[string]RecordSrv, len(records))
+	for name, record := range records {
+		if normal, ok := normalizedKey(client, "SRV", name, func(n string) bool { _, ok := records[n]; return ok }); ok {
+			answers := make([]string, len(record.Answer))
+			for i, answer := range record.Answer {
+				answers[i] = answer
+				if srv, err := parseSrvAnswer(answer); err == nil {
+					srv.Target = normalizedName(client, "SRV target", srv.Target)
+					answers[i] = formatSrvAnswer(srv)
+				}
+			}
+			record.Answer = answers
+			out[normal] = record
+		}
+	}
+	return out
+}
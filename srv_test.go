@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const srvConfig = `{
+  "default": {
+    "srv": {
+      "_http._tcp.Web.Stack.": {"ttl": 30, "answer": ["10 5 8080 Web-1.Stack.", "20 0 8081 web-2.stack."]}
+    }
+  }
+}`
+
+func TestSrvRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "answers.json")
+	if err := ioutil.WriteFile(path, []byte(srvConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseAnswers(path)
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	rec, ok := parsed[DEFAULT_KEY].Srv["_http._tcp.web.stack."]
+	if !ok || rec.Answer[0] != "10 5 8080 web-1.stack." {
+		t.Fatalf("Expected the normalized SRV record, got %v", parsed[DEFAULT_KEY].Srv)
+	}
+
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+	answers, environmentAnswers = parsed, nil
+	clearClientSpecificCaches()
+
+	req := new(dns.Msg)
+	req.SetQuestion("_http._tcp.web.stack.", dns.TypeSRV)
+	w := &testWriter{}
+	route(w, req)
+	if w.msg == nil || len(w.msg.Answer) != 2 {
+		t.Fatalf("Expected 2 SRV answers, got %v", w.msg)
+	}
+	srv, ok := w.msg.Answer[0].(*dns.SRV)
+	if !ok || srv.Priority != 10 || srv.Weight != 5 || srv.Port != 8080 || srv.Target != "web-1.stack." || srv.Hdr.Ttl != 30 {
+		t.Fatalf("Incorrect SRV answer %v", w.msg.Answer[0])
+	}
+
+	for _, invalid := range []string{"10 5 8080", "10 5 80800 web.", "a 5 80 web.", "10 5 80 bad..name"} {
+		if _, err := parseSrvAnswer(invalid); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+	if err := validateAnswer("SRV", []string{"10 5 8080 web.stack."}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Reloads are staged: the new answers are loaded, the answers that would be served with them (merged
+// with the other sources) are validated and indexed aside, and only then swapped in, so a reload that
+// fails at any point leaves the served answers untouched. A validation-only reload stops before the swap.
+
+// Where a reload failed
+const (
+	RELOAD_STAGE_LOAD     = "load"
+	RELOAD_STAGE_VALIDATE = "validate"
+)
+
+type reloadError struct {
+	stage string
+	err   error
+}
+
+func (e *reloadError) Error() string {
+	return e.err.Error()
+}
+
+// The stage of a failed reload, if it says
+func reloadStage(err error) string {
+	if err, ok := err.(*reloadError); ok {
+		return err.stage
+	}
+	return ""
+}
+
+// The served answers with everything derived from them, ready to be swapped in
+type stagedAnswers struct {
+	answers      Answers
+	environments map[string]Answers
+	blocks       map[string]Answers
+}
+
+func indexAnswers(merged Answers) *stagedAnswers {
+	environments := merged.Environments()
+	return &stagedAnswers{answers: merged, environments: environments, blocks: serverBlockViews(merged, environments)}
+}
+
+// Swaps in the staged answers. Must be called with answersMutex held.
+func serveAnswers(staged *stagedAnswers) {
+	clearClientSpecificCaches()
+	clearServedWeights()
+	answers = staged.answers
+	environmentAnswers = staged.environments
+	serverBlockAnswers = staged.blocks
+	rateLimiter.SetRules(answers.RateLimitRules())
+	blocklists.SetRules(answers.BlocklistRules())
+	healthChecks.SetRecords(answers)
+	updateAnswersVersion()
+	zoneVersions.Update(answers)
+}
+
+// Checks the answers served as a whole, as the sources merged into them are only checked on their own
+func validateServed(merged Answers) error {
+	if err := validateRules(merged); err != nil {
+		return err
+	}
+	for _, environment := range merged.Environments() {
+		if err := validateRules(environment); err != nil {
+			return err
+		}
+	}
+	if err := validateTsigKeys(merged); err != nil {
+		return err
+	}
+	return validateSrvRecords(merged)
+}
+
+// The answers that would be served with the candidate answers as those of the base source
+func stageBaseAnswers(candidate Answers) (*stagedAnswers, error) {
+	answersMutex.Lock()
+	defer answersMutex.Unlock()
+	merged := composeAnswers(baseSource(), candidate)
+	if err := validateServed(merged); err != nil {
+		return nil, &reloadError{RELOAD_STAGE_VALIDATE, err}
+	}
+	return indexAnswers(merged), nil
+}
+
+// Replaces the answers of the base source with the candidate answers, if the answers served with
+// them are valid. Must be called with baseMutex held.
+func applyBaseAnswers(candidate Answers) error {
+	return applyComposed(candidate, func() Answers { return composeAnswers(baseSource(), candidate) })
+}
+
+// Like applyBaseAnswers, for a candidate that only differs from the base source's answers in the
+// entries of the keys: only those are composed again. Must be called with baseMutex held.
+func applyBaseKeys(candidate Answers, keys map[string]bool) error {
+	return applyComposed(candidate, func() Answers { return recomposeKeys(keys, baseSource(), candidate) })
+}
+
+// Serves the answers composed with the candidate, if they are valid
+func applyComposed(candidate Answers, compose func() Answers) error {
+	answersMutex.Lock()
+	merged := compose()
+	if err := validateServed(merged); err != nil {
+		answersMutex.Unlock()
+		return &reloadError{RELOAD_STAGE_VALIDATE, err}
+	}
+	baseSource().replace(candidate)
+	serveAnswers(indexAnswers(merged))
+	answersMutex.Unlock()
+	snapshotServed(candidate)
+	return nil
+}
+
+// Reads the answers file, or generates the answers from metadata
+func loadCandidate() (Answers, error) {
+	if metadataDriven() {
+		candidate, err := configGenerator.GenerateAnswers()
+		if err != nil {
+			return nil, &reloadError{RELOAD_STAGE_LOAD, err}
+		}
+		ConvertPtrIps(&candidate)
+		candidate.SetSource(metadataSource(*metadataServer))
+		return candidate, nil
+	}
+	candidate, err := ParseAnswers(answersPath())
+	if err != nil {
+		return nil, &reloadError{RELOAD_STAGE_LOAD, err}
+	}
+	return candidate, nil
+}
+
+// The answers file to read: --answers-fallback while the --answers file doesn't exist, so a host that
+// starts before its config generator serves the baseline until the file is written and reloaded
+func answersPath() string {
+	if *answersFallback == "" || isAnswersUrl(*answersFile) {
+		return *answersFile
+	}
+	if _, err := os.Stat(*answersFile); os.IsNotExist(err) {
+		log.WithFields(log.Fields{"file": *answersFile, "fallback": *answersFallback}).Warn("Answers file missing, reading the fallback")
+		return *answersFallback
+	}
+	return *answersFile
+}
+
+// Serves the --answers-fallback answers, for when the --answers ones fail to load at startup
+func loadFallbackAnswers() error {
+	_, err := os.Stat(*answersFallback)
+	var fallback Answers
+	if err == nil {
+		fallback, err = ParseAnswers(*answersFallback)
+	}
+	if err != nil {
+		err = &reloadError{RELOAD_STAGE_LOAD, err}
+	} else {
+		baseMutex.Lock()
+		err = applyBaseAnswers(fallback)
+		baseMutex.Unlock()
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"file": *answersFallback, "stage": reloadStage(err)}).Errorf("Failed to load fallback answers: %v", err)
+		return err
+	}
+	stats.incr("answersFallbacks")
+	log.WithFields(log.Fields{"file": *answersFallback}).Warn("Serving the fallback answers")
+	return nil
+}
+
+// Loads and validates the answers like a reload, without serving them. The counts and checksum are
+// those of the answers that would be served.
+func validateReload() ReloadResult {
+	start := time.Now()
+	candidate, err := loadCandidate()
+	var staged *stagedAnswers
+	if err == nil {
+		staged, err = stageBaseAnswers(candidate)
+	}
+
+	answersMutex.Lock()
+	result := ReloadResult{
+		Ok:         err == nil,
+		DryRun:     true,
+		Clients:    len(answers),
+		Records:    answers.Counts(),
+		Generation: answersVersion.Generation,
+		Checksum:   answersVersion.Checksum,
+	}
+	answersMutex.Unlock()
+	if staged != nil {
+		result.Clients = len(staged.answers)
+		result.Records = staged.answers.Counts()
+		result.Checksum = answersChecksum(staged.answers)
+	}
+	result.DurationMs = durationMs(time.Since(start))
+	if err != nil {
+		result.Error = err.Error()
+		result.Stage = reloadStage(err)
+		log.WithFields(log.Fields{"stage": result.Stage}).Warnf("Answers failed validation: %v", err)
+	} else {
+		log.WithFields(log.Fields{"checksum": result.Checksum, "durationMs": result.DurationMs}).Info("Answers validated")
+	}
+	return result
+}
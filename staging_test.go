@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStagedReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedFile := *answersFile
+	defer func() { *answersFile = savedFile }()
+	*answersFile = filepath.Join(dir, "answers.json")
+	if err := setupSources(""); err != nil {
+		t.Fatal(err)
+	}
+	defer setBaseAnswers(make(Answers))
+
+	write := func(data string) {
+		if err := ioutil.WriteFile(*answersFile, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"default": {"a": {"web.": {"answer": ["10.0.0.1"]}}}}`)
+	if err := loadAnswers(); err != nil {
+		t.Fatalf("Failed to load answers: %v", err)
+	}
+	served := currentAnswersVersion()
+
+	// Validation reports what would be served, and serves nothing new
+	write(`{"default": {"a": {"web.": {"answer": ["10.0.0.1"]}, "db.": {"answer": ["10.0.0.2"]}}}}`)
+	result := validateReload()
+	if !result.Ok || !result.DryRun || result.Records["A"] != 2 || result.Checksum == served.Checksum {
+		t.Fatalf("Expected the new answers to validate, got %+v", result)
+	}
+	if version := currentAnswersVersion(); version.Checksum != served.Checksum || len(answers[DEFAULT_KEY].A) != 1 {
+		t.Fatalf("Expected the served answers to stay, got %+v", version)
+	}
+
+	write(`{"default": {"a": {"web.": {"answer": ["10.0.0.1"]}}, "order": [{"zone": "", "order": ["local"]}]}}`)
+	if result := validateReload(); result.Ok || result.Stage != RELOAD_STAGE_LOAD || result.Records["A"] != 1 {
+		t.Fatalf("Expected the answers to fail to load, got %+v", result)
+	}
+	if err := loadAnswers(); err == nil || reloadStage(err) != RELOAD_STAGE_LOAD {
+		t.Fatalf("Expected the reload to fail to load, got %v", err)
+	}
+
+	// Answers of the wrong types are rejected, not loaded as what parsed of them
+	write(`{"default": {"a": {"web.": {"answer": "10.0.0.1"}}, "recurse": "8.8.8.8"}}`)
+	if result := validateReload(); result.Ok || result.Stage != RELOAD_STAGE_LOAD {
+		t.Fatalf("Expected the malformed answers to fail to load, got %+v", result)
+	}
+	if err := loadAnswers(); err == nil || reloadStage(err) != RELOAD_STAGE_LOAD {
+		t.Fatalf("Expected the reload of malformed answers to fail to load, got %v", err)
+	}
+
+	// Answers that fail validation as served are never swapped in
+	baseMutex.Lock()
+	err = applyBaseAnswers(Answers{
+		DEFAULT_KEY: ClientAnswers{Order: []OrderRule{{Zone: "example.com"}}},
+	})
+	baseMutex.Unlock()
+	if err == nil || reloadStage(err) != RELOAD_STAGE_VALIDATE {
+		t.Fatalf("Expected the candidate to fail validation, got %v", err)
+	}
+	if version := currentAnswersVersion(); version.Checksum != served.Checksum || len(fileRecords.Answers()[DEFAULT_KEY].A) != 1 {
+		t.Fatalf("Expected the served answers to stay, got %+v", version)
+	}
+
+	write(`{"default": {"a": {"db.": {"answer": ["10.0.0.2"]}}}}`)
+	if err := loadAnswers(); err != nil || len(answers[DEFAULT_KEY].A) != 1 || currentAnswersVersion().Generation != served.Generation+1 {
+		t.Fatalf("Expected the new answers to be served, got %v", err)
+	}
+}
+
+func TestAnswersFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fallback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	savedFile, savedFallback := *answersFile, *answersFallback
+	defer func() { *answersFile, *answersFallback = savedFile, savedFallback }()
+	*answersFile = filepath.Join(dir, "answers.json")
+	*answersFallback = filepath.Join(dir, "fallback.json")
+	if err := setupSources(""); err != nil {
+		t.Fatal(err)
+	}
+	defer setBaseAnswers(make(Answers))
+	ioutil.WriteFile(*answersFallback, []byte(`{"default": {"recurse": ["10.0.0.53"]}}`), 0644)
+
+	// A missing answers file reads as the fallback
+	if err := loadAnswers(); err != nil {
+		t.Fatal(err)
+	}
+	if recurse := answers[DEFAULT_KEY].Recurse; len(recurse) != 1 || recurse[0] != "10.0.0.53" {
+		t.Fatalf("Expected the fallback answers, got %+v", answers[DEFAULT_KEY])
+	}
+
+	// An invalid one fails to load, and the fallback stands in for it at startup
+	ioutil.WriteFile(*answersFile, []byte(`{"default": {"miss": "bogus"}}`), 0644)
+	if err := loadAnswers(); err == nil {
+		t.Fatalf("Expected the invalid answers to fail to load")
+	}
+	setBaseAnswers(make(Answers))
+	if err := loadFallbackAnswers(); err != nil || len(answers[DEFAULT_KEY].Recurse) != 1 {
+		t.Fatalf("Expected the fallback answers, got %v", err)
+	}
+
+	// Once written, the answers file replaces the fallback on reload
+	ioutil.WriteFile(*answersFile, []byte(`{"default": {"a": {"web.": {"answer": ["10.0.0.1"]}}}}`), 0644)
+	if err := loadAnswers(); err != nil || len(answers[DEFAULT_KEY].A) != 1 || len(answers[DEFAULT_KEY].Recurse) != 0 {
+		t.Fatalf("Expected the answers file to be served, got %v", err)
+	}
+
+	os.Remove(*answersFallback)
+	if err := loadFallbackAnswers(); err == nil {
+		t.Fatalf("Expected a missing fallback to fail to load")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const SOURCE_PEER = "peer"
+
+// State an active instance hands to its standby through GET /v1/state. YAML keeps every record
+// type (the JSON encoding of the answers leaves out PTR and TXT).
+type peerState struct {
+	Base    Answers `yaml:"base"`
+	Dynamic Answers `yaml:"dynamic"`
+}
+
+func httpState(w http.ResponseWriter, req *http.Request) {
+	state := peerState{Base: baseSource().Answers(), Dynamic: dynamicRecords.Answers()}
+	b, err := yaml.Marshal(&state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-yaml")
+	w.Write(b)
+}
+
+func fetchState(addr string) (*peerState, error) {
+	client := &http.Client{Timeout: time.Duration(*heartbeatInterval) * time.Second}
+	resp, err := client.Get("http://" + addr + "/v1/state")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &peerState{}
+	if err := yaml.Unmarshal(body, state); err != nil {
+		return nil, err
+	}
+	if state.Base == nil {
+		state.Base = make(Answers)
+	}
+	if state.Dynamic == nil {
+		state.Dynamic = make(Answers)
+	}
+	state.Base.SetSource(SOURCE_PEER + ":" + addr)
+	state.Dynamic.SetSource(SOURCE_DYNAMIC)
+	return state, nil
+}
+
+// Mirrors the answers and dynamic records of the active instance every --heartbeat-interval. When it
+// hasn't answered for --failover-timeout, binds the --listen addresses (retrying until the active has
+// let go of them) and serves the last state it copied, from then on as the active instance.
+func runStandby(active string) {
+	log.Infof("Standing by for %s", active)
+	interval := time.Duration(*heartbeatInterval) * time.Second
+	lastSeen := time.Now()
+	for {
+		if state, err := fetchState(active); err == nil {
+			if !reflect.DeepEqual(state.Base, baseSource().Answers()) {
+				setBaseAnswers(state.Base)
+			}
+			if !reflect.DeepEqual(state.Dynamic, dynamicRecords.Answers()) {
+				dynamicRecords.Set(state.Dynamic)
+			}
+			lastSeen = time.Now()
+		} else {
+			log.WithFields(log.Fields{"active": active}).Debugf("Missed heartbeat: %v", err)
+			if time.Since(lastSeen) >= time.Duration(*failoverTimeout)*time.Second {
+				break
+			}
+		}
+		time.Sleep(interval)
+	}
+
+	log.Warnf("No heartbeat from %s for %ds, taking over", active, *failoverTimeout)
+	stats.incr("failovers")
+	for _, addr := range listenAddrs() {
+		for {
+			err := listenDns(addr)
+			if err == nil {
+				break
+			}
+			log.Warnf("Cannot listen on %s yet: %v", addr, err)
+			time.Sleep(interval)
+		}
+	}
+	startLeaseSweeper()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	if err := setupSources(""); err != nil {
+		t.Fatal(err)
+	}
+	ttl := uint32(30)
+	setBaseAnswers(Answers{DEFAULT_KEY: ClientAnswers{
+		Recurse: []string{"8.8.8.8"},
+		A:       map[string]RecordA{"web.": {Answer: []string{"10.0.0.1"}, Ttl: &ttl}},
+		Ptr:     map[string]RecordPtr{"1.0.0.10.in-addr.arpa.": {Answer: "web."}},
+	}})
+	dynamicRecords.Set(Answers{DEFAULT_KEY: ClientAnswers{Txt: map[string]RecordTxt{"info.": {Answer: []string{"x"}}}}})
+	defer setBaseAnswers(make(Answers))
+	defer dynamicRecords.Set(make(Answers))
+
+	server := httptest.NewServer(http.HandlerFunc(httpState))
+	defer server.Close()
+
+	state, err := fetchState(strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := state.Base[DEFAULT_KEY]
+	if len(base.Recurse) != 1 || *base.A["web."].Ttl != 30 || base.Ptr["1.0.0.10.in-addr.arpa."].Answer != "web." {
+		t.Fatalf("Incorrect base answers %+v", base)
+	}
+	if !strings.HasPrefix(base.A["web."].Source, SOURCE_PEER+":") {
+		t.Fatalf("Incorrect source %s", base.A["web."].Source)
+	}
+	if rec := state.Dynamic[DEFAULT_KEY].Txt["info."]; len(rec.Answer) != 1 || rec.Source != SOURCE_DYNAMIC {
+		t.Fatalf("Incorrect dynamic records %+v", state.Dynamic)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Bucket for queries that don't fall under any configured zone
+const OTHER_ZONE = "other"
+
+// How local answers were found, see Answers.MatchKind
+const (
+	MATCH_EXACT    = "exact"
+	MATCH_WILDCARD = "wildcard"
+	MATCH_PATTERN  = "pattern"
+)
+
+// Records how the local answer to the query being answered through w was found
+func setMatch(w dns.ResponseWriter, match string) {
+	if qw, ok := w.(*queryWriter); ok {
+		qw.match = match
+	}
+	trace(w, "match=%s", match)
+}
+
+type queryStats struct {
+	Queries  uint64 `json:"queries"`
+	NXDomain uint64 `json:"nxdomain"`
+	// Local answers by how they were found
+	matches map[string]uint64
+	latency time.Duration
+	max     time.Duration
+}
+
+func (q *queryStats) record(rcode int, match string, elapsed time.Duration) {
+	q.Queries++
+	if rcode == dns.RcodeNameError {
+		q.NXDomain++
+	}
+	if match != "" {
+		if q.matches == nil {
+			q.matches = make(map[string]uint64)
+		}
+		q.matches[match]++
+	}
+	q.latency += elapsed
+	if elapsed > q.max {
+		q.max = elapsed
+	}
+}
+
+func (q *queryStats) MarshalJSON() ([]byte, error) {
+	out := map[string]interface{}{
+		"queries":      q.Queries,
+		"nxdomain":     q.NXDomain,
+		"nxdomainRate": 0.0,
+		"avgLatencyMs": 0.0,
+		"maxLatencyMs": durationMs(q.max),
+		"exact":        q.matches[MATCH_EXACT],
+		"wildcard":     q.matches[MATCH_WILDCARD],
+		"pattern":      q.matches[MATCH_PATTERN],
+		"wildcardRate": 0.0,
+	}
+	if local := q.matches[MATCH_EXACT] + q.matches[MATCH_WILDCARD] + q.matches[MATCH_PATTERN]; local > 0 {
+		out["wildcardRate"] = float64(q.matches[MATCH_WILDCARD]) / float64(local)
+	}
+	if q.Queries > 0 {
+		out["nxdomainRate"] = float64(q.NXDomain) / float64(q.Queries)
+		out["avgLatencyMs"] = durationMs(q.latency) / float64(q.Queries)
+	}
+	return json.Marshal(out)
+}
+
+type Stats struct {
+	sync.Mutex
+	counters  map[string]uint64
+	zones     map[string]*queryStats
+	tags      map[string]*queryStats
+	upstreams map[string]map[string]uint64
+	spoofing  map[string]map[string]uint64
+	// Queries and queries over the rate limit of each transport
+	transports map[string]map[string]uint64
+}
+
+var stats = &Stats{
+	counters:   make(map[string]uint64),
+	zones:      make(map[string]*queryStats),
+	tags:       make(map[string]*queryStats),
+	upstreams:  make(map[string]map[string]uint64),
+	spoofing:   make(map[string]map[string]uint64),
+	transports: make(map[string]map[string]uint64),
+}
+
+func (s *Stats) incr(name string) {
+	s.Lock()
+	s.counters[name]++
+	s.Unlock()
+}
+
+func (s *Stats) recordQuery(zone string, tag string, rcode int, match string, elapsed time.Duration) {
+	s.Lock()
+	for _, group := range []struct {
+		m   map[string]*queryStats
+		key string
+	}{{s.zones, zone}, {s.tags, tag}} {
+		q, ok := group.m[group.key]
+		if !ok {
+			q = &queryStats{}
+			group.m[group.key] = q
+		}
+		q.record(rcode, match, elapsed)
+	}
+	s.Unlock()
+}
+
+func (s *Stats) MarshalJSON() ([]byte, error) {
+	gauges := readResourceGauges()
+	version := currentAnswersVersion()
+	caches := recursionCacheCounters()
+	var signatures map[string]interface{}
+	if dnssecSigner != nil {
+		signatures = dnssecSigner.gauges()
+	}
+	s.Lock()
+	defer s.Unlock()
+	return json.Marshal(map[string]interface{}{
+		"dnssec":     signatures,
+		"server":     s.counters,
+		"zones":      s.zones,
+		"tags":       s.tags,
+		"upstreams":  s.upstreams,
+		"spoofing":   s.spoofing,
+		"transports": s.transports,
+		"cache":      caches,
+		"runtime":    gauges,
+		"answers":    version,
+	})
+}
+
+// Counts the outcome of a query sent to a recurser: the response code when there is a response,
+// otherwise whether it timed out, failed at the network level or came back malformed.
+func (s *Stats) recordUpstream(resolver string, resp *dns.Msg, err error) {
+	outcome := "malformed"
+	if err == nil && resp != nil {
+		outcome = dns.RcodeToString[resp.Rcode]
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		outcome = "timeouts"
+	} else if _, ok := err.(net.Error); ok {
+		outcome = "networkErrors"
+	} else if _, ok := err.(*upstreamLimitError); ok {
+		outcome = "rejected"
+	}
+
+	s.Lock()
+	counters, ok := s.upstreams[resolver]
+	if !ok {
+		counters = make(map[string]uint64)
+		s.upstreams[resolver] = counters
+	}
+	counters[outcome]++
+	s.Unlock()
+}
+
+// Counts a query that arrived on the transport, and whether it was over the transport's rate limit
+func (s *Stats) recordTransport(transport string, limited bool) {
+	s.Lock()
+	if s.transports == nil {
+		s.transports = make(map[string]map[string]uint64)
+	}
+	counters, ok := s.transports[transport]
+	if !ok {
+		counters = map[string]uint64{"queries": 0, "limited": 0}
+		s.transports[transport] = counters
+	}
+	counters["queries"]++
+	if limited {
+		counters["limited"]++
+	}
+	s.Unlock()
+}
+
+// Figures out which configured zone (authoritative or default search suffix) a name belongs to,
+// preferring the longest match. Anything else is counted under OTHER_ZONE.
+func statsZone(fqdn string) string {
+	fqdn = "." + strings.TrimLeft(dns.Fqdn(strings.ToLower(fqdn)), ".")
+	zone := OTHER_ZONE
+	suffixes := answers.AuthoritativeSuffixes()
+	for _, search := range answers.SearchSuffixes(DEFAULT_KEY) {
+		suffixes = append(suffixes, "."+strings.Trim(search, ".")+".")
+	}
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(fqdn, suffix) && (zone == OTHER_ZONE || len(suffix) > len(zone)+1) {
+			zone = strings.TrimLeft(suffix, ".")
+		}
+	}
+	return zone
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func httpStats(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRecordUpstream(t *testing.T) {
+	s := &Stats{upstreams: make(map[string]map[string]uint64)}
+	nx := new(dns.Msg)
+	nx.Rcode = dns.RcodeNameError
+
+	s.recordUpstream("8.8.8.8", nx, nil)
+	s.recordUpstream("8.8.8.8", nx, nil)
+	s.recordUpstream("8.8.8.8", nil, timeoutError{})
+	s.recordUpstream("8.8.4.4", nil, dns.ErrShortRead)
+
+	if s.upstreams["8.8.8.8"]["NXDOMAIN"] != 2 || s.upstreams["8.8.8.8"]["timeouts"] != 1 {
+		t.Fatalf("Incorrect counters for 8.8.8.8 [%v]", s.upstreams["8.8.8.8"])
+	}
+	if s.upstreams["8.8.4.4"]["malformed"] != 1 {
+		t.Fatalf("Incorrect counters for 8.8.4.4 [%v]", s.upstreams["8.8.4.4"])
+	}
+}
+
+func TestMatchStats(t *testing.T) {
+	saved, savedEnvironments, savedStats := answers, environmentAnswers, stats
+	defer func() { answers, environmentAnswers, stats = saved, savedEnvironments, savedStats }()
+	stats = &Stats{counters: make(map[string]uint64), zones: make(map[string]*queryStats), tags: make(map[string]*queryStats)}
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Authoritative: []string{"corp.internal"},
+		A: map[string]RecordA{
+			"web.corp.internal.": {Answer: []string{"10.0.0.1"}},
+			"*.corp.internal.":   {Answer: []string{"10.0.0.2"}},
+		},
+		Txt:      map[string]RecordTxt{"web.corp.internal.": {Answer: []string{"exact"}}},
+		Patterns: []PatternRule{{Match: `^pr-(\d+)\.build\.internal$`, Type: "A", Answer: []string{"10.99.0.$1"}}},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	for _, name := range []string{"web.corp.internal.", "wbe.corp.internal.", "api.corp.internal.", "pr-7.build.internal."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		handleQuery(&testWriter{}, req)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("web.corp.internal.", dns.TypeTXT)
+	handleQuery(&testWriter{}, req)
+
+	zone := stats.zones["corp.internal."]
+	if zone == nil || zone.matches[MATCH_EXACT] != 2 || zone.matches[MATCH_WILDCARD] != 2 {
+		t.Fatalf("Expected 2 exact and 2 wildcard answers in corp.internal., got %+v", zone)
+	}
+	if other := stats.zones[OTHER_ZONE]; other == nil || other.matches[MATCH_PATTERN] != 1 {
+		t.Fatalf("Expected a pattern answer, got %+v", other)
+	}
+}
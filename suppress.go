@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Suppression rules, read from the "suppress" list of the default entry. Clients in a rule's
+// network get NXDOMAIN for the zone and every name under it, whatever the answers or recursers
+// would have returned.
+func (answers *Answers) SuppressRules() []SuppressRule {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.Suppress
+}
+
+func (answers *Answers) Suppressed(clientIp string, fqdn string) bool {
+	for _, rule := range answers.SuppressRules() {
+		if inNetwork(clientIp, rule.Network) && inZone(fqdn, rule.Zone) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *SuppressRule) Validate() error {
+	if rule.Zone == "" {
+		return fmt.Errorf("suppress rule without a zone: %+v", *rule)
+	}
+	if parseNetwork(rule.Network) == nil {
+		return fmt.Errorf("invalid network for suppressed zone %s: %s", rule.Zone, rule.Network)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSuppressed(t *testing.T) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Suppress: []SuppressRule{
+				{Network: "10.42.99.0/24", Zone: "corp.internal"},
+				{Network: "10.42.1.7", Zone: "example.com."},
+			},
+		},
+	}
+
+	cases := []struct {
+		client     string
+		name       string
+		suppressed bool
+	}{
+		{"10.42.99.5", "db.corp.internal.", true},
+		{"10.42.99.5", "CORP.internal.", true},
+		{"10.42.99.5", "notcorp.internal.", false},
+		{"10.42.98.5", "db.corp.internal.", false},
+		{"10.42.1.7", "www.example.com.", true},
+		{"10.42.1.8", "www.example.com.", false},
+	}
+	for _, tc := range cases {
+		if suppressed := answers.Suppressed(tc.client, tc.name); suppressed != tc.suppressed {
+			t.Fatalf("Incorrect suppression for %s %s: expected %v, got %v", tc.client, tc.name, tc.suppressed, suppressed)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Tag given to queries that don't match any classification rule
+const UNTAGGED = "untagged"
+
+// Classification rules, read from the "tags" list of the default entry. The first rule whose
+// network, suffix and type (each optional) all match the query gives the query its tag.
+func (answers *Answers) TagRules() []TagRule {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.Tags
+}
+
+func (answers *Answers) Classify(clientIp string, question dns.Question) string {
+	for _, rule := range answers.TagRules() {
+		if rule.Matches(clientIp, question) {
+			return rule.Tag
+		}
+	}
+	return UNTAGGED
+}
+
+func (rule *TagRule) Matches(clientIp string, question dns.Question) bool {
+	if rule.Network != "" && !inNetwork(clientIp, rule.Network) {
+		return false
+	}
+	if rule.Suffix != "" && !inZone(question.Name, rule.Suffix) {
+		return false
+	}
+	if rule.Qtype != "" && !strings.EqualFold(rule.Qtype, dns.Type(question.Qtype).String()) {
+		return false
+	}
+	return true
+}
+
+func (rule *TagRule) Validate() error {
+	if rule.Tag == "" {
+		return fmt.Errorf("tag rule without a tag: %+v", *rule)
+	}
+	if rule.Network != "" && parseNetwork(rule.Network) == nil {
+		return fmt.Errorf("invalid network for tag %s: %s", rule.Tag, rule.Network)
+	}
+	if rule.Qtype != "" {
+		if _, ok := dns.StringToType[strings.ToUpper(rule.Qtype)]; !ok {
+			return fmt.Errorf("invalid type for tag %s: %s", rule.Tag, rule.Qtype)
+		}
+	}
+	return nil
+}
+
+// Whether the name is the zone or a name under it, ignoring case
+func inZone(name string, zone string) bool {
+	suffix := "." + strings.Trim(strings.ToLower(zone), ".") + "."
+	return strings.HasSuffix("."+strings.ToLower(dns.Fqdn(name)), suffix)
+}
+
+// Parses a CIDR network or a single address
+func parseNetwork(network string) *net.IPNet {
+	if _, n, err := net.ParseCIDR(network); err == nil {
+		return n
+	}
+	if ip := net.ParseIP(network); ip != nil {
+		bits := 128
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	return nil
+}
+
+func inNetwork(clientIp string, network string) bool {
+	n := parseNetwork(network)
+	ip := net.ParseIP(clientIp)
+	return n != nil && ip != nil && n.Contains(ip)
+}
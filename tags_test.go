@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClassify(t *testing.T) {
+	answers := Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Tags: []TagRule{
+				{Tag: "ptr", Qtype: "ptr"},
+				{Tag: "tenant-a", Network: "10.42.1.0/24", Suffix: "corp.internal"},
+				{Tag: "host", Network: "10.42.2.1"},
+			},
+		},
+	}
+
+	cases := []struct {
+		client string
+		name   string
+		qtype  uint16
+		tag    string
+	}{
+		{"10.42.1.5", "db.corp.internal.", dns.TypeA, "tenant-a"},
+		{"10.42.1.5", "google.com.", dns.TypeA, UNTAGGED},
+		{"10.42.2.1", "google.com.", dns.TypeA, "host"},
+		{"10.42.1.5", "5.1.42.10.in-addr.arpa.", dns.TypePTR, "ptr"},
+	}
+	for _, tc := range cases {
+		q := dns.Question{Name: tc.name, Qtype: tc.qtype, Qclass: dns.ClassINET}
+		if tag := answers.Classify(tc.client, q); tag != tc.tag {
+			t.Fatalf("Incorrect tag for %s %s: expected %s, got %s", tc.client, tc.name, tc.tag, tag)
+		}
+	}
+}
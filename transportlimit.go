@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Transports queries arrive on, as named by transport(). The DNS over HTTPS listener identifies
+// itself with the last one.
+var limitedTransports = []string{"udp", "tcp", "doh"}
+
+// Server-wide rate limits of the queries of each transport (--transport-rate-limits), so clients
+// of an expensive transport (a TCP or TLS handshake, an HTTP request per query) can't take up the
+// handlers the cheap UDP queries need.
+type transportLimiter struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var transportLimits = &transportLimiter{buckets: make(map[string]*tokenBucket)}
+
+// Parses comma-delimited TRANSPORT=QPS limits, e.g. "udp=5000,tcp=500,doh=100"
+func parseTransportLimits(spec string) (map[string]float64, error) {
+	limits := make(map[string]float64)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("expected TRANSPORT=QPS, got %q", entry)
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		known := false
+		for _, t := range limitedTransports {
+			known = known || t == name
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown transport %q, expected one of %s", name, strings.Join(limitedTransports, ", "))
+		}
+		qps, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || qps <= 0 || math.IsInf(qps, 0) {
+			return nil, fmt.Errorf("invalid rate %q of transport %s", parts[1], name)
+		}
+		if _, ok := limits[name]; ok {
+			return nil, fmt.Errorf("transport %s given more than once", name)
+		}
+		limits[name] = qps
+	}
+	return limits, nil
+}
+
+func (l *transportLimiter) SetLimits(limits map[string]float64) {
+	l.Lock()
+	defer l.Unlock()
+	l.buckets = make(map[string]*tokenBucket)
+	for name, qps := range limits {
+		l.buckets[name] = &tokenBucket{rate: qps, tokens: math.Max(qps, 1), last: time.Now()}
+	}
+}
+
+// Whether a query of the transport may be answered now
+func (l *transportLimiter) Allow(transport string) bool {
+	l.Lock()
+	defer l.Unlock()
+	bucket, ok := l.buckets[transport]
+	return !ok || bucket.take(time.Now())
+}
+
+// Answers the query, unless its transport is over its rate limit
+func transportLimitedRoute(w dns.ResponseWriter, req *dns.Msg, next func(dns.ResponseWriter, *dns.Msg)) {
+	t := transport(w)
+	if transportLimits.Allow(t) {
+		stats.recordTransport(t, false)
+		next(w, req)
+		return
+	}
+	stats.recordTransport(t, true)
+	log.WithFields(log.Fields{"transport": t, "client": clientAddr(w)}).Debug("Transport over its rate limit")
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	setExtendedError(w, EDE_OTHER, "rate limit of the transport exceeded")
+	w.WriteMsg(m)
+}
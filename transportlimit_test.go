@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type transportWriter struct {
+	testWriter
+	name string
+}
+
+func (w *transportWriter) Transport() string { return w.name }
+
+func TestParseTransportLimits(t *testing.T) {
+	limits, err := parseTransportLimits("udp=5000, TCP=500,doh=0.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 3 || limits["udp"] != 5000 || limits["tcp"] != 500 || limits["doh"] != 0.5 {
+		t.Fatalf("Unexpected limits %v", limits)
+	}
+	for _, spec := range []string{"udp", "quic=10", "dot=10", "tcp=0", "tcp=-1", "tcp=many", "udp=1,udp=2"} {
+		if _, err := parseTransportLimits(spec); err == nil {
+			t.Fatalf("Expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestTransportRateLimits(t *testing.T) {
+	saved, savedEnvironments, savedStats := answers, environmentAnswers, stats
+	defer func() {
+		answers, environmentAnswers, stats = saved, savedEnvironments, savedStats
+		transportLimits.SetLimits(nil)
+	}()
+	stats = &Stats{counters: make(map[string]uint64), zones: make(map[string]*queryStats), tags: make(map[string]*queryStats)}
+	answers = Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"web.internal.": {Answer: []string{"10.0.0.1"}}}}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+	transportLimits.SetLimits(map[string]float64{"doh": 2})
+
+	query := func(name string) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("web.internal.", dns.TypeA)
+		w := &transportWriter{name: name}
+		if name == "udp" {
+			handleQuery(&w.testWriter, req)
+		} else {
+			handleQuery(w, req)
+		}
+		return w.msg
+	}
+	// The DoH queries over the limit are refused, UDP ones aren't held up by them
+	for i := 0; i < 3; i++ {
+		msg := query("doh")
+		if rcode := msg.Rcode; (i < 2) != (rcode == dns.RcodeSuccess) || (i == 2) != (rcode == dns.RcodeRefused) {
+			t.Fatalf("Unexpected response to DoH query %d: %v", i, msg)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if msg := query("udp"); msg.Rcode != dns.RcodeSuccess {
+			t.Fatalf("Expected UDP queries to be answered, got %v", msg)
+		}
+	}
+
+	if doh := stats.transports["doh"]; doh["queries"] != 3 || doh["limited"] != 1 {
+		t.Fatalf("Expected 3 DoH queries, 1 limited, got %v", doh)
+	}
+	if udp := stats.transports["udp"]; udp["queries"] != 3 || udp["limited"] != 0 {
+		t.Fatalf("Expected 3 UDP queries, none limited, got %v", udp)
+	}
+}
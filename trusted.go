@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Networks of the forwarders (--trusted-proxies) whose word about the client behind them is taken
+var trustedProxies []*net.IPNet
+
+func setupTrustedProxies() error {
+	var err error
+	trustedProxies, err = parseNetworkList(*trustedProxyList, "trusted proxy")
+	return err
+}
+
+func trustedProxy(addr string) bool {
+	return inNetworks(trustedProxies, addr)
+}
+
+// The comma-delimited addresses or networks
+func parseNetworkList(list string, what string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range splitTrim(list, ",") {
+		if entry == "" {
+			continue
+		}
+		network := parseNetwork(entry)
+		if network == nil {
+			return nil, fmt.Errorf("invalid %s %s", what, entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func inNetworks(networks []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func clientSubnet(req *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return subnet
+			}
+		}
+	}
+	return nil
+}
+
+func removeClientSubnet(req *dns.Msg) {
+	opt := req.IsEdns0()
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if _, ok := option.(*dns.EDNS0_SUBNET); !ok {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
+
+// The client a query from a trusted proxy was sent on behalf of: the address of its client subnet
+// option (ECS), masked to the source prefix. Nothing for queries that don't carry one, that have a
+// source prefix of 0 (the client asked not to be identified), or that come from anyone else: the ECS
+// of those isn't honored, and is dropped from the query so it isn't forwarded to the recursers
+// either, which would cache subnet-specific answers for everyone.
+func proxiedClient(w dns.ResponseWriter, req *dns.Msg) string {
+	subnet := clientSubnet(req)
+	if subnet == nil {
+		return ""
+	}
+	proxy := clientAddr(w)
+	if !trustedProxy(proxy) {
+		log.WithFields(log.Fields{"client": proxy, "subnet": subnet.String()}).Debug("Ignored client subnet from an untrusted source")
+		stats.incr("untrustedClientSubnets")
+		removeClientSubnet(req)
+		return ""
+	}
+	if subnet.SourceNetmask == 0 || subnet.Address == nil {
+		return ""
+	}
+	bits := 32
+	if subnet.Family == 2 {
+		bits = 128
+	}
+	if int(subnet.SourceNetmask) > bits {
+		return ""
+	}
+	return subnet.Address.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits)).String()
+}
+
+// The address of the trusted proxy a query came through, if it was sent on behalf of another client
+func proxyAddr(w dns.ResponseWriter) string {
+	if qw, ok := w.(*queryWriter); ok && qw.client != "" {
+		return clientAddr(qw.ResponseWriter)
+	}
+	return ""
+}
+
+// Source prefix lengths of the client subnets sent to the recursers, the longest RFC 7871 recommends
+const (
+	FORWARDED_SUBNET_IPV4_PREFIX = 24
+	FORWARDED_SUBNET_IPV6_PREFIX = 56
+)
+
+// The query as sent to the recursers: with --forward-client-subnet, one with a client subnet option
+// naming the client's network, unless it carries the option of a trusted proxy already
+func forwardedQuery(req *dns.Msg, client string) *dns.Msg {
+	ip := net.ParseIP(client)
+	if !*forwardClientSubnet || ip == nil || clientSubnet(req) != nil {
+		return req
+	}
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: FORWARDED_SUBNET_IPV4_PREFIX}
+	if ip4 := ip.To4(); ip4 != nil {
+		subnet.Address = ip4.Mask(net.CIDRMask(FORWARDED_SUBNET_IPV4_PREFIX, 32))
+	} else {
+		subnet.Family, subnet.SourceNetmask = 2, FORWARDED_SUBNET_IPV6_PREFIX
+		subnet.Address = ip.Mask(net.CIDRMask(FORWARDED_SUBNET_IPV6_PREFIX, 128))
+	}
+	out := req.Copy()
+	if out.IsEdns0() == nil {
+		out.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	opt := out.IsEdns0()
+	opt.Option = append(opt.Option, subnet)
+	return out
+}
+
+// Whether the recursers tailored the response to the client subnet of the query (a scope prefix length
+// other than 0), so it must not be served to clients of other networks
+func subnetSpecific(resp *dns.Msg) bool {
+	subnet := clientSubnet(resp)
+	return subnet != nil && subnet.SourceScope > 0
+}
+
+// Takes what forwardedQuery added back out of the response to the query: the client subnet option, and
+// the OPT record for clients that didn't use EDNS0
+func restoreClientSubnet(req *dns.Msg, resp *dns.Msg) {
+	if req.IsEdns0() == nil {
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+	} else if clientSubnet(req) == nil && clientSubnet(resp) != nil {
+		removeClientSubnet(resp)
+	}
+}
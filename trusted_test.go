@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func subnetQuery(address string, netmask uint8) *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion("web.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	family := uint16(1)
+	if net.ParseIP(address).To4() == nil {
+		family = 2
+	}
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: netmask, Address: net.ParseIP(address)})
+	return req
+}
+
+func TestProxiedClient(t *testing.T) {
+	saved := *trustedProxyList
+	defer func() {
+		*trustedProxyList = saved
+		setupTrustedProxies()
+	}()
+
+	// The test writer's queries come from 10.1.1.1
+	*trustedProxyList = "10.1.0.0/16, 192.0.2.1"
+	if err := setupTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		address  string
+		netmask  uint8
+		expected string
+	}{
+		{"10.42.1.7", 32, "10.42.1.7"},
+		{"10.42.1.7", 24, "10.42.1.0"},
+		{"2001:db8::7", 56, "2001:db8::"},
+		{"10.42.1.7", 0, ""},
+	} {
+		req := subnetQuery(test.address, test.netmask)
+		qw := &queryWriter{ResponseWriter: &testWriter{}}
+		qw.client = proxiedClient(qw.ResponseWriter, req)
+		if qw.client != test.expected {
+			t.Fatalf("Expected %q for %s/%d, got %q", test.expected, test.address, test.netmask, qw.client)
+		}
+		if test.expected != "" && (clientAddr(qw) != test.expected || proxyAddr(qw) != "10.1.1.1") {
+			t.Fatalf("Expected %s via 10.1.1.1, got %s via %s", test.expected, clientAddr(qw), proxyAddr(qw))
+		}
+		if clientSubnet(req) == nil {
+			t.Fatalf("Expected the client subnet of a trusted proxy to be kept")
+		}
+	}
+
+	// Anyone else's client subnet is ignored and dropped
+	*trustedProxyList = "192.0.2.1"
+	setupTrustedProxies()
+	req := subnetQuery("10.42.1.7", 32)
+	qw := &queryWriter{ResponseWriter: &testWriter{}}
+	qw.client = proxiedClient(qw.ResponseWriter, req)
+	if qw.client != "" || clientAddr(qw) != "10.1.1.1" || proxyAddr(qw) != "" {
+		t.Fatalf("Expected the socket source, got %s", clientAddr(qw))
+	}
+	if clientSubnet(req) != nil || req.IsEdns0() == nil {
+		t.Fatalf("Expected only the client subnet option to be dropped")
+	}
+
+	*trustedProxyList = "10.1.0.0/33"
+	if err := setupTrustedProxies(); err == nil {
+		t.Fatalf("Expected an invalid network to be rejected")
+	}
+}
+
+func TestForwardedClientSubnet(t *testing.T) {
+	saved := *forwardClientSubnet
+	defer func() { *forwardClientSubnet = saved }()
+	*forwardClientSubnet = true
+
+	plain := new(dns.Msg)
+	plain.SetQuestion("www.example.com.", dns.TypeA)
+	for _, test := range []struct {
+		client   string
+		expected string
+		netmask  uint8
+	}{
+		{"10.42.1.7", "10.42.1.0", 24},
+		{"2001:db8:1:2::7", "2001:db8:1::", 56},
+	} {
+		forwarded := forwardedQuery(plain, test.client)
+		subnet := clientSubnet(forwarded)
+		if subnet == nil || subnet.Address.String() != test.expected || subnet.SourceNetmask != test.netmask {
+			t.Fatalf("Expected %s/%d for %s, got %v", test.expected, test.netmask, test.client, subnet)
+		}
+	}
+	if plain.IsEdns0() != nil {
+		t.Fatalf("Expected the client's query to be left alone")
+	}
+
+	// The client subnet of a trusted proxy is forwarded as it is
+	proxied := subnetQuery("10.42.1.7", 32)
+	if forwarded := forwardedQuery(proxied, "10.42.1.7"); forwarded != proxied {
+		t.Fatalf("Expected a query with a client subnet to be forwarded as it is")
+	}
+
+	// What was added is taken out of the response again
+	resp := new(dns.Msg)
+	resp.SetReply(forwardedQuery(plain, "10.42.1.7"))
+	resp.SetEdns0(4096, false)
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, SourceScope: 24, Address: net.ParseIP("10.42.1.0")})
+	if !subnetSpecific(resp) {
+		t.Fatalf("Expected a response with a scope to be specific to the subnet")
+	}
+	restoreClientSubnet(plain, resp)
+	if resp.IsEdns0() != nil {
+		t.Fatalf("Expected the OPT record to be dropped for a client without EDNS0")
+	}
+
+	edns := new(dns.Msg)
+	edns.SetQuestion("www.example.com.", dns.TypeA)
+	edns.SetEdns0(4096, false)
+	resp = new(dns.Msg)
+	resp.SetReply(edns)
+	resp.SetEdns0(4096, false)
+	resp.IsEdns0().Option = append(resp.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("10.42.1.0")})
+	restoreClientSubnet(edns, resp)
+	if resp.IsEdns0() == nil || clientSubnet(resp) != nil || subnetSpecific(resp) {
+		t.Fatalf("Expected only the client subnet option to be dropped")
+	}
+}
+
+func TestClientSubnetFallback(t *testing.T) {
+	saved, savedEnvironments, savedProxies, savedFallback := answers, environmentAnswers, *trustedProxyList, *clientSubnetFallback
+	defer func() {
+		answers, environmentAnswers, *trustedProxyList, *clientSubnetFallback = saved, savedEnvironments, savedProxies, savedFallback
+		setupTrustedProxies()
+	}()
+	answers = Answers{
+		DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.0.0.1"}}}},
+		"10.1.1.1":  ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.0.0.2"}}}},
+		"10.42.2.7": ClientAnswers{A: map[string]RecordA{"web.": {Answer: []string{"10.0.0.3"}}}},
+	}
+	environmentAnswers = nil
+	*trustedProxyList = "10.1.1.1"
+	setupTrustedProxies()
+
+	for _, test := range []struct {
+		fallback bool
+		client   string
+		expected string
+	}{
+		{false, "10.42.1.7", "10.0.0.1"},
+		{true, "10.42.1.7", "10.0.0.2"},
+		{true, "10.42.2.7", "10.0.0.3"},
+	} {
+		*clientSubnetFallback = test.fallback
+		clearClientSpecificCaches()
+		w := &queryWriter{ResponseWriter: &testWriter{}}
+		req := subnetQuery(test.client, 32)
+		w.client = proxiedClient(w, req)
+		route(w, req)
+		msg := w.ResponseWriter.(*testWriter).msg
+		if msg == nil || len(msg.Answer) != 1 || msg.Answer[0].(*dns.A).A.String() != test.expected {
+			t.Fatalf("Expected %s for %s (fallback %v), got %v", test.expected, test.client, test.fallback, msg)
+		}
+	}
+}
+
+func TestSubnetSpecificResponsesNotCached(t *testing.T) {
+	dns.HandleFunc("geo.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		answer := "10.9.9.9"
+		if subnet := clientSubnet(req); subnet != nil {
+			// Tailored to the subnet, as geo-aware servers do
+			answer = "10.9.9." + fmt.Sprint(subnet.Address.To4()[2])
+			m.SetEdns0(4096, false)
+			m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1,
+				SourceNetmask: subnet.SourceNetmask, SourceScope: 24, Address: subnet.Address})
+		}
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(answer),
+		}}
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("geo.test.")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	saved, savedEnvironments, savedCache, savedForward := answers, environmentAnswers, globalCache, *forwardClientSubnet
+	defer func() {
+		answers, environmentAnswers, globalCache, *forwardClientSubnet = saved, savedEnvironments, savedCache, savedForward
+	}()
+	answers = Answers{DEFAULT_KEY: ClientAnswers{Recurse: []string{conn.LocalAddr().String()}}}
+	environmentAnswers = nil
+	globalCache = cache.New(10, 600)
+	clearClientSpecificCaches()
+	*forwardClientSubnet = true
+
+	// The test writer's queries come from 10.1.1.1
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("www.geo.test.", dns.TypeA)
+		w := &testWriter{}
+		route(w, req)
+		if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].(*dns.A).A.String() != "10.9.9.1" {
+			t.Fatalf("Expected the answer for the client's subnet, got %v", w.msg)
+		}
+		if w.msg.IsEdns0() != nil {
+			t.Fatalf("Expected no OPT record for a client without EDNS0, got %v", w.msg)
+		}
+	}
+	if msg, _ := globalCache.Hit(dns.Question{Name: "www.geo.test.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, false, false, 1); msg != nil {
+		t.Fatalf("Expected the subnet-specific response not to be cached for everyone")
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// TSIG keys (RFC 8945), read from --tsig-keys, authenticate the peers of zone transfers and NOTIFY: a
+// zone with a "tsig" key is only transferred to secondaries that sign their requests with the key, and
+// its NOTIFYs are signed with it; a --secondary zone with a key signs its transfers with it and only
+// takes NOTIFYs signed with it. Any signed query is verified, answered with a signed response, and the
+// key it was signed with is that of its QueryContext. Queries whose signature doesn't check out get
+// NOTAUTH.
+const TSIG_FUDGE = 300
+
+// Bytes of the largest MAC of the supported algorithms (HMAC-SHA512)
+const TSIG_MAX_MAC_SIZE = 64
+
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    string
+}
+
+var (
+	tsigKeys map[string]tsigKey
+	// Batched UDP queries (--udp-batch) are served without verifying their signature
+	errTsigUnverified = errors.New("TSIG isn't verified on this listener")
+)
+
+var tsigAlgorithms = map[string]string{
+	"hmac-md5":    dns.HmacMD5,
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// Reads the keys of the --tsig-keys file, one "NAME ALGORITHM SECRET" line per key with a base64
+// secret; # starts a comment. Called once when parsing flags.
+func loadTsigKeys(path string) error {
+	tsigKeys = nil
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	keys := make(map[string]tsigKey)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return fmt.Errorf("line %d: expected NAME ALGORITHM SECRET", line)
+		}
+		name := tsigKeyName(fields[0])
+		if _, ok := dns.IsDomainName(name); !ok || name == "" {
+			return fmt.Errorf("line %d: invalid key name %q", line, fields[0])
+		}
+		algorithm, ok := tsigAlgorithms[strings.TrimSuffix(strings.ToLower(fields[1]), ".")]
+		if !ok {
+			return fmt.Errorf("line %d: unsupported algorithm %q", line, fields[1])
+		}
+		if _, err := base64.StdEncoding.DecodeString(fields[2]); err != nil {
+			return fmt.Errorf("line %d: invalid secret: %v", line, err)
+		}
+		if _, ok := keys[name]; ok {
+			return fmt.Errorf("line %d: duplicate key %s", line, name)
+		}
+		keys[name] = tsigKey{name: name, algorithm: algorithm, secret: fields[2]}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	tsigKeys = keys
+	log.WithFields(log.Fields{"keys": len(keys)}).Info("Loaded TSIG keys")
+	return nil
+}
+
+// Key names are compared as lower case names with the trailing dot; empty for no key
+func tsigKeyName(name string) string {
+	if name = strings.Trim(name, "."); name == "" {
+		return ""
+	}
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// The secrets by key name, as the dns library takes them; nil without keys
+func tsigSecrets() map[string]string {
+	if len(tsigKeys) == 0 {
+		return nil
+	}
+	secrets := make(map[string]string, len(tsigKeys))
+	for name, key := range tsigKeys {
+		secrets[name] = key.secret
+	}
+	return secrets
+}
+
+// Checks the signature of a signed query: the key must be one of ours and the server must have found
+// the signature valid. Unsigned queries pass without a key.
+func verifyTsig(w dns.ResponseWriter, req *dns.Msg) (string, error) {
+	signature := req.IsTsig()
+	if signature == nil {
+		return "", nil
+	}
+	name := tsigKeyName(signature.Hdr.Name)
+	key, ok := tsigKeys[name]
+	if !ok {
+		return "", dns.ErrSecret
+	}
+	if !strings.EqualFold(signature.Algorithm, key.algorithm) {
+		return "", dns.ErrKeyAlg
+	}
+	if err := w.TsigStatus(); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Signs the message with the key (the server computes the MAC when writing it)
+func signMsg(m *dns.Msg, name string) {
+	if key, ok := tsigKeys[name]; ok {
+		m.SetTsig(key.name, key.algorithm, TSIG_FUDGE, now().Unix())
+	}
+}
+
+// The key the query was signed with, empty for unsigned queries
+func requestKey(w dns.ResponseWriter) string {
+	if qw, ok := w.(*queryWriter); ok {
+		return qw.tsig
+	}
+	return ""
+}
+
+// Answers a query whose signature doesn't check out with NOTAUTH
+func refuseTsig(w dns.ResponseWriter, req *dns.Msg, err error) {
+	stats.incr("tsigFailures")
+	log.WithFields(log.Fields{"client": clientAddr(w), "key": req.IsTsig().Hdr.Name}).Warnf("Rejected query with an invalid TSIG: %v", err)
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeNotAuth)
+	w.WriteMsg(m)
+}
+
+// Whether the key names one of the --tsig-keys
+func knownTsigKey(name string) bool {
+	_, ok := tsigKeys[tsigKeyName(name)]
+	return ok
+}
+
+// Checks that the keys of the declared zones are among the --tsig-keys
+func validateTsigKeys(answers Answers) error {
+	for _, rule := range answers.ZoneRules() {
+		if rule.Tsig != "" && !knownTsigKey(rule.Tsig) {
+			return fmt.Errorf("unknown TSIG key for zone %s: %s", rule.Zone, rule.Tsig)
+		}
+	}
+	return nil
+}
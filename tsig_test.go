@@ -0,0 +1,141 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+const testTsigSecret = "c2VjcmV0IG9mIHRoZSB0cmFuc2ZlciBrZXk="
+
+func TestLoadTsigKeys(t *testing.T) {
+	defer func() { tsigKeys = nil }()
+	dir, err := ioutil.TempDir("", "tsig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+
+	ioutil.WriteFile(path, []byte("# transfers\nTransfer.Key. hmac-sha256 "+testTsigSecret+"\n\nnotify.key HMAC-SHA512 "+testTsigSecret+" # notifies\n"), 0600)
+	if err := loadTsigKeys(path); err != nil {
+		t.Fatal(err)
+	}
+	if key := tsigKeys["transfer.key."]; key.algorithm != dns.HmacSHA256 || key.secret != testTsigSecret {
+		t.Fatalf("Incorrect key %+v", key)
+	}
+	if key := tsigKeys["notify.key."]; key.algorithm != dns.HmacSHA512 {
+		t.Fatalf("Incorrect key %+v", key)
+	}
+
+	for _, invalid := range []string{
+		"transfer.key hmac-sha256\n",
+		"transfer.key hmac-sha3 " + testTsigSecret + "\n",
+		"transfer.key hmac-sha256 not-base64!\n",
+		"transfer.key hmac-sha256 " + testTsigSecret + "\nTRANSFER.KEY hmac-sha1 " + testTsigSecret + "\n",
+	} {
+		ioutil.WriteFile(path, []byte(invalid), 0600)
+		if err := loadTsigKeys(path); err == nil {
+			t.Fatalf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestTsigTransfers(t *testing.T) {
+	saved, savedEnvironments, savedVersions, savedCache := answers, environmentAnswers, zoneVersions, globalCache
+	defer func() {
+		answers, environmentAnswers, zoneVersions, globalCache = saved, savedEnvironments, savedVersions, savedCache
+		tsigKeys, secondaryZones = nil, nil
+	}()
+	globalCache = cache.New(10, 600)
+	tsigKeys = map[string]tsigKey{"transfer.key.": {name: "transfer.key.", algorithm: dns.HmacSHA256, secret: testTsigSecret}}
+	zoneVersions = &zoneTracker{versions: make(map[string][]zoneVersion)}
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Zones: []ZoneRule{{Zone: "example.internal", Ns: []string{"ns1.example.internal"}, Serial: 7, Transfer: []string{"127.0.0.0/8"}, Tsig: "Transfer.Key"}},
+		A:     map[string]RecordA{"web.example.internal.": {Answer: []string{"10.0.0.1"}}},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+	zoneVersions.Update(answers)
+	if err := validateTsigKeys(answers); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{Listener: listener, Handler: dns.HandlerFunc(handleQuery), TsigSecret: tsigSecrets()}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	primary := listener.Addr().String()
+
+	// A secondary signing with the key gets the zone, one without it is refused
+	if err := setupSecondaries("example.internal@" + primary + "/transfer.key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondaryZones[0].refresh(); err != nil {
+		t.Fatalf("Expected the signed transfer, got %v", err)
+	}
+	if web := secondaryRecords.Answers()[DEFAULT_KEY].A["web.example.internal."]; len(web.Answer) != 1 || web.Answer[0] != "10.0.0.1" {
+		t.Fatalf("Expected the transferred records, got %+v", web)
+	}
+	if err := setupSecondaries("example.internal@" + primary); err != nil {
+		t.Fatal(err)
+	}
+	if err := secondaryZones[0].refresh(); err == nil {
+		t.Fatalf("Expected the unsigned transfer to be refused")
+	}
+	if err := setupSecondaries("example.internal@" + primary + "/other.key"); err == nil {
+		t.Fatalf("Expected an unknown key to be rejected")
+	}
+
+	// Signed queries get signed responses, and NOTAUTH when signed with another secret
+	client := &dns.Client{Net: "tcp", TsigSecret: tsigSecrets()}
+	req := new(dns.Msg)
+	req.SetQuestion("web.example.internal.", dns.TypeA)
+	signMsg(req, "transfer.key.")
+	resp, _, err := client.Exchange(req, primary)
+	if err != nil || resp.Rcode != dns.RcodeSuccess || resp.IsTsig() == nil {
+		t.Fatalf("Expected a signed response, got %v %v", resp, err)
+	}
+	client.TsigSecret = map[string]string{"transfer.key.": "b3RoZXIgc2VjcmV0"}
+	signMsg(req, "transfer.key.")
+	if resp, _, err = client.Exchange(req, primary); err != nil || resp.Rcode != dns.RcodeNotAuth {
+		t.Fatalf("Expected NOTAUTH, got %v %v", resp, err)
+	}
+
+	delete(tsigKeys, "transfer.key.")
+	if err := validateTsigKeys(answers); err == nil {
+		t.Fatalf("Expected the unknown key of the zone to be rejected")
+	}
+}
+
+func TestTsigNotify(t *testing.T) {
+	defer func() { tsigKeys, secondaryZones = nil, nil }()
+	tsigKeys = map[string]tsigKey{"notify.key.": {name: "notify.key.", algorithm: dns.HmacSHA256, secret: testTsigSecret}}
+	if err := setupSecondaries("mirror.corp@127.0.0.1/notify.key"); err != nil {
+		t.Fatal(err)
+	}
+
+	notify := new(dns.Msg)
+	notify.SetNotify("mirror.corp.")
+	w := &testWriter{remote: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}}
+	answerNotify(&queryWriter{ResponseWriter: w}, notify)
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Fatalf("Expected the unsigned NOTIFY to be refused, got %v", w.msg)
+	}
+	answerNotify(&queryWriter{ResponseWriter: w, tsig: "notify.key."}, notify)
+	if w.msg.Rcode != dns.RcodeSuccess || w.msg.IsTsig() == nil {
+		t.Fatalf("Expected the signed NOTIFY to be accepted with a signed response, got %v", w.msg)
+	}
+
+	if query := newQueryContext(&queryWriter{ResponseWriter: w, tsig: "notify.key."}, DEFAULT_KEY); query.TsigName != "notify.key." {
+		t.Fatalf("Expected the key of the query, got %q", query.TsigName)
+	}
+}
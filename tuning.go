@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Applies --gomaxprocs, --gc-percent and --cpu-affinity, so the server can be sized for a small edge
+// box or a share of a big host from the configuration
+func applyTuning() error {
+	if *cpuAffinity != "" {
+		cpus, err := parseCpuList(*cpuAffinity, runtime.NumCPU())
+		if err != nil {
+			return err
+		}
+		if err := setCpuAffinity(cpus); err != nil {
+			return fmt.Errorf("failed to set the CPU affinity to %s: %v", *cpuAffinity, err)
+		}
+		// Without an explicit --gomaxprocs, run no more threads than there are CPUs to run them on
+		if *gomaxprocs == 0 {
+			runtime.GOMAXPROCS(len(cpus))
+		}
+	}
+	if *gomaxprocs > 0 {
+		runtime.GOMAXPROCS(int(*gomaxprocs))
+	}
+	if *gcPercent != 100 {
+		runtimedebug.SetGCPercent(*gcPercent)
+	}
+	log.WithFields(log.Fields{"gomaxprocs": runtime.GOMAXPROCS(0), "gcPercent": *gcPercent, "udpReaders": *udpReaders, "cpus": *cpuAffinity}).Debug("Tuning")
+	return nil
+}
+
+// Parses a CPU list like "0-3,6" of the count CPUs, numbered from 0
+func parseCpuList(list string, count int) ([]int, error) {
+	var cpus []int
+	for _, part := range splitTrim(list, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		last := first
+		if err == nil && len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || first < 0 || last < first {
+			return nil, fmt.Errorf("invalid CPU list: %s", list)
+		}
+		if last >= count {
+			return nil, fmt.Errorf("invalid CPU list: %s, CPU %d of %d CPUs", list, last, count)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("invalid CPU list: %s", list)
+	}
+	return cpus, nil
+}
+
+// Binds a UDP socket. With more than one --udp-readers, the sockets for the address share it
+// (SO_REUSEPORT) and the kernel spreads the queries over them.
+func listenUDP(network string, addr *net.UDPAddr) (*net.UDPConn, error) {
+	if *udpReaders <= 1 {
+		return net.ListenUDP(network, addr)
+	}
+	config := net.ListenConfig{Control: reusePort}
+	conn, err := config.ListenPacket(context.Background(), network, addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("multiple UDP readers are only supported on Linux")
+}
+
+func setCpuAffinity(cpus []int) error {
+	return errors.New("CPU affinity is only supported on Linux")
+}
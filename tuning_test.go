@@ -0,0 +1,18 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCpuList(t *testing.T) {
+	cpus, err := parseCpuList("0-2, 6", 8)
+	if err != nil || !reflect.DeepEqual(cpus, []int{0, 1, 2, 6}) {
+		t.Fatalf("Incorrect CPUs %v: %v", cpus, err)
+	}
+	for _, list := range []string{"", "3-1", "a", "-1", "1-b", "8", "0-4294967295"} {
+		if _, err := parseCpuList(list, 8); err == nil {
+			t.Fatalf("Expected %q to be rejected", list)
+		}
+	}
+}
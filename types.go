@@ -1,23 +1,135 @@
 package main
 
 type RecordA struct {
-	Ttl    *uint32  `json:"-"`
-	Answer []string `json:"answer"`
+	Ttl     *uint32           `json:"-"`
+	Answer  []string          `json:"answer"`
+	Weights map[string]uint32 `json:"weights,omitempty"`
+	Check   *HealthCheck      `json:"check,omitempty"`
+	Comment string            `json:"comment,omitempty"`
+	Source  string            `json:"-" yaml:"-"`
+	Expires int64             `json:"-" yaml:"expires,omitempty"`
 }
 
 type RecordCname struct {
-	Ttl    *uint32 `json:"-"`
-	Answer string  `json:"answer"`
+	Ttl     *uint32 `json:"-"`
+	Answer  string  `json:"answer"`
+	Comment string  `json:"comment,omitempty"`
+	Source  string  `json:"-" yaml:"-"`
+	Expires int64   `json:"-" yaml:"expires,omitempty"`
 }
 
 type RecordPtr struct {
-	Ttl    *uint32 `json:"-"`
-	Answer string  `json:"answer"`
+	Ttl     *uint32 `json:"-"`
+	Answer  string  `json:"answer"`
+	Comment string  `json:"comment,omitempty"`
+	Source  string  `json:"-" yaml:"-"`
+	Expires int64   `json:"-" yaml:"expires,omitempty"`
 }
 
 type RecordTxt struct {
-	Ttl    *uint32  `json:"-"`
+	Ttl     *uint32  `json:"-"`
+	Answer  []string `json:"answer"`
+	Comment string   `json:"comment,omitempty"`
+	Source  string   `json:"-" yaml:"-"`
+	Expires int64    `json:"-" yaml:"expires,omitempty"`
+}
+
+type RecordSrv struct {
+	Ttl     *uint32  `json:"-"`
+	Answer  []string `json:"answer"`
+	Comment string   `json:"comment,omitempty"`
+	Source  string   `json:"-" yaml:"-"`
+	Expires int64    `json:"-" yaml:"expires,omitempty"`
+}
+
+type HealthCheck struct {
+	Type     string `json:"type"`
+	Port     uint16 `json:"port"`
+	Path     string `json:"path,omitempty"`
+	Interval uint32 `json:"interval,omitempty"`
+	Timeout  uint32 `json:"timeout,omitempty"`
+}
+
+type TagRule struct {
+	Tag     string `json:"tag"`
+	Network string `json:"network"`
+	Suffix  string `json:"suffix"`
+	Qtype   string `json:"qtype"`
+}
+
+type RouteRule struct {
+	Suffix  string   `json:"suffix"`
+	Qtype   string   `json:"qtype"`
+	Recurse []string `json:"recurse"`
+}
+
+type SuppressRule struct {
+	Network string `json:"network"`
+	Zone    string `json:"zone"`
+}
+
+type OrderRule struct {
+	Zone  string   `json:"zone"`
+	Order []string `json:"order"`
+}
+
+type RateLimitRule struct {
+	Zone string  `json:"zone"`
+	Qps  float64 `json:"qps"`
+}
+
+type BlocklistRule struct {
+	Name    string `json:"name"`
+	Url     string `json:"url"`
+	Format  string `json:"format"`
+	Refresh uint32 `json:"refresh,omitempty"`
+	Expire  uint32 `json:"expire,omitempty"`
+	Network string `json:"network,omitempty"`
+}
+
+type PatternRule struct {
+	Match  string   `json:"match"`
+	Type   string   `json:"type"`
 	Answer []string `json:"answer"`
+	Ttl    *uint32  `json:"ttl,omitempty"`
+}
+
+type Identity struct {
+	Hostname string `json:"hostname,omitempty"`
+	Mbox     string `json:"mbox,omitempty"`
+	Nsid     string `json:"nsid,omitempty"`
+	Version  string `json:"version,omitempty"`
+}
+
+type ZoneRule struct {
+	Zone    string   `json:"zone"`
+	Ns      []string `json:"ns"`
+	Mbox    string   `json:"mbox,omitempty"`
+	Serial  uint32   `json:"serial,omitempty"`
+	Refresh uint32   `json:"refresh,omitempty"`
+	Retry   uint32   `json:"retry,omitempty"`
+	Expire  uint32   `json:"expire,omitempty"`
+	Minttl  uint32   `json:"minttl,omitempty"`
+	Ttl     *uint32  `json:"ttl,omitempty"`
+	// Networks of the secondaries that may transfer the zone, and the secondaries to notify of changes
+	Transfer []string `json:"transfer,omitempty"`
+	Notify   []string `json:"notify,omitempty"`
+	// TSIG key the secondaries must sign transfers with, which signs the NOTIFYs
+	Tsig string `json:"tsig,omitempty"`
+	// How the NSEC3 chain of the zone is made when it's signed (--dnssec)
+	Nsec3 *Nsec3Rule `json:"nsec3,omitempty"`
+}
+
+type Nsec3Rule struct {
+	// Leave the delegations to the zones declared under it out of the chain
+	OptOut     bool   `json:"optout,omitempty"`
+	Iterations uint16 `json:"iterations,omitempty"`
+}
+
+type EnvironmentRule struct {
+	Name     string `json:"name"`
+	Network  string `json:"network"`
+	Listener string `json:"listener"`
 }
 
 type ClientAnswers struct {
@@ -28,6 +140,24 @@ type ClientAnswers struct {
 	Cname         map[string]RecordCname `json:"cname"`
 	Ptr           map[string]RecordPtr   `json:"-"`
 	Txt           map[string]RecordTxt   `json:"-"`
+	Srv           map[string]RecordSrv   `json:"-"`
+	// Shorthand records of any type, expanded into the maps above when loaded
+	Records      map[string]interface{} `json:"records,omitempty" yaml:"records,omitempty"`
+	Tags         []TagRule              `json:"tags,omitempty"`
+	Suppress     []SuppressRule         `json:"suppress,omitempty"`
+	Routes       []RouteRule            `json:"routes,omitempty"`
+	Order        []OrderRule            `json:"order,omitempty"`
+	RateLimits   []RateLimitRule        `json:"ratelimits,omitempty"`
+	Blocklists   []BlocklistRule        `json:"blocklists,omitempty"`
+	Patterns     []PatternRule          `json:"patterns,omitempty"`
+	Environments []EnvironmentRule      `json:"environments,omitempty"`
+	Identity     *Identity              `json:"identity,omitempty"`
+	Zones        []ZoneRule             `json:"zones,omitempty"`
+	Host         string                 `json:"host,omitempty"`
+	Hosts        map[string]string      `json:"hosts,omitempty"`
+	Ttl          *uint32                `json:"ttl,omitempty"`
+	Recursion    *bool                  `json:"recursion,omitempty"`
+	Miss         string                 `json:"miss,omitempty"`
 }
 
 type Answers map[string]ClientAnswers
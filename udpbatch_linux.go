@@ -0,0 +1,319 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Room for the IP_PKTINFO or IPV6_PKTINFO control message, as in the dns package
+const BATCH_OOB_SIZE = 40
+
+// struct mmsghdr
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+	_   [4]byte
+}
+
+// Buffers for a batch of datagrams, with the headers pointing into them
+type batch struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	bufs  [][]byte
+	oobs  [][]byte
+	names []syscall.RawSockaddrAny
+}
+
+func newBatch(size int, bufSize int) *batch {
+	b := &batch{
+		hdrs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		bufs:  make([][]byte, size),
+		oobs:  make([][]byte, size),
+		names: make([]syscall.RawSockaddrAny, size),
+	}
+	for i := range b.hdrs {
+		b.bufs[i] = make([]byte, bufSize)
+		b.oobs[i] = make([]byte, BATCH_OOB_SIZE)
+	}
+	return b
+}
+
+// Points header i at its buffers, capped to the lengths given
+func (b *batch) prepare(i int, dataLen int, oobLen int) {
+	b.iovs[i].Base = &b.bufs[i][0]
+	b.iovs[i].SetLen(dataLen)
+	h := &b.hdrs[i].hdr
+	h.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+	h.Namelen = uint32(syscall.SizeofSockaddrAny)
+	h.Iov = &b.iovs[i]
+	h.Iovlen = 1
+	h.Control = nil
+	h.SetControllen(0)
+	if oobLen > 0 {
+		h.Control = &b.oobs[i][0]
+		h.SetControllen(oobLen)
+	}
+	b.hdrs[i].len = 0
+}
+
+// A reply waiting to be sent with the next sendmmsg
+type batchReply struct {
+	data []byte
+	oob  []byte
+	// The client's address as it came from recvmmsg
+	name    syscall.RawSockaddrAny
+	namelen uint32
+	addr    *net.UDPAddr
+}
+
+// Serves a UDP socket reading up to size queries per recvmmsg and writing the replies that are
+// ready, up to size at a time, per sendmmsg. Queries are handled like a dns.Server does.
+type batchServer struct {
+	conn     *net.UDPConn
+	raw      syscall.RawConn
+	size     int
+	replies  chan batchReply
+	stopping chan struct{}
+	drain    chan struct{}
+	drained  chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	// The read loop and the queries being handled
+	inFlight sync.WaitGroup
+}
+
+func newBatchServer(conn *net.UDPConn, size int) (*batchServer, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	// Have the kernel tell us the address each query was sent to, so the reply comes from it
+	raw.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVPKTINFO, 1)
+	})
+	return &batchServer{
+		conn:     conn,
+		raw:      raw,
+		size:     size,
+		replies:  make(chan batchReply, size*4),
+		stopping: make(chan struct{}),
+		drain:    make(chan struct{}),
+		drained:  make(chan struct{}),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+func (s *batchServer) ActivateAndServe() error {
+	s.inFlight.Add(1)
+	defer s.inFlight.Done()
+	go s.writeLoop()
+
+	b := newBatch(s.size, dns.DefaultMsgSize)
+	for {
+		for i := range b.hdrs {
+			b.prepare(i, dns.DefaultMsgSize, BATCH_OOB_SIZE)
+		}
+		var n int
+		var errno syscall.Errno
+		err := s.raw.Read(func(fd uintptr) bool {
+			r, _, e := syscall.Syscall6(SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(len(b.hdrs)), syscall.MSG_DONTWAIT, 0, 0)
+			n, errno = int(r), e
+			return errno != syscall.EAGAIN
+		})
+		select {
+		case <-s.stopping:
+			return nil
+		default:
+		}
+		if err == nil && errno != 0 {
+			err = errno
+		}
+		if err != nil {
+			if errno == syscall.EINTR {
+				continue
+			}
+			return err
+		}
+
+		for i := 0; i < n; i++ {
+			addr := sockaddrToUDP(&b.names[i])
+			if addr == nil || b.hdrs[i].len == 0 {
+				continue
+			}
+			w := &batchWriter{server: s, name: b.names[i], namelen: b.hdrs[i].hdr.Namelen, addr: addr}
+			w.oob = append([]byte(nil), b.oobs[i][:b.hdrs[i].hdr.Controllen]...)
+			m := append([]byte(nil), b.bufs[i][:b.hdrs[i].len]...)
+			s.inFlight.Add(1)
+			go s.serve(w, m)
+		}
+	}
+}
+
+func (s *batchServer) serve(w *batchWriter, m []byte) {
+	defer s.inFlight.Done()
+
+	req := new(dns.Msg)
+	if err := req.Unpack(m); err != nil {
+		x := new(dns.Msg)
+		x.SetRcodeFormatError(req)
+		w.WriteMsg(x)
+		return
+	}
+	if req.Response {
+		return
+	}
+	dns.DefaultServeMux.ServeDNS(w, req)
+}
+
+// Sends the queued replies, as many per sendmmsg as are waiting, until told to drain: then it sends
+// whatever is left in the queue and returns
+func (s *batchServer) writeLoop() {
+	b := newBatch(s.size, 0)
+	pending := make([]batchReply, 0, s.size)
+	drain, draining := s.drain, false
+	for {
+		if draining && len(s.replies) == 0 {
+			close(s.drained)
+			return
+		}
+		select {
+		case reply := <-s.replies:
+			pending = append(pending[:0], reply)
+		case <-drain:
+			draining, drain = true, nil
+			continue
+		}
+	more:
+		for len(pending) < s.size {
+			select {
+			case reply := <-s.replies:
+				pending = append(pending, reply)
+			default:
+				break more
+			}
+		}
+		s.send(b, pending)
+	}
+}
+
+func (s *batchServer) send(b *batch, replies []batchReply) {
+	for i, reply := range replies {
+		b.bufs[i] = reply.data
+		b.prepare(i, len(reply.data), 0)
+		if len(reply.oob) > 0 {
+			b.hdrs[i].hdr.Control = &reply.oob[0]
+			b.hdrs[i].hdr.SetControllen(len(reply.oob))
+		}
+		b.names[i] = reply.name
+		b.hdrs[i].hdr.Namelen = reply.namelen
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(time.Duration(*writeTimeout) * time.Second))
+	for sent := 0; sent < len(replies); {
+		var n int
+		var errno syscall.Errno
+		err := s.raw.Write(func(fd uintptr) bool {
+			r, _, e := syscall.Syscall6(SYS_SENDMMSG, fd, uintptr(unsafe.Pointer(&b.hdrs[sent])), uintptr(len(replies)-sent), syscall.MSG_DONTWAIT, 0, 0)
+			n, errno = int(r), e
+			return errno != syscall.EAGAIN
+		})
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			stats.incr("writeTimeouts")
+			return
+		}
+		if err != nil {
+			return
+		}
+		if errno != 0 {
+			if errno == syscall.EINTR {
+				continue
+			}
+			// Skip the datagram the kernel refused (e.g. an unreachable client) and carry on
+			log.WithFields(log.Fields{"client": replies[sent].addr}).Debug("Failed to send reply: ", errno)
+			n = 1
+		}
+		sent += n
+	}
+}
+
+// Stops reading, waits for the queries being handled to be answered, sends the replies still queued
+// and closes the socket. Writes only fail once all of that is done.
+func (s *batchServer) Shutdown() error {
+	stopped := false
+	s.stopOnce.Do(func() {
+		stopped = true
+		close(s.stopping)
+		s.conn.SetReadDeadline(time.Now())
+		s.inFlight.Wait()
+		close(s.drain)
+		<-s.drained
+		close(s.done)
+	})
+	if !stopped {
+		return errors.New("server already shut down")
+	}
+	return s.conn.Close()
+}
+
+// The ResponseWriter of queries served by a batchServer
+type batchWriter struct {
+	server  *batchServer
+	oob     []byte
+	name    syscall.RawSockaddrAny
+	namelen uint32
+	addr    *net.UDPAddr
+}
+
+func (w *batchWriter) LocalAddr() net.Addr  { return w.server.conn.LocalAddr() }
+func (w *batchWriter) RemoteAddr() net.Addr { return w.addr }
+func (w *batchWriter) Close() error         { return nil }
+func (w *batchWriter) TsigStatus() error    { return errTsigUnverified }
+func (w *batchWriter) TsigTimersOnly(bool)  {}
+func (w *batchWriter) Hijack()              {}
+
+func (w *batchWriter) WriteMsg(m *dns.Msg) error {
+	data, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (w *batchWriter) Write(data []byte) (int, error) {
+	select {
+	case w.server.replies <- batchReply{data: data, oob: w.oob, name: w.name, namelen: w.namelen, addr: w.addr}:
+		return len(data), nil
+	case <-w.server.done:
+		return 0, errors.New("server shut down")
+	}
+}
+
+func sockaddrToUDP(rsa *syscall.RawSockaddrAny) *net.UDPAddr {
+	switch rsa.Addr.Family {
+	case syscall.AF_INET:
+		sa := (*syscall.RawSockaddrInet4)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		return &net.UDPAddr{IP: net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3]), Port: int(port[0])<<8 | int(port[1])}
+	case syscall.AF_INET6:
+		sa := (*syscall.RawSockaddrInet6)(unsafe.Pointer(rsa))
+		port := (*[2]byte)(unsafe.Pointer(&sa.Port))
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, sa.Addr[:])
+		return &net.UDPAddr{IP: ip, Port: int(port[0])<<8 | int(port[1])}
+	}
+	return nil
+}
@@ -0,0 +1,7 @@
+package main
+
+// Not defined by the syscall package for amd64
+const (
+	SYS_RECVMMSG = 299
+	SYS_SENDMMSG = 307
+)
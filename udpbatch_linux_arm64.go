@@ -0,0 +1,6 @@
+package main
+
+const (
+	SYS_RECVMMSG = 243
+	SYS_SENDMMSG = 269
+)
@@ -0,0 +1,117 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestBatchServer(t *testing.T) {
+	dns.HandleFunc("batch.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+			Txt: []string{w.RemoteAddr().String()},
+		}}
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("batch.test.")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newBatchServer(conn, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ActivateAndServe()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 32)
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(fmt.Sprintf("q%d.batch.test.", i), dns.TypeTXT)
+			resp, _, err := new(dns.Client).Exchange(req, conn.LocalAddr().String())
+			if err == nil && (len(resp.Answer) != 1 || resp.Answer[0].Header().Name != req.Question[0].Name) {
+				err = fmt.Errorf("unexpected response %v", resp)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Query failed: %v", err)
+	}
+
+	if err := server.Shutdown(); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	if err := server.Shutdown(); err == nil {
+		t.Fatalf("Expected the second shutdown to fail")
+	}
+}
+
+func TestBatchServerShutdownAnswersInFlight(t *testing.T) {
+	handling := make(chan struct{}, 16)
+	dns.HandleFunc("slow.batch.test.", func(w dns.ResponseWriter, req *dns.Msg) {
+		handling <- struct{}{}
+		time.Sleep(100 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+	defer dns.HandleRemove("slow.batch.test.")
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := newBatchServer(conn, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ActivateAndServe()
+
+	const queries = 16
+	var wg sync.WaitGroup
+	errs := make(chan error, queries)
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion(fmt.Sprintf("q%d.slow.batch.test.", i), dns.TypeA)
+			if _, _, err := (&dns.Client{ReadTimeout: 2 * time.Second}).Exchange(req, conn.LocalAddr().String()); err != nil {
+				errs <- err
+			}
+		}(i)
+	}
+	// Shut down with every query read and still being handled
+	for i := 0; i < queries; i++ {
+		<-handling
+	}
+	if err := server.Shutdown(); err != nil {
+		t.Fatalf("Failed to shut down: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Expected every query in flight to be answered, got %v", err)
+	}
+}
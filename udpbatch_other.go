@@ -0,0 +1,19 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// Batched UDP I/O needs recvmmsg/sendmmsg, which we only use on Linux (amd64 and arm64)
+type batchServer struct{}
+
+func newBatchServer(conn *net.UDPConn, size int) (*batchServer, error) {
+	return nil, errors.New("--udp-batch is only supported on Linux (amd64 and arm64)")
+}
+
+func (s *batchServer) ActivateAndServe() error { return nil }
+func (s *batchServer) Shutdown() error         { return nil }
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Placeholders in header values replaced for every request to a DNS over HTTPS recurser, so a
+// gateway can trace each query, e.g. "traceparent: 00-{trace-id}-{span-id}-01"
+const (
+	HEADER_TRACE_ID = "{trace-id}"
+	HEADER_SPAN_ID  = "{span-id}"
+)
+
+// An HTTP header added to the requests to DNS over HTTPS recursers (--upstream-doh-headers), for
+// gateways that want an auth token or trace IDs. Scoped to the recurser with the URL, if given.
+type upstreamHeader struct {
+	upstream string
+	name     string
+	value    string
+}
+
+var upstreamHeaders []upstreamHeader
+
+// Reads a file of "[URL] Name: value" lines (# comment lines), kept out of the command line as the
+// values are often credentials. Headers without the URL of a recurser apply to all of them.
+func loadUpstreamHeaders(path string) error {
+	upstreamHeaders = nil
+	if path == "" {
+		return nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var headers []upstreamHeader
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		header := upstreamHeader{}
+		if strings.HasPrefix(text, "https://") {
+			fields := strings.SplitN(text, " ", 2)
+			if len(fields) != 2 {
+				return fmt.Errorf("line %d: expected a header after the URL", line)
+			}
+			upstream, err := canonicalDohRecurser(fields[0])
+			if err != nil {
+				return fmt.Errorf("line %d: %v", line, err)
+			}
+			header.upstream, text = upstream, strings.TrimSpace(fields[1])
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 || !validHeaderName(strings.TrimSpace(parts[0])) {
+			return fmt.Errorf("line %d: expected [URL] Name: value", line)
+		}
+		header.name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(parts[0]))
+		header.value = strings.TrimSpace(parts[1])
+		headers = append(headers, header)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	upstreamHeaders = headers
+	log.WithFields(log.Fields{"headers": len(headers)}).Info("Loaded upstream headers")
+	return nil
+}
+
+// Headers only ever reach DoH recursers, so the file is rejected at startup rather than quietly
+// doing nothing when none is configured, or when a header is scoped to a URL that isn't one of them
+func checkUpstreamHeaders(recursers []string) error {
+	if len(upstreamHeaders) == 0 {
+		return nil
+	}
+	doh := make(map[string]bool)
+	for _, resolver := range recursers {
+		if isDohRecurser(resolver) {
+			doh[resolver] = true
+		}
+	}
+	if len(doh) == 0 {
+		return fmt.Errorf("no DNS over HTTPS recurser is configured")
+	}
+	for _, header := range upstreamHeaders {
+		if header.upstream != "" && !doh[header.upstream] {
+			return fmt.Errorf("%s isn't a configured DNS over HTTPS recurser", header.upstream)
+		}
+	}
+	return nil
+}
+
+// Header names are HTTP tokens
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// Adds the headers for the recurser to a request to it, with fresh trace and span IDs
+func setUpstreamHeaders(r *http.Request, upstream string) {
+	var replacer *strings.Replacer
+	for _, header := range upstreamHeaders {
+		if header.upstream != "" && header.upstream != upstream {
+			continue
+		}
+		value := header.value
+		if strings.Contains(value, "{") {
+			if replacer == nil {
+				replacer = strings.NewReplacer(
+					HEADER_TRACE_ID, fmt.Sprintf("%016x%016x", random.Uint64(), random.Uint64()),
+					HEADER_SPAN_ID, fmt.Sprintf("%016x", random.Uint64()))
+			}
+			value = replacer.Replace(value)
+		}
+		r.Header.Add(header.name, value)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestUpstreamHeaders(t *testing.T) {
+	defer func() { upstreamHeaders = nil }()
+	dir, err := ioutil.TempDir("", "headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "headers")
+
+	ioutil.WriteFile(path, []byte(`# Tracing for every recurser
+traceparent: 00-{trace-id}-{span-id}-01
+https://doh.corp.internal/dns-query authorization: Bearer s3cr#t
+`), 0600)
+	if err := loadUpstreamHeaders(path); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(upstream string) *http.Request {
+		r, _ := http.NewRequest("POST", upstream, nil)
+		setUpstreamHeaders(r, upstream)
+		return r
+	}
+	r := request("https://doh.corp.internal/dns-query")
+	if r.Header.Get("Authorization") != "Bearer s3cr#t" {
+		t.Fatalf("Expected the gateway's token, got %v", r.Header)
+	}
+	traceparent := regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`)
+	first := r.Header.Get("Traceparent")
+	if !traceparent.MatchString(first) {
+		t.Fatalf("Expected a trace parent, got %q", first)
+	}
+	r = request("https://dns.example.com/dns-query")
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Traceparent") == first || !traceparent.MatchString(r.Header.Get("Traceparent")) {
+		t.Fatalf("Expected a new trace and no token for another recurser, got %v", r.Header)
+	}
+
+	for _, data := range []string{"no header", "bad name: x", "https://doh.corp.internal/dns-query"} {
+		ioutil.WriteFile(path, []byte(data), 0600)
+		if err := loadUpstreamHeaders(path); err == nil {
+			t.Fatalf("Expected %q to be rejected", data)
+		}
+	}
+}
+
+func TestCheckUpstreamHeaders(t *testing.T) {
+	defer func() { upstreamHeaders = nil }()
+	upstreamHeaders = nil
+	if err := checkUpstreamHeaders([]string{"8.8.8.8:53"}); err != nil {
+		t.Fatalf("Expected no headers to need no DoH recurser, got %v", err)
+	}
+
+	upstreamHeaders = []upstreamHeader{{name: "Traceparent", value: "00-{trace-id}-{span-id}-01"}}
+	if err := checkUpstreamHeaders([]string{"8.8.8.8:53", "tls://1.1.1.1:853"}); err == nil {
+		t.Fatalf("Expected headers without a DoH recurser to be rejected")
+	}
+	if err := checkUpstreamHeaders([]string{"8.8.8.8:53", "https://dns.example.com/dns-query"}); err != nil {
+		t.Fatalf("Expected headers for the DoH recurser, got %v", err)
+	}
+
+	upstreamHeaders = append(upstreamHeaders, upstreamHeader{upstream: "https://doh.corp.internal/dns-query", name: "Authorization", value: "Bearer s3cr#t"})
+	if err := checkUpstreamHeaders([]string{"https://dns.example.com/dns-query"}); err == nil {
+		t.Fatalf("Expected a header for a recurser that isn't configured to be rejected")
+	}
+	if err := checkUpstreamHeaders([]string{"https://dns.example.com/dns-query", "https://doh.corp.internal/dns-query"}); err != nil {
+		t.Fatalf("Expected the scoped header to be accepted, got %v", err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Logger for queries forwarded to recursers, kept apart from the client-facing logs. Nil unless
+// --upstream-log is set.
+var upstreamLog *log.Logger
+
+func openUpstreamLog(path string) error {
+	logger := log.New()
+	if path != "-" {
+		output, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		logger.Out = output
+	}
+	logger.Formatter = &log.TextFormatter{DisableColors: true}
+	upstreamLog = logger
+	return nil
+}
+
+// logUpstream writes one audit line per query forwarded to a recurser.
+func logUpstream(req *dns.Msg, resolver string, transport string, resp *dns.Msg, err error, elapsed time.Duration) {
+	if upstreamLog == nil {
+		return
+	}
+
+	fields := log.Fields{
+		"upstream": resolver,
+		"proto":    transport,
+		"duration": elapsed.String(),
+	}
+	if len(req.Question) > 0 {
+		fields["question"] = strings.ToLower(req.Question[0].Name)
+		fields["type"] = dns.Type(req.Question[0].Qtype).String()
+	}
+	if resp != nil && err == nil {
+		fields["rcode"] = dns.RcodeToString[resp.Rcode]
+		fields["answers"] = len(resp.Answer)
+	} else {
+		fields["rcode"] = "none"
+		fields["error"] = err
+	}
+
+	upstreamLog.WithFields(fields).Info("Upstream query")
+}
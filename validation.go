@@ -0,0 +1,590 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// DNSSEC validation of recursed responses (--dnssec-validate): queries go to the recursers with the DO
+// and CD bits, so they hand over signatures and bogus data alike, and every signed RRset of a response
+// is verified with the DNSKEYs of its signer, themselves authenticated by the DS of the parent zone up
+// to a trust anchor (the root zone's keys unless --dnssec-trust-anchors). A response whose RRsets all
+// verify, negative ones with the NSEC or NSEC3 records proving the denial, is secure and gets AD.
+// Unsigned records are only insecure below a delegation the parent's signed denial shows to have no
+// DS (or outside the trust anchors); anywhere else they are bogus, as are responses that fail to
+// verify, and with --dnssec-fail-closed answered with SERVFAIL unless the client set CD.
+//
+// Whether or not responses are validated, only clients that set DO get DNSSEC records and only those
+// that set DO or AD get the AD bit (RFC 6840, section 5.8).
+const (
+	DNSSEC_SECURE   = "secure"
+	DNSSEC_INSECURE = "insecure"
+	DNSSEC_BOGUS    = "bogus"
+
+	// How far up the chain of trust goes before giving up
+	DNSSEC_MAX_CHAIN = 16
+	// How long authenticated keys are trusted at most, and how long a zone whose keys failed to
+	// authenticate is left alone
+	DNSSEC_KEY_TTL     = time.Hour
+	DNSSEC_FAILURE_TTL = 30 * time.Second
+)
+
+// The DS records of the root zone's key signing keys (KSK-2017 and KSK-2024)
+var rootTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Records without signatures at or below a delegation proven to have no DS
+var errInsecure = errors.New("insecure")
+
+type bogusError struct {
+	reason string
+}
+
+func (e *bogusError) Error() string {
+	return e.reason
+}
+
+func bogus(format string, args ...interface{}) error {
+	return &bogusError{fmt.Sprintf(format, args...)}
+}
+
+type zoneKeys struct {
+	keys    []*dns.DNSKEY
+	err     error
+	expires time.Time
+}
+
+// The DS RRset of a name, or why it has none
+type delegation struct {
+	ds      []dns.RR
+	err     error
+	expires time.Time
+}
+
+type dnssecValidator struct {
+	sync.Mutex
+	// DS or DNSKEY records by zone
+	anchors     map[string][]dns.RR
+	keys        map[string]zoneKeys
+	delegations map[string]delegation
+	// Sends the validator's own queries, replaced by tests
+	resolve func(req *dns.Msg, resolvers []string) (*dns.Msg, error)
+}
+
+var validator *dnssecValidator
+
+// Sets up validation with the trust anchors of the file (one DS or DNSKEY record per line), or of
+// the root zone for no file. Called once when parsing flags.
+func setupValidation(anchorsFile string) error {
+	lines := rootTrustAnchors
+	if anchorsFile != "" {
+		data, err := ioutil.ReadFile(anchorsFile)
+		if err != nil {
+			return err
+		}
+		lines = strings.Split(string(data), "\n")
+	}
+	anchors := make(map[string][]dns.RR)
+	for i, line := range lines {
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		record, err := dns.NewRR(line)
+		if err != nil {
+			return fmt.Errorf("trust anchor on line %d: %v", i+1, err)
+		}
+		switch record.(type) {
+		case *dns.DS, *dns.DNSKEY:
+		default:
+			return fmt.Errorf("trust anchor on line %d isn't a DS or DNSKEY record", i+1)
+		}
+		zone := strings.ToLower(record.Header().Name)
+		anchors[zone] = append(anchors[zone], record)
+	}
+	if len(anchors) == 0 {
+		return fmt.Errorf("no trust anchors")
+	}
+	validator = &dnssecValidator{anchors: anchors, keys: make(map[string]zoneKeys), delegations: make(map[string]delegation), resolve: ResolveTryAll}
+	return nil
+}
+
+// The query as sent to the recursers when validating: with DO for the signatures, and CD so bogus
+// data comes back to be found bogus here rather than as a SERVFAIL
+func validatingQuery(req *dns.Msg) *dns.Msg {
+	out := req.Copy()
+	if o := out.IsEdns0(); o != nil {
+		o.SetDo()
+	} else {
+		out.SetEdns0(dns.DefaultMsgSize, true)
+	}
+	out.CheckingDisabled = true
+	return out
+}
+
+// Validates the response, setting AD when it is secure. Returns the outcome (DNSSEC_*) and, for
+// bogus responses, why.
+func (v *dnssecValidator) Validate(msg *dns.Msg, resolvers []string) (string, error) {
+	msg.AuthenticatedData = false
+	secure := true
+	proofs := make(map[string]*denialProof)
+	answerRRsets := splitRRsets(msg.Answer)
+	for i, section := range [][]*signedRRset{answerRRsets, splitRRsets(msg.Ns)} {
+		answer := i == 0
+		for _, rrset := range section {
+			header := rrset.records[0].Header()
+			if len(rrset.sigs) == 0 {
+				// Delegations in the authority section aren't signed, nor are CNAMEs synthesized from a DNAME
+				if (!answer && header.Rrtype == dns.TypeNS) || synthesizedCname(rrset, answerRRsets) {
+					continue
+				}
+				if err := v.unsigned(header.Name, resolvers); err != errInsecure {
+					return DNSSEC_BOGUS, err
+				}
+				secure = false
+				continue
+			}
+			if err := v.verify(rrset, resolvers); err == errInsecure {
+				secure = false
+				continue
+			} else if err != nil {
+				return DNSSEC_BOGUS, err
+			}
+			if !answer && (header.Rrtype == dns.TypeNSEC || header.Rrtype == dns.TypeNSEC3) {
+				zone := strings.ToLower(rrset.sigs[0].SignerName)
+				if proofs[zone] == nil {
+					proofs[zone] = &denialProof{zone: zone}
+				}
+				proofs[zone].add(rrset.records)
+			}
+		}
+	}
+
+	if name, qtype, negative := deniedName(msg); negative {
+		// The proof of the zone closest to the name
+		var proof *denialProof
+		for zone, p := range proofs {
+			if dns.IsSubDomain(zone, name) && (proof == nil || dns.CountLabel(zone) > dns.CountLabel(proof.zone)) {
+				proof = p
+			}
+		}
+		if proof == nil || proof.empty() {
+			// No denial, only fine for a name of an insecure zone
+			if err := v.unsigned(name, resolvers); err != errInsecure {
+				return DNSSEC_BOGUS, err
+			}
+			secure = false
+		} else if err := proof.prove(name, qtype, msg.Rcode == dns.RcodeNameError); err == errInsecure {
+			secure = false
+		} else if err != nil {
+			return DNSSEC_BOGUS, err
+		}
+	} else if len(msg.Answer) == 0 {
+		secure = false
+	}
+	if !secure {
+		return DNSSEC_INSECURE, nil
+	}
+	msg.AuthenticatedData = true
+	return DNSSEC_SECURE, nil
+}
+
+// For an NXDOMAIN or NODATA response, the name (at the end of the CNAME chain of the answer) and type
+// whose absence it has to prove
+func deniedName(msg *dns.Msg) (string, uint16, bool) {
+	if len(msg.Question) == 0 || (msg.Rcode != dns.RcodeSuccess && msg.Rcode != dns.RcodeNameError) {
+		return "", 0, false
+	}
+	name, qtype := strings.ToLower(msg.Question[0].Name), msg.Question[0].Qtype
+	for i := 0; i < DNSSEC_MAX_CHAIN; i++ {
+		target := ""
+		for _, record := range msg.Answer {
+			header := record.Header()
+			if !strings.EqualFold(header.Name, name) {
+				continue
+			}
+			if header.Rrtype == qtype || qtype == dns.TypeANY {
+				return "", 0, false
+			}
+			if cname, ok := record.(*dns.CNAME); ok {
+				target = strings.ToLower(cname.Target)
+			}
+		}
+		if target == "" {
+			break
+		}
+		name = target
+	}
+	return name, qtype, true
+}
+
+// Whether the RRset is a CNAME below a signed DNAME of the answer, which stands for it (RFC 4035,
+// section 3.2.3)
+func synthesizedCname(rrset *signedRRset, answer []*signedRRset) bool {
+	if rrset.records[0].Header().Rrtype != dns.TypeCNAME {
+		return false
+	}
+	owner := strings.ToLower(rrset.records[0].Header().Name)
+	for _, dname := range answer {
+		header := dname.records[0].Header()
+		if header.Rrtype == dns.TypeDNAME && len(dname.sigs) > 0 && !strings.EqualFold(header.Name, owner) && dns.IsSubDomain(strings.ToLower(header.Name), owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// Proves that records of the name may come without signatures (errInsecure): the name is at or below a
+// delegation without DS. In a signed zone, unsigned records are bogus, as their signatures may well
+// have been stripped on the way.
+func (v *dnssecValidator) unsigned(name string, resolvers []string) error {
+	name = strings.ToLower(dns.Fqdn(name))
+	if _, err := v.delegationSigners(name, resolvers, 0); err != nil {
+		return err
+	}
+	return bogus("%s unsigned at the apex of a signed zone", name)
+}
+
+type signedRRset struct {
+	records []dns.RR
+	sigs    []*dns.RRSIG
+}
+
+// The RRsets of the section with the signatures covering them
+func splitRRsets(section []dns.RR) []*signedRRset {
+	var order []string
+	rrsets := make(map[string]*signedRRset)
+	get := func(name string, rrtype uint16) *signedRRset {
+		key := strings.ToLower(name) + " " + dns.Type(rrtype).String()
+		rrset, ok := rrsets[key]
+		if !ok {
+			rrset = &signedRRset{}
+			rrsets[key] = rrset
+			order = append(order, key)
+		}
+		return rrset
+	}
+	for _, record := range section {
+		switch record := record.(type) {
+		case *dns.RRSIG:
+			rrset := get(record.Hdr.Name, record.TypeCovered)
+			rrset.sigs = append(rrset.sigs, record)
+		case *dns.OPT:
+		default:
+			rrset := get(record.Header().Name, record.Header().Rrtype)
+			rrset.records = append(rrset.records, record)
+		}
+	}
+	var out []*signedRRset
+	for _, key := range order {
+		// Signatures of records that aren't there prove nothing
+		if len(rrsets[key].records) > 0 {
+			out = append(out, rrsets[key])
+		}
+	}
+	return out
+}
+
+// Verifies the RRset with the authenticated keys of its signer
+func (v *dnssecValidator) verify(rrset *signedRRset, resolvers []string) error {
+	owner := rrset.records[0].Header().Name
+	signer := strings.ToLower(rrset.sigs[0].SignerName)
+	if !dns.IsSubDomain(signer, owner) {
+		return bogus("%s signed by %s, which isn't its zone", owner, signer)
+	}
+	keys, err := v.zoneKeys(signer, resolvers, 0)
+	if err != nil {
+		return err
+	}
+	return verifyRRset(rrset.records, rrset.sigs, keys)
+}
+
+// Whether one of the signatures, currently valid, verifies the RRset with one of the keys
+func verifyRRset(records []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) error {
+	owner := records[0].Header().Name
+	rrtype := dns.Type(records[0].Header().Rrtype)
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now()) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() == sig.KeyTag && key.Algorithm == sig.Algorithm && sig.Verify(key, records) == nil {
+				return nil
+			}
+		}
+	}
+	return bogus("no valid signature of %s %s", owner, rrtype)
+}
+
+// The DNSKEYs of the zone, authenticated by a trust anchor or by the zone's DS in its parent
+func (v *dnssecValidator) zoneKeys(zone string, resolvers []string, depth int) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	v.Lock()
+	cached, ok := v.keys[zone]
+	v.Unlock()
+	if ok && now().Before(cached.expires) {
+		return cached.keys, cached.err
+	}
+
+	keys, ttl, err := v.authenticateKeys(zone, resolvers, depth)
+	if err != nil {
+		ttl = DNSSEC_FAILURE_TTL
+		log.WithFields(log.Fields{"zone": zone}).Debugf("Failed to authenticate DNSKEYs: %v", err)
+	}
+	v.Lock()
+	v.keys[zone] = zoneKeys{keys: keys, err: err, expires: now().Add(ttl)}
+	v.Unlock()
+	return keys, err
+}
+
+func (v *dnssecValidator) authenticateKeys(zone string, resolvers []string, depth int) ([]*dns.DNSKEY, time.Duration, error) {
+	if depth > DNSSEC_MAX_CHAIN {
+		return nil, 0, bogus("chain of trust of %s too long", zone)
+	}
+	// The keys the trust anchors or the parent's DS vouch for
+	anchors, err := v.delegationSigners(zone, resolvers, depth)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := v.query(zone, dns.TypeDNSKEY, resolvers)
+	if err != nil {
+		return nil, 0, bogus("no DNSKEY for %s: %v", zone, err)
+	}
+	var dnskeys []*dns.DNSKEY
+	var records []dns.RR
+	var sigs []*dns.RRSIG
+	ttl := DNSSEC_KEY_TTL
+	for _, rrset := range splitRRsets(resp.Answer) {
+		if rrset.records[0].Header().Rrtype != dns.TypeDNSKEY || !strings.EqualFold(rrset.records[0].Header().Name, zone) {
+			continue
+		}
+		for _, record := range rrset.records {
+			dnskeys = append(dnskeys, record.(*dns.DNSKEY))
+			if d := time.Duration(record.Header().Ttl) * time.Second; d < ttl {
+				ttl = d
+			}
+		}
+		records, sigs = rrset.records, rrset.sigs
+	}
+	if len(dnskeys) == 0 {
+		return nil, 0, bogus("no DNSKEY for %s", zone)
+	}
+
+	var trusted []*dns.DNSKEY
+	for _, key := range dnskeys {
+		if matchesAnchor(key, anchors) {
+			trusted = append(trusted, key)
+		}
+	}
+	if len(trusted) == 0 {
+		return nil, 0, bogus("no DNSKEY of %s matches its DS", zone)
+	}
+	if err := verifyRRset(records, sigs, trusted); err != nil {
+		return nil, 0, err
+	}
+	return dnskeys, ttl, nil
+}
+
+// The trust anchors of the name, or its DS RRset authenticated in the parent zone. errInsecure when
+// it's proven to have none: the parent's signed NSEC or NSEC3 records show a delegation without DS,
+// the parent is itself insecure, or no trust anchor is above the name. Anything else is bogus, the
+// proof that the name isn't a delegation at all included.
+func (v *dnssecValidator) delegationSigners(name string, resolvers []string, depth int) ([]dns.RR, error) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if anchors, ok := v.anchors[name]; ok {
+		return anchors, nil
+	}
+	if v.closestAnchor(name) == "" {
+		return nil, errInsecure
+	}
+	v.Lock()
+	cached, ok := v.delegations[name]
+	v.Unlock()
+	if ok && now().Before(cached.expires) {
+		return cached.ds, cached.err
+	}
+
+	ds, err := v.findDelegationSigners(name, resolvers, depth)
+	ttl := DNSSEC_KEY_TTL
+	if err != nil && err != errInsecure {
+		ttl = DNSSEC_FAILURE_TTL
+		log.WithFields(log.Fields{"name": name}).Debugf("Failed to authenticate DS: %v", err)
+	}
+	v.Lock()
+	v.delegations[name] = delegation{ds: ds, err: err, expires: now().Add(ttl)}
+	v.Unlock()
+	return ds, err
+}
+
+func (v *dnssecValidator) findDelegationSigners(name string, resolvers []string, depth int) ([]dns.RR, error) {
+	if depth > DNSSEC_MAX_CHAIN {
+		return nil, bogus("chain of trust of %s too long", name)
+	}
+	resp, err := v.query(name, dns.TypeDS, resolvers)
+	if err != nil {
+		return nil, bogus("no DS for %s: %v", name, err)
+	}
+	for _, rrset := range splitRRsets(resp.Answer) {
+		if rrset.records[0].Header().Rrtype != dns.TypeDS || !strings.EqualFold(rrset.records[0].Header().Name, name) {
+			continue
+		}
+		if len(rrset.sigs) == 0 {
+			return nil, v.insecureParent(name, resp, resolvers, depth)
+		}
+		parent := strings.ToLower(rrset.sigs[0].SignerName)
+		if parent == name || !dns.IsSubDomain(parent, name) {
+			return nil, bogus("DS of %s signed by %s, which isn't its parent", name, parent)
+		}
+		keys, err := v.zoneKeys(parent, resolvers, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyRRset(rrset.records, rrset.sigs, keys); err != nil {
+			return nil, err
+		}
+		return rrset.records, nil
+	}
+
+	// No DS: the parent's NSEC or NSEC3 records have to prove it
+	var proof *denialProof
+	for _, rrset := range splitRRsets(resp.Ns) {
+		rrtype := rrset.records[0].Header().Rrtype
+		if (rrtype != dns.TypeNSEC && rrtype != dns.TypeNSEC3) || len(rrset.sigs) == 0 {
+			continue
+		}
+		parent := strings.ToLower(rrset.sigs[0].SignerName)
+		if parent == name || !dns.IsSubDomain(parent, name) || (proof != nil && proof.zone != parent) {
+			continue
+		}
+		keys, err := v.zoneKeys(parent, resolvers, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if err := verifyRRset(rrset.records, rrset.sigs, keys); err != nil {
+			return nil, err
+		}
+		if proof == nil {
+			proof = &denialProof{zone: parent}
+		}
+		proof.add(rrset.records)
+	}
+	if proof == nil || proof.empty() {
+		return nil, v.insecureParent(name, resp, resolvers, depth)
+	}
+	if err := proof.prove(name, dns.TypeDS, resp.Rcode == dns.RcodeNameError); err != nil {
+		// errInsecure for a delegation the NSEC3 chain opted out of
+		return nil, err
+	}
+	if proof.delegation(name) {
+		return nil, errInsecure
+	}
+	return nil, bogus("%s is in the signed zone %s", name, proof.zone)
+}
+
+// An unsigned DS response (or denial) is only fine from an insecure zone: the one of its SOA record
+// if that's above the name (and the closest trust anchor), else the parent name's
+func (v *dnssecValidator) insecureParent(name string, resp *dns.Msg, resolvers []string, depth int) error {
+	parent := parentName(name)
+	if parent == "" {
+		return bogus("unsigned DS response for %s", name)
+	}
+	anchor := v.closestAnchor(name)
+	for _, record := range resp.Ns {
+		zone := strings.ToLower(record.Header().Name)
+		if _, ok := record.(*dns.SOA); ok && zone != name && dns.IsSubDomain(zone, name) && dns.IsSubDomain(anchor, zone) {
+			parent = zone
+		}
+	}
+	if _, err := v.delegationSigners(parent, resolvers, depth+1); err != nil {
+		return err
+	}
+	return bogus("unsigned DS response for %s below the signed zone %s", name, parent)
+}
+
+// The deepest trust anchor at or above the name, "" for none
+func (v *dnssecValidator) closestAnchor(name string) string {
+	closest := ""
+	for zone := range v.anchors {
+		if dns.IsSubDomain(zone, name) && (closest == "" || dns.CountLabel(zone) > dns.CountLabel(closest)) {
+			closest = zone
+		}
+	}
+	return closest
+}
+
+// Whether the key is one of the anchors, or the key of one of the DS records
+func matchesAnchor(key *dns.DNSKEY, anchors []dns.RR) bool {
+	for _, anchor := range anchors {
+		switch anchor := anchor.(type) {
+		case *dns.DNSKEY:
+			if anchor.Algorithm == key.Algorithm && anchor.PublicKey == key.PublicKey {
+				return true
+			}
+		case *dns.DS:
+			if anchor.KeyTag != key.KeyTag() || anchor.Algorithm != key.Algorithm {
+				continue
+			}
+			if ds := key.ToDS(anchor.DigestType); ds != nil && strings.EqualFold(ds.Digest, anchor.Digest) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (v *dnssecValidator) query(name string, qtype uint16, resolvers []string) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	req.CheckingDisabled = true
+	resp, err := v.resolve(req, resolvers)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("no response")
+	}
+	return resp, nil
+}
+
+// Only clients that set DO get the DNSSEC records they didn't ask for, and only those that set DO or
+// AD get the AD bit
+func presentDnssec(req *dns.Msg, m *dns.Msg) {
+	do := false
+	if o := req.IsEdns0(); o != nil {
+		do = o.Do()
+	}
+	if !do && !req.AuthenticatedData {
+		m.AuthenticatedData = false
+	}
+	if do {
+		return
+	}
+	qtype := req.Question[0].Qtype
+	strip := func(section []dns.RR) []dns.RR {
+		var out []dns.RR
+		for _, record := range section {
+			switch rrtype := record.Header().Rrtype; rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if rrtype != qtype {
+					continue
+				}
+			}
+			out = append(out, record)
+		}
+		return out
+	}
+	m.Answer, m.Ns, m.Extra = strip(m.Answer), strip(m.Ns), strip(m.Extra)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/rancher/rancher-dns/cache"
+)
+
+func TestValidateRecursedResponses(t *testing.T) {
+	saved, savedEnvironments, savedUpstreams, savedCache, savedFailClosed := answers, environmentAnswers, fakeUpstreams, globalCache, *dnssecFailClosed
+	defer func() {
+		answers, environmentAnswers, fakeUpstreams, globalCache, *dnssecFailClosed = saved, savedEnvironments, savedUpstreams, savedCache, savedFailClosed
+		validator = nil
+	}()
+	globalCache = cache.New(10, 600)
+	answers = Answers{DEFAULT_KEY: ClientAnswers{Recurse: []string{"192.0.2.53"}}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	signer := func() *zoneSigner {
+		ksk, _ := loadSigningKey("", DNSSEC_KSK_FLAGS)
+		zsk, _ := loadSigningKey("", DNSSEC_ZSK_FLAGS)
+		return &zoneSigner{ksk: ksk, zsk: zsk, announced: make(map[string]bool)}
+	}
+	parent, child := signer(), signer()
+	rr := func(s string) dns.RR {
+		record, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+	response := func(answer ...dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.Answer = answer
+		return m
+	}
+	negative := func(rcode int, authority ...dns.RR) *dns.Msg {
+		m := new(dns.Msg)
+		m.Rcode = rcode
+		m.Ns = authority
+		return m
+	}
+
+	// com. is the trust anchor, example.com. has its DS there
+	dir, err := ioutil.TempDir("", "validation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	anchors := filepath.Join(dir, "anchors")
+	ioutil.WriteFile(anchors, []byte("; com.\n"+parent.ksk.record("com.", 3600).ToDS(dns.SHA256).String()+"\n"), 0644)
+	if err := setupValidation(anchors); err != nil {
+		t.Fatal(err)
+	}
+
+	bad := child.signSection("example.com.", []dns.RR{rr("bad.example.com. 300 IN A 10.0.0.2")})
+	bad[0].(*dns.A).A = net.ParseIP("10.6.6.6")
+
+	// The NSEC chain of example.com.: the apex, bad, insecure (a delegation without DS) and www
+	soa := rr("example.com. 300 IN SOA ns.example.com. admin.example.com. 1 7200 900 1209600 300")
+	apexNsec := rr("example.com. 300 IN NSEC bad.example.com. NS SOA RRSIG NSEC DNSKEY")
+	insecureNsec := rr("insecure.example.com. 300 IN NSEC www.example.com. NS RRSIG NSEC")
+	wwwNsec := rr("www.example.com. 300 IN NSEC example.com. A RRSIG NSEC")
+	chain := newNSEC3Chain("example.com.", map[string][]uint16{
+		"example.com.":     {dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY},
+		"bad.example.com.": {dns.TypeA},
+		"www.example.com.": {dns.TypeA},
+	}, NSEC3Params{Salt: "AB"}, 300)
+	fakeUpstreams = replayUpstreams{
+		"com. DNSKEY":          response(parent.signSection("com.", parent.dnskeys("com.", 3600))...),
+		"example.com. DS":      response(parent.signSection("com.", []dns.RR{child.ksk.record("example.com.", 3600).ToDS(dns.SHA256)})...),
+		"example.com. DNSKEY":  response(child.signSection("example.com.", child.dnskeys("example.com.", 3600))...),
+		"www.example.com. A":   response(child.signSection("example.com.", []dns.RR{rr("www.example.com. 300 IN A 10.0.0.1")})...),
+		"bad.example.com. A":   response(bad...),
+		"plain.example.com. A": response(rr("plain.example.com. 300 IN A 10.0.0.3")),
+		// Signed, but the signature was stripped on the way
+		"stripped.example.com. A": response(rr("stripped.example.com. 300 IN A 10.6.6.6")),
+
+		"insecure.example.com. DS":     negative(dns.RcodeSuccess, child.signSection("example.com.", []dns.RR{soa, insecureNsec})...),
+		"www.insecure.example.com. DS": negative(dns.RcodeSuccess, rr("insecure.example.com. 300 IN SOA ns.insecure.example.com. admin.insecure.example.com. 1 7200 900 1209600 300")),
+		"www.insecure.example.com. A":  response(rr("www.insecure.example.com. 300 IN A 10.0.0.4")),
+
+		"missing.example.com. A": negative(dns.RcodeNameError, child.signSection("example.com.", []dns.RR{soa, apexNsec, insecureNsec})...),
+		"www.example.com. AAAA":  negative(dns.RcodeSuccess, child.signSection("example.com.", []dns.RR{soa, wwwNsec})...),
+		"gone.example.com. A":    negative(dns.RcodeNameError, child.signSection("example.com.", append([]dns.RR{soa}, chain.Denial("gone.example.com.")...))...),
+		// A signed SOA alone, and a denial made for another name
+		"forged.example.com. A": negative(dns.RcodeNameError, child.signSection("example.com.", []dns.RR{soa})...),
+		"cdn.example.com. A":    negative(dns.RcodeNameError, child.signSection("example.com.", []dns.RR{soa, apexNsec, insecureNsec})...),
+	}
+
+	queryType := func(name string, qtype uint16, do, cd bool) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		req.SetEdns0(dns.DefaultMsgSize, do)
+		req.CheckingDisabled = cd
+		w := &testWriter{}
+		route(&queryWriter{ResponseWriter: w, edns: true}, req)
+		if w.msg == nil {
+			t.Fatalf("Expected a response for %s", name)
+		}
+		return w.msg
+	}
+	query := func(name string, do, cd bool) *dns.Msg {
+		return queryType(name, dns.TypeA, do, cd)
+	}
+
+	if msg := query("www.example.com.", true, false); !msg.AuthenticatedData || len(msg.Answer) != 2 {
+		t.Fatalf("Expected a secure response with its signature, got %v", msg)
+	}
+	if msg := query("www.example.com.", false, false); msg.AuthenticatedData || len(msg.Answer) != 1 {
+		t.Fatalf("Expected neither AD nor the signature without DO, got %v", msg)
+	}
+	if msg := query("www.insecure.example.com.", true, false); msg.AuthenticatedData || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+		t.Fatalf("Expected an insecure response without AD below the delegation without DS, got %v", msg)
+	}
+	if msg := query("missing.example.com.", true, false); !msg.AuthenticatedData || msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected a secure NXDOMAIN proven by NSEC, got %v", msg)
+	}
+	if msg := query("gone.example.com.", true, false); !msg.AuthenticatedData || msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("Expected a secure NXDOMAIN proven by NSEC3, got %v", msg)
+	}
+	if msg := queryType("www.example.com.", dns.TypeAAAA, true, false); !msg.AuthenticatedData || msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 {
+		t.Fatalf("Expected a secure NODATA proven by NSEC, got %v", msg)
+	}
+	for _, name := range []string{"plain.example.com.", "stripped.example.com.", "forged.example.com.", "cdn.example.com."} {
+		msg := fakeUpstreams[name+" A"].Copy()
+		msg.SetQuestion(name, dns.TypeA)
+		if result, err := validator.Validate(msg, []string{"192.0.2.53"}); result != DNSSEC_BOGUS || err == nil {
+			t.Fatalf("Expected %s to be bogus, got %s", name, result)
+		}
+	}
+	if msg := query("bad.example.com.", true, false); msg.AuthenticatedData || msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected the bogus response without AD, got %v", msg)
+	}
+
+	// Failing closed, except for clients that check for themselves
+	*dnssecFailClosed = true
+	globalCache = cache.New(10, 600)
+	if msg := query("bad.example.com.", true, false); msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected SERVFAIL for the bogus response, got %v", msg)
+	}
+	if msg := query("bad.example.com.", true, true); msg.Rcode != dns.RcodeSuccess || msg.AuthenticatedData {
+		t.Fatalf("Expected the unvalidated response with CD, got %v", msg)
+	}
+	if msg := query("bad.example.com.", true, false); msg.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("Expected the unvalidated response not to be cached, got %v", msg)
+	}
+	for _, name := range []string{"stripped.example.com.", "forged.example.com.", "cdn.example.com."} {
+		if msg := query(name, true, false); msg.Rcode != dns.RcodeServerFailure || msg.AuthenticatedData {
+			t.Fatalf("Expected SERVFAIL for %s, got %v", name, msg)
+		}
+	}
+	if msg := query("www.insecure.example.com.", true, false); msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("Expected the insecure response, got %v", msg)
+	}
+
+	// A DS that doesn't match the keys breaks the chain
+	validator.keys, validator.delegations = make(map[string]zoneKeys), make(map[string]delegation)
+	fakeUpstreams["example.com. DS"] = response(parent.signSection("com.", []dns.RR{parent.ksk.record("example.com.", 3600).ToDS(dns.SHA256)})...)
+	if result, err := validator.Validate(fakeUpstreams["www.example.com. A"].Copy(), []string{"192.0.2.53"}); result != DNSSEC_BOGUS || err == nil {
+		t.Fatalf("Expected a broken chain to be bogus, got %s", result)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Weight of the addresses of a weighted record that its "weights" don't list
+const DEFAULT_WEIGHT = 1
+
+// Most weights of served records remembered; past that, they are forgotten and remembered anew
+const MAX_SERVED_WEIGHTS = 10000
+
+// Weighted records, read from the "weights" of an "a" entry ({"10.0.0.1": 90, "10.0.0.2": 10}), are
+// ordered by drawing the addresses one after the other with a chance proportional to their weight, so
+// clients taking the first address spread over them proportionally. Addresses of weight 0 are only
+// ever last. The weights of the records served are remembered under their name and address for
+// ordering the responses cached for the client the same way.
+var servedWeights = struct {
+	sync.Mutex
+	weights map[string]uint32
+}{weights: make(map[string]uint32)}
+
+func (rec *RecordA) ValidateWeights(name string) error {
+	for address := range rec.Weights {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return fmt.Errorf("invalid weighted address for %s: %s", name, address)
+		}
+		if _, ok := rec.weight(ip); !ok {
+			return fmt.Errorf("weighted address %s isn't an answer of %s", address, name)
+		}
+	}
+	return nil
+}
+
+// The weight of the address, and whether it's one of the record's answers
+func (rec *RecordA) weight(ip net.IP) (uint32, bool) {
+	found := false
+	for _, answer := range rec.Answer {
+		if ip.Equal(net.ParseIP(answer)) {
+			found = true
+			break
+		}
+	}
+	for address, weight := range rec.Weights {
+		if ip.Equal(net.ParseIP(address)) {
+			return weight, found
+		}
+	}
+	return DEFAULT_WEIGHT, found
+}
+
+func servedWeightKey(record dns.RR) (string, bool) {
+	switch record := record.(type) {
+	case *dns.A:
+		return record.Hdr.Name + " " + record.A.String(), true
+	case *dns.AAAA:
+		return record.Hdr.Name + " " + record.AAAA.String(), true
+	}
+	return "", false
+}
+
+// Remembers the weights of the records of the weighted record
+func rememberWeights(records []dns.RR, rec RecordA) {
+	servedWeights.Lock()
+	defer servedWeights.Unlock()
+	if len(servedWeights.weights)+len(records) > MAX_SERVED_WEIGHTS {
+		servedWeights.weights = make(map[string]uint32)
+	}
+	for _, record := range records {
+		key, ok := servedWeightKey(record)
+		if !ok {
+			continue
+		}
+		switch record := record.(type) {
+		case *dns.A:
+			servedWeights.weights[key], _ = rec.weight(record.A)
+		case *dns.AAAA:
+			servedWeights.weights[key], _ = rec.weight(record.AAAA)
+		}
+	}
+}
+
+func clearServedWeights() {
+	servedWeights.Lock()
+	servedWeights.weights = make(map[string]uint32)
+	servedWeights.Unlock()
+}
+
+// The weights of the address records, if they are those of a weighted record
+func servedWeightsOf(addresses []dns.RR) ([]uint32, bool) {
+	weights := make([]uint32, len(addresses))
+	servedWeights.Lock()
+	defer servedWeights.Unlock()
+	for i, record := range addresses {
+		key, ok := servedWeightKey(record)
+		weight, known := servedWeights.weights[key]
+		if !ok || !known {
+			return nil, false
+		}
+		weights[i] = weight
+	}
+	return weights, true
+}
+
+// Orders the address records by their weights, if they are those of a weighted record. Reports
+// whether they were.
+func weightedOrder(addresses []dns.RR) bool {
+	weights, ok := servedWeightsOf(addresses)
+	if !ok {
+		return false
+	}
+
+	for i := 0; i < len(addresses)-1; i++ {
+		var total uint64
+		for _, weight := range weights[i:] {
+			total += uint64(weight)
+		}
+		// Only addresses of weight 0 are left, their order doesn't matter
+		j := i + random.Intn(len(addresses)-i)
+		if total > 0 {
+			draw := uint64(random.Int63n(int64(total)))
+			for j = i; draw >= uint64(weights[j]); j++ {
+				draw -= uint64(weights[j])
+			}
+		}
+		addresses[i], addresses[j] = addresses[j], addresses[i]
+		weights[i], weights[j] = weights[j], weights[i]
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestWeightedAnswers(t *testing.T) {
+	defer clearServedWeights()
+	answers := Answers{DEFAULT_KEY: ClientAnswers{A: map[string]RecordA{
+		"web.weighted.": {Answer: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"}, Weights: map[string]uint32{"10.0.0.1": 60, "10.0.0.2": 20, "10.0.0.4": 0}},
+	}}}
+
+	firsts := make(map[string]int)
+	var cached []dns.RR
+	for i := 0; i < 2000; i++ {
+		records, ok := answers.MatchingExact(dns.TypeA, DEFAULT_KEY, "web.weighted.", "web.weighted.")
+		if !ok || len(records) != 4 {
+			t.Fatalf("Expected the 4 addresses, got %v", records)
+		}
+		if last := records[3].(*dns.A).A.String(); last != "10.0.0.4" {
+			t.Fatalf("Expected the address of weight 0 last, got %v", records)
+		}
+		firsts[records[0].(*dns.A).A.String()]++
+		cached = records
+	}
+	// 60, 20 and (unlisted) 1 of 81
+	if firsts["10.0.0.1"] < 1300 || firsts["10.0.0.2"] < 350 || firsts["10.0.0.2"] > 650 || firsts["10.0.0.3"] > 100 {
+		t.Fatalf("Expected the first addresses to follow the weights, got %v", firsts)
+	}
+
+	// Cached responses are ordered by the weights they were served with
+	firsts = make(map[string]int)
+	for i := 0; i < 200; i++ {
+		shuffle(&cached)
+		if last := cached[3].(*dns.A).A.String(); last != "10.0.0.4" {
+			t.Fatalf("Expected the address of weight 0 last, got %v", cached)
+		}
+		firsts[cached[0].(*dns.A).A.String()]++
+	}
+	if firsts["10.0.0.1"] < firsts["10.0.0.2"] || firsts["10.0.0.2"] < firsts["10.0.0.3"] {
+		t.Fatalf("Expected cached responses to follow the weights, got %v", firsts)
+	}
+
+	for _, invalid := range []RecordA{
+		{Answer: []string{"10.0.0.1"}, Weights: map[string]uint32{"10.0.0.9": 1}},
+		{Answer: []string{"10.0.0.1"}, Weights: map[string]uint32{"web": 1}},
+	} {
+		if err := invalid.ValidateWeights("web.weighted."); err == nil {
+			t.Fatalf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
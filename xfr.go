@@ -0,0 +1,403 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Zone transfers of the declared zones to secondaries: the records of the top-level "default" entry in
+// a zone are its contents, transferred in full (AXFR) or as the changes since the secondary's serial
+// (IXFR), to the addresses and networks of the zone's "transfer" list only. The serial starts at the
+// configured one or the current Unix time, whichever is ahead. Every change of the contents bumps it,
+// to at least the configured one, and the zone's "notify" secondaries are sent
+// a NOTIFY so they come for the change right away instead of on their refresh timer.
+
+const (
+	// Versions of each zone kept for incremental transfers; secondaries further behind get all of it
+	ZONE_HISTORY = 20
+	// Records per message of a transfer
+	XFR_RECORDS_PER_MESSAGE = 100
+	NOTIFY_ATTEMPTS         = 3
+	NOTIFY_TIMEOUT          = 2 * time.Second
+)
+
+// The contents of a zone as of a serial, and what changed from the previous version
+type zoneVersion struct {
+	serial  uint32
+	records []dns.RR
+	removed []dns.RR
+	added   []dns.RR
+}
+
+type zoneTracker struct {
+	sync.RWMutex
+	// Oldest first, by zone name
+	versions map[string][]zoneVersion
+	notify   func(zone string, secondaries []string, key string)
+}
+
+var zoneVersions = &zoneTracker{versions: make(map[string][]zoneVersion), notify: notifySecondaries}
+
+// Records a new version of the zones whose contents changed in the answers. Called on every change of
+// the served answers.
+func (z *zoneTracker) Update(answers Answers) {
+	z.Lock()
+	defer z.Unlock()
+	declared := make(map[string]bool)
+	for _, rule := range answers.ZoneRules() {
+		zone := rule.name()
+		declared[zone] = true
+		records := answers.zoneContents(zone)
+		history := z.versions[zone]
+		if len(history) == 0 {
+			z.versions[zone] = []zoneVersion{{serial: initialSerial(rule.Serial), records: records}}
+			continue
+		}
+
+		last := history[len(history)-1]
+		removed, added := diffRecords(last.records, records)
+		if len(removed) == 0 && len(added) == 0 && !serialNewer(rule.Serial, last.serial) {
+			continue
+		}
+		serial := nextSerial(last.serial, rule.Serial)
+		history = append(history, zoneVersion{serial: serial, records: records, removed: removed, added: added})
+		if len(history) > ZONE_HISTORY {
+			history = history[len(history)-ZONE_HISTORY:]
+		}
+		z.versions[zone] = history
+		log.WithFields(log.Fields{"zone": zone, "serial": serial, "removed": len(removed), "added": len(added)}).Info("Zone changed")
+		if len(rule.Notify) > 0 && z.notify != nil {
+			z.notify(zone, rule.Notify, tsigKeyName(rule.Tsig))
+		}
+	}
+	for zone := range z.versions {
+		if !declared[zone] {
+			delete(z.versions, zone)
+		}
+	}
+}
+
+// The serial of the zone's current version
+func (z *zoneTracker) serial(zone string) (uint32, bool) {
+	z.RLock()
+	defer z.RUnlock()
+	history := z.versions[zone]
+	if len(history) == 0 {
+		return 0, false
+	}
+	return history[len(history)-1].serial, true
+}
+
+func (z *zoneTracker) history(zone string) []zoneVersion {
+	z.RLock()
+	defer z.RUnlock()
+	return z.versions[zone]
+}
+
+// The serial of a zone's first version: the configured one, or the current Unix time if that's further
+// ahead. Versions aren't kept across restarts, so the serial a restart starts from has to be ahead of the
+// ones secondaries already have, which went up by one with every change since the configured one.
+func initialSerial(configured uint32) uint32 {
+	serial := uint32(now().Unix())
+	if serialNewer(configured, serial) {
+		serial = configured
+	}
+	return serial
+}
+
+// The serial after the current one: one more, or the configured one if that's further ahead
+func nextSerial(current uint32, configured uint32) uint32 {
+	next := current + 1
+	if serialNewer(configured, next) {
+		next = configured
+	}
+	return next
+}
+
+// Whether serial a is after b in serial number arithmetic (RFC 1982)
+func serialNewer(a uint32, b uint32) bool {
+	return a != b && a-b < 1<<31
+}
+
+// The records of the default entry in the zone, sorted, without those of the declared zones under it
+// (which are delegated to the name servers of theirs instead). SOA records are left out.
+func (answers *Answers) zoneContents(zone string) []dns.RR {
+	client := (*answers)[DEFAULT_KEY]
+	ttl := answers.Ttl(DEFAULT_KEY)
+	recordTtl := func(own *uint32) uint32 {
+		if own != nil {
+			return *own
+		}
+		return ttl
+	}
+	var subzones []*ZoneRule
+	rules := answers.ZoneRules()
+	for i := range rules {
+		if name := rules[i].name(); name != zone && inZone(name, zone) {
+			subzones = append(subzones, &rules[i])
+		}
+	}
+	inContents := func(name string) bool {
+		if !inZone(name, zone) {
+			return false
+		}
+		for _, subzone := range subzones {
+			if inZone(name, subzone.name()) {
+				return false
+			}
+		}
+		return true
+	}
+	header := func(name string, rrtype uint16, ttl uint32) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	var records []dns.RR
+	if rule := answers.zoneApex(zone); rule != nil {
+		records = append(records, rule.nsRecords(recordTtl(rule.Ttl))...)
+	}
+	for _, subzone := range subzones {
+		records = append(records, subzone.nsRecords(recordTtl(subzone.Ttl))...)
+	}
+	for name, rec := range client.A {
+		if !inContents(name) {
+			continue
+		}
+		for _, answer := range rec.Answer {
+			ip := net.ParseIP(answer)
+			if ip4 := ip.To4(); ip4 != nil {
+				records = append(records, &dns.A{Hdr: header(name, dns.TypeA, recordTtl(rec.Ttl)), A: ip4})
+			} else if ip != nil {
+				records = append(records, &dns.AAAA{Hdr: header(name, dns.TypeAAAA, recordTtl(rec.Ttl)), AAAA: ip})
+			}
+		}
+	}
+	for name, rec := range client.Cname {
+		if inContents(name) {
+			records = append(records, &dns.CNAME{Hdr: header(name, dns.TypeCNAME, recordTtl(rec.Ttl)), Target: rec.Answer})
+		}
+	}
+	for name, rec := range client.Ptr {
+		if inContents(name) {
+			records = append(records, &dns.PTR{Hdr: header(name, dns.TypePTR, recordTtl(rec.Ttl)), Ptr: rec.Answer})
+		}
+	}
+	for name, rec := range client.Txt {
+		if !inContents(name) {
+			continue
+		}
+		for _, answer := range rec.Answer {
+			records = append(records, &dns.TXT{Hdr: header(name, dns.TypeTXT, recordTtl(rec.Ttl)), Txt: []string{answer}})
+		}
+	}
+	for name, rec := range client.Srv {
+		if !inContents(name) {
+			continue
+		}
+		for _, answer := range rec.Answer {
+			if srv, err := parseSrvAnswer(answer); err == nil {
+				srv.Hdr = header(name, dns.TypeSRV, recordTtl(rec.Ttl))
+				records = append(records, srv)
+			}
+		}
+	}
+	sort.Sort(byRecordString(records))
+	return records
+}
+
+type byRecordString []dns.RR
+
+func (r byRecordString) Len() int           { return len(r) }
+func (r byRecordString) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRecordString) Less(i, j int) bool { return r[i].String() < r[j].String() }
+
+// The records only in before, and those only in after
+func diffRecords(before []dns.RR, after []dns.RR) (removed []dns.RR, added []dns.RR) {
+	seen := make(map[string]bool, len(before))
+	for _, record := range before {
+		seen[record.String()] = true
+	}
+	kept := make(map[string]bool, len(after))
+	for _, record := range after {
+		kept[record.String()] = true
+		if !seen[record.String()] {
+			added = append(added, record)
+		}
+	}
+	for _, record := range before {
+		if !kept[record.String()] {
+			removed = append(removed, record)
+		}
+	}
+	return
+}
+
+// Whether the client may transfer the zone
+func (rule *ZoneRule) transferAllowed(clientIp string) bool {
+	for _, network := range rule.Transfer {
+		if inNetwork(clientIp, network) {
+			return true
+		}
+	}
+	return false
+}
+
+// Answers AXFR and IXFR queries for the declared zones of the top-level answers, over TCP, to the
+// peers in their "transfer" networks (and signed with their TSIG key if they have one)
+func answerTransfer(w dns.ResponseWriter, req *dns.Msg) {
+	question := req.Question[0]
+	zone := strings.ToLower(question.Name)
+	clientIp := peerAddr(w)
+	fields := log.Fields{"client": clientIp, "zone": zone, "type": dns.Type(question.Qtype).String()}
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	rule := answers.zoneApex(zone)
+	if rule == nil || !rule.transferAllowed(clientIp) {
+		log.WithFields(fields).Warn("Refused zone transfer")
+		stats.incr("transfersRefused")
+		m.Rcode = dns.RcodeRefused
+		setExtendedError(w, EDE_PROHIBITED, "zone transfer not allowed")
+		w.WriteMsg(m)
+		return
+	}
+	if key := tsigKeyName(rule.Tsig); key != "" && requestKey(w) != key {
+		log.WithFields(fields).Warn("Refused zone transfer not signed with the key of the zone")
+		stats.incr("transfersRefused")
+		m.Rcode = dns.RcodeRefused
+		setExtendedError(w, EDE_PROHIBITED, "zone transfer requires TSIG")
+		w.WriteMsg(m)
+		return
+	}
+	m.Authoritative = true
+	soa := answers.zoneSoa(zone)
+
+	// Over UDP, IXFR only gets the current SOA (the secondary then knows whether to come over TCP)
+	if !isTcp(w) {
+		if question.Qtype == dns.TypeIXFR {
+			m.Answer = []dns.RR{soa}
+		} else {
+			m.Rcode = dns.RcodeFormatError
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	var records []dns.RR
+	incremental := false
+	if question.Qtype == dns.TypeIXFR {
+		records, incremental = incrementalTransfer(req, soa, zoneVersions.history(zone))
+	}
+	if !incremental {
+		records = append([]dns.RR{soa}, answers.zoneContents(zone)...)
+		records = append(records, soa)
+	}
+	for start := 0; start < len(records); start += XFR_RECORDS_PER_MESSAGE {
+		end := start + XFR_RECORDS_PER_MESSAGE
+		if end > len(records) {
+			end = len(records)
+		}
+		part := new(dns.Msg)
+		part.SetReply(req)
+		part.Authoritative = true
+		part.Answer = records[start:end]
+		if err := w.WriteMsg(part); err != nil {
+			log.WithFields(fields).Warnf("Zone transfer failed: %v", err)
+			return
+		}
+		// The MACs of signed messages after the first chain to the previous one
+		if requestKey(w) != "" {
+			w.TsigTimersOnly(true)
+		}
+	}
+	stats.incr("transfers")
+	fields["serial"] = soa.Serial
+	fields["records"] = len(records)
+	fields["incremental"] = incremental
+	log.WithFields(fields).Info("Transferred zone")
+}
+
+// The records of an incremental transfer (RFC 1995) from the serial of the secondary's SOA in the
+// authority section: the current SOA alone when it is up to date, otherwise the removed and added
+// records of each version since, each set led by the SOA of the version. False when the history
+// doesn't go back to the secondary's serial.
+func incrementalTransfer(req *dns.Msg, soa *dns.SOA, history []zoneVersion) ([]dns.RR, bool) {
+	var since uint32
+	found := false
+	for _, record := range req.Ns {
+		if current, ok := record.(*dns.SOA); ok {
+			since, found = current.Serial, true
+		}
+	}
+	if !found {
+		return nil, false
+	}
+	if since == soa.Serial || serialNewer(since, soa.Serial) {
+		return []dns.RR{soa}, true
+	}
+
+	start := -1
+	for i, version := range history {
+		if version.serial == since {
+			start = i
+		}
+	}
+	if start < 0 || history[len(history)-1].serial != soa.Serial {
+		return nil, false
+	}
+	versionSoa := func(serial uint32) dns.RR {
+		record := *soa
+		record.Serial = serial
+		return &record
+	}
+	records := []dns.RR{soa}
+	for i := start + 1; i < len(history); i++ {
+		records = append(records, versionSoa(history[i-1].serial))
+		records = append(records, history[i].removed...)
+		records = append(records, versionSoa(history[i].serial))
+		records = append(records, history[i].added...)
+	}
+	return append(records, soa), true
+}
+
+// Sends a NOTIFY for the zone to each of the secondaries, signed with the key if there is one, trying a
+// few times until they answer
+func notifySecondaries(zone string, secondaries []string, key string) {
+	for _, secondary := range secondaries {
+		go func(secondary string) {
+			addr := resolverAddr(secondary)
+			fields := log.Fields{"zone": zone, "secondary": addr}
+			req := new(dns.Msg)
+			req.SetNotify(zone)
+			client := &dns.Client{DialTimeout: NOTIFY_TIMEOUT, ReadTimeout: NOTIFY_TIMEOUT, WriteTimeout: NOTIFY_TIMEOUT, TsigSecret: tsigSecrets()}
+			var err error
+			for attempt := 0; attempt < NOTIFY_ATTEMPTS; attempt++ {
+				if req.Extra = nil; key != "" {
+					signMsg(req, key)
+				}
+				var resp *dns.Msg
+				if resp, _, err = client.Exchange(req, addr); err == nil && resp.Rcode == dns.RcodeSuccess {
+					stats.incr("notifies")
+					log.WithFields(fields).Debug("Sent NOTIFY")
+					return
+				} else if err == nil {
+					err = errorRcode(resp.Rcode)
+				}
+			}
+			stats.incr("notifyErrors")
+			log.WithFields(fields).Warnf("Failed to NOTIFY secondary: %v", err)
+		}(secondary)
+	}
+}
+
+type errorRcode int
+
+func (rcode errorRcode) Error() string {
+	return "secondary answered " + dns.RcodeToString[int(rcode)]
+}
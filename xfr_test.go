@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Keeps every message of a transfer, sent over TCP
+type transferWriter struct {
+	testWriter
+	msgs []*dns.Msg
+}
+
+func (w *transferWriter) RemoteAddr() net.Addr {
+	if w.remote != nil {
+		return w.remote
+	}
+	return &net.TCPAddr{IP: net.ParseIP("10.1.1.1"), Port: 5353}
+}
+
+func (w *transferWriter) WriteMsg(m *dns.Msg) error { w.msgs = append(w.msgs, m); return nil }
+
+func TestZoneTransfers(t *testing.T) {
+	saved, savedEnvironments, savedVersions, savedNow := answers, environmentAnswers, zoneVersions, now
+	defer func() {
+		answers, environmentAnswers, zoneVersions, now = saved, savedEnvironments, savedVersions, savedNow
+	}()
+	// A clock behind the configured serial
+	now = func() time.Time { return time.Unix(50, 0) }
+	var notified []string
+	zoneVersions = &zoneTracker{versions: make(map[string][]zoneVersion), notify: func(zone string, secondaries []string, key string) {
+		notified = append(notified, zone)
+	}}
+
+	load := func(addresses ...string) {
+		answers = Answers{DEFAULT_KEY: ClientAnswers{
+			Zones: []ZoneRule{
+				{Zone: "example.internal", Ns: []string{"ns1.example.internal"}, Serial: 100, Transfer: []string{"10.1.0.0/16"}, Notify: []string{"10.1.1.2"}},
+				{Zone: "dev.example.internal", Ns: []string{"ns1.example.internal"}},
+			},
+			A: map[string]RecordA{
+				"web.example.internal.":     {Answer: addresses},
+				"app.dev.example.internal.": {Answer: []string{"10.0.1.1"}},
+				"web.other.internal.":       {Answer: []string{"10.0.2.1"}},
+			},
+			Cname: map[string]RecordCname{"www.example.internal.": {Answer: "web.example.internal."}},
+		}}
+		environmentAnswers = nil
+		zoneVersions.Update(answers)
+	}
+	transfer := func(qtype uint16, serial uint32, w dns.ResponseWriter) {
+		req := new(dns.Msg)
+		req.SetQuestion("example.internal.", qtype)
+		if serial != 0 {
+			req.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "example.internal.", Rrtype: dns.TypeSOA, Class: dns.ClassINET}, Serial: serial}}
+		}
+		route(&queryWriter{ResponseWriter: w, client: "10.1.1.1", edns: true}, req)
+	}
+	records := func(w *transferWriter) []dns.RR {
+		var out []dns.RR
+		for _, msg := range w.msgs {
+			out = append(out, msg.Answer...)
+		}
+		return out
+	}
+
+	load("10.0.0.1")
+	if serial, _ := zoneVersions.serial("example.internal."); serial != 100 {
+		t.Fatalf("Expected the configured serial first, got %d", serial)
+	}
+	w := &transferWriter{}
+	transfer(dns.TypeAXFR, 0, w)
+	axfr := records(w)
+	// SOA, NS, the address and the alias, the delegation of the subzone, SOA
+	if len(axfr) != 6 || axfr[0].(*dns.SOA).Serial != 100 || axfr[5].Header().Rrtype != dns.TypeSOA {
+		t.Fatalf("Expected the whole zone, got %v", axfr)
+	}
+	for _, record := range axfr {
+		if record.Header().Name == "app.dev.example.internal." || record.Header().Name == "web.other.internal." {
+			t.Fatalf("Expected only the records of the zone, got %v", record)
+		}
+	}
+
+	// Unchanged contents keep the serial; changes bump it and notify
+	load("10.0.0.1")
+	load("10.0.0.2")
+	if serial, _ := zoneVersions.serial("example.internal."); serial != 101 || len(notified) != 1 {
+		t.Fatalf("Expected serial 101 and a NOTIFY, got %d %v", serial, notified)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.internal.", dns.TypeSOA)
+	udp := &testWriter{}
+	clearClientSpecificCaches()
+	route(&queryWriter{ResponseWriter: udp}, req)
+	if msg := udp.msg; len(msg.Answer) != 1 || msg.Answer[0].(*dns.SOA).Serial != 101 {
+		t.Fatalf("Expected the SOA with the new serial, got %v", msg)
+	}
+
+	// IXFR from the previous serial: the removed and added address
+	w = &transferWriter{}
+	transfer(dns.TypeIXFR, 100, w)
+	ixfr := records(w)
+	if len(ixfr) != 6 || ixfr[1].(*dns.SOA).Serial != 100 || ixfr[2].(*dns.A).A.String() != "10.0.0.1" || ixfr[3].(*dns.SOA).Serial != 101 || ixfr[4].(*dns.A).A.String() != "10.0.0.2" {
+		t.Fatalf("Expected the changes since 100, got %v", ixfr)
+	}
+	// Up to date secondaries get the SOA alone, unknown serials the whole zone
+	w = &transferWriter{}
+	transfer(dns.TypeIXFR, 101, w)
+	if got := records(w); len(got) != 1 {
+		t.Fatalf("Expected the SOA alone, got %v", got)
+	}
+	w = &transferWriter{}
+	transfer(dns.TypeIXFR, 42, w)
+	if got := records(w); len(got) != 6 {
+		t.Fatalf("Expected the whole zone, got %v", got)
+	}
+
+	// Over UDP, IXFR gets the SOA and AXFR isn't served
+	transfer(dns.TypeIXFR, 100, udp)
+	if len(udp.msg.Answer) != 1 {
+		t.Fatalf("Expected the SOA over UDP, got %v", udp.msg)
+	}
+	transfer(dns.TypeAXFR, 0, udp)
+	if udp.msg.Rcode != dns.RcodeFormatError {
+		t.Fatalf("Expected FORMERR for AXFR over UDP, got %v", udp.msg)
+	}
+
+	// Clients outside of the transfer networks, and zones without them, are refused
+	w = &transferWriter{testWriter: testWriter{remote: &net.TCPAddr{IP: net.ParseIP("10.2.1.1"), Port: 5353}}}
+	req.SetQuestion("example.internal.", dns.TypeAXFR)
+	route(&queryWriter{ResponseWriter: w, edns: true}, req)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeRefused {
+		t.Fatalf("Expected REFUSED, got %v", w.msgs)
+	}
+	// Whatever client a proxy (by ECS or the PROXY protocol) says the query is from
+	w = &transferWriter{testWriter: testWriter{remote: &net.TCPAddr{IP: net.ParseIP("10.2.1.1"), Port: 5353}}}
+	route(&queryWriter{ResponseWriter: w, client: "10.1.1.1", edns: true}, req)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeRefused {
+		t.Fatalf("Expected REFUSED for a proxied client, got %v", w.msgs)
+	}
+	w = &transferWriter{}
+	req.SetQuestion("dev.example.internal.", dns.TypeAXFR)
+	route(&queryWriter{ResponseWriter: w, client: "10.1.1.1", edns: true}, req)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeRefused {
+		t.Fatalf("Expected REFUSED, got %v", w.msgs)
+	}
+
+	for _, invalid := range []ZoneRule{
+		{Zone: "example.internal", Ns: []string{"ns1.example.internal"}, Transfer: []string{"10.1.0.0/33"}},
+		{Zone: "example.internal", Ns: []string{"ns1.example.internal"}, Notify: []string{"10.1.1.2:99999"}},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", invalid)
+		}
+	}
+}
+
+func TestSerialArithmetic(t *testing.T) {
+	if !serialNewer(1, 0xffffffff) || serialNewer(0xffffffff, 1) || serialNewer(5, 5) {
+		t.Fatalf("Expected serials to wrap around")
+	}
+	if nextSerial(0xffffffff, 0) != 0 || nextSerial(100, 2000) != 2000 || nextSerial(100, 50) != 101 {
+		t.Fatalf("Unexpected next serials")
+	}
+
+	// After a restart, the serial starts ahead of those of the versions before it
+	defer func(saved func() time.Time) { now = saved }(now)
+	now = func() time.Time { return time.Unix(1700000000, 0) }
+	if initialSerial(0) != 1700000000 || initialSerial(100) != 1700000000 || initialSerial(2024010101) != 2024010101 {
+		t.Fatalf("Unexpected initial serials")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Serializes the changes of the answers loaded from the file, so a zone reload doesn't undo (or get
+// undone by) a full reload running at the same time
+var baseMutex sync.Mutex
+
+// Replaces the records of the answers file under the zone with those of the fragment, an answers
+// file of the zone's records only (of any client), without reading or parsing the answers file. For
+// huge answers files where a one-record change shouldn't pay for a full reload; the fragment has to
+// say what the file does, or the next full reload brings the file's records back.
+func reloadZone(zone string, data []byte) ReloadResult {
+	start := time.Now()
+	err := replaceZone(zone, data)
+
+	answersMutex.Lock()
+	result := ReloadResult{
+		Ok:         err == nil,
+		Zone:       zone,
+		Clients:    len(answers),
+		Records:    answers.Counts(),
+		Generation: answersVersion.Generation,
+		Checksum:   answersVersion.Checksum,
+		DurationMs: durationMs(time.Since(start)),
+	}
+	answersMutex.Unlock()
+	if err != nil {
+		result.Error = err.Error()
+		log.WithFields(log.Fields{"zone": zone}).Errorf("Failed to reload zone: %v", err)
+	} else {
+		log.WithFields(log.Fields{"zone": zone, "durationMs": result.DurationMs}).Info("Reloaded zone")
+	}
+	return result
+}
+
+func replaceZone(zone string, data []byte) error {
+	if metadataDriven() {
+		return fmt.Errorf("zones can only be reloaded from an answers file")
+	}
+	fragment, err := parseAnswersData(data)
+	if err != nil {
+		return err
+	}
+	for key, client := range fragment {
+		if client.hasSettings() {
+			return fmt.Errorf("%s: a zone fragment only has records", key)
+		}
+		for _, name := range client.recordNames() {
+			if !inZone(name, zone) {
+				return fmt.Errorf("%s: %s isn't in zone %s", key, name, zone)
+			}
+		}
+	}
+	// The fragment stands in for the file's records of the zone
+	fragment.SetSource(fileSource(*answersFile))
+
+	baseMutex.Lock()
+	defer baseMutex.Unlock()
+	current := fileRecords.Answers()
+	updated := current.withoutZone(zone)
+	// Only the entries with records in the zone, before or after, are composed again
+	changed := make(map[string]bool)
+	for key, client := range current {
+		if client.hasRecordsIn(zone) {
+			changed[key] = true
+		}
+	}
+	for key, records := range fragment {
+		client := updated[key]
+		client.mergeRecords(&records)
+		updated[key] = client
+		changed[key] = true
+	}
+	return applyBaseKeys(updated, changed)
+}
+
+// The names of the client's records of every type
+func (client *ClientAnswers) recordNames() []string {
+	var names []string
+	for name := range client.A {
+		names = append(names, name)
+	}
+	for name := range client.Cname {
+		names = append(names, name)
+	}
+	for name := range client.Ptr {
+		names = append(names, name)
+	}
+	for name := range client.Txt {
+		names = append(names, name)
+	}
+	for name := range client.Srv {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Whether the client has records of names in or under the zone
+func (client *ClientAnswers) hasRecordsIn(zone string) bool {
+	for _, name := range client.recordNames() {
+		if inZone(name, zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// The answers without the records under the zone. Entries without any are shared with the answers,
+// not copied.
+func (answers *Answers) withoutZone(zone string) Answers {
+	out := make(Answers, len(*answers))
+	for key, client := range *answers {
+		out[key] = client
+		if !client.hasRecordsIn(zone) {
+			continue
+		}
+
+		c := client
+		c.A, c.Cname, c.Ptr, c.Txt, c.Srv = make(map[string]RecordA), make(map[string]RecordCname), make(map[string]RecordPtr), make(map[string]RecordTxt), make(map[string]RecordSrv)
+		for name, rec := range client.A {
+			if !inZone(name, zone) {
+				c.A[name] = rec
+			}
+		}
+		for name, rec := range client.Cname {
+			if !inZone(name, zone) {
+				c.Cname[name] = rec
+			}
+		}
+		for name, rec := range client.Ptr {
+			if !inZone(name, zone) {
+				c.Ptr[name] = rec
+			}
+		}
+		for name, rec := range client.Txt {
+			if !inZone(name, zone) {
+				c.Txt[name] = rec
+			}
+		}
+		for name, rec := range client.Srv {
+			if !inZone(name, zone) {
+				c.Srv[name] = rec
+			}
+		}
+		out[key] = c
+	}
+	return out
+}
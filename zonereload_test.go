@@ -0,0 +1,70 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReloadZone(t *testing.T) {
+	if err := setupSources(""); err != nil {
+		t.Fatal(err)
+	}
+	defer setBaseAnswers(make(Answers))
+	setBaseAnswers(Answers{
+		DEFAULT_KEY: ClientAnswers{
+			Recurse: []string{"8.8.8.8"},
+			A: map[string]RecordA{
+				"web.a.internal.": {Answer: []string{"10.0.0.1"}},
+				"old.a.internal.": {Answer: []string{"10.0.0.2"}},
+				"web.b.internal.": {Answer: []string{"10.0.1.1"}},
+			},
+		},
+		"10.1.1.1": ClientAnswers{Cname: map[string]RecordCname{"db.a.internal.": {Answer: "web.a.internal."}}},
+		"10.2.2.2": ClientAnswers{A: map[string]RecordA{"app.b.internal.": {Answer: []string{"10.0.1.2"}}}},
+	})
+	untouched := reflect.ValueOf(answers["10.2.2.2"].A).Pointer()
+
+	result := reloadZone("a.internal", []byte(`{"default": {"a": {"web.a.internal.": {"answer": ["10.0.0.9"]}, "new.a.internal.": {"answer": ["10.0.0.3"]}}}}`))
+	if !result.Ok || result.Zone != "a.internal" {
+		t.Fatalf("Expected the zone to be reloaded [%+v]", result)
+	}
+	def := answers[DEFAULT_KEY]
+	if rec := def.A["web.a.internal."]; len(rec.Answer) != 1 || rec.Answer[0] != "10.0.0.9" {
+		t.Fatalf("Expected the zone's record to be replaced [%+v]", rec)
+	}
+	if _, ok := def.A["new.a.internal."]; !ok {
+		t.Fatalf("Expected the zone's new record")
+	}
+	if _, ok := def.A["old.a.internal."]; ok {
+		t.Fatalf("Expected the record left out of the fragment to be removed")
+	}
+	if _, ok := answers["10.1.1.1"].Cname["db.a.internal."]; ok {
+		t.Fatalf("Expected the zone's records of every client to be replaced")
+	}
+	if _, ok := def.A["web.b.internal."]; !ok || len(def.Recurse) != 1 {
+		t.Fatalf("Expected the other zones and the settings to be kept [%+v]", def)
+	}
+	// Only the entries with records of the zone are composed again, to what a full rebuild would make
+	if reflect.ValueOf(answers["10.2.2.2"].A).Pointer() != untouched {
+		t.Fatalf("Expected the entry without records of the zone not to be composed again")
+	}
+	answersMutex.Lock()
+	rebuilt := composeAnswers(nil, nil)
+	answersMutex.Unlock()
+	if !reflect.DeepEqual(answers, rebuilt) {
+		t.Fatalf("Expected the answers of a full rebuild, got %+v instead of %+v", answers, rebuilt)
+	}
+
+	for _, invalid := range []string{
+		`{"default": {"a": {"web.b.internal.": {"answer": ["10.0.0.9"]}}}}`,
+		`{"default": {"recurse": ["1.1.1.1"]}}`,
+		`{"default": {"a": `,
+	} {
+		if result := reloadZone("a.internal", []byte(invalid)); result.Ok {
+			t.Fatalf("Expected %s to be rejected", invalid)
+		}
+	}
+	if _, ok := answers[DEFAULT_KEY].A["new.a.internal."]; !ok {
+		t.Fatalf("Expected a rejected fragment to change nothing")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/miekg/dns"
+)
+
+// Zones, read from the "zones" list of the default entry, that we are the authority for: names in them
+// that have no answer are NXDOMAIN like those of authoritative suffixes, negative answers carry the SOA
+// of the zone in the authority section, and SOA and NS queries for the zone itself are answered. The
+// primary server of the SOA is the first NS, its mailbox that of the zone or of the identity. Without a
+// serial, the generation of the served answers is used, which changes with every change of them; once
+// the zone is served, the serial is that of its transfers (see xfr.go).
+
+// SOA timers as sent for zones that don't have them
+const (
+	DEFAULT_SOA_REFRESH = 60
+	DEFAULT_SOA_RETRY   = 10
+	DEFAULT_SOA_EXPIRE  = 86400
+	DEFAULT_SOA_MINTTL  = 1
+)
+
+func (answers *Answers) ZoneRules() []ZoneRule {
+	client, ok := (*answers)[DEFAULT_KEY]
+	if !ok {
+		return nil
+	}
+	return client.Zones
+}
+
+func (rule *ZoneRule) Validate() error {
+	if _, ok := dns.IsDomainName(rule.Zone); !ok || strings.Trim(rule.Zone, ".") == "" {
+		return fmt.Errorf("invalid zone: %q", rule.Zone)
+	}
+	if len(rule.Ns) == 0 {
+		return fmt.Errorf("zone %s without a name server", rule.Zone)
+	}
+	for _, ns := range rule.Ns {
+		if _, ok := dns.IsDomainName(ns); !ok {
+			return fmt.Errorf("invalid name server for zone %s: %s", rule.Zone, ns)
+		}
+	}
+	if rule.Mbox != "" {
+		if !validMbox(rule.Mbox) {
+			return fmt.Errorf("invalid mbox for zone %s: %s", rule.Zone, rule.Mbox)
+		}
+	}
+	for _, network := range rule.Transfer {
+		if parseNetwork(network) == nil {
+			return fmt.Errorf("invalid transfer network for zone %s: %s", rule.Zone, network)
+		}
+	}
+	for _, secondary := range rule.Notify {
+		if _, err := canonicalRecurser(secondary); err != nil {
+			return fmt.Errorf("invalid secondary to notify for zone %s: %v", rule.Zone, err)
+		}
+	}
+	if rule.Nsec3 != nil && rule.Nsec3.Iterations > MAX_NSEC3_ITERATIONS {
+		return fmt.Errorf("too many NSEC3 iterations for zone %s: %d, at most %d", rule.Zone, rule.Nsec3.Iterations, MAX_NSEC3_ITERATIONS)
+	}
+	return nil
+}
+
+// The NSEC3 parameters of the zone's chain, with a new salt
+func (rule *ZoneRule) nsec3Params() NSEC3Params {
+	params := NSEC3Params{Salt: randomSalt(DNSSEC_SALT_LENGTH)}
+	if rule != nil && rule.Nsec3 != nil {
+		params.OptOut, params.Iterations = rule.Nsec3.OptOut, rule.Nsec3.Iterations
+	}
+	return params
+}
+
+// The zone name as served: lower case, with the trailing dot
+func (rule *ZoneRule) name() string {
+	return strings.ToLower(dns.Fqdn(strings.Trim(rule.Zone, ".")))
+}
+
+// The declared zone with the longest name containing the name
+func (answers *Answers) ZoneFor(fqdn string) *ZoneRule {
+	var found *ZoneRule
+	rules := answers.ZoneRules()
+	for i := range rules {
+		if inZone(fqdn, rules[i].Zone) && (found == nil || len(rules[i].name()) > len(found.name())) {
+			found = &rules[i]
+		}
+	}
+	return found
+}
+
+// The declared zone whose apex the name is
+func (answers *Answers) zoneApex(fqdn string) *ZoneRule {
+	if zone := answers.ZoneFor(fqdn); zone != nil && zone.name() == strings.ToLower(fqdn) {
+		return zone
+	}
+	return nil
+}
+
+// The SOA of the zone, the declared one or that of an authoritative suffix
+func (answers *Answers) zoneSoa(zone string) *dns.SOA {
+	identity := identityFor(*answers)
+	rule := answers.zoneApex(zone)
+	if rule == nil {
+		serial++
+		return soaRecord(identity, zone, serial)
+	}
+
+	record := soaRecord(identity, rule.name(), rule.Serial)
+	if tracked, ok := zoneVersions.serial(rule.name()); ok {
+		record.Serial = tracked
+	} else if rule.Serial == 0 {
+		record.Serial = uint32(currentAnswersVersion().Generation)
+	}
+	record.Ns = dns.Fqdn(strings.ToLower(rule.Ns[0]))
+	if rule.Mbox != "" {
+		record.Mbox = mboxName(rule.Mbox)
+	}
+	if rule.Refresh != 0 {
+		record.Refresh = rule.Refresh
+	}
+	if rule.Retry != 0 {
+		record.Retry = rule.Retry
+	}
+	if rule.Expire != 0 {
+		record.Expire = rule.Expire
+	}
+	if rule.Minttl != 0 {
+		record.Minttl = rule.Minttl
+	}
+	if rule.Ttl != nil {
+		record.Hdr.Ttl = *rule.Ttl
+	}
+	return record
+}
+
+// The NS records of the declared zone
+func (rule *ZoneRule) nsRecords(ttl uint32) []dns.RR {
+	var records []dns.RR
+	for _, ns := range rule.Ns {
+		hdr := dns.RR_Header{Name: rule.name(), Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: ttl}
+		records = append(records, &dns.NS{Hdr: hdr, Ns: dns.Fqdn(strings.ToLower(ns))})
+	}
+	return records
+}
+
+// Has the SOA of the zone containing the name in the authority section of a negative response, when
+// the name is in a declared zone or an authoritative suffix
+func (answers *Answers) addNegativeSoa(m *dns.Msg, fqdn string) {
+	if rule := answers.ZoneFor(fqdn); rule != nil {
+		m.Ns = append(m.Ns, answers.zoneSoa(rule.name()))
+		return
+	}
+	for _, suffix := range answers.AuthoritativeSuffixes() {
+		if strings.HasSuffix(fqdn, suffix) {
+			m.Ns = append(m.Ns, answers.zoneSoa(strings.TrimLeft(suffix, ".")))
+			return
+		}
+	}
+}
+
+// Answers SOA and NS queries for the apex of a declared zone, with the local addresses of the name
+// servers as additional records, and DNSKEY and NSEC3PARAM queries when signing. Reports whether a
+// response was sent.
+func answerZoneApex(w dns.ResponseWriter, req *dns.Msg, m *dns.Msg, answers Answers, query *QueryContext) bool {
+	question := req.Question[0]
+	fqdn := strings.ToLower(question.Name)
+	rule := answers.zoneApex(fqdn)
+	signed := dnssecSigner != nil && (question.Qtype == dns.TypeDNSKEY || question.Qtype == dns.TypeNSEC3PARAM)
+	if rule == nil || (question.Qtype != dns.TypeSOA && question.Qtype != dns.TypeNS && !signed) {
+		return false
+	}
+
+	soa := answers.zoneSoa(rule.name())
+	switch question.Qtype {
+	case dns.TypeSOA:
+		m.Answer = append(m.Answer, soa)
+	case dns.TypeDNSKEY:
+		m.Answer = append(m.Answer, dnssecSigner.dnskeys(rule.name(), soa.Hdr.Ttl)...)
+	case dns.TypeNSEC3PARAM:
+		m.Answer = append(m.Answer, dnssecSigner.nsec3param(rule.name(), soa.Hdr.Ttl))
+	default:
+		m.Answer = append(m.Answer, rule.nsRecords(soa.Hdr.Ttl)...)
+		for _, ns := range rule.Ns {
+			ns = dns.Fqdn(strings.ToLower(ns))
+			for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+				found, _ := answers.Addresses(qtype, query, formatFqdn(query.ClientKey, ns), ns, nil, 1)
+				for _, record := range found {
+					if record.Header().Rrtype == qtype {
+						m.Extra = append(m.Extra, record)
+					}
+				}
+			}
+		}
+	}
+	m.Authoritative = true
+	m.RecursionAvailable = false
+	trace(w, "path=zone-apex")
+	trace(w, "zone=%s", rule.name())
+	Respond(w, req, m)
+	log.WithFields(log.Fields{"client": query.ClientKey, "type": dns.Type(question.Qtype).String(), "question": fqdn}).Debug("Answered zone apex")
+	return true
+}
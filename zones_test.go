@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestZones(t *testing.T) {
+	saved, savedEnvironments := answers, environmentAnswers
+	defer func() { answers, environmentAnswers = saved, savedEnvironments }()
+	ttl := uint32(300)
+	answers = Answers{DEFAULT_KEY: ClientAnswers{
+		Zones: []ZoneRule{
+			{Zone: "example.internal", Ns: []string{"ns1.example.internal", "ns2.example.net"}, Mbox: "hostmaster@example.internal", Serial: 2024010101, Minttl: 30, Ttl: &ttl},
+			{Zone: "dev.example.internal.", Ns: []string{"ns1.example.internal"}},
+		},
+		A: map[string]RecordA{
+			"ns1.example.internal.": {Answer: []string{"10.0.0.53"}},
+			"web.example.internal.": {Answer: []string{"10.0.0.1"}},
+		},
+	}}
+	environmentAnswers = nil
+	clearClientSpecificCaches()
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+		w := &testWriter{}
+		route(&queryWriter{ResponseWriter: w}, req)
+		if w.msg == nil {
+			t.Fatalf("Expected a response for %s", name)
+		}
+		return w.msg
+	}
+	soaOf := func(msg *dns.Msg) *dns.SOA {
+		if len(msg.Ns) != 1 {
+			t.Fatalf("Expected an SOA in the authority section, got %v", msg)
+		}
+		return msg.Ns[0].(*dns.SOA)
+	}
+
+	// The zone itself
+	msg := query("example.internal.", dns.TypeSOA)
+	if len(msg.Answer) != 1 || !msg.Authoritative {
+		t.Fatalf("Expected the SOA, got %v", msg)
+	}
+	soa := msg.Answer[0].(*dns.SOA)
+	if soa.Ns != "ns1.example.internal." || soa.Mbox != "hostmaster.example.internal." || soa.Serial != 2024010101 || soa.Minttl != 30 || soa.Hdr.Ttl != 300 {
+		t.Fatalf("Expected the declared SOA, got %v", soa)
+	}
+	msg = query("example.internal.", dns.TypeNS)
+	if len(msg.Answer) != 2 || msg.Answer[1].(*dns.NS).Ns != "ns2.example.net." {
+		t.Fatalf("Expected the name servers, got %v", msg)
+	}
+	if len(msg.Extra) != 1 || msg.Extra[0].(*dns.A).A.String() != "10.0.0.53" {
+		t.Fatalf("Expected the address of the local name server, got %v", msg.Extra)
+	}
+	if msg := query("example.internal.", dns.TypeA); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 || soaOf(msg).Hdr.Name != "example.internal." {
+		t.Fatalf("Expected NODATA for the zone itself, got %v", msg)
+	}
+
+	// Negative answers have the SOA of the most specific zone
+	if msg := query("missing.example.internal.", dns.TypeA); msg.Rcode != dns.RcodeNameError || soaOf(msg).Serial != 2024010101 {
+		t.Fatalf("Expected NXDOMAIN with the SOA, got %v", msg)
+	}
+	if msg := query("web.example.internal.", dns.TypeAAAA); msg.Rcode != dns.RcodeSuccess || soaOf(msg).Hdr.Name != "example.internal." {
+		t.Fatalf("Expected NODATA with the SOA, got %v", msg)
+	}
+	if soa := soaOf(query("missing.dev.example.internal.", dns.TypeA)); soa.Hdr.Name != "dev.example.internal." || soa.Minttl != DEFAULT_SOA_MINTTL {
+		t.Fatalf("Expected the SOA of the subzone, got %v", soa)
+	}
+	if msg := query("web.example.internal.", dns.TypeA); len(msg.Answer) != 1 || len(msg.Ns) != 0 {
+		t.Fatalf("Expected a plain answer, got %v", msg)
+	}
+
+	for _, invalid := range []ZoneRule{
+		{Zone: "example.internal"},
+		{Zone: ".", Ns: []string{"ns1.example.internal"}},
+		{Zone: "example..internal", Ns: []string{"ns1.example.internal"}},
+		{Zone: "example.internal", Ns: []string{"ns1.example.internal"}, Mbox: "a@b@example.internal"},
+	} {
+		if err := invalid.Validate(); err == nil {
+			t.Fatalf("Expected %+v to be rejected", invalid)
+		}
+	}
+}